@@ -0,0 +1,173 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"fmt"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/cache"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	machineResource           = "machines"
+	machineSetResource        = "machinesets"
+	machineDeploymentResource = "machinedeployments"
+	clusterResource           = "clusters"
+	machinePoolResource       = "machinepools"
+)
+
+// supportedGroupVersions are the cluster-api versions the autoscaler works with, in order of preference
+var supportedGroupVersions = []schema.GroupVersion{
+	{Group: "cluster.x-k8s.io", Version: "v1beta1"},
+	{Group: "cluster.x-k8s.io", Version: "v1alpha4"},
+	{Group: "cluster.x-k8s.io", Version: "v1alpha3"},
+	{Group: "cluster.k8s.io", Version: "v1alpha1"},
+}
+
+// supportedMachinePoolGroupVersions are the MachinePool versions the autoscaler works with, in order of
+// preference. MachinePools were experimental before v1beta1 and lived in their own group.
+var supportedMachinePoolGroupVersions = []schema.GroupVersion{
+	{Group: "cluster.x-k8s.io", Version: "v1beta1"},
+	{Group: "exp.cluster.x-k8s.io", Version: "v1alpha4"},
+	{Group: "exp.cluster.x-k8s.io", Version: "v1alpha3"},
+}
+
+// clusterNameLabel returns the label naming the Cluster of the objects of a cluster-api version
+func clusterNameLabel(groupVersion schema.GroupVersion) string {
+	if groupVersion.Group == "cluster.k8s.io" {
+		return LegacyClusterNameLabel
+	}
+	return ClusterNameLabel
+}
+
+// discoverGroupVersion returns the preferred supported cluster-api version served by the API server
+func discoverGroupVersion(discoveryClient discovery.DiscoveryInterface) (schema.GroupVersion, error) {
+	tried := make([]string, 0, len(supportedGroupVersions))
+	for _, gv := range supportedGroupVersions {
+		tried = append(tried, gv.String())
+		if servesResource(discoveryClient, gv, machineDeploymentResource) {
+			return gv, nil
+		}
+	}
+	return schema.GroupVersion{}, fmt.Errorf("no supported cluster-api version is served, tried %s", strings.Join(tried, ", "))
+}
+
+// discoverMachinePoolGroupVersion returns the preferred supported MachinePool version served by the API
+// server. MachinePools are optional, so false is returned if none is served.
+func discoverMachinePoolGroupVersion(discoveryClient discovery.DiscoveryInterface) (schema.GroupVersion, bool) {
+	for _, gv := range supportedMachinePoolGroupVersions {
+		if servesResource(discoveryClient, gv, machinePoolResource) {
+			return gv, true
+		}
+	}
+	return schema.GroupVersion{}, false
+}
+
+// servesResource checks whether the API server serves a resource in a group version
+func servesResource(discoveryClient discovery.DiscoveryInterface, gv schema.GroupVersion, name string) bool {
+	resources, err := discoveryClient.ServerResourcesForGroupVersion(gv.String())
+	if err != nil || resources == nil {
+		return false
+	}
+	for _, resource := range resources.APIResources {
+		if resource.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// versions returns the served cluster-api and MachinePool versions
+func (mm *ClusterapiMachineManager) versions() (groupVersion, machinePoolGroupVersion schema.GroupVersion) {
+	mm.versionLock.RLock()
+	defer mm.versionLock.RUnlock()
+	return mm.groupVersion, mm.machinePoolGroupVersion
+}
+
+// resource returns the client of a cluster-api resource in its served version
+func (mm *ClusterapiMachineManager) resource(name string) dynamic.NamespaceableResourceInterface {
+	groupVersion, machinePoolGroupVersion := mm.versions()
+	if name == machinePoolResource {
+		groupVersion = machinePoolGroupVersion
+	}
+	return mm.dynamicClient.Resource(groupVersion.WithResource(name))
+}
+
+// suspectVersions has the served versions rediscovered by the next refresh if an API call failed as if the
+// served cluster-api version was dropped or can't be converted anymore, e.g. while cluster-api is upgraded.
+// Objects that are merely gone fail alike, in which case the rediscovery finds the versions unchanged.
+func (mm *ClusterapiMachineManager) suspectVersions(err error) {
+	if err == nil || mm.discoveryClient == nil {
+		return
+	}
+	if errors.IsNotFound(err) || strings.Contains(err.Error(), "conversion webhook") {
+		atomic.StoreInt32(&mm.versionsSuspect, 1)
+	}
+}
+
+// rediscoverVersions discovers the served versions again and, if they changed, replaces the informers of the
+// cluster-api objects with ones of the new versions. The new informers are synced by the refresh.
+func (mm *ClusterapiMachineManager) rediscoverVersions() error {
+	groupVersion, err := discoverGroupVersion(mm.discoveryClient)
+	if err != nil {
+		return err
+	}
+	machinePoolGroupVersion, _ := discoverMachinePoolGroupVersion(mm.discoveryClient)
+
+	mm.versionLock.Lock()
+	defer mm.versionLock.Unlock()
+	if groupVersion == mm.groupVersion && machinePoolGroupVersion == mm.machinePoolGroupVersion {
+		return nil
+	}
+	select {
+	case <-mm.stopCh:
+		return fmt.Errorf("machine manager is stopped")
+	default:
+	}
+	infoS("Served cluster-api versions changed, replacing informers", "from", mm.groupVersion, "to", groupVersion,
+		"machinePoolVersion", machinePoolGroupVersion)
+
+	mm.groupVersion = groupVersion
+	mm.machinePoolGroupVersion = machinePoolGroupVersion
+	if mm.clusterName != "" {
+		mm.machineSelector = labels.SelectorFromSet(labels.Set{clusterNameLabel(groupVersion): mm.clusterName})
+	}
+	for namespace := range mm.informers {
+		informers := newNamespaceInformers(mm.dynamicClient, groupVersion, namespace, mm.informerOptions)
+		if mm.clusterName != "" {
+			informers[machineResource] = newMachineInformer(mm.dynamicClient, groupVersion, namespace, mm.machineSelector, mm.informerOptions)
+		}
+		if !machinePoolGroupVersion.Empty() {
+			informers[machinePoolResource] = newInformer(mm.dynamicClient, machinePoolGroupVersion.WithResource(machinePoolResource),
+				namespace, cache.Indexers{}, mm.informerOptions)
+		}
+		mm.informers[namespace] = informers
+	}
+
+	close(mm.informersStopCh)
+	mm.informersStopCh = make(chan struct{})
+	if mm.informersStarted {
+		mm.runInformers(mm.objectInformers(), mm.informersStopCh)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider/clusterapi/fake"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	corefake "k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func newTestDiscovery(groupVersions ...string) *fakediscovery.FakeDiscovery {
+	discovery := corefake.NewSimpleClientset().Discovery().(*fakediscovery.FakeDiscovery)
+	for _, gv := range groupVersions {
+		discovery.Resources = append(discovery.Resources, &metav1.APIResourceList{
+			GroupVersion: gv,
+			APIResources: []metav1.APIResource{
+				{Name: machineResource},
+				{Name: machineSetResource},
+				{Name: machineDeploymentResource},
+			},
+		})
+	}
+	return discovery
+}
+
+func TestDiscoverGroupVersion(t *testing.T) {
+	gv, err := discoverGroupVersion(newTestDiscovery("cluster.k8s.io/v1alpha1"))
+	assert.NoError(t, err)
+	assert.Equal(t, schema.GroupVersion{Group: "cluster.k8s.io", Version: "v1alpha1"}, gv)
+
+	gv, err = discoverGroupVersion(newTestDiscovery("cluster.k8s.io/v1alpha1", "cluster.x-k8s.io/v1alpha3", "cluster.x-k8s.io/v1beta1"))
+	assert.NoError(t, err)
+	assert.Equal(t, schema.GroupVersion{Group: "cluster.x-k8s.io", Version: "v1beta1"}, gv)
+}
+
+func TestDiscoverGroupVersionNoneServed(t *testing.T) {
+	_, err := discoverGroupVersion(newTestDiscovery("cluster.x-k8s.io/v1alpha2"))
+	assert.EqualError(t, err, "no supported cluster-api version is served, tried cluster.x-k8s.io/v1beta1, cluster.x-k8s.io/v1alpha4, cluster.x-k8s.io/v1alpha3, cluster.k8s.io/v1alpha1")
+}
+
+func TestDiscoverMachinePoolGroupVersion(t *testing.T) {
+	discovery := newTestDiscovery("cluster.x-k8s.io/v1alpha3")
+	_, found := discoverMachinePoolGroupVersion(discovery)
+	assert.False(t, found)
+
+	discovery.Resources = append(discovery.Resources, &metav1.APIResourceList{
+		GroupVersion: "exp.cluster.x-k8s.io/v1alpha3",
+		APIResources: []metav1.APIResource{{Name: machinePoolResource}},
+	})
+	gv, found := discoverMachinePoolGroupVersion(discovery)
+	assert.True(t, found)
+	assert.Equal(t, schema.GroupVersion{Group: "exp.cluster.x-k8s.io", Version: "v1alpha3"}, gv)
+}
+
+func TestClusterNameLabel(t *testing.T) {
+	assert.Equal(t, LegacyClusterNameLabel, clusterNameLabel(schema.GroupVersion{Group: "cluster.k8s.io", Version: "v1alpha1"}))
+	assert.Equal(t, ClusterNameLabel, clusterNameLabel(schema.GroupVersion{Group: "cluster.x-k8s.io", Version: "v1beta1"}))
+}
+
+func TestRediscoverVersions(t *testing.T) {
+	preferred := schema.GroupVersion{Group: "cluster.x-k8s.io", Version: "v1alpha3"}
+	md := buildTestMachineDeployment("md", 1, 0, 10)
+	dynamicClient := newTestDynamicClient(md)
+	// during the upgrade, the MachineDeployment is served in both versions
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(md)
+	assert.NoError(t, err)
+	served := &unstructured.Unstructured{Object: content}
+	served.SetAPIVersion(preferred.String())
+	dynamicClient.Add(preferred.WithResource(machineDeploymentResource), served)
+
+	discovery := newTestDiscovery(preferred.String(), testGroupVersion.String())
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(), dynamicClient, preferred, nil)
+	mm.discoveryClient = discovery
+	mm.configureInformers(informerOptions{errorHandler: mm.suspectVersions})
+	defer mm.Cleanup()
+	if !assert.NoError(t, mm.Refresh(context.TODO())) {
+		return
+	}
+	assert.Len(t, mm.AllDeployments(), 1)
+
+	// the preferred version is dropped
+	discovery.Resources = discovery.Resources[1:]
+	dynamicClient.AddReactor(func(action fake.DynamicAction) (bool, error) {
+		if action.Resource.GroupVersion() == preferred {
+			return true, apierrors.NewNotFound(action.Resource.GroupResource(), action.Name)
+		}
+		return false, nil
+	})
+	_, err = mm.SetDeploymentSize(mm.AllDeployments()[0], 2)
+	assert.Error(t, err)
+
+	if !assert.NoError(t, mm.Refresh(context.TODO())) {
+		return
+	}
+	groupVersion, _ := mm.versions()
+	assert.Equal(t, testGroupVersion, groupVersion)
+	if assert.Len(t, mm.AllDeployments(), 1) {
+		_, err := mm.SetDeploymentSize(mm.AllDeployments()[0], 2)
+		assert.NoError(t, err)
+	}
+}
+
+func TestSuspectVersions(t *testing.T) {
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(), newTestDynamicClient(), testGroupVersion, nil)
+	mm.suspectVersions(apierrors.NewNotFound(schema.GroupResource{Resource: machineResource}, "m"))
+	assert.Equal(t, int32(0), mm.versionsSuspect)
+
+	mm.discoveryClient = newTestDiscovery(testGroupVersion.String())
+	mm.suspectVersions(apierrors.NewConflict(schema.GroupResource{Resource: machineResource}, "m", fmt.Errorf("conflict")))
+	assert.Equal(t, int32(0), mm.versionsSuspect)
+	mm.suspectVersions(apierrors.NewInternalError(fmt.Errorf("conversion webhook for cluster.x-k8s.io/v1alpha3, Kind=Machine failed")))
+	assert.Equal(t, int32(1), mm.versionsSuspect)
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"encoding/json"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// fieldManager is the field manager of the server-side apply patches of the autoscaler, which owns the
+	// replicas of the scaled objects and the delete-machine annotation
+	fieldManager = "cluster-autoscaler-clusterapi"
+
+	// applyPatchType is the content type of server-side apply patches. The vendored apimachinery predates
+	// server-side apply and doesn't define it.
+	applyPatchType = types.PatchType("application/apply-patch+yaml")
+)
+
+// resourceKinds maps the cluster-api resources to their kinds, which apply patches must state
+var resourceKinds = map[string]string{
+	machineResource:           "Machine",
+	machineSetResource:        "MachineSet",
+	machineDeploymentResource: "MachineDeployment",
+	machinePoolResource:       "MachinePool",
+}
+
+// newApplyClient creates the REST client sending server-side apply patches. The vendored dynamic client
+// can't set the field manager, so the requests are built by hand.
+func newApplyClient(config *rest.Config) (rest.Interface, error) {
+	config = rest.CopyConfig(config)
+	config.GroupVersion = &schema.GroupVersion{}
+	config.APIPath = "/apis"
+	config.AcceptContentTypes = "application/json"
+	config.ContentType = "application/json"
+	config.NegotiatedSerializer = serializer.DirectCodecFactory{CodecFactory: scheme.Codecs}
+	if config.UserAgent == "" {
+		config.UserAgent = rest.DefaultKubernetesUserAgent()
+	}
+	return rest.RESTClientFor(config)
+}
+
+// apply sets annotations and spec fields of a cluster-api object with a server-side apply patch as fieldManager,
+// forcing their ownership. The patch only holds the given fields, so that no other field changes owner. ok is
+// false if server-side apply isn't available, i.e. no apply client is configured or the apiserver rejected the
+// patch, in which case the caller falls back to a regular patch. Apiservers not supporting the patch type at
+// all aren't sent apply patches anymore.
+func (mm *ClusterapiMachineManager) apply(resource, namespace, name string, annotations map[string]string, spec map[string]interface{}) (obj *unstructured.Unstructured, ok bool, err error) {
+	if mm.applyClient == nil || atomic.LoadInt32(&mm.applyUnsupported) == 1 {
+		return nil, false, nil
+	}
+
+	groupVersion, machinePoolGroupVersion := mm.versions()
+	if resource == machinePoolResource {
+		groupVersion = machinePoolGroupVersion
+	}
+	metadata := map[string]interface{}{"name": name, "namespace": namespace}
+	if len(annotations) > 0 {
+		metadata["annotations"] = annotations
+	}
+	patch := map[string]interface{}{
+		"apiVersion": groupVersion.String(),
+		"kind":       resourceKinds[resource],
+		"metadata":   metadata,
+	}
+	if len(spec) > 0 {
+		patch["spec"] = spec
+	}
+	body, err := json.Marshal(patch)
+	if err != nil {
+		return nil, false, err
+	}
+
+	raw, err := mm.applyClient.Patch(applyPatchType).
+		AbsPath("apis", groupVersion.Group, groupVersion.Version, "namespaces", namespace, resource, name).
+		Param("fieldManager", fieldManager).
+		Param("force", "true").
+		Body(body).
+		Do().
+		Raw()
+	if errors.IsUnsupportedMediaType(err) {
+		if atomic.CompareAndSwapInt32(&mm.applyUnsupported, 0, 1) {
+			warningS("Server-side apply not supported, patching instead", "err", err)
+		}
+		return nil, false, nil
+	}
+	if errors.IsBadRequest(err) {
+		verboseInfoS(4, "Apply patch rejected, patching instead", "namespace", namespace, strings.ToLower(resourceKinds[resource]), name, "err", err)
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, true, err
+	}
+	decoded, err := runtime.Decode(unstructured.UnstructuredJSONScheme, raw)
+	if err != nil {
+		return nil, true, err
+	}
+	return decoded.(*unstructured.Unstructured), true, nil
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	corefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// appliedPatch is an apply patch received by newTestApplyServer
+type appliedPatch struct {
+	path        string
+	query       string
+	contentType string
+	body        map[string]interface{}
+}
+
+// newTestApplyServer answers apply patches with the given status, echoing the patch on success
+func newTestApplyServer(t *testing.T, status int) (*httptest.Server, *[]appliedPatch) {
+	patches := make([]appliedPatch, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		patch := appliedPatch{path: r.URL.Path, query: r.URL.RawQuery, contentType: r.Header.Get("Content-Type")}
+		assert.NoError(t, json.Unmarshal(raw, &patch.body))
+		patches = append(patches, patch)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			w.Write(raw)
+		}
+	}))
+	return server, &patches
+}
+
+func TestSetReplicasApplies(t *testing.T) {
+	server, patches := newTestApplyServer(t, http.StatusOK)
+	defer server.Close()
+
+	dynamicClient := newTestDynamicClient(buildTestMachineDeployment("md", 1, 0, 10))
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(), dynamicClient, testGroupVersion, nil)
+	applyClient, err := newApplyClient(&rest.Config{Host: server.URL})
+	assert.NoError(t, err)
+	mm.applyClient = applyClient
+
+	assert.NoError(t, mm.setReplicas(machineDeploymentResource, "kube-system", "md", 3))
+
+	if assert.Len(t, *patches, 1) {
+		patch := (*patches)[0]
+		assert.Equal(t, "/apis/cluster.k8s.io/v1alpha1/namespaces/kube-system/machinedeployments/md", patch.path)
+		assert.Equal(t, "fieldManager=cluster-autoscaler-clusterapi&force=true", patch.query)
+		assert.Equal(t, string(applyPatchType), patch.contentType)
+		// only spec.replicas is owned
+		assert.Equal(t, map[string]interface{}{
+			"apiVersion": "cluster.k8s.io/v1alpha1",
+			"kind":       "MachineDeployment",
+			"metadata":   map[string]interface{}{"name": "md", "namespace": "kube-system"},
+			"spec":       map[string]interface{}{"replicas": float64(3)},
+		}, patch.body)
+	}
+	for _, action := range dynamicClient.RecordedActions() {
+		assert.NotContains(t, []string{"update", "patch"}, action.Verb)
+	}
+}
+
+func TestMarkMachineForDeletionApplies(t *testing.T) {
+	server, patches := newTestApplyServer(t, http.StatusOK)
+	defer server.Close()
+
+	md := buildTestMachineDeployment("md", 1, 0, 10)
+	ms := buildTestMachineSet(md, "ms", 1)
+	m := buildTestMachine(ms, "m", buildTestNode("n"))
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(), newTestDynamicClient(m, ms, md), testGroupVersion, nil)
+	applyClient, err := newApplyClient(&rest.Config{Host: server.URL})
+	assert.NoError(t, err)
+	mm.applyClient = applyClient
+
+	assert.NoError(t, mm.MarkMachineForDeletion(m))
+
+	if assert.Len(t, *patches, 1) {
+		patch := (*patches)[0]
+		assert.Equal(t, "/apis/cluster.k8s.io/v1alpha1/namespaces/kube-system/machines/m", patch.path)
+		// only the delete-machine annotation is owned
+		annotations, _, _ := unstructured.NestedStringMap(patch.body, "metadata", "annotations")
+		assert.Len(t, annotations, 1)
+		assert.Contains(t, annotations, DeleteMachineAnnotation)
+		assert.NotContains(t, patch.body, "spec")
+	}
+}
+
+func TestApplyFallsBackToPatches(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		status      int
+		applyPerSet int
+	}{
+		// apiservers without server-side apply aren't sent apply patches again
+		{name: "unsupported media type", status: http.StatusUnsupportedMediaType, applyPerSet: 0},
+		{name: "bad request", status: http.StatusBadRequest, applyPerSet: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server, patches := newTestApplyServer(t, tc.status)
+			defer server.Close()
+
+			dynamicClient := newTestDynamicClient(buildTestMachineDeployment("md", 1, 0, 10))
+			mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(), dynamicClient, testGroupVersion, nil)
+			applyClient, err := newApplyClient(&rest.Config{Host: server.URL})
+			assert.NoError(t, err)
+			mm.applyClient = applyClient
+
+			assert.NoError(t, mm.setReplicas(machineDeploymentResource, "kube-system", "md", 3))
+			assert.NoError(t, mm.setReplicas(machineDeploymentResource, "kube-system", "md", 4))
+
+			assert.Len(t, *patches, 1+tc.applyPerSet)
+			updated, err := dynamicClient.Resource(testGroupVersion.WithResource(machineDeploymentResource)).Namespace("kube-system").Get("md", v1.GetOptions{})
+			assert.NoError(t, err)
+			replicas, _, _ := unstructured.NestedInt64(updated.Object, "spec", "replicas")
+			assert.Equal(t, int64(4), replicas)
+		})
+	}
+}
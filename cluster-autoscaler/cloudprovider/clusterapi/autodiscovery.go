@@ -0,0 +1,61 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"fmt"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
+	"strings"
+)
+
+const (
+	autoDiscovererTypeClusterapi = "clusterapi"
+)
+
+// parseAutoDiscoverySpecs parses the --node-group-auto-discovery specs of the form
+// clusterapi:<label selector>, e.g. clusterapi:autoscaling=enabled,pool in (workers,gpu).
+// A node group is managed if its labels match any of the selectors.
+func parseAutoDiscoverySpecs(do cloudprovider.NodeGroupDiscoveryOptions) ([]labels.Selector, error) {
+	selectors := make([]labels.Selector, 0, len(do.NodeGroupAutoDiscoverySpecs))
+	for _, spec := range do.NodeGroupAutoDiscoverySpecs {
+		selector, err := parseAutoDiscoverySpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		selectors = append(selectors, selector)
+	}
+	return selectors, nil
+}
+
+func parseAutoDiscoverySpec(spec string) (labels.Selector, error) {
+	tokens := strings.SplitN(spec, ":", 2)
+	if len(tokens) != 2 {
+		return nil, fmt.Errorf("spec \"%s\" should be %s:<label selector>", spec, autoDiscovererTypeClusterapi)
+	}
+	if tokens[0] != autoDiscovererTypeClusterapi {
+		return nil, fmt.Errorf("unsupported discoverer specified: %s", tokens[0])
+	}
+	if strings.TrimSpace(tokens[1]) == "" {
+		return nil, fmt.Errorf("empty label selector in spec \"%s\"", spec)
+	}
+	selector, err := labels.Parse(tokens[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid label selector in spec \"%s\": %v", spec, err)
+	}
+	return selector, nil
+}
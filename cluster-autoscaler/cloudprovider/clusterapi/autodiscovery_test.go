@@ -0,0 +1,56 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
+	"testing"
+)
+
+func TestParseAutoDiscoverySpecs(t *testing.T) {
+	selectors, err := parseAutoDiscoverySpecs(cloudprovider.NodeGroupDiscoveryOptions{
+		NodeGroupAutoDiscoverySpecs: []string{
+			"clusterapi:autoscaling=enabled,pool in (workers,gpu)",
+			"clusterapi:team=data",
+		},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, selectors, 2)
+	assert.True(t, selectors[0].Matches(labels.Set{"autoscaling": "enabled", "pool": "gpu"}))
+	assert.False(t, selectors[0].Matches(labels.Set{"autoscaling": "enabled", "pool": "infra"}))
+	assert.True(t, selectors[1].Matches(labels.Set{"team": "data"}))
+}
+
+func TestParseAutoDiscoverySpecsNone(t *testing.T) {
+	selectors, err := parseAutoDiscoverySpecs(cloudprovider.NodeGroupDiscoveryOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, selectors)
+}
+
+func TestParseAutoDiscoverySpecInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"autoscaling=enabled",
+		"asg:tag=foo",
+		"clusterapi:",
+		"clusterapi:in (",
+	} {
+		_, err := parseAutoDiscoverySpec(spec)
+		assert.Error(t, err, spec)
+	}
+}
@@ -0,0 +1,210 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/autoscaler/cluster-autoscaler/config"
+	"strconv"
+	"time"
+)
+
+const (
+	// ScaleDownUtilizationThresholdAnnotation overrides the scale-down utilization threshold of a node group
+	ScaleDownUtilizationThresholdAnnotation = "autoscaler.syseleven.de/scale-down-utilization-threshold"
+	// ScaleDownGpuUtilizationThresholdAnnotation overrides the scale-down gpu utilization threshold of a node group
+	ScaleDownGpuUtilizationThresholdAnnotation = "autoscaler.syseleven.de/scale-down-gpu-utilization-threshold"
+	// ScaleDownUnneededTimeAnnotation overrides the scale-down unneeded time of a node group
+	ScaleDownUnneededTimeAnnotation = "autoscaler.syseleven.de/scale-down-unneeded-time"
+	// ScaleDownUnreadyTimeAnnotation overrides the scale-down unready time of a node group
+	ScaleDownUnreadyTimeAnnotation = "autoscaler.syseleven.de/scale-down-unready-time"
+	// ScaleDownAnnotation disables the scale down of a node group if set to ScaleDownDisabled, scale ups are unaffected
+	ScaleDownAnnotation = "autoscaler.syseleven.de/scale-down"
+	// ScaleDownDisabled is the value of ScaleDownAnnotation that disables scale down
+	ScaleDownDisabled = "disabled"
+	// ScaleCooldownAnnotation sets the minimum duration between scale actions of a node group
+	ScaleCooldownAnnotation = "autoscaler.syseleven.de/scale-cooldown"
+	// MinNodeLifetimeAnnotation sets the minimum age of a node group's machines before they may be scaled down
+	MinNodeLifetimeAnnotation = "autoscaler.syseleven.de/min-node-lifetime"
+	// MaxScaleUpStepAnnotation caps the number of machines a node group adds in a single scale up
+	MaxScaleUpStepAnnotation = "autoscaler.syseleven.de/max-scale-up-step"
+	// ScaleUpTimeoutAnnotation overrides the time a node group's machines may take to come up, defaults to 15m
+	ScaleUpTimeoutAnnotation = "autoscaler.syseleven.de/scale-up-timeout"
+	// ReplicaDivergenceTimeoutAnnotation overrides how long the status replicas of a node group may fall behind
+	// its spec replicas, defaults to the autoscaler's max-node-provision-time
+	ReplicaDivergenceTimeoutAnnotation = "autoscaler.syseleven.de/replica-divergence-timeout"
+	// NodeStartupTimeoutAnnotation overrides how long a node group's machines may have a registered node that
+	// never became ready, defaults to the autoscaler's max-node-provision-time
+	NodeStartupTimeoutAnnotation = "autoscaler.syseleven.de/node-startup-timeout"
+
+	defaultScaleUpTimeout = 15 * time.Minute
+
+	// scaleDownDisabledTime is the scale-down unneeded and unready time of node groups with scale down disabled
+	scaleDownDisabledTime = 100 * 365 * 24 * time.Hour
+)
+
+// autoscalingOptionsFromAnnotations overrides the defaults with the scale-down annotations of a
+// MachineDeployment or MachineSet. Invalid annotations are ignored with a warning. If scale down
+// is disabled, no node is ever utilized little enough or unneeded long enough to be removed.
+func autoscalingOptionsFromAnnotations(obj v1.Object, defaults config.NodeGroupAutoscalingOptions) *config.NodeGroupAutoscalingOptions {
+	options := defaults
+	annotations := obj.GetAnnotations()
+
+	if scaleDownDisabled(obj) {
+		options.ScaleDownUtilizationThreshold = 0
+		options.ScaleDownGpuUtilizationThreshold = 0
+		options.ScaleDownUnneededTime = scaleDownDisabledTime
+		options.ScaleDownUnreadyTime = scaleDownDisabledTime
+		return &options
+	}
+
+	for annotation, threshold := range map[string]*float64{
+		ScaleDownUtilizationThresholdAnnotation:    &options.ScaleDownUtilizationThreshold,
+		ScaleDownGpuUtilizationThresholdAnnotation: &options.ScaleDownGpuUtilizationThreshold,
+	} {
+		val, ok := annotations[annotation]
+		if !ok {
+			continue
+		}
+		parsed, err := strconv.ParseFloat(val, 64)
+		if err != nil || parsed < 0 || parsed > 1 {
+			warningS("Invalid annotation, using default", append(objectKeys(obj), "annotation", annotation, "value", val)...)
+			continue
+		}
+		*threshold = parsed
+	}
+
+	for annotation, duration := range map[string]*time.Duration{
+		ScaleDownUnneededTimeAnnotation: &options.ScaleDownUnneededTime,
+		ScaleDownUnreadyTimeAnnotation:  &options.ScaleDownUnreadyTime,
+	} {
+		val, ok := annotations[annotation]
+		if !ok {
+			continue
+		}
+		parsed, err := time.ParseDuration(val)
+		if err != nil || parsed < 0 {
+			warningS("Invalid annotation, using default", append(objectKeys(obj), "annotation", annotation, "value", val)...)
+			continue
+		}
+		*duration = parsed
+	}
+
+	return &options
+}
+
+// scaleDownDisabled checks whether the scale down of a MachineDeployment, MachineSet or MachinePool is disabled
+func scaleDownDisabled(obj v1.Object) bool {
+	val, ok := obj.GetAnnotations()[ScaleDownAnnotation]
+	if !ok {
+		return false
+	}
+	if val != ScaleDownDisabled && val != "enabled" {
+		warningS("Invalid annotation, ignoring", append(objectKeys(obj), "annotation", ScaleDownAnnotation, "value", val)...)
+	}
+	return val == ScaleDownDisabled
+}
+
+// scaleCooldown returns the scale cooldown of a MachineDeployment or MachineSet, 0 if unset or invalid
+func scaleCooldown(obj v1.Object) time.Duration {
+	val, ok := obj.GetAnnotations()[ScaleCooldownAnnotation]
+	if !ok {
+		return 0
+	}
+	cooldown, err := time.ParseDuration(val)
+	if err != nil || cooldown < 0 {
+		warningS("Invalid annotation, ignoring", append(objectKeys(obj), "annotation", ScaleCooldownAnnotation, "value", val)...)
+		return 0
+	}
+	return cooldown
+}
+
+// minNodeLifetime returns the minimum age of a MachineDeployment's or MachineSet's machines before they may be
+// scaled down, 0 if unset or invalid
+func minNodeLifetime(obj v1.Object) time.Duration {
+	val, ok := obj.GetAnnotations()[MinNodeLifetimeAnnotation]
+	if !ok {
+		return 0
+	}
+	lifetime, err := time.ParseDuration(val)
+	if err != nil || lifetime < 0 {
+		warningS("Invalid annotation, ignoring", append(objectKeys(obj), "annotation", MinNodeLifetimeAnnotation, "value", val)...)
+		return 0
+	}
+	return lifetime
+}
+
+// maxScaleUpStep returns the max number of machines a MachineDeployment, MachineSet or MachinePool adds in a
+// single scale up, 0 if unset or invalid
+func maxScaleUpStep(obj v1.Object) int {
+	val, ok := obj.GetAnnotations()[MaxScaleUpStepAnnotation]
+	if !ok {
+		return 0
+	}
+	step, err := strconv.Atoi(val)
+	if err != nil || step <= 0 {
+		warningS("Invalid annotation, ignoring", append(objectKeys(obj), "annotation", MaxScaleUpStepAnnotation, "value", val)...)
+		return 0
+	}
+	return step
+}
+
+// scaleUpTimeout returns the time a MachineDeployment's or MachineSet's machines may take to come up, after which
+// their creation is considered failed. 0 disables the timeout.
+func scaleUpTimeout(obj v1.Object) time.Duration {
+	val, ok := obj.GetAnnotations()[ScaleUpTimeoutAnnotation]
+	if !ok {
+		return defaultScaleUpTimeout
+	}
+	timeout, err := time.ParseDuration(val)
+	if err != nil || timeout < 0 {
+		warningS("Invalid annotation, using default", append(objectKeys(obj), "annotation", ScaleUpTimeoutAnnotation, "value", val)...)
+		return defaultScaleUpTimeout
+	}
+	return timeout
+}
+
+// replicaDivergenceTimeout returns how long the status replicas of a node group's MachineDeployment, MachineSet
+// or MachinePool may fall behind its spec replicas, after which the missing replicas are considered failed.
+// 0 disables the timeout.
+func replicaDivergenceTimeout(obj v1.Object, defaultTimeout time.Duration) time.Duration {
+	val, ok := obj.GetAnnotations()[ReplicaDivergenceTimeoutAnnotation]
+	if !ok {
+		return defaultTimeout
+	}
+	timeout, err := time.ParseDuration(val)
+	if err != nil || timeout < 0 {
+		warningS("Invalid annotation, using default", append(objectKeys(obj), "annotation", ReplicaDivergenceTimeoutAnnotation, "value", val)...)
+		return defaultTimeout
+	}
+	return timeout
+}
+
+// nodeStartupTimeout returns how long the machines of a node group's MachineDeployment or MachineSet may have a
+// node that never became ready, after which they are considered failed. 0 disables the timeout.
+func nodeStartupTimeout(obj v1.Object, defaultTimeout time.Duration) time.Duration {
+	val, ok := obj.GetAnnotations()[NodeStartupTimeoutAnnotation]
+	if !ok {
+		return defaultTimeout
+	}
+	timeout, err := time.ParseDuration(val)
+	if err != nil || timeout < 0 {
+		warningS("Invalid annotation, using default", append(objectKeys(obj), "annotation", NodeStartupTimeoutAnnotation, "value", val)...)
+		return defaultTimeout
+	}
+	return timeout
+}
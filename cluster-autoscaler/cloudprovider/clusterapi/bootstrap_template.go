@@ -0,0 +1,104 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"fmt"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"strings"
+)
+
+// bootstrapConfigTemplateRef returns the reference to the bootstrap config template (e.g. a
+// KubeadmConfigTemplate) of an unstructured MachineDeployment or MachineSet, or nil if it has none.
+// v1alpha1 has no bootstrap providers, so the reference is only found in newer versions.
+func bootstrapConfigTemplateRef(u *unstructured.Unstructured) *apiv1.ObjectReference {
+	ref, found, err := unstructured.NestedMap(u.Object, "spec", "template", "spec", "bootstrap", "configRef")
+	if err != nil || !found {
+		return nil
+	}
+	objectRef := &apiv1.ObjectReference{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(ref, objectRef); err != nil {
+		return nil
+	}
+	return objectRef
+}
+
+// bootstrapConfigTemplate returns the bootstrap config template referenced by an unstructured
+// MachineDeployment or MachineSet from the template cache. It returns nil if there is none or it
+// doesn't exist.
+func (mm *ClusterapiMachineManager) bootstrapConfigTemplate(u *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	ref := bootstrapConfigTemplateRef(u)
+	if ref == nil {
+		return nil, nil
+	}
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = u.GetNamespace()
+	}
+	return mm.getTemplate(templateKey{apiVersion: ref.APIVersion, kind: ref.Kind, namespace: namespace, name: ref.Name})
+}
+
+// kubeadmNodeRegistration reads the node labels passed to the kubelet and the taints registered with
+// the node from the join configuration of a KubeadmConfigTemplate.
+func kubeadmNodeRegistration(template *unstructured.Unstructured) (map[string]string, []apiv1.Taint, error) {
+	path := []string{"spec", "template", "spec", "joinConfiguration", "nodeRegistration"}
+
+	nodeLabels, _, err := unstructured.NestedString(template.Object, append(path, "kubeletExtraArgs", "node-labels")...)
+	if err != nil {
+		return nil, nil, err
+	}
+	labels, err := parseNodeLabels(nodeLabels)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid node-labels of %s %s: %v", template.GetKind(), template.GetName(), err)
+	}
+
+	rawTaints, _, err := unstructured.NestedSlice(template.Object, append(path, "taints")...)
+	if err != nil {
+		return nil, nil, err
+	}
+	taints := make([]apiv1.Taint, 0, len(rawTaints))
+	for _, rawTaint := range rawTaints {
+		rawTaint, ok := rawTaint.(map[string]interface{})
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid taint of %s %s: %v", template.GetKind(), template.GetName(), rawTaint)
+		}
+		taint := apiv1.Taint{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(rawTaint, &taint); err != nil {
+			return nil, nil, fmt.Errorf("invalid taint of %s %s: %v", template.GetKind(), template.GetName(), err)
+		}
+		taints = append(taints, taint)
+	}
+	return labels, taints, nil
+}
+
+// parseNodeLabels parses the kubelet's --node-labels format, i.e. "key1=value1,key2=value2"
+func parseNodeLabels(s string) (map[string]string, error) {
+	labels := map[string]string{}
+	if strings.TrimSpace(s) == "" {
+		return labels, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid label %q, expected <key>=<value>", pair)
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return labels, nil
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"testing"
+)
+
+func buildTestKubeadmConfigTemplate(name string, nodeRegistration map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "bootstrap.cluster.x-k8s.io/v1alpha3",
+			"kind":       "KubeadmConfigTemplate",
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": "kube-system",
+			},
+			"spec": map[string]interface{}{
+				"template": map[string]interface{}{
+					"spec": map[string]interface{}{
+						"joinConfiguration": map[string]interface{}{
+							"nodeRegistration": nodeRegistration,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestKubeadmNodeRegistration(t *testing.T) {
+	template := buildTestKubeadmConfigTemplate("workers", map[string]interface{}{
+		"kubeletExtraArgs": map[string]interface{}{
+			"node-labels": "pool=workers, node-role.kubernetes.io/worker=",
+		},
+		"taints": []interface{}{
+			map[string]interface{}{"key": "dedicated", "value": "workers", "effect": "NoSchedule"},
+		},
+	})
+
+	labels, taints, err := kubeadmNodeRegistration(template)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"pool": "workers", "node-role.kubernetes.io/worker": ""}, labels)
+	assert.Equal(t, []apiv1.Taint{{Key: "dedicated", Value: "workers", Effect: apiv1.TaintEffectNoSchedule}}, taints)
+}
+
+func TestKubeadmNodeRegistrationEmpty(t *testing.T) {
+	labels, taints, err := kubeadmNodeRegistration(buildTestKubeadmConfigTemplate("workers", map[string]interface{}{}))
+	assert.NoError(t, err)
+	assert.Empty(t, labels)
+	assert.Empty(t, taints)
+}
+
+func TestKubeadmNodeRegistrationInvalidLabels(t *testing.T) {
+	_, _, err := kubeadmNodeRegistration(buildTestKubeadmConfigTemplate("workers", map[string]interface{}{
+		"kubeletExtraArgs": map[string]interface{}{"node-labels": "pool"},
+	}))
+	assert.EqualError(t, err, `invalid node-labels of KubeadmConfigTemplate workers: invalid label "pool", expected <key>=<value>`)
+}
+
+func TestBootstrapConfigTemplateRef(t *testing.T) {
+	md := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	assert.Nil(t, bootstrapConfigTemplateRef(md))
+
+	unstructured.SetNestedMap(md.Object, map[string]interface{}{
+		"apiVersion": "bootstrap.cluster.x-k8s.io/v1alpha3",
+		"kind":       "KubeadmConfigTemplate",
+		"name":       "workers",
+	}, "spec", "template", "spec", "bootstrap", "configRef")
+	assert.Equal(t, &apiv1.ObjectReference{
+		APIVersion: "bootstrap.cluster.x-k8s.io/v1alpha3",
+		Kind:       "KubeadmConfigTemplate",
+		Name:       "workers",
+	}, bootstrapConfigTemplateRef(md))
+}
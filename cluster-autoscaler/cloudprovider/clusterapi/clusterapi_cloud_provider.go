@@ -17,13 +17,26 @@ limitations under the License.
 package clusterapi
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
+	apimachv1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider/clusterapi/exp"
 	"k8s.io/autoscaler/cluster-autoscaler/config"
 	"k8s.io/autoscaler/cluster-autoscaler/utils/errors"
+	kube_util "k8s.io/autoscaler/cluster-autoscaler/utils/kubernetes"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog"
+	"os"
+	"sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	"sync"
+	"time"
 )
 
 const (
@@ -35,22 +48,71 @@ const (
 type ClusterapiCloudProvider struct {
 	resourceLimiter *cloudprovider.ResourceLimiter
 	machineManager  MachineManager
-}
+	priceModel      *ClusterapiPriceModel
+	cloudConfig     *CloudConfig
+	eventRecorder   record.EventRecorder
 
-// BuildClusterapiCloudProvider creates new ClusterapiCloudProvider
-func BuildClusterapiCloudProvider(machineManager MachineManager, resourceLimiter *cloudprovider.ResourceLimiter) (cloudprovider.CloudProvider, error) {
-	if err := machineManager.Refresh(); err != nil {
-		return nil, err
-	}
+	// nodeGroups caches the node groups by kind, namespace and name, so that they and their state
+	// survive between loops. A node group is rebuilt once its MachineDeployment or MachineSet changes.
+	nodeGroups     map[string]*ClusterapiNodeGroup
+	nodeGroupsLock sync.Mutex
+	// synced is set once the machine manager was refreshed successfully. Until then there are no node
+	// groups, so that the autoscaler doesn't act on a partial view of the cluster.
+	synced bool
+	// lastRefresh is the time of the last successful refresh, checked by the health check
+	lastRefresh time.Time
+}
 
+// BuildClusterapiCloudProvider creates new ClusterapiCloudProvider. Scale events are
+// recorded against the node groups' objects unless eventRecorder is nil.
+func BuildClusterapiCloudProvider(machineManager MachineManager, resourceLimiter *cloudprovider.ResourceLimiter, cloudConfig *CloudConfig, eventRecorder record.EventRecorder) (cloudprovider.CloudProvider, error) {
 	clusterapi := &ClusterapiCloudProvider{
 		resourceLimiter: resourceLimiter,
 		machineManager:  machineManager,
+		priceModel:      NewClusterapiPriceModel(machineManager, cloudConfig.machineTypePrices()),
+		cloudConfig:     cloudConfig,
+		eventRecorder:   eventRecorder,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cloudConfig.getStartupTimeout())
+	defer cancel()
+	// the informers retry until the apiserver is reachable, so this blocks until their caches are complete
+	if err := machineManager.WaitForCacheSync(ctx); err != nil {
+		return nil, err
+	}
+	if err := clusterapi.initialRefresh(ctx); err != nil {
+		return nil, err
 	}
 
 	return clusterapi, nil
 }
 
+// initialRefresh refreshes the node groups on startup. Failures, e.g. while the control plane of the management
+// cluster rolls, are retried with startupRefreshBackoff until the configured number of attempts is used up or
+// ctx is done.
+func (clusterapi *ClusterapiCloudProvider) initialRefresh(ctx context.Context) error {
+	attempts := clusterapi.cloudConfig.getStartupRefreshAttempts()
+	delay := startupRefreshBackoff.Duration
+	for attempt := 1; ; attempt++ {
+		err := clusterapi.Refresh()
+		if err == nil {
+			return nil
+		}
+		if attempt >= attempts {
+			return autoscalerError(err).AddPrefix("initial refresh failed after %d attempts: ", attempt)
+		}
+
+		jittered := wait.Jitter(delay, startupRefreshBackoff.Jitter)
+		warningS("Initial refresh failed, retrying", "operation", "Refresh", "attempt", attempt, "attempts", attempts, "delay", jittered, "err", err)
+		select {
+		case <-ctx.Done():
+			return autoscalerError(err).AddPrefix("initial refresh failed within startup timeout after %d attempts: ", attempt)
+		case <-time.After(jittered):
+		}
+		delay = time.Duration(float64(delay) * startupRefreshBackoff.Factor)
+	}
+}
+
 // Name returns name of the cloud provider.
 func (clusterapi *ClusterapiCloudProvider) Name() string {
 	return ProviderName
@@ -59,33 +121,162 @@ func (clusterapi *ClusterapiCloudProvider) Name() string {
 // NodeGroups returns all node groups configured for this cloud provider.
 func (clusterapi *ClusterapiCloudProvider) NodeGroups() []cloudprovider.NodeGroup {
 	mds := clusterapi.machineManager.AllDeployments()
-	ngs := make([]cloudprovider.NodeGroup, len(mds))
-	for i, md := range mds {
-		ngs[i] = NewClusterapiNodeGroup(clusterapi.machineManager, md)
+	mss := clusterapi.machineManager.AllMachineSets()
+	mps := clusterapi.machineManager.AllMachinePools()
+
+	clusterapi.nodeGroupsLock.Lock()
+	defer clusterapi.nodeGroupsLock.Unlock()
+
+	if !clusterapi.synced {
+		warningS("Cloud provider not synced yet, no node groups")
+		return []cloudprovider.NodeGroup{}
+	}
+	ngs := make([]cloudprovider.NodeGroup, 0, len(mds)+len(mss)+len(mps))
+	current := make(map[string]bool, len(mds)+len(mss)+len(mps))
+	for _, md := range mds {
+		ngs = append(ngs, clusterapi.nodeGroupFor(md))
+		current[nodeGroupKey(md)] = true
+	}
+	for _, ms := range mss {
+		ngs = append(ngs, clusterapi.nodeGroupFor(ms))
+		current[nodeGroupKey(ms)] = true
+	}
+	for _, mp := range mps {
+		ngs = append(ngs, clusterapi.nodeGroupFor(mp))
+		current[nodeGroupKey(mp)] = true
+	}
+
+	// drop the node groups whose MachineDeployment, MachineSet or MachinePool is gone
+	for key := range clusterapi.nodeGroups {
+		if !current[key] {
+			delete(clusterapi.nodeGroups, key)
+		}
 	}
 
 	return ngs
 }
 
+// NodeGroupStatus is the autoscaler's view of a node group, e.g. for debug handlers
+type NodeGroupStatus struct {
+	// Kind is MachineDeployment, MachineSet or MachinePool
+	Kind      string
+	Namespace string
+	Name      string
+	Min       int
+	Max       int
+	// Current is the target size of the node group
+	Current int
+	// Ready is the number of ready nodes of the node group
+	Ready int
+}
+
+// NodeGroupStatuses returns the status of all node groups as of the last refresh, without changing them
+func (clusterapi *ClusterapiCloudProvider) NodeGroupStatuses() []NodeGroupStatus {
+	nodeGroups := clusterapi.NodeGroups()
+	statuses := make([]NodeGroupStatus, 0, len(nodeGroups))
+	for _, nodeGroup := range nodeGroups {
+		ng := nodeGroup.(*ClusterapiNodeGroup)
+		obj := ng.object()
+		ready := 0
+		for _, node := range ng.nodes() {
+			if isReady, _, err := kube_util.GetReadinessState(node); err == nil && isReady {
+				ready++
+			}
+		}
+		statuses = append(statuses, NodeGroupStatus{
+			Kind:      kindOf(obj),
+			Namespace: obj.GetNamespace(),
+			Name:      obj.GetName(),
+			Min:       ng.MinSize(),
+			Max:       ng.MaxSize(),
+			Current:   ng.replicas(),
+			Ready:     ready,
+		})
+	}
+	return statuses
+}
+
 // NodeGroupForNode returns the node group for the given node, nil if the node
 // should not be processed by cluster autoscaler, or non-nil error if such
 // occurred.
 func (clusterapi *ClusterapiCloudProvider) NodeGroupForNode(node *v1.Node) (cloudprovider.NodeGroup, error) {
+	var obj apimachv1.Object
 	if md := clusterapi.machineManager.DeploymentForNode(node); md != nil {
-		return NewClusterapiNodeGroup(clusterapi.machineManager, md), nil
+		obj = md
+	} else if ms := clusterapi.machineManager.MachineSetForNode(node); ms != nil {
+		obj = ms
+	} else if mp := clusterapi.machineManager.MachinePoolForNode(node); mp != nil {
+		obj = mp
+	} else {
+		// node is not part of a nodegroup, this is perfectly fine just return nil
+		return nil, nil
 	}
-	// node is not part of a nodegroup, this is perfectly fine just return nil
-	return nil, nil
+
+	clusterapi.nodeGroupsLock.Lock()
+	defer clusterapi.nodeGroupsLock.Unlock()
+	return clusterapi.nodeGroupFor(obj), nil
+}
+
+// GetNodeGpuConfig returns the GPU config of the node group of a GPU node, nil if the node has no GPUs
+// or doesn't belong to a node group
+func (clusterapi *ClusterapiCloudProvider) GetNodeGpuConfig(node *v1.Node) *GpuConfig {
+	nodeGroup, err := clusterapi.NodeGroupForNode(node)
+	if err != nil || nodeGroup == nil {
+		return nil
+	}
+	gpuConfig := nodeGroup.(*ClusterapiNodeGroup).GpuConfig()
+	if !gpuConfig.hasGpu(node) {
+		return nil
+	}
+	return gpuConfig
+}
+
+// nodeGroupFor returns the cached node group of a MachineDeployment or MachineSet. The node group is
+// built if it isn't cached yet or if the object changed since. nodeGroupsLock must be held.
+func (clusterapi *ClusterapiCloudProvider) nodeGroupFor(obj apimachv1.Object) *ClusterapiNodeGroup {
+	key := nodeGroupKey(obj)
+	cached, ok := clusterapi.nodeGroups[key]
+	if ok && cached.object().GetUID() == obj.GetUID() && cached.object().GetResourceVersion() == obj.GetResourceVersion() {
+		return cached
+	}
+
+	var ng *ClusterapiNodeGroup
+	switch o := obj.(type) {
+	case *v1alpha1.MachineDeployment:
+		ng = NewClusterapiNodeGroup(clusterapi.machineManager, o, clusterapi.cloudConfig)
+	case *v1alpha1.MachineSet:
+		ng = NewClusterapiMachineSetNodeGroup(clusterapi.machineManager, o, clusterapi.cloudConfig)
+	case *exp.MachinePool:
+		ng = NewClusterapiMachinePoolNodeGroup(clusterapi.machineManager, o, clusterapi.cloudConfig)
+	default:
+		panic(fmt.Sprintf("unexpected node group object %T", obj))
+	}
+	ng.eventRecorder = clusterapi.eventRecorder
+	// the state of a node group survives changes of its object, e.g. by its own scale actions
+	if ok && cached.object().GetUID() == obj.GetUID() {
+		ng.lastScaleAction = cached.lastScaleAction
+		ng.divergedSince = cached.divergedSince
+	}
+	if clusterapi.nodeGroups == nil {
+		clusterapi.nodeGroups = make(map[string]*ClusterapiNodeGroup)
+	}
+	clusterapi.nodeGroups[key] = ng
+	return ng
+}
+
+// nodeGroupKey identifies the node group of a MachineDeployment or MachineSet by its kind and id
+func nodeGroupKey(obj apimachv1.Object) string {
+	return kindOf(obj) + "/" + nodeGroupId(obj)
 }
 
 // Pricing returns pricing model for this cloud provider or error if not available.
 func (clusterapi *ClusterapiCloudProvider) Pricing() (cloudprovider.PricingModel, errors.AutoscalerError) {
-	return nil, cloudprovider.ErrNotImplemented
+	return clusterapi.priceModel, nil
 }
 
 // GetAvailableMachineTypes get all machine types that can be requested from the cloud provider.
 func (clusterapi *ClusterapiCloudProvider) GetAvailableMachineTypes() ([]string, error) {
-	return []string{}, nil
+	return clusterapi.machineManager.AvailableMachineTypes(), nil
 }
 
 // NewNodeGroup builds a theoretical node group based on the node definition provided. The node group is not automatically
@@ -102,24 +293,76 @@ func (clusterapi *ClusterapiCloudProvider) GetResourceLimiter() (*cloudprovider.
 
 // Cleanup cleans up open resources before the cloud provider is destroyed, i.e. go routines etc.
 func (clusterapi *ClusterapiCloudProvider) Cleanup() error {
-	return nil
+	return clusterapi.machineManager.Cleanup()
 }
 
 // Refresh is called before every main loop and can be used to dynamically update cloud provider state.
 // In particular the list of node groups returned by NodeGroups can change as a result of CloudProvider.Refresh().
+//
+// The refresh is bounded by the configured refresh timeout, so that an unreachable cluster doesn't stall
+// the main loop.
 func (clusterapi *ClusterapiCloudProvider) Refresh() error {
-	return clusterapi.machineManager.Refresh()
+	timeout := clusterapi.cloudConfig.getRefreshTimeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := clusterapi.machineManager.Refresh(ctx); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return errors.NewAutoscalerError(errors.ApiCallError, "refresh timed out after %v: %v", timeout, err)
+		}
+		return err
+	}
+
+	clusterapi.nodeGroupsLock.Lock()
+	clusterapi.synced = true
+	clusterapi.lastRefresh = time.Now()
+	clusterapi.nodeGroupsLock.Unlock()
+	return nil
 }
 
 // BuildClusterapi builds Clusterapi cloud provider, manager etc.
 func BuildClusterapi(opts config.AutoscalingOptions, do cloudprovider.NodeGroupDiscoveryOptions, rl *cloudprovider.ResourceLimiter, kubeConfig *rest.Config) cloudprovider.CloudProvider {
-	machineManager, err := NewMachineManager(kubeConfig)
+	var configReader io.ReadCloser
+	if opts.CloudConfig != "" {
+		var err error
+		configReader, err = os.Open(opts.CloudConfig)
+		if err != nil {
+			klog.Fatalf("Couldn't open cloud provider configuration %s: %#v", opts.CloudConfig, err)
+		}
+		defer configReader.Close()
+	}
+	cloudConfig, err := ReadCloudConfig(configReader)
+	if err != nil {
+		klog.Fatalf("Couldn't read cloud provider configuration %s: %v", opts.CloudConfig, err)
+	}
+	cloudConfig.maxNodeProvisionTime = opts.MaxNodeProvisionTime
+
+	autoDiscoverySelectors, err := parseAutoDiscoverySpecs(do)
+	if err != nil {
+		klog.Fatalf("Invalid node group auto discovery specs: %v", err)
+	}
+
+	managementKubeConfig, err := cloudConfig.managementKubeConfig(kubeConfig)
+	if err != nil {
+		klog.Fatalf("Couldn't read cloud provider configuration %s: %v", opts.CloudConfig, err)
+	}
+
+	machineManager, err := NewMachineManager(cloudConfig.throttled(kubeConfig), cloudConfig.throttled(managementKubeConfig),
+		cloudConfig.machineManagerOptions(autoDiscoverySelectors))
 	if err != nil {
 		klog.Fatalf("Failed to create Clusterapi machine manager: %v", err)
 	}
-	provider, err := BuildClusterapiCloudProvider(machineManager, rl)
+	// events are recorded against the cluster-api objects, so they belong to the management cluster
+	managementClient, err := kubernetes.NewForConfig(managementKubeConfig)
+	if err != nil {
+		klog.Fatalf("Failed to create kubernetes client: %v", err)
+	}
+	provider, err := BuildClusterapiCloudProvider(machineManager, rl, cloudConfig, kube_util.CreateEventRecorder(managementClient))
 	if err != nil {
 		klog.Fatalf("Failed to create Clusterapi cloud provider: %v", err)
 	}
+	// Register clusterapi provider metrics.
+	RegisterMetrics()
+	registerHealthCheck(provider.(*ClusterapiCloudProvider))
 	return provider
 }
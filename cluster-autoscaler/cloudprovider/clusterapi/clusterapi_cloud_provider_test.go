@@ -17,12 +17,26 @@ limitations under the License.
 package clusterapi
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
-	"k8s.io/api/core/v1"
+	"github.com/stretchr/testify/mock"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider/clusterapi/exp"
 	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider/clusterapi/fake"
+	"k8s.io/autoscaler/cluster-autoscaler/utils/test"
+	corefake "k8s.io/client-go/kubernetes/fake"
 	"sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func newTestMachineManager(t *testing.T) *fake.MachineManagerMock {
@@ -40,22 +54,81 @@ func newTestProvider(t *testing.T) *ClusterapiCloudProvider {
 	return &ClusterapiCloudProvider{
 		resourceLimiter: resourceLimiter,
 		machineManager:  manager,
+		synced:          true,
 	}
 }
 
 func TestBuildClusterapiCloudProvider(t *testing.T) {
 	machineManager := newTestMachineManager(t)
-	machineManager.On("Refresh").Return(nil)
+	machineManager.On("WaitForCacheSync", mock.Anything).Return(nil)
+	machineManager.On("Refresh", mock.Anything).Return(nil)
 
 	resourceLimiter := cloudprovider.NewResourceLimiter(
 		map[string]int64{cloudprovider.ResourceNameCores: 1, cloudprovider.ResourceNameMemory: 10000000},
 		map[string]int64{cloudprovider.ResourceNameCores: 10, cloudprovider.ResourceNameMemory: 100000000})
-	_, err := BuildClusterapiCloudProvider(machineManager, resourceLimiter)
+	_, err := BuildClusterapiCloudProvider(machineManager, resourceLimiter, &CloudConfig{}, nil)
 
 	assert.NoError(t, err)
 	machineManager.AssertExpectations(t)
 }
 
+func TestBuildClusterapiCloudProviderNotSynced(t *testing.T) {
+	machineManager := newTestMachineManager(t)
+	machineManager.On("WaitForCacheSync", mock.Anything).Return(errors.New("machine manager is stopped"))
+
+	_, err := BuildClusterapiCloudProvider(machineManager, nil, &CloudConfig{}, nil)
+	assert.EqualError(t, err, "machine manager is stopped")
+	machineManager.AssertNotCalled(t, "Refresh", mock.Anything)
+}
+
+func TestBuildClusterapiCloudProviderRetriesInitialRefresh(t *testing.T) {
+	defer func(backoff wait.Backoff) { startupRefreshBackoff = backoff }(startupRefreshBackoff)
+	startupRefreshBackoff = wait.Backoff{Duration: time.Millisecond, Factor: 2.0, Jitter: 0.5}
+
+	machineManager := newTestMachineManager(t)
+	machineManager.On("WaitForCacheSync", mock.Anything).Return(nil)
+	machineManager.On("Refresh", mock.Anything).Return(errors.New("connection refused")).Twice()
+	machineManager.On("Refresh", mock.Anything).Return(nil).Once()
+	_, err := BuildClusterapiCloudProvider(machineManager, nil, &CloudConfig{}, nil)
+	assert.NoError(t, err)
+	machineManager.AssertNumberOfCalls(t, "Refresh", 3)
+
+	// the provider fails once the attempts are used up
+	cfg, err := ReadCloudConfig(strings.NewReader("[global]\nstartup-refresh-attempts = 2\n"))
+	assert.NoError(t, err)
+	machineManager = newTestMachineManager(t)
+	machineManager.On("WaitForCacheSync", mock.Anything).Return(nil)
+	machineManager.On("Refresh", mock.Anything).Return(errors.New("connection refused"))
+	_, err = BuildClusterapiCloudProvider(machineManager, nil, cfg, nil)
+	assert.EqualError(t, err, "initial refresh failed after 2 attempts: connection refused")
+	machineManager.AssertNumberOfCalls(t, "Refresh", 2)
+
+	// or the startup timeout elapsed
+	startupRefreshBackoff.Duration = time.Hour
+	cfg, err = ReadCloudConfig(strings.NewReader("[global]\nstartup-timeout = 10ms\n"))
+	assert.NoError(t, err)
+	_, err = BuildClusterapiCloudProvider(machineManager, nil, cfg, nil)
+	assert.EqualError(t, err, "initial refresh failed within startup timeout after 1 attempts: connection refused")
+}
+
+func TestNodeGroupsNotSynced(t *testing.T) {
+	md := buildTestMachineDeployment("md", 1, 0, 10)
+	machineManager := newTestMachineManager(t)
+	machineManager.On("AllDeployments").Return([]*v1alpha1.MachineDeployment{md})
+	machineManager.On("AllMachineSets").Return([]*v1alpha1.MachineSet{})
+	machineManager.On("AllMachinePools").Return([]*exp.MachinePool{})
+	machineManager.On("Refresh", mock.Anything).Return(errors.New("informer caches not synced")).Once()
+	machineManager.On("Refresh", mock.Anything).Return(nil)
+	provider := newTestProvider(t)
+	provider.machineManager = machineManager
+	provider.synced = false
+
+	assert.Error(t, provider.Refresh())
+	assert.Empty(t, provider.NodeGroups())
+	assert.NoError(t, provider.Refresh())
+	assert.Len(t, provider.NodeGroups(), 1)
+}
+
 func TestName(t *testing.T) {
 	provider := newTestProvider(t)
 	assert.Equal(t, provider.Name(), "clusterapi")
@@ -64,88 +137,442 @@ func TestName(t *testing.T) {
 func TestNodeGroups(t *testing.T) {
 	md1 := buildTestMachineDeployment("md1", 1, 0, 10)
 	md2 := buildTestMachineDeployment("md2", 2, 0, 10)
+	ms1 := buildTestStandaloneMachineSet("ms1", 1, 0, 5)
+	mp1 := buildTestMachinePool("mp1", 1, 0, 3)
 
 	machineManager := newTestMachineManager(t)
-	machineManager.On("Refresh").Return(nil)
+	machineManager.On("WaitForCacheSync", mock.Anything).Return(nil)
+	machineManager.On("Refresh", mock.Anything).Return(nil)
 	machineManager.On("AllDeployments").Return([]*v1alpha1.MachineDeployment{md1, md2})
+	machineManager.On("AllMachineSets").Return([]*v1alpha1.MachineSet{ms1})
+	machineManager.On("AllMachinePools").Return([]*exp.MachinePool{mp1})
 
 	resourceLimiter := cloudprovider.NewResourceLimiter(
 		map[string]int64{cloudprovider.ResourceNameCores: 1, cloudprovider.ResourceNameMemory: 10000000},
 		map[string]int64{cloudprovider.ResourceNameCores: 10, cloudprovider.ResourceNameMemory: 100000000})
-	cp, err := BuildClusterapiCloudProvider(machineManager, resourceLimiter)
+	cp, err := BuildClusterapiCloudProvider(machineManager, resourceLimiter, &CloudConfig{}, nil)
 	assert.NoError(t, err)
 
 	nodeGroups := cp.NodeGroups()
-	assert.Len(t, nodeGroups, 2)
-	assert.Equal(t, "md1", nodeGroups[0].Id())
-	assert.Equal(t, "md2", nodeGroups[1].Id())
+	assert.Len(t, nodeGroups, 4)
+	assert.Equal(t, "kube-system/md1", nodeGroups[0].Id())
+	assert.Equal(t, "kube-system/md2", nodeGroups[1].Id())
+	assert.Equal(t, "kube-system/ms1", nodeGroups[2].Id())
+	assert.Equal(t, 5, nodeGroups[2].MaxSize())
+	assert.Equal(t, "kube-system/mp1", nodeGroups[3].Id())
+	assert.Equal(t, 3, nodeGroups[3].MaxSize())
 
 	machineManager.AssertExpectations(t)
 }
 
+func TestNodeGroupsOfNamespacesWithSameNames(t *testing.T) {
+	workersA := buildTestMachineDeployment("workers", 1, 0, 10)
+	workersA.Namespace = "tenant-a"
+	workersB := buildTestMachineDeployment("workers", 2, 0, 10)
+	workersB.Namespace = "tenant-b"
+	nodeA := buildTestNode("a")
+	nodeB := buildTestNode("b")
+
+	provider := newTestProvider(t)
+	manager := provider.machineManager.(*fake.MachineManagerMock)
+	manager.On("AllDeployments").Return([]*v1alpha1.MachineDeployment{workersA, workersB})
+	manager.On("AllMachineSets").Return([]*v1alpha1.MachineSet{})
+	manager.On("AllMachinePools").Return([]*exp.MachinePool{})
+	manager.On("DeploymentForNode", nodeA).Return(workersA)
+	manager.On("DeploymentForNode", nodeB).Return(workersB)
+
+	nodeGroups := provider.NodeGroups()
+	assert.Len(t, nodeGroups, 2)
+	assert.Equal(t, "tenant-a/workers", nodeGroups[0].Id())
+	assert.Equal(t, "tenant-b/workers", nodeGroups[1].Id())
+
+	nodeGroup, err := provider.NodeGroupForNode(nodeB)
+	assert.NoError(t, err)
+	assert.True(t, nodeGroup == nodeGroups[1])
+	nodeGroup, err = provider.NodeGroupForNode(nodeA)
+	assert.NoError(t, err)
+	assert.True(t, nodeGroup == nodeGroups[0])
+}
+
+func TestNodeGroupsCached(t *testing.T) {
+	md1 := buildTestMachineDeployment("md1", 1, 0, 10)
+	md1.ResourceVersion = "1"
+	md2 := buildTestMachineDeployment("md2", 2, 0, 10)
+	n := buildTestNode("n")
+
+	machineManager := newTestMachineManager(t)
+	machineManager.On("AllDeployments").Return([]*v1alpha1.MachineDeployment{md1, md2}).Twice()
+	machineManager.On("AllMachineSets").Return([]*v1alpha1.MachineSet{})
+	machineManager.On("AllMachinePools").Return([]*exp.MachinePool{})
+	machineManager.On("DeploymentForNode", n).Return(md1)
+	provider := newTestProvider(t)
+	provider.machineManager = machineManager
+
+	nodeGroups := provider.NodeGroups()
+	assert.Len(t, nodeGroups, 2)
+	assert.Equal(t, nodeGroups, provider.NodeGroups())
+	nodeGroups[0].(*ClusterapiNodeGroup).lastScaleAction = time.Now()
+	nodeGroups[0].(*ClusterapiNodeGroup).divergedSince = time.Now().Add(-time.Minute)
+	ng, err := provider.NodeGroupForNode(n)
+	assert.NoError(t, err)
+	assert.True(t, ng == nodeGroups[0])
+
+	// a changed MachineDeployment gets a new node group, a removed one is dropped
+	updated := md1.DeepCopy()
+	updated.ResourceVersion = "2"
+	machineManager.On("AllDeployments").Return([]*v1alpha1.MachineDeployment{updated})
+	updatedNodeGroups := provider.NodeGroups()
+	assert.Len(t, updatedNodeGroups, 1)
+	assert.False(t, updatedNodeGroups[0] == nodeGroups[0])
+	assert.Equal(t, updated, updatedNodeGroups[0].(*ClusterapiNodeGroup).machineDeployment)
+	assert.Equal(t, nodeGroups[0].(*ClusterapiNodeGroup).lastScaleAction, updatedNodeGroups[0].(*ClusterapiNodeGroup).lastScaleAction)
+	assert.Equal(t, nodeGroups[0].(*ClusterapiNodeGroup).divergedSince, updatedNodeGroups[0].(*ClusterapiNodeGroup).divergedSince)
+	assert.Len(t, provider.nodeGroups, 1)
+}
+
 func TestNodeGroupForNodeAndNodesOfNodeGroup(t *testing.T) {
 	md1 := buildTestMachineDeployment("md1", 1, 0, 10)
 	ms1 := buildTestMachineSet(md1, "ms1", 2)
 
 	n11 := buildTestNode("n11")
-	buildTestMachine(ms1, "m11", n11)
+	m11 := buildTestMachine(ms1, "m11", n11)
 
 	n12 := buildTestNode("n12")
-	buildTestMachine(ms1, "m12", n12)
+	m12 := buildTestMachine(ms1, "m12", n12)
 
 	md2 := buildTestMachineDeployment("md2", 2, 0, 10)
-	buildTestMachineSet(md2, "ms2", 2)
+	ms2 := buildTestMachineSet(md2, "ms2", 2)
 
 	n21 := buildTestNode("n21")
-	buildTestMachine(ms1, "m21", n21)
+	m21 := buildTestMachine(ms2, "m21", n21)
 
 	machineManager := newTestMachineManager(t)
-	machineManager.On("Refresh").Return(nil)
+	machineManager.On("WaitForCacheSync", mock.Anything).Return(nil)
+	machineManager.On("Refresh", mock.Anything).Return(nil)
 
 	machineManager.On("DeploymentForNode", n11).Return(md1)
 	machineManager.On("DeploymentForNode", n12).Return(md1)
-	machineManager.On("NodesForDeployment", md1).Return([]*v1.Node{n11, n12})
+	machineManager.On("MachinesForDeployment", md1).Return([]*v1alpha1.Machine{m11, m12})
+	machineManager.On("NodeForMachine", m11).Return(n11)
+	machineManager.On("NodeForMachine", m12).Return(n12)
 
 	machineManager.On("DeploymentForNode", n21).Return(md2)
-	machineManager.On("NodesForDeployment", md2).Return([]*v1.Node{n21})
+	machineManager.On("MachinesForDeployment", md2).Return([]*v1alpha1.Machine{m21})
+	machineManager.On("NodeForMachine", m21).Return(n21)
 
 	resourceLimiter := cloudprovider.NewResourceLimiter(
 		map[string]int64{cloudprovider.ResourceNameCores: 1, cloudprovider.ResourceNameMemory: 10000000},
 		map[string]int64{cloudprovider.ResourceNameCores: 10, cloudprovider.ResourceNameMemory: 100000000})
-	cp, err := BuildClusterapiCloudProvider(machineManager, resourceLimiter)
+	cp, err := BuildClusterapiCloudProvider(machineManager, resourceLimiter, &CloudConfig{}, nil)
 	assert.NoError(t, err)
 
 	nodeGroup, err := cp.NodeGroupForNode(n11)
 	assert.NoError(t, err)
-	assert.Equal(t, "md1", nodeGroup.Id())
+	assert.Equal(t, "kube-system/md1", nodeGroup.Id())
 
 	nodeGroup, err = cp.NodeGroupForNode(n12)
 	assert.NoError(t, err)
-	assert.Equal(t, "md1", nodeGroup.Id())
+	assert.Equal(t, "kube-system/md1", nodeGroup.Id())
 
 	nodes, err := nodeGroup.Nodes()
 	assert.NoError(t, err)
-	assert.Equal(t, []cloudprovider.Instance{{Id: "n11"}, {Id: "n12"}}, nodes)
+	running := &cloudprovider.InstanceStatus{State: cloudprovider.InstanceRunning}
+	assert.Equal(t, []cloudprovider.Instance{{Id: "n11", Status: running}, {Id: "n12", Status: running}}, nodes)
 
 	nodeGroup, err = cp.NodeGroupForNode(n21)
 	assert.NoError(t, err)
-	assert.Equal(t, "md2", nodeGroup.Id())
+	assert.Equal(t, "kube-system/md2", nodeGroup.Id())
 
 	nodes, err = nodeGroup.Nodes()
 	assert.NoError(t, err)
-	assert.Equal(t, []cloudprovider.Instance{{Id: "n21"}}, nodes)
+	// md2 has 2 replicas but only one machine so far
+	assert.Equal(t, []cloudprovider.Instance{
+		{Id: "n21", Status: running},
+		{Id: "clusterapi://kube-system/md2/uncreated-0", Status: &cloudprovider.InstanceStatus{State: cloudprovider.InstanceCreating}},
+	}, nodes)
+
+	machineManager.AssertExpectations(t)
+}
+
+func TestNodesRoundTripToNodeGroup(t *testing.T) {
+	md := buildTestMachineDeployment("md", 3, 0, 10)
+	ms := buildTestMachineSet(md, "ms", 3)
+	other := buildTestMachineDeployment("other", 1, 0, 10)
+	otherMs := buildTestMachineSet(other, "other-ms", 1)
+
+	machines := make([]runtime.Object, 0)
+	nodes := make([]runtime.Object, 0)
+	nodesByProviderID := make(map[string]*apiv1.Node)
+	for i, owner := range []*v1alpha1.MachineSet{ms, ms, otherMs} {
+		node := buildTestNode(fmt.Sprintf("n%d", i))
+		// the machines' providerIDs are formatted differently than the nodes'
+		node.Spec.ProviderID = fmt.Sprintf("openstack:///ABC-%d", i)
+		machine := buildTestMachine(owner, fmt.Sprintf("m%d", i), node)
+		providerID := fmt.Sprintf("openstack://abc-%d/", i)
+		machine.Spec.ProviderID = &providerID
+		machines = append(machines, machine)
+		nodes = append(nodes, node)
+		nodesByProviderID[node.Spec.ProviderID] = node
+	}
+	unregistered := buildTestMachine(ms, "unregistered", nil)
+	providerID := "openstack:///abc-3"
+	unregistered.Spec.ProviderID = &providerID
+	// a machine without providerID is resolved by its pending instance id
+	pending := buildTestMachine(ms, "pending", nil)
+
+	dynamicClient := newTestDynamicClient(append(machines, unregistered, pending, ms, otherMs, md, other)...)
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(nodes...), dynamicClient, testGroupVersion, nil)
+	cp, err := BuildClusterapiCloudProvider(mm, nil, &CloudConfig{}, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for _, nodeGroup := range cp.NodeGroups() {
+		instances, err := nodeGroup.Nodes()
+		assert.NoError(t, err)
+		for _, instance := range instances {
+			// the autoscaler matches instances to nodes by their providerID as is, and stands in
+			// a node named like the instance for unregistered ones
+			node, ok := nodesByProviderID[instance.Id]
+			if !ok {
+				node = &apiv1.Node{
+					ObjectMeta: metav1.ObjectMeta{Name: instance.Id},
+					Spec:       apiv1.NodeSpec{ProviderID: instance.Id},
+				}
+			}
+			resolved, err := cp.NodeGroupForNode(node)
+			assert.NoError(t, err)
+			if assert.NotNil(t, resolved, instance.Id) {
+				assert.Equal(t, nodeGroup.Id(), resolved.Id(), instance.Id)
+			}
+		}
+	}
+}
+
+func TestMissingInfrastructureTemplate(t *testing.T) {
+	md := buildTestMachineDeployment("md", 0, 0, 10)
+	md.Annotations[CpuCapacityAnnotation] = "4"
+	md.Annotations[MemoryCapacityAnnotation] = "16Gi"
+	setTestInfrastructureTemplate(md, "infrastructure.cluster.x-k8s.io/v1alpha2", "OpenStackMachineTemplate", "deleted")
+
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(), newTestDynamicClient(md), testGroupVersion, nil)
+	defer mm.Cleanup()
+	cp, err := BuildClusterapiCloudProvider(mm, nil, &CloudConfig{}, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	machineTypes, err := cp.GetAvailableMachineTypes()
+	assert.NoError(t, err)
+	assert.Empty(t, machineTypes)
+	nodeGroups := cp.NodeGroups()
+	if !assert.Len(t, nodeGroups, 1) {
+		return
+	}
+	nodeInfo, err := nodeGroups[0].TemplateNodeInfo()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), nodeInfo.Node().Status.Capacity.Cpu().Value())
+}
+
+func TestZeroReplicaNodeGroup(t *testing.T) {
+	md := buildTestMachineDeployment("md", 0, 0, 3)
+	md.Annotations[CpuCapacityAnnotation] = "4"
+	md.Annotations[MemoryCapacityAnnotation] = "16Gi"
+
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(), newTestDynamicClient(md), testGroupVersion, nil)
+	defer mm.Cleanup()
+	cp, err := BuildClusterapiCloudProvider(mm, nil, &CloudConfig{}, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// a group scaled to zero stays a node group that can be scaled up
+	nodeGroups := cp.NodeGroups()
+	if !assert.Len(t, nodeGroups, 1) {
+		return
+	}
+	size, err := nodeGroups[0].TargetSize()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, size)
+	_, err = nodeGroups[0].TemplateNodeInfo()
+	assert.NoError(t, err)
+	assert.NoError(t, nodeGroups[0].IncreaseSize(2))
+	size, err = nodeGroups[0].TargetSize()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, size)
+
+	assert.NoError(t, cp.Refresh())
+	assert.Len(t, cp.NodeGroups(), 1)
+	assert.Equal(t, int32(2), *mm.AllDeployments()[0].Spec.Replicas)
+}
+
+func TestNodeGroupStatuses(t *testing.T) {
+	md := buildTestMachineDeployment("md", 2, 1, 10)
+	ms := buildTestMachineSet(md, "ms", 2)
+	ready := buildTestNode("ready")
+	test.SetNodeReadyState(ready, true, time.Now())
+	unready := buildTestNode("unready")
+	test.SetNodeReadyState(unready, false, time.Now())
+	m1 := buildTestMachine(ms, "m1", ready)
+	m2 := buildTestMachine(ms, "m2", unready)
+	standalone := buildTestStandaloneMachineSet("standalone", 0, 0, 3)
+
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(ready, unready), newTestDynamicClient(md, ms, m1, m2, standalone),
+		testGroupVersion, nil)
+	defer mm.Cleanup()
+	cp, err := BuildClusterapiCloudProvider(mm, nil, &CloudConfig{}, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.ElementsMatch(t, []NodeGroupStatus{
+		{Kind: "MachineDeployment", Namespace: "kube-system", Name: "md", Min: 1, Max: 10, Current: 2, Ready: 1},
+		{Kind: "MachineSet", Namespace: "kube-system", Name: "standalone", Min: 0, Max: 3, Current: 0, Ready: 0},
+	}, cp.(*ClusterapiCloudProvider).NodeGroupStatuses())
+}
+
+// TestRefreshConcurrentWithReads is meant to be run with -race. The health check and the autoscaler read
+// the node groups while they are refreshed.
+func TestRefreshConcurrentWithReads(t *testing.T) {
+	md := buildTestMachineDeployment("md", 1, 0, 10)
+	ms := buildTestMachineSet(md, "ms", 1)
+	node := buildTestNode("n1")
+	machine := buildTestMachine(ms, "m1", node)
+
+	dynamicClient := newTestDynamicClient(md, ms, machine)
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(node), dynamicClient, testGroupVersion, nil)
+	defer mm.Cleanup()
+	cp, err := BuildClusterapiCloudProvider(mm, nil, &CloudConfig{}, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	clusterapi := cp.(*ClusterapiCloudProvider)
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	read := func(f func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					f()
+				}
+			}
+		}()
+	}
+	read(func() {
+		for _, ng := range cp.NodeGroups() {
+			ng.TargetSize()
+			ng.Nodes()
+		}
+	})
+	read(func() {
+		cp.NodeGroupForNode(node)
+		clusterapi.healthy(time.Now())
+	})
+	read(func() {
+		mm.DeploymentForNode(node)
+		mm.MachineForNode(node)
+		mm.NodesForDeployment(md)
+		mm.AllDeployments()
+	})
+
+	for i := 0; i < 10; i++ {
+		_, err := dynamicClient.Resource(testGroupVersion.WithResource(machineDeploymentResource)).Namespace("kube-system").
+			Patch("md", types.MergePatchType, []byte(fmt.Sprintf(`{"spec":{"replicas":%d}}`, i%10+1)), metav1.UpdateOptions{})
+		assert.NoError(t, err)
+		assert.NoError(t, cp.Refresh())
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestNodeGroupDeletedBetweenRefreshes(t *testing.T) {
+	md := buildTestMachineDeployment("md", 1, 0, 10)
+	dynamicClient := newTestDynamicClient(md)
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(), dynamicClient, testGroupVersion, nil)
+	cp, err := BuildClusterapiCloudProvider(mm, nil, &CloudConfig{}, nil)
+	if !assert.NoError(t, err) || !assert.Len(t, cp.NodeGroups(), 1) {
+		return
+	}
+	nodeGroup := cp.NodeGroups()[0]
+
+	err = dynamicClient.Resource(testGroupVersion.WithResource(machineDeploymentResource)).Namespace("kube-system").
+		Delete("md", &metav1.DeleteOptions{})
+	assert.NoError(t, err)
+
+	assert.EqualError(t, nodeGroup.IncreaseSize(1), "node group kube-system/md no longer exists")
+	assert.False(t, nodeGroup.Exist())
+	assert.EqualError(t, nodeGroup.DecreaseTargetSize(-1), "node group kube-system/md no longer exists")
+
+	err = wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return len(cp.NodeGroups()) == 0, cp.Refresh()
+	})
+	assert.NoError(t, err)
+}
+
+func TestNodeGroupForNodeOfStandaloneMachineSet(t *testing.T) {
+	ms := buildTestStandaloneMachineSet("ms", 1, 0, 5)
+	n := buildTestNode("n")
+	m := buildTestMachine(ms, "m", n)
+	unmanaged := buildTestNode("unmanaged")
+
+	machineManager := newTestMachineManager(t)
+	machineManager.On("WaitForCacheSync", mock.Anything).Return(nil)
+	machineManager.On("Refresh", mock.Anything).Return(nil)
+	machineManager.On("DeploymentForNode", n).Return((*v1alpha1.MachineDeployment)(nil))
+	machineManager.On("MachineSetForNode", n).Return(ms)
+	machineManager.On("MachinesForMachineSet", ms).Return([]*v1alpha1.Machine{m})
+	machineManager.On("NodeForMachine", m).Return(n)
+	machineManager.On("SetMachineSetSize", ms, 2).Return(true, nil)
+	machineManager.On("DeploymentForNode", unmanaged).Return((*v1alpha1.MachineDeployment)(nil))
+	machineManager.On("MachineSetForNode", unmanaged).Return((*v1alpha1.MachineSet)(nil))
+	machineManager.On("MachinePoolForNode", unmanaged).Return((*exp.MachinePool)(nil))
+
+	resourceLimiter := cloudprovider.NewResourceLimiter(
+		map[string]int64{cloudprovider.ResourceNameCores: 1, cloudprovider.ResourceNameMemory: 10000000},
+		map[string]int64{cloudprovider.ResourceNameCores: 10, cloudprovider.ResourceNameMemory: 100000000})
+	cp, err := BuildClusterapiCloudProvider(machineManager, resourceLimiter, &CloudConfig{}, nil)
+	assert.NoError(t, err)
+
+	nodeGroup, err := cp.NodeGroupForNode(n)
+	assert.NoError(t, err)
+	assert.Equal(t, "kube-system/ms", nodeGroup.Id())
+
+	nodes, err := nodeGroup.Nodes()
+	assert.NoError(t, err)
+	assert.Equal(t, []cloudprovider.Instance{{Id: "n", Status: &cloudprovider.InstanceStatus{State: cloudprovider.InstanceRunning}}}, nodes)
+
+	assert.NoError(t, nodeGroup.IncreaseSize(1))
+
+	nodeGroup, err = cp.NodeGroupForNode(unmanaged)
+	assert.NoError(t, err)
+	assert.Nil(t, nodeGroup)
 
 	machineManager.AssertExpectations(t)
 }
 
+func TestCleanup(t *testing.T) {
+	provider := newTestProvider(t)
+	provider.machineManager.(*fake.MachineManagerMock).On("Cleanup").Return(nil)
+
+	assert.NoError(t, provider.Cleanup())
+	provider.machineManager.(*fake.MachineManagerMock).AssertExpectations(t)
+}
+
 func TestRefresh(t *testing.T) {
 	machineManager := newTestMachineManager(t)
-	machineManager.On("Refresh").Return(nil)
+	machineManager.On("WaitForCacheSync", mock.Anything).Return(nil)
+	machineManager.On("Refresh", mock.Anything).Return(nil)
 
 	resourceLimiter := cloudprovider.NewResourceLimiter(
 		map[string]int64{cloudprovider.ResourceNameCores: 1, cloudprovider.ResourceNameMemory: 10000000},
 		map[string]int64{cloudprovider.ResourceNameCores: 10, cloudprovider.ResourceNameMemory: 100000000})
-	cp, err := BuildClusterapiCloudProvider(machineManager, resourceLimiter)
+	cp, err := BuildClusterapiCloudProvider(machineManager, resourceLimiter, &CloudConfig{}, nil)
 	assert.NoError(t, err)
 
 	assert.NoError(t, cp.Refresh())
@@ -153,3 +580,28 @@ func TestRefresh(t *testing.T) {
 	machineManager.AssertExpectations(t)
 	machineManager.AssertNumberOfCalls(t, "Refresh", 2)
 }
+
+func TestRefreshTimeout(t *testing.T) {
+	machineManager := newTestMachineManager(t)
+	machineManager.On("WaitForCacheSync", mock.Anything).Return(nil)
+	machineManager.On("Refresh", mock.Anything).Return(nil).Once()
+	machineManager.On("Refresh", mock.Anything).Return(errors.New("informer caches not synced")).Run(func(args mock.Arguments) {
+		<-args.Get(0).(context.Context).Done()
+	})
+
+	cloudConfig, err := ReadCloudConfig(strings.NewReader("[global]\nrefresh-timeout = 10ms\n"))
+	assert.NoError(t, err)
+	cp, err := BuildClusterapiCloudProvider(machineManager, nil, cloudConfig, nil)
+	assert.NoError(t, err)
+
+	assert.EqualError(t, cp.Refresh(), "refresh timed out after 10ms: informer caches not synced")
+}
+
+func TestGetAvailableMachineTypes(t *testing.T) {
+	provider := newTestProvider(t)
+	provider.machineManager.(*fake.MachineManagerMock).On("AvailableMachineTypes").Return([]string{"m1.large", "m1.small"})
+
+	machineTypes, err := provider.GetAvailableMachineTypes()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"m1.large", "m1.small"}, machineTypes)
+}
@@ -0,0 +1,610 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"fmt"
+	"gopkg.in/gcfg.v1"
+	"io"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/autoscaler/cluster-autoscaler/utils/gpu"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"os"
+	"time"
+)
+
+const (
+	defaultRefreshTimeout       = 30 * time.Second
+	defaultRefreshConcurrency   = 4
+	defaultHealthCheckStaleness = 5 * time.Minute
+	defaultMaxDeleteBatch       = 100
+	defaultStartupAttempts      = 5
+	defaultStartupTimeout       = 5 * time.Minute
+	defaultListPageSize         = 500
+	// defaultKubeAPIQPSPerRefresh is the client QPS granted per namespace refreshed in parallel, with a
+	// burst of twice the QPS
+	defaultKubeAPIQPSPerRefresh = 5
+	// defaultMaxNodeProvisionTime is the default of the autoscaler's max-node-provision-time
+	defaultMaxNodeProvisionTime = 15 * time.Minute
+)
+
+// CloudConfig is the configuration of the clusterapi cloud provider, read from
+// the file passed via --cloud-config. Example:
+//
+//	[global]
+//	kube-reserved = cpu=100m,memory=256Mi
+//	system-reserved = cpu=100m,memory=128Mi
+//	refresh-timeout = 30s
+//	refresh-interval = 1m
+//	refresh-concurrency = 4
+//	startup-refresh-attempts = 5
+//	startup-timeout = 5m
+//	list-page-size = 500
+//	resync-period = 0s
+//	kube-api-qps = 20
+//	kube-api-burst = 40
+//	health-check-staleness = 5m
+//	max-delete-batch = 100
+//	hint-annotation = autoscaler.syseleven.de/spot
+//	hint-annotation = example.com/gpu-interconnect
+//	namespace = tenant-a
+//	namespace = tenant-b
+//	observe-only-namespace = tenant-b
+//	cluster-name = workload
+//	cluster-namespace = tenant-a
+//	management-kubeconfig = /etc/kubernetes/management.kubeconfig
+//	dry-run = false
+//	delete-unregistered-machines = false
+//	protect-cordoned-nodes = false
+//	pdb-aware-deletion = false
+//	fail-on-missing-permissions = false
+//	instance-id = autoscaler-a
+//	skip-foreign-node-groups = false
+//
+//	[openstack]
+//	auth-url = https://keystone.example.com:5000/v3
+//	username = autoscaler
+//	password = secret
+//	domain-name = Default
+//	project-name = workload
+//	region = dbl
+//
+//	[machine-type "m1.small"]
+//	price-per-hour = 0.05
+//	cpu = 1
+//	memory = 2Gi
+//	ephemeral-storage = 20Gi
+type CloudConfig struct {
+	Global struct {
+		// KubeReserved and SystemReserved are subtracted from the capacity of template nodes to get their
+		// allocatable, like kubelet's flags of the same name. Node groups may override them with annotations.
+		KubeReserved   string `gcfg:"kube-reserved"`
+		SystemReserved string `gcfg:"system-reserved"`
+		// RefreshTimeout bounds the duration of a refresh of the cluster-api objects, defaults to 30s
+		RefreshTimeout string `gcfg:"refresh-timeout"`
+		// RefreshInterval is the minimum time between two refreshes, which otherwise happen on every
+		// autoscaler loop. Refreshes within the interval keep the cached state.
+		RefreshInterval string `gcfg:"refresh-interval"`
+		// RefreshConcurrency limits the number of namespaces refreshed in parallel, defaults to 4
+		RefreshConcurrency int `gcfg:"refresh-concurrency"`
+		// StartupRefreshAttempts is the number of attempts of the initial refresh on startup, retried with a
+		// jittered backoff, before the autoscaler fails. Defaults to 5.
+		StartupRefreshAttempts int `gcfg:"startup-refresh-attempts"`
+		// StartupTimeout bounds the initial sync and refresh on startup including retries, defaults to 5m
+		StartupTimeout string `gcfg:"startup-timeout"`
+		// ListPageSize is the number of objects the informers list at once on their initial sync, so that
+		// huge lists don't spike the apiserver's memory. Defaults to 500.
+		ListPageSize int `gcfg:"list-page-size"`
+		// ResyncPeriod is the period of the informers' resyncs of their caches, disabled by default
+		ResyncPeriod string `gcfg:"resync-period"`
+		// KubeAPIQPS and KubeAPIBurst limit the requests of the clients of the workload and management
+		// clusters. They default to 5 QPS per parallel refresh, with a burst of twice the QPS.
+		KubeAPIQPS   int `gcfg:"kube-api-qps"`
+		KubeAPIBurst int `gcfg:"kube-api-burst"`
+		// HealthCheckStaleness is how long ago the last successful refresh may be for the health check to
+		// pass, defaults to 5m
+		HealthCheckStaleness string `gcfg:"health-check-staleness"`
+		// MaxDeleteBatch is the maximum number of nodes a node group deletes at once, as a guard against
+		// mass scale downs. Larger batches are refused as a whole. Defaults to 100.
+		MaxDeleteBatch int `gcfg:"max-delete-batch"`
+		// HintAnnotation are the annotations of the node groups exposed as hints for expanders, see
+		// ClusterapiNodeGroup.Hints. Defaults to the spot, disk-type and network-class annotations.
+		HintAnnotation []string `gcfg:"hint-annotation"`
+		// Namespace restricts the managed cluster-api objects to the given namespaces, all namespaces if unset
+		Namespace []string `gcfg:"namespace"`
+		// ObserveOnlyNamespace lists namespaces whose node groups are discovered and reported but never scaled,
+		// e.g. to roll out autoscaling namespace by namespace. They must be among the managed namespaces.
+		ObserveOnlyNamespace []string `gcfg:"observe-only-namespace"`
+		// ClusterName restricts the node groups and the Machines matched to nodes to those of the named Cluster,
+		// e.g. to run one autoscaler per workload cluster on a shared management cluster. All if unset.
+		ClusterName string `gcfg:"cluster-name"`
+		// ClusterNamespace is the namespace of the Cluster named by cluster-name, to which the managed
+		// cluster-api objects are restricted. It must be among the managed namespaces, if any.
+		ClusterNamespace string `gcfg:"cluster-namespace"`
+		// ManagementKubeconfig points to the cluster holding the cluster-api objects, if that's not the
+		// workload cluster the autoscaler runs in and whose nodes it scales
+		ManagementKubeconfig string `gcfg:"management-kubeconfig"`
+		// DryRun logs the scale actions instead of executing them, while the node groups are still discovered
+		// and sized against the cluster
+		DryRun bool `gcfg:"dry-run"`
+		// DeleteUnregisteredMachines lets the autoscaler delete the machines that never registered a node, e.g.
+		// because they are stuck in provisioning, when it removes long unregistered nodes
+		DeleteUnregisteredMachines bool `gcfg:"delete-unregistered-machines"`
+		// ProtectCordonedNodes keeps the autoscaler from deleting nodes cordoned by other tooling, e.g. for
+		// maintenance, until they are uncordoned
+		ProtectCordonedNodes bool `gcfg:"protect-cordoned-nodes"`
+		// PDBAwareDeletion makes node groups that delete several nodes at once mark the machines whose nodes
+		// host the fewest pods guarded by a PodDisruptionBudget first, so that they drain with the fewest blocked
+		// evictions
+		PDBAwareDeletion bool `gcfg:"pdb-aware-deletion"`
+		// FailOnMissingPermissions makes the startup fail if the autoscaler lacks permissions on the cluster-api
+		// objects in any of its namespaces, instead of only logging them
+		FailOnMissingPermissions bool `gcfg:"fail-on-missing-permissions"`
+		// InstanceID identifies the autoscaler in the managed-by label of the objects it scales, defaults to
+		// the hostname, i.e. the pod name
+		InstanceID string `gcfg:"instance-id"`
+		// SkipForeignNodeGroups ignores the node groups whose managed-by label names another autoscaler
+		// instance, so that several autoscalers may share a namespace
+		SkipForeignNodeGroups bool `gcfg:"skip-foreign-node-groups"`
+	}
+
+	// OpenStack holds the credentials to look up the capacity of flavors from Nova for scaling from zero.
+	// Without, the capacity is taken from annotations, the machine types and the well-known flavors.
+	OpenStack struct {
+		AuthURL     string `gcfg:"auth-url"`
+		Username    string `gcfg:"username"`
+		Password    string `gcfg:"password"`
+		DomainName  string `gcfg:"domain-name"`
+		ProjectID   string `gcfg:"project-id"`
+		ProjectName string `gcfg:"project-name"`
+		Region      string `gcfg:"region"`
+	}
+
+	// MachineType holds defaults keyed by machine type (i.e. OpenStack flavor)
+	MachineType map[string]*MachineTypeConfig `gcfg:"machine-type"`
+
+	// maxNodeProvisionTime is the autoscaler's max-node-provision-time
+	maxNodeProvisionTime time.Duration
+
+	kubeReserved    apiv1.ResourceList
+	systemReserved  apiv1.ResourceList
+	refreshTimeout  time.Duration
+	refreshInterval time.Duration
+	resyncPeriod    time.Duration
+	startupTimeout  time.Duration
+
+	healthCheckStaleness time.Duration
+}
+
+// MachineTypeConfig holds defaults for all node groups of a given machine type
+type MachineTypeConfig struct {
+	// PricePerHour is used when a MachineDeployment has no price annotation
+	PricePerHour float64 `gcfg:"price-per-hour"`
+	// CPU, Memory, GPU and EphemeralStorage are the node capacity used to scale from zero when a
+	// MachineDeployment has no capacity annotations. CPU and memory are required for the capacity to be used.
+	CPU              string `gcfg:"cpu"`
+	Memory           string `gcfg:"memory"`
+	GPU              string `gcfg:"gpu"`
+	EphemeralStorage string `gcfg:"ephemeral-storage"`
+
+	capacity apiv1.ResourceList
+}
+
+// ReadCloudConfig parses a CloudConfig. A nil reader yields an empty config.
+func ReadCloudConfig(configReader io.Reader) (*CloudConfig, error) {
+	cfg := &CloudConfig{}
+	if configReader != nil {
+		if err := gcfg.ReadInto(cfg, configReader); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.MachineType == nil {
+		cfg.MachineType = map[string]*MachineTypeConfig{}
+	}
+
+	var err error
+	cfg.kubeReserved, err = parseResourceList(cfg.Global.KubeReserved)
+	if err != nil {
+		return nil, fmt.Errorf("invalid kube-reserved: %v", err)
+	}
+	cfg.systemReserved, err = parseResourceList(cfg.Global.SystemReserved)
+	if err != nil {
+		return nil, fmt.Errorf("invalid system-reserved: %v", err)
+	}
+
+	cfg.refreshTimeout = defaultRefreshTimeout
+	if cfg.Global.RefreshTimeout != "" {
+		cfg.refreshTimeout, err = time.ParseDuration(cfg.Global.RefreshTimeout)
+		if err != nil || cfg.refreshTimeout <= 0 {
+			return nil, fmt.Errorf("invalid refresh-timeout: %s", cfg.Global.RefreshTimeout)
+		}
+	}
+
+	if cfg.Global.RefreshInterval != "" {
+		cfg.refreshInterval, err = time.ParseDuration(cfg.Global.RefreshInterval)
+		if err != nil || cfg.refreshInterval < 0 {
+			return nil, fmt.Errorf("invalid refresh-interval: %s", cfg.Global.RefreshInterval)
+		}
+	}
+
+	cfg.startupTimeout = defaultStartupTimeout
+	if cfg.Global.StartupTimeout != "" {
+		cfg.startupTimeout, err = time.ParseDuration(cfg.Global.StartupTimeout)
+		if err != nil || cfg.startupTimeout <= 0 {
+			return nil, fmt.Errorf("invalid startup-timeout: %s", cfg.Global.StartupTimeout)
+		}
+	}
+
+	cfg.healthCheckStaleness = defaultHealthCheckStaleness
+	if cfg.Global.HealthCheckStaleness != "" {
+		cfg.healthCheckStaleness, err = time.ParseDuration(cfg.Global.HealthCheckStaleness)
+		if err != nil || cfg.healthCheckStaleness <= 0 {
+			return nil, fmt.Errorf("invalid health-check-staleness: %s", cfg.Global.HealthCheckStaleness)
+		}
+	}
+
+	if cfg.Global.RefreshConcurrency < 0 {
+		return nil, fmt.Errorf("invalid refresh-concurrency: %d", cfg.Global.RefreshConcurrency)
+	}
+
+	if cfg.Global.StartupRefreshAttempts < 0 {
+		return nil, fmt.Errorf("invalid startup-refresh-attempts: %d", cfg.Global.StartupRefreshAttempts)
+	}
+
+	if cfg.Global.MaxDeleteBatch < 0 {
+		return nil, fmt.Errorf("invalid max-delete-batch: %d", cfg.Global.MaxDeleteBatch)
+	}
+
+	if cfg.Global.ListPageSize < 0 {
+		return nil, fmt.Errorf("invalid list-page-size: %d", cfg.Global.ListPageSize)
+	}
+
+	if cfg.Global.ResyncPeriod != "" {
+		cfg.resyncPeriod, err = time.ParseDuration(cfg.Global.ResyncPeriod)
+		if err != nil || cfg.resyncPeriod < 0 {
+			return nil, fmt.Errorf("invalid resync-period: %s", cfg.Global.ResyncPeriod)
+		}
+	}
+
+	if cfg.Global.KubeAPIQPS < 0 {
+		return nil, fmt.Errorf("invalid kube-api-qps: %d", cfg.Global.KubeAPIQPS)
+	}
+	if cfg.Global.KubeAPIBurst < 0 {
+		return nil, fmt.Errorf("invalid kube-api-burst: %d", cfg.Global.KubeAPIBurst)
+	}
+
+	if errs := validation.IsValidLabelValue(cfg.Global.InstanceID); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid instance-id: %s", cfg.Global.InstanceID)
+	}
+	if len(cfg.Global.Namespace) > 0 {
+		managed := sets.NewString(cfg.Global.Namespace...)
+		for _, namespace := range cfg.Global.ObserveOnlyNamespace {
+			if !managed.Has(namespace) {
+				return nil, fmt.Errorf("invalid observe-only-namespace: %s is not a managed namespace", namespace)
+			}
+		}
+		if cfg.Global.ClusterNamespace != "" && !managed.Has(cfg.Global.ClusterNamespace) {
+			return nil, fmt.Errorf("invalid cluster-namespace: %s is not a managed namespace", cfg.Global.ClusterNamespace)
+		}
+	}
+	if cfg.Global.ClusterNamespace != "" && cfg.Global.ClusterName == "" {
+		return nil, fmt.Errorf("invalid cluster-namespace: %s requires cluster-name", cfg.Global.ClusterNamespace)
+	}
+
+	for machineType, mtc := range cfg.MachineType {
+		if mtc == nil {
+			continue
+		}
+		if mtc.capacity, err = mtc.parseCapacity(); err != nil {
+			return nil, fmt.Errorf("invalid capacity of machine-type %s: %v", machineType, err)
+		}
+	}
+	return cfg, nil
+}
+
+// parseCapacity parses the configured node capacity of a machine type, nil if there is none. The GPUs
+// are counted as the default GPU resource, see gpuResourceName.
+func (mtc *MachineTypeConfig) parseCapacity() (apiv1.ResourceList, error) {
+	if mtc.CPU == "" && mtc.Memory == "" && mtc.GPU == "" && mtc.EphemeralStorage == "" {
+		return nil, nil
+	}
+	if mtc.CPU == "" || mtc.Memory == "" {
+		return nil, fmt.Errorf("cpu and memory are required")
+	}
+	capacity := apiv1.ResourceList{}
+	for name, val := range map[apiv1.ResourceName]string{
+		apiv1.ResourceCPU:              mtc.CPU,
+		apiv1.ResourceMemory:           mtc.Memory,
+		gpu.ResourceNvidiaGPU:          mtc.GPU,
+		apiv1.ResourceEphemeralStorage: mtc.EphemeralStorage,
+	} {
+		if val == "" {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", name, err)
+		}
+		capacity[name] = quantity
+	}
+	return capacity, nil
+}
+
+// getKubeReserved returns the resources reserved on every node. A nil config reserves nothing.
+func (cfg *CloudConfig) getKubeReserved() apiv1.ResourceList {
+	if cfg == nil {
+		return nil
+	}
+	return cfg.kubeReserved
+}
+
+// getSystemReserved returns the resources reserved for system daemons on every node. A nil config reserves nothing.
+func (cfg *CloudConfig) getSystemReserved() apiv1.ResourceList {
+	if cfg == nil {
+		return nil
+	}
+	return cfg.systemReserved
+}
+
+// getRefreshTimeout returns the maximum duration of a refresh
+func (cfg *CloudConfig) getRefreshTimeout() time.Duration {
+	if cfg == nil || cfg.refreshTimeout == 0 {
+		return defaultRefreshTimeout
+	}
+	return cfg.refreshTimeout
+}
+
+// getRefreshInterval returns the minimum time between two refreshes, 0 refreshes on every loop
+func (cfg *CloudConfig) getRefreshInterval() time.Duration {
+	if cfg == nil {
+		return 0
+	}
+	return cfg.refreshInterval
+}
+
+// getStartupRefreshAttempts returns the number of attempts of the initial refresh
+func (cfg *CloudConfig) getStartupRefreshAttempts() int {
+	if cfg == nil || cfg.Global.StartupRefreshAttempts == 0 {
+		return defaultStartupAttempts
+	}
+	return cfg.Global.StartupRefreshAttempts
+}
+
+// getStartupTimeout returns the maximum duration of the initial sync and refresh
+func (cfg *CloudConfig) getStartupTimeout() time.Duration {
+	if cfg == nil || cfg.startupTimeout == 0 {
+		return defaultStartupTimeout
+	}
+	return cfg.startupTimeout
+}
+
+// getHealthCheckStaleness returns how long ago the last successful refresh may be for the health check to pass
+func (cfg *CloudConfig) getHealthCheckStaleness() time.Duration {
+	if cfg == nil || cfg.healthCheckStaleness == 0 {
+		return defaultHealthCheckStaleness
+	}
+	return cfg.healthCheckStaleness
+}
+
+// getRefreshConcurrency returns the number of namespaces refreshed in parallel
+func (cfg *CloudConfig) getRefreshConcurrency() int {
+	if cfg == nil || cfg.Global.RefreshConcurrency == 0 {
+		return defaultRefreshConcurrency
+	}
+	return cfg.Global.RefreshConcurrency
+}
+
+// getListPageSize returns the number of objects the informers list at once
+func (cfg *CloudConfig) getListPageSize() int64 {
+	if cfg == nil || cfg.Global.ListPageSize == 0 {
+		return defaultListPageSize
+	}
+	return int64(cfg.Global.ListPageSize)
+}
+
+// getResyncPeriod returns the period of the informers' resyncs, 0 disables them
+func (cfg *CloudConfig) getResyncPeriod() time.Duration {
+	if cfg == nil {
+		return 0
+	}
+	return cfg.resyncPeriod
+}
+
+// getKubeAPIQPS returns the QPS of the clients, by default scaled with the refresh concurrency
+func (cfg *CloudConfig) getKubeAPIQPS() int {
+	if cfg == nil || cfg.Global.KubeAPIQPS == 0 {
+		return defaultKubeAPIQPSPerRefresh * cfg.getRefreshConcurrency()
+	}
+	return cfg.Global.KubeAPIQPS
+}
+
+// getKubeAPIBurst returns the burst of the clients, twice their QPS by default
+func (cfg *CloudConfig) getKubeAPIBurst() int {
+	if cfg == nil || cfg.Global.KubeAPIBurst == 0 {
+		return 2 * cfg.getKubeAPIQPS()
+	}
+	return cfg.Global.KubeAPIBurst
+}
+
+// getHintAnnotations returns the annotations of the node groups exposed as hints
+func (cfg *CloudConfig) getHintAnnotations() []string {
+	if cfg == nil || len(cfg.Global.HintAnnotation) == 0 {
+		return defaultHintAnnotations
+	}
+	return cfg.Global.HintAnnotation
+}
+
+// getMaxNodeProvisionTime returns the autoscaler's max-node-provision-time
+func (cfg *CloudConfig) getMaxNodeProvisionTime() time.Duration {
+	if cfg == nil || cfg.maxNodeProvisionTime == 0 {
+		return defaultMaxNodeProvisionTime
+	}
+	return cfg.maxNodeProvisionTime
+}
+
+// hasOpenstackCredentials checks whether OpenStack credentials are configured to look up flavors
+func (cfg *CloudConfig) hasOpenstackCredentials() bool {
+	return cfg != nil && cfg.OpenStack.AuthURL != ""
+}
+
+// deleteUnregisteredMachines returns whether the machines that never registered a node may be deleted
+func (cfg *CloudConfig) deleteUnregisteredMachines() bool {
+	return cfg != nil && cfg.Global.DeleteUnregisteredMachines
+}
+
+// getInstanceID returns the configured instance id, or else the hostname if it is a valid label value
+func (cfg *CloudConfig) getInstanceID() string {
+	if cfg != nil && cfg.Global.InstanceID != "" {
+		return cfg.Global.InstanceID
+	}
+	hostname, err := os.Hostname()
+	if err != nil || len(validation.IsValidLabelValue(hostname)) > 0 {
+		return ""
+	}
+	return hostname
+}
+
+// protectCordonedNodes returns whether nodes cordoned by other tooling are protected from scale down
+func (cfg *CloudConfig) protectCordonedNodes() bool {
+	return cfg != nil && cfg.Global.ProtectCordonedNodes
+}
+
+// getNamespaces returns the namespaces of the managed cluster-api objects, only the Cluster's with cluster-namespace
+func (cfg *CloudConfig) getNamespaces() []string {
+	if cfg.Global.ClusterNamespace != "" {
+		return []string{cfg.Global.ClusterNamespace}
+	}
+	return cfg.Global.Namespace
+}
+
+// observeOnly returns whether the node groups of a namespace are never scaled
+func (cfg *CloudConfig) observeOnly(namespace string) bool {
+	if cfg == nil {
+		return false
+	}
+	for _, observed := range cfg.Global.ObserveOnlyNamespace {
+		if observed == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// pdbAwareDeletion returns whether machines are ordered for deletion by the pods guarded by PodDisruptionBudgets
+func (cfg *CloudConfig) pdbAwareDeletion() bool {
+	return cfg != nil && cfg.Global.PDBAwareDeletion
+}
+
+// getMaxDeleteBatch returns the maximum number of nodes a node group deletes at once
+func (cfg *CloudConfig) getMaxDeleteBatch() int {
+	if cfg == nil || cfg.Global.MaxDeleteBatch == 0 {
+		return defaultMaxDeleteBatch
+	}
+	return cfg.Global.MaxDeleteBatch
+}
+
+// managementKubeConfig returns the client config for the cluster holding the cluster-api objects,
+// which is the workload cluster unless a management kubeconfig is configured
+func (cfg *CloudConfig) managementKubeConfig(workloadKubeConfig *rest.Config) (*rest.Config, error) {
+	if cfg == nil || cfg.Global.ManagementKubeconfig == "" {
+		return workloadKubeConfig, nil
+	}
+	kubeConfig, err := clientcmd.BuildConfigFromFlags("", cfg.Global.ManagementKubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid management-kubeconfig %s: %v", cfg.Global.ManagementKubeconfig, err)
+	}
+	return kubeConfig, nil
+}
+
+// throttled returns a copy of a client config with the configured QPS and burst
+func (cfg *CloudConfig) throttled(kubeConfig *rest.Config) *rest.Config {
+	kubeConfig = rest.CopyConfig(kubeConfig)
+	kubeConfig.QPS = float32(cfg.getKubeAPIQPS())
+	kubeConfig.Burst = cfg.getKubeAPIBurst()
+	return kubeConfig
+}
+
+// machineManagerOptions returns the options of the machine manager. Flavors are looked up if OpenStack
+// credentials are configured, the lookup is disabled if they are invalid.
+func (cfg *CloudConfig) machineManagerOptions(autoDiscoverySelectors []labels.Selector) MachineManagerOptions {
+	opts := MachineManagerOptions{
+		AutoDiscoverySelectors:   autoDiscoverySelectors,
+		Namespaces:               cfg.getNamespaces(),
+		ClusterName:              cfg.Global.ClusterName,
+		RefreshConcurrency:       cfg.getRefreshConcurrency(),
+		RefreshInterval:          cfg.getRefreshInterval(),
+		ListPageSize:             cfg.getListPageSize(),
+		ResyncPeriod:             cfg.getResyncPeriod(),
+		DryRun:                   cfg.Global.DryRun,
+		FailOnMissingPermissions: cfg.Global.FailOnMissingPermissions,
+		InstanceID:               cfg.getInstanceID(),
+		SkipForeignNodeGroups:    cfg.Global.SkipForeignNodeGroups,
+	}
+	if cfg.hasOpenstackCredentials() {
+		flavors, err := newNovaFlavors(cfg)
+		if err != nil {
+			warningS("Flavor lookup disabled", "err", err)
+		} else {
+			opts.flavors = flavors
+		}
+	}
+	return opts
+}
+
+// machineTypeCapacity returns a copy of the configured default node capacity of a machine type, if any
+func (cfg *CloudConfig) machineTypeCapacity(machineType string) (apiv1.ResourceList, bool) {
+	if cfg == nil || machineType == "" {
+		return nil, false
+	}
+	mtc := cfg.MachineType[machineType]
+	if mtc == nil || mtc.capacity == nil {
+		return nil, false
+	}
+	return mtc.capacity.DeepCopy(), true
+}
+
+// hasMachineTypeCapacities checks whether a default node capacity is configured for any machine type
+func (cfg *CloudConfig) hasMachineTypeCapacities() bool {
+	if cfg == nil {
+		return false
+	}
+	for _, mtc := range cfg.MachineType {
+		if mtc != nil && mtc.capacity != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// machineTypePrices returns the configured default hourly price per machine type
+func (cfg *CloudConfig) machineTypePrices() map[string]float64 {
+	prices := make(map[string]float64)
+	if cfg == nil {
+		return prices
+	}
+	for machineType, mtc := range cfg.MachineType {
+		if mtc != nil && mtc.PricePerHour > 0 {
+			prices[machineType] = mtc.PricePerHour
+		}
+	}
+	return prices
+}
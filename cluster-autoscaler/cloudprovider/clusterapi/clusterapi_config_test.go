@@ -0,0 +1,376 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/autoscaler/cluster-autoscaler/utils/gpu"
+	"k8s.io/client-go/rest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadCloudConfig(t *testing.T) {
+	cfg, err := ReadCloudConfig(strings.NewReader(`
+[machine-type "m1.small"]
+price-per-hour = 0.05
+
+[machine-type "m1.large"]
+price-per-hour = 0.2
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]float64{"m1.small": 0.05, "m1.large": 0.2}, cfg.machineTypePrices())
+}
+
+func TestReadCloudConfigEmpty(t *testing.T) {
+	cfg, err := ReadCloudConfig(nil)
+	assert.NoError(t, err)
+	assert.Empty(t, cfg.machineTypePrices())
+}
+
+func TestReadCloudConfigInvalid(t *testing.T) {
+	_, err := ReadCloudConfig(strings.NewReader("[machine-type \"m1.small\"]\nprice-per-hour = cheap\n"))
+	assert.Error(t, err)
+}
+
+func TestReadCloudConfigRefreshTimeout(t *testing.T) {
+	cfg, err := ReadCloudConfig(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 30*time.Second, cfg.getRefreshTimeout())
+
+	cfg, err = ReadCloudConfig(strings.NewReader("[global]\nrefresh-timeout = 1m\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, cfg.getRefreshTimeout())
+
+	_, err = ReadCloudConfig(strings.NewReader("[global]\nrefresh-timeout = -1s\n"))
+	assert.EqualError(t, err, "invalid refresh-timeout: -1s")
+}
+
+func TestReadCloudConfigRefreshInterval(t *testing.T) {
+	cfg, err := ReadCloudConfig(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), cfg.getRefreshInterval())
+
+	cfg, err = ReadCloudConfig(strings.NewReader("[global]\nrefresh-interval = 1m\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, cfg.getRefreshInterval())
+
+	_, err = ReadCloudConfig(strings.NewReader("[global]\nrefresh-interval = often\n"))
+	assert.EqualError(t, err, "invalid refresh-interval: often")
+}
+
+func TestReadCloudConfigHealthCheckStaleness(t *testing.T) {
+	cfg, err := ReadCloudConfig(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 5*time.Minute, cfg.getHealthCheckStaleness())
+
+	cfg, err = ReadCloudConfig(strings.NewReader("[global]\nhealth-check-staleness = 10m\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 10*time.Minute, cfg.getHealthCheckStaleness())
+
+	_, err = ReadCloudConfig(strings.NewReader("[global]\nhealth-check-staleness = 0s\n"))
+	assert.EqualError(t, err, "invalid health-check-staleness: 0s")
+}
+
+func TestReadCloudConfigRefreshConcurrency(t *testing.T) {
+	cfg, err := ReadCloudConfig(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, cfg.getRefreshConcurrency())
+
+	cfg, err = ReadCloudConfig(strings.NewReader("[global]\nrefresh-concurrency = 8\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 8, cfg.getRefreshConcurrency())
+
+	_, err = ReadCloudConfig(strings.NewReader("[global]\nrefresh-concurrency = -1\n"))
+	assert.EqualError(t, err, "invalid refresh-concurrency: -1")
+}
+
+func TestReadCloudConfigMaxDeleteBatch(t *testing.T) {
+	cfg, err := ReadCloudConfig(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 100, cfg.getMaxDeleteBatch())
+
+	cfg, err = ReadCloudConfig(strings.NewReader("[global]\nmax-delete-batch = 5\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 5, cfg.getMaxDeleteBatch())
+
+	_, err = ReadCloudConfig(strings.NewReader("[global]\nmax-delete-batch = -1\n"))
+	assert.EqualError(t, err, "invalid max-delete-batch: -1")
+}
+
+func TestReadCloudConfigProtectCordonedNodes(t *testing.T) {
+	var cfg *CloudConfig
+	assert.False(t, cfg.protectCordonedNodes())
+
+	cfg, err := ReadCloudConfig(strings.NewReader("[global]\nprotect-cordoned-nodes = true\n"))
+	assert.NoError(t, err)
+	assert.True(t, cfg.protectCordonedNodes())
+}
+
+func TestReadCloudConfigObserveOnlyNamespace(t *testing.T) {
+	var cfg *CloudConfig
+	assert.False(t, cfg.observeOnly("tenant-a"))
+
+	cfg, err := ReadCloudConfig(strings.NewReader("[global]\nobserve-only-namespace = tenant-a\n"))
+	assert.NoError(t, err)
+	assert.True(t, cfg.observeOnly("tenant-a"))
+	assert.False(t, cfg.observeOnly("tenant-b"))
+
+	_, err = ReadCloudConfig(strings.NewReader("[global]\nnamespace = tenant-b\nobserve-only-namespace = tenant-a\n"))
+	assert.EqualError(t, err, "invalid observe-only-namespace: tenant-a is not a managed namespace")
+}
+
+func TestReadCloudConfigStartup(t *testing.T) {
+	var cfg *CloudConfig
+	assert.Equal(t, 5, cfg.getStartupRefreshAttempts())
+	assert.Equal(t, 5*time.Minute, cfg.getStartupTimeout())
+
+	cfg, err := ReadCloudConfig(strings.NewReader("[global]\nstartup-refresh-attempts = 10\nstartup-timeout = 10m\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 10, cfg.getStartupRefreshAttempts())
+	assert.Equal(t, 10*time.Minute, cfg.getStartupTimeout())
+
+	_, err = ReadCloudConfig(strings.NewReader("[global]\nstartup-refresh-attempts = -1\n"))
+	assert.EqualError(t, err, "invalid startup-refresh-attempts: -1")
+
+	_, err = ReadCloudConfig(strings.NewReader("[global]\nstartup-timeout = 0s\n"))
+	assert.EqualError(t, err, "invalid startup-timeout: 0s")
+}
+
+func TestReadCloudConfigClusterNamespace(t *testing.T) {
+	cfg, err := ReadCloudConfig(strings.NewReader("[global]\nnamespace = tenant-a\nnamespace = tenant-b\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tenant-a", "tenant-b"}, cfg.getNamespaces())
+
+	cfg, err = ReadCloudConfig(strings.NewReader("[global]\nnamespace = tenant-a\nnamespace = tenant-b\ncluster-name = workload\ncluster-namespace = tenant-a\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tenant-a"}, cfg.getNamespaces())
+
+	_, err = ReadCloudConfig(strings.NewReader("[global]\nnamespace = tenant-b\ncluster-name = workload\ncluster-namespace = tenant-a\n"))
+	assert.EqualError(t, err, "invalid cluster-namespace: tenant-a is not a managed namespace")
+
+	_, err = ReadCloudConfig(strings.NewReader("[global]\ncluster-namespace = tenant-a\n"))
+	assert.EqualError(t, err, "invalid cluster-namespace: tenant-a requires cluster-name")
+}
+
+func TestReadCloudConfigPDBAwareDeletion(t *testing.T) {
+	var cfg *CloudConfig
+	assert.False(t, cfg.pdbAwareDeletion())
+
+	cfg, err := ReadCloudConfig(strings.NewReader("[global]\npdb-aware-deletion = true\n"))
+	assert.NoError(t, err)
+	assert.True(t, cfg.pdbAwareDeletion())
+}
+
+func TestReadCloudConfigInstanceID(t *testing.T) {
+	cfg, err := ReadCloudConfig(strings.NewReader("[global]\ninstance-id = autoscaler-a\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "autoscaler-a", cfg.getInstanceID())
+
+	hostname, err := os.Hostname()
+	assert.NoError(t, err)
+	cfg, err = ReadCloudConfig(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, hostname, cfg.getInstanceID())
+
+	_, err = ReadCloudConfig(strings.NewReader("[global]\ninstance-id = autoscaler a\n"))
+	assert.EqualError(t, err, "invalid instance-id: autoscaler a")
+}
+
+func TestReadCloudConfigInformers(t *testing.T) {
+	cfg, err := ReadCloudConfig(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(500), cfg.getListPageSize())
+	assert.Equal(t, time.Duration(0), cfg.getResyncPeriod())
+
+	cfg, err = ReadCloudConfig(strings.NewReader("[global]\nlist-page-size = 100\nresync-period = 10m\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), cfg.getListPageSize())
+	assert.Equal(t, 10*time.Minute, cfg.getResyncPeriod())
+
+	_, err = ReadCloudConfig(strings.NewReader("[global]\nlist-page-size = -1\n"))
+	assert.EqualError(t, err, "invalid list-page-size: -1")
+	_, err = ReadCloudConfig(strings.NewReader("[global]\nresync-period = often\n"))
+	assert.EqualError(t, err, "invalid resync-period: often")
+}
+
+func TestThrottled(t *testing.T) {
+	kubeConfig := &rest.Config{Host: "https://workload:6443"}
+
+	// the QPS scales with the refresh concurrency by default
+	cfg, err := ReadCloudConfig(strings.NewReader("[global]\nrefresh-concurrency = 8\n"))
+	assert.NoError(t, err)
+	throttled := cfg.throttled(kubeConfig)
+	assert.Equal(t, float32(40), throttled.QPS)
+	assert.Equal(t, 80, throttled.Burst)
+	assert.Equal(t, kubeConfig.Host, throttled.Host)
+	assert.Equal(t, float32(0), kubeConfig.QPS)
+
+	cfg, err = ReadCloudConfig(strings.NewReader("[global]\nkube-api-qps = 50\nkube-api-burst = 60\n"))
+	assert.NoError(t, err)
+	throttled = cfg.throttled(kubeConfig)
+	assert.Equal(t, float32(50), throttled.QPS)
+	assert.Equal(t, 60, throttled.Burst)
+
+	_, err = ReadCloudConfig(strings.NewReader("[global]\nkube-api-qps = -1\n"))
+	assert.EqualError(t, err, "invalid kube-api-qps: -1")
+}
+
+func TestMachineManagerOptions(t *testing.T) {
+	cfg, err := ReadCloudConfig(strings.NewReader(`[global]
+namespace = tenant-a
+cluster-name = cluster-a
+refresh-concurrency = 8
+refresh-interval = 1m
+list-page-size = 100
+resync-period = 10m
+dry-run = true
+fail-on-missing-permissions = true
+instance-id = autoscaler-a
+skip-foreign-node-groups = true
+`))
+	assert.NoError(t, err)
+	selectors := []labels.Selector{labels.Everything()}
+	assert.Equal(t, MachineManagerOptions{
+		AutoDiscoverySelectors:   selectors,
+		Namespaces:               []string{"tenant-a"},
+		ClusterName:              "cluster-a",
+		RefreshConcurrency:       8,
+		RefreshInterval:          time.Minute,
+		ListPageSize:             100,
+		ResyncPeriod:             10 * time.Minute,
+		DryRun:                   true,
+		FailOnMissingPermissions: true,
+		InstanceID:               "autoscaler-a",
+		SkipForeignNodeGroups:    true,
+	}, cfg.machineManagerOptions(selectors))
+}
+
+func TestManagementKubeConfig(t *testing.T) {
+	workload := &rest.Config{Host: "https://workload:6443"}
+
+	cfg, err := ReadCloudConfig(nil)
+	assert.NoError(t, err)
+	kubeConfig, err := cfg.managementKubeConfig(workload)
+	assert.NoError(t, err)
+	assert.Equal(t, workload, kubeConfig)
+
+	kubeconfigFile, err := ioutil.TempFile("", "management-kubeconfig")
+	assert.NoError(t, err)
+	defer os.Remove(kubeconfigFile.Name())
+	_, err = kubeconfigFile.WriteString(`apiVersion: v1
+kind: Config
+clusters:
+- name: management
+  cluster:
+    server: https://management:6443
+contexts:
+- name: management
+  context:
+    cluster: management
+current-context: management
+`)
+	assert.NoError(t, err)
+	assert.NoError(t, kubeconfigFile.Close())
+
+	cfg, err = ReadCloudConfig(strings.NewReader("[global]\nmanagement-kubeconfig = " + kubeconfigFile.Name() + "\n"))
+	assert.NoError(t, err)
+	kubeConfig, err = cfg.managementKubeConfig(workload)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://management:6443", kubeConfig.Host)
+
+	cfg, err = ReadCloudConfig(strings.NewReader("[global]\nmanagement-kubeconfig = /does/not/exist\n"))
+	assert.NoError(t, err)
+	_, err = cfg.managementKubeConfig(workload)
+	assert.Error(t, err)
+}
+
+func TestReadCloudConfigNamespaces(t *testing.T) {
+	cfg, err := ReadCloudConfig(strings.NewReader("[global]\nnamespace = tenant-a\nnamespace = tenant-b\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tenant-a", "tenant-b"}, cfg.Global.Namespace)
+}
+
+func TestReadCloudConfigMachineTypeCapacity(t *testing.T) {
+	cfg, err := ReadCloudConfig(strings.NewReader(`
+[machine-type "m1.small"]
+price-per-hour = 0.05
+cpu = 1
+memory = 2Gi
+[machine-type "g1.large"]
+cpu = 8
+memory = 32Gi
+gpu = 2
+ephemeral-storage = 100Gi
+[machine-type "m1.large"]
+price-per-hour = 0.2
+`))
+	assert.NoError(t, err)
+	assert.True(t, cfg.hasMachineTypeCapacities())
+
+	capacity, found := cfg.machineTypeCapacity("m1.small")
+	assert.True(t, found)
+	assert.Equal(t, int64(1000), capacity.Cpu().MilliValue())
+	assert.Equal(t, int64(2*1024*1024*1024), capacity.Memory().Value())
+	assert.Len(t, capacity, 2)
+
+	capacity, found = cfg.machineTypeCapacity("g1.large")
+	assert.True(t, found)
+	gpus := capacity[gpu.ResourceNvidiaGPU]
+	assert.Equal(t, int64(2), gpus.Value())
+	assert.Equal(t, int64(100*1024*1024*1024), capacity.StorageEphemeral().Value())
+
+	_, found = cfg.machineTypeCapacity("m1.large")
+	assert.False(t, found)
+	_, found = cfg.machineTypeCapacity("unknown")
+	assert.False(t, found)
+
+	_, err = ReadCloudConfig(strings.NewReader("[machine-type \"m1.small\"]\ncpu = 1\n"))
+	assert.EqualError(t, err, "invalid capacity of machine-type m1.small: cpu and memory are required")
+	_, err = ReadCloudConfig(strings.NewReader("[machine-type \"m1.small\"]\ncpu = one\nmemory = 2Gi\n"))
+	assert.Error(t, err)
+
+	cfg, err = ReadCloudConfig(nil)
+	assert.NoError(t, err)
+	assert.False(t, cfg.hasMachineTypeCapacities())
+}
+
+func TestReadCloudConfigKubeReserved(t *testing.T) {
+	cfg, err := ReadCloudConfig(strings.NewReader("[global]\nkube-reserved = cpu=100m,memory=256Mi\n"))
+	assert.NoError(t, err)
+	kubeReserved := cfg.getKubeReserved()
+	assert.Equal(t, int64(100), kubeReserved.Cpu().MilliValue())
+	assert.Equal(t, int64(256*1024*1024), kubeReserved.Memory().Value())
+
+	_, err = ReadCloudConfig(strings.NewReader("[global]\nkube-reserved = cpu\n"))
+	assert.Error(t, err)
+}
+
+func TestReadCloudConfigSystemReserved(t *testing.T) {
+	cfg, err := ReadCloudConfig(strings.NewReader("[global]\nsystem-reserved = memory=128Mi\n"))
+	assert.NoError(t, err)
+	systemReserved := cfg.getSystemReserved()
+	assert.Equal(t, int64(128*1024*1024), systemReserved.Memory().Value())
+	assert.Empty(t, cfg.getKubeReserved())
+
+	_, err = ReadCloudConfig(strings.NewReader("[global]\nsystem-reserved = memory\n"))
+	assert.Error(t, err)
+}
@@ -19,23 +19,63 @@ package clusterapi
 import (
 	"fmt"
 	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apimachv1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
-	"k8s.io/klog"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider/clusterapi/exp"
+	"k8s.io/autoscaler/cluster-autoscaler/config"
+	"k8s.io/autoscaler/cluster-autoscaler/utils/deletetaint"
+	"k8s.io/autoscaler/cluster-autoscaler/utils/errors"
+	kube_util "k8s.io/autoscaler/cluster-autoscaler/utils/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/kubernetes/pkg/scheduler/cache"
 	schedulercache "k8s.io/kubernetes/pkg/scheduler/cache"
 	"log"
+	"sigs.k8s.io/cluster-api/pkg/apis/cluster/common"
 	"sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-// ClusterapiNodeGroup implements NodeGroup interface.
+const (
+	// defaultReplicas is cluster-api's default of an unset replica count
+	defaultReplicas = 1
+	// onDeleteStrategyType is the MachineDeployment strategy that only replaces machines once they are deleted
+	onDeleteStrategyType common.MachineDeploymentStrategyType = "OnDelete"
+)
+
+// ClusterapiNodeGroup implements NodeGroup interface. It is backed either by a
+// MachineDeployment, by a standalone MachineSet or by a MachinePool.
 type ClusterapiNodeGroup struct {
 	machineManager    MachineManager
 	machineDeployment *v1alpha1.MachineDeployment
+	machineSet        *v1alpha1.MachineSet
+	machinePool       *exp.MachinePool
 	attrs             *MachineDeploymentAttrs
+	cloudConfig       *CloudConfig
+
+	// divergedSince is when the status replicas of the node group fell behind its spec replicas, zero while
+	// they are in line
+	divergedSince time.Time
+	// lastScaleAction is the time of the last successful IncreaseSize or DeleteNodes
+	lastScaleAction time.Time
+	// eventRecorder records scale events against the node group's object, if set
+	eventRecorder record.EventRecorder
+	// deleted is set once scaling found the node group's object deleted since the last refresh
+	deleted bool
+	// pendingReplicas is the replica count the node group's own object was last scaled to. The object is shared
+	// with the machine manager's cache and not modified, so its replicas are stale until the node group is
+	// rebuilt for the refreshed object. Guarded by pendingLock, as nodes are deleted concurrently.
+	pendingReplicas *int
+	pendingLock     sync.Mutex
 }
 
 // NewClusterapiNodeGroup creates a ClusterapiNodeGroup
-func NewClusterapiNodeGroup(machineManager MachineManager, machineDeployment *v1alpha1.MachineDeployment) *ClusterapiNodeGroup {
+func NewClusterapiNodeGroup(machineManager MachineManager, machineDeployment *v1alpha1.MachineDeployment, cloudConfig *CloudConfig) *ClusterapiNodeGroup {
 	attrs := GetMachineDeploymentAttrs(machineDeployment)
 	if nil == attrs {
 		// should never happen because MachineManager only hands out MachineDeployment with valid annotations
@@ -46,11 +86,259 @@ func NewClusterapiNodeGroup(machineManager MachineManager, machineDeployment *v1
 		machineManager:    machineManager,
 		machineDeployment: machineDeployment,
 		attrs:             attrs,
+		cloudConfig:       cloudConfig,
+	}
+	return ng
+}
+
+// NewClusterapiMachineSetNodeGroup creates a ClusterapiNodeGroup for a standalone MachineSet
+func NewClusterapiMachineSetNodeGroup(machineManager MachineManager, machineSet *v1alpha1.MachineSet, cloudConfig *CloudConfig) *ClusterapiNodeGroup {
+	attrs := GetMachineSetAttrs(machineSet)
+	if nil == attrs {
+		// should never happen because MachineManager only hands out MachineSets with valid annotations
+		log.Panicf("NewClusterapiMachineSetNodeGroup called w/ attribute-less machineSet (%s)", machineSet.Name)
+	}
+
+	ng := &ClusterapiNodeGroup{
+		machineManager: machineManager,
+		machineSet:     machineSet,
+		attrs:          attrs,
+		cloudConfig:    cloudConfig,
+	}
+	return ng
+}
+
+// NewClusterapiMachinePoolNodeGroup creates a ClusterapiNodeGroup for a MachinePool
+func NewClusterapiMachinePoolNodeGroup(machineManager MachineManager, machinePool *exp.MachinePool, cloudConfig *CloudConfig) *ClusterapiNodeGroup {
+	attrs := GetMachinePoolAttrs(machinePool)
+	if nil == attrs {
+		// should never happen because MachineManager only hands out MachinePools with valid annotations
+		log.Panicf("NewClusterapiMachinePoolNodeGroup called w/ attribute-less machinePool (%s)", machinePool.Name)
+	}
+
+	ng := &ClusterapiNodeGroup{
+		machineManager: machineManager,
+		machinePool:    machinePool,
+		attrs:          attrs,
+		cloudConfig:    cloudConfig,
 	}
 	return ng
 }
 
-// MaxSize returns maximum size of the node group.
+// object returns the MachineDeployment, MachineSet or MachinePool backing the node group
+func (ng *ClusterapiNodeGroup) object() apimachv1.Object {
+	if ng.machineSet != nil {
+		return ng.machineSet
+	}
+	if ng.machinePool != nil {
+		return ng.machinePool
+	}
+	return ng.machineDeployment
+}
+
+// replicas returns the replica count of the node group. Like cluster-api, which defaults unset replicas
+// to 1, a nil replica count is taken as 1.
+func (ng *ClusterapiNodeGroup) replicas() int {
+	if ng.scalesMachineSets() {
+		replicas := 0
+		for _, ms := range ng.machineManager.MachineSetsForDeployment(ng.machineDeployment) {
+			replicas += replicasOf(ms.Spec.Replicas)
+		}
+		return replicas
+	}
+	ng.pendingLock.Lock()
+	pending := ng.pendingReplicas
+	ng.pendingLock.Unlock()
+	if pending != nil {
+		return *pending
+	}
+	var replicas *int32
+	if ng.machineSet != nil {
+		replicas = ng.machineSet.Spec.Replicas
+	} else if ng.machinePool != nil {
+		replicas = ng.machinePool.Spec.Replicas
+	} else {
+		replicas = ng.machineDeployment.Spec.Replicas
+	}
+	return replicasOf(replicas)
+}
+
+// statusReplicas returns the number of replicas cluster-api reports in the status of the node group
+func (ng *ClusterapiNodeGroup) statusReplicas() int {
+	if ng.scalesMachineSets() {
+		replicas := 0
+		for _, ms := range ng.machineManager.MachineSetsForDeployment(ng.machineDeployment) {
+			replicas += int(ms.Status.Replicas)
+		}
+		return replicas
+	}
+	if ng.machineSet != nil {
+		return int(ng.machineSet.Status.Replicas)
+	}
+	if ng.machinePool != nil {
+		return int(ng.machinePool.Status.Replicas)
+	}
+	return int(ng.machineDeployment.Status.Replicas)
+}
+
+func (ng *ClusterapiNodeGroup) nodes() []*v1.Node {
+	if ng.machineSet != nil {
+		return ng.machineManager.NodesForMachineSet(ng.machineSet)
+	}
+	if ng.machinePool != nil {
+		return ng.machineManager.NodesForMachinePool(ng.machinePool)
+	}
+	return ng.machineManager.NodesForDeployment(ng.machineDeployment)
+}
+
+// machines returns the machines of the node group. MachinePools have none.
+func (ng *ClusterapiNodeGroup) machines() []*v1alpha1.Machine {
+	if ng.machineSet != nil {
+		return ng.machineManager.MachinesForMachineSet(ng.machineSet)
+	}
+	if ng.machinePool != nil {
+		return nil
+	}
+	return ng.machineManager.MachinesForDeployment(ng.machineDeployment)
+}
+
+func (ng *ClusterapiNodeGroup) setSize(size int) error {
+	if ng.deleted {
+		return ng.deletedError()
+	}
+	if ng.scalesMachineSets() {
+		// the replicas are those of the MachineSets, which the machine manager's cache already reflects
+		return ng.notFoundAsDeleted(ng.setActiveMachineSetSize(size))
+	}
+	var applied bool
+	var err error
+	if ng.machineSet != nil {
+		applied, err = ng.machineManager.SetMachineSetSize(ng.machineSet, size)
+	} else if ng.machinePool != nil {
+		applied, err = ng.machineManager.SetMachinePoolSize(ng.machinePool, size)
+	} else {
+		applied, err = ng.machineManager.SetDeploymentSize(ng.machineDeployment, size)
+	}
+	if err != nil {
+		return ng.notFoundAsDeleted(err)
+	}
+	// in dry-run mode nothing was scaled, so the node group keeps its size
+	if applied {
+		ng.setPendingReplicas(size)
+	}
+	return nil
+}
+
+// setPendingReplicas records the replica count the node group's object was scaled to
+func (ng *ClusterapiNodeGroup) setPendingReplicas(size int) {
+	ng.pendingLock.Lock()
+	defer ng.pendingLock.Unlock()
+	ng.pendingReplicas = &size
+}
+
+// scalesMachineSets checks whether the node group's MachineDeployment delegates scaling to its MachineSets
+// with ScaleTargetAnnotation. The node group is still identified and bounded by the MachineDeployment, but
+// its size is that of all its MachineSets.
+func (ng *ClusterapiNodeGroup) scalesMachineSets() bool {
+	return ng.machineSet == nil && ng.machinePool == nil &&
+		ng.machineDeployment.Annotations[ScaleTargetAnnotation] == ScaleTargetMachineSet
+}
+
+// setActiveMachineSetSize sets the size of a node group that scales its MachineSets by changing the
+// replicas of the active MachineSet by the difference to the current size
+func (ng *ClusterapiNodeGroup) setActiveMachineSetSize(size int) error {
+	ms := activeMachineSet(ng.machineManager.MachineSetsForDeployment(ng.machineDeployment))
+	if ms == nil {
+		return fmt.Errorf("MachineDeployment %s has no MachineSet to scale", ng.machineDeployment.Name)
+	}
+	msSize := replicasOf(ms.Spec.Replicas) + size - ng.replicas()
+	if msSize < 0 {
+		return fmt.Errorf("MachineSet %s of MachineDeployment %s can't be scaled to %d replicas", ms.Name, ng.machineDeployment.Name, msSize)
+	}
+	_, err := ng.machineManager.SetMachineSetSize(ms, msSize)
+	return err
+}
+
+// activeMachineSet returns the MachineSet of a MachineDeployment that is scaled, the one of the highest revision
+// that has replicas. During a rollout, that's the new MachineSet as soon as it was scaled up. If no MachineSet
+// has replicas, the one of the highest revision is returned.
+func activeMachineSet(mss []*v1alpha1.MachineSet) *v1alpha1.MachineSet {
+	var active *v1alpha1.MachineSet
+	for _, ms := range mss {
+		if active == nil || moreActive(ms, active) {
+			active = ms
+		}
+	}
+	return active
+}
+
+// moreActive orders MachineSets by whether they have replicas, then by revision and finally by name
+func moreActive(a, b *v1alpha1.MachineSet) bool {
+	if aHasReplicas, bHasReplicas := replicasOf(a.Spec.Replicas) > 0, replicasOf(b.Spec.Replicas) > 0; aHasReplicas != bHasReplicas {
+		return aHasReplicas
+	}
+	if aRevision, bRevision := machineSetRevision(a), machineSetRevision(b); aRevision != bRevision {
+		return aRevision > bRevision
+	}
+	return a.Name > b.Name
+}
+
+// machineSetRevision returns the rollout revision of a MachineSet of a MachineDeployment, 0 if unknown
+func machineSetRevision(ms *v1alpha1.MachineSet) int64 {
+	for _, annotation := range []string{RevisionAnnotation, LegacyRevisionAnnotation} {
+		if revision, err := strconv.ParseInt(ms.Annotations[annotation], 10, 64); err == nil {
+			return revision
+		}
+	}
+	return 0
+}
+
+// notFoundAsDeleted marks the node group as deleted if its object wasn't found, i.e. it was deleted
+// since the last refresh, and replaces the NotFound error with one saying so. Other errors are
+// classified, see autoscalerError.
+func (ng *ClusterapiNodeGroup) notFoundAsDeleted(err error) error {
+	if err == nil {
+		return nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return autoscalerError(err)
+	}
+	warningS("Node group no longer exists", append(objectKeys(ng.object()), "err", err)...)
+	ng.deleted = true
+	return ng.deletedError()
+}
+
+func (ng *ClusterapiNodeGroup) deletedError() errors.AutoscalerError {
+	return errors.NewAutoscalerError(errors.CloudProviderError, "node group %s no longer exists", ng.Id())
+}
+
+// recordScaleEvent records a normal event against the MachineDeployment or MachineSet of the node group.
+func (ng *ClusterapiNodeGroup) recordScaleEvent(reason, messageFmt string, args ...interface{}) {
+	ng.recordEvent(v1.EventTypeNormal, reason, messageFmt, args...)
+}
+
+// recordEvent records an event of the given type against the object of the node group
+func (ng *ClusterapiNodeGroup) recordEvent(eventType, reason, messageFmt string, args ...interface{}) {
+	if ng.eventRecorder == nil {
+		return
+	}
+	obj := ng.object()
+	apiVersion := v1alpha1.SchemeGroupVersion.String()
+	if ng.machinePool != nil {
+		apiVersion = ng.machinePool.APIVersion
+	}
+	ref := &v1.ObjectReference{
+		Kind:            kindOf(obj),
+		APIVersion:      apiVersion,
+		Namespace:       obj.GetNamespace(),
+		Name:            obj.GetName(),
+		UID:             obj.GetUID(),
+		ResourceVersion: obj.GetResourceVersion(),
+	}
+	ng.eventRecorder.Eventf(ref, eventType, reason, messageFmt, args...)
+}
+
+// MaxSize returns maximum size of the node group. It doesn't include the size of an overflow group.
 func (ng *ClusterapiNodeGroup) MaxSize() int {
 	return ng.attrs.maxSize
 }
@@ -64,29 +352,122 @@ func (ng *ClusterapiNodeGroup) MinSize() int {
 // number of nodes in Kubernetes is different at the moment but should be equal
 // to Size() once everything stabilizes (new nodes finish startup and registration or
 // removed nodes are deleted completely).
+//
+// The target size is the observed replica count, even if it lies outside of the size bounds
+// because someone else scaled the node group, see warnAboveMaxSize.
 func (ng *ClusterapiNodeGroup) TargetSize() (int, error) {
-	replicas := ng.machineDeployment.Spec.Replicas
-	if nil == replicas {
-		return 0, fmt.Errorf("replica count unset for MachineDeployment: %s", ng.machineDeployment.Name)
+	return ng.replicas(), nil
+}
+
+// TargetSizeWithoutDeletions returns the target size less the machines that are annotated for deletion
+// but not yet covered by a lowered replica count, e.g. because the replicas haven't settled yet or
+// couldn't be lowered after annotating. These machines are removed on the next scale-down.
+func (ng *ClusterapiNodeGroup) TargetSizeWithoutDeletions() int {
+	return ng.targetSizeWithoutDeletions(nil)
+}
+
+// targetSizeWithoutDeletions is TargetSizeWithoutDeletions, not counting the excluded machines as annotated
+func (ng *ClusterapiNodeGroup) targetSizeWithoutDeletions(excluded map[types.UID]bool) int {
+	replicas := ng.replicas()
+	if ng.machinePool != nil {
+		return replicas
+	}
+	existing, annotated := 0, 0
+	for _, machine := range ng.machines() {
+		if machineDeleting(machine) {
+			continue
+		}
+		existing++
+		if _, ok := machine.Annotations[DeleteMachineAnnotation]; ok && !excluded[machine.UID] {
+			annotated++
+		}
+	}
+	// surplus machines are already covered by a lowered replica count and go first
+	surplus := existing - replicas
+	if surplus < 0 {
+		surplus = 0
+	}
+	if annotated <= surplus {
+		return replicas
+	}
+	return replicas - (annotated - surplus)
+}
+
+// SizeBoundError is returned when a scaling action is refused because it would take a node group
+// above its max size or below its min size
+type SizeBoundError struct {
+	// NodeGroup is the id of the node group
+	NodeGroup string
+	// Current is the target size the action started from
+	Current int
+	// Delta is the requested change of the target size, negative for a decrease
+	Delta int
+	Min   int
+	Max   int
+}
+
+func (e *SizeBoundError) Error() string {
+	direction := "increase"
+	if e.Delta < 0 {
+		direction = "decrease"
 	}
-	return int(*replicas), nil
+	return fmt.Sprintf("ClusterapiNodeGroup size %s too large - group:%s current:%d delta:%d desired:%d min:%d max:%d",
+		direction, e.NodeGroup, e.Current, e.Delta, e.Current+e.Delta, e.Min, e.Max)
+}
+
+// checkSizeBounds returns a *SizeBoundError if changing the target size from size by delta leaves the
+// node group's bounds
+func (ng *ClusterapiNodeGroup) checkSizeBounds(size, delta int) error {
+	if desired := size + delta; (delta > 0 && desired > ng.MaxSize()) || (delta < 0 && desired < ng.MinSize()) {
+		return &SizeBoundError{NodeGroup: ng.Id(), Current: size, Delta: delta, Min: ng.MinSize(), Max: ng.MaxSize()}
+	}
+	return nil
 }
 
 // IncreaseSize increases the size of the node group. To delete a node you need
 // to explicitly name it and use DeleteNode. This function should wait until
 // node group size is updated.
+//
+// Increases beyond the max-scale-up-step annotation of the node group are capped to it.
 func (ng *ClusterapiNodeGroup) IncreaseSize(delta int) error {
 	if delta <= 0 {
-		return fmt.Errorf("ClusterapiNodeGroup size increase size must be positive")
+		return fmt.Errorf("ClusterapiNodeGroup size increase size must be positive - delta:%d", delta)
+	}
+	if err := ng.checkObserveOnly(); err != nil {
+		return err
+	}
+	if err := ng.checkCooldown(); err != nil {
+		return err
 	}
 	size, err := ng.TargetSize()
 	if err != nil {
 		return err
 	}
-	if size+delta > ng.MaxSize() {
-		return fmt.Errorf("ClusterapiNodeGroup size increase too large - desired:%d max:%d", size+delta, ng.MaxSize())
+	// never pass an oversized replica count on to cluster-api, which would create the machines right away
+	if err := ng.checkSizeBounds(size, delta); err != nil {
+		if overflow := ng.OverflowGroup(); overflow != "" {
+			infoS("Node group at max size, overflow group available", ng.logKeys("IncreaseSize", "overflowGroup", overflow)...)
+		}
+		return err
+	}
+	// the autoscaler requests the remainder in its next loops
+	if step := maxScaleUpStep(ng.object()); step > 0 && delta > step {
+		infoS("Capping scale up to max scale up step", ng.logKeys("IncreaseSize", "delta", delta, "maxScaleUpStep", step)...)
+		delta = step
 	}
-	return ng.machineManager.SetDeploymentSize(ng.machineDeployment, size+delta)
+	if err := ng.setSize(size + delta); err != nil {
+		if rejectedByAdmission(err) {
+			warningS("Scale up rejected by admission", ng.logKeys("IncreaseSize", "from", size, "to", size+delta, "err", err)...)
+			ng.recordEvent(v1.EventTypeWarning, "ScaleUpRejected", "Scale up from %d to %d replicas rejected by admission: %v", size, size+delta, err)
+			return autoscalerError(err).AddPrefix("scale up of node group %s rejected by admission: ", ng.Id())
+		}
+		return err
+	}
+	ng.lastScaleAction = time.Now()
+	infoS("Scaled up node group", ng.logKeys("IncreaseSize", "from", size, "to", size+delta)...)
+	registerScaleUp(ng.object(), delta)
+	ng.recordScaleEvent("ScaledUp", "Scaled up from %d to %d replicas", size, size+delta)
+	return nil
 	// TODO interface documentation: "This function should wait until node group size is updated"
 	//  have we fulfilled that?
 }
@@ -94,102 +475,747 @@ func (ng *ClusterapiNodeGroup) IncreaseSize(delta int) error {
 // DeleteNodes deletes nodes from this node group. Error is returned either on
 // failure or if the given node doesn't belong to this node group. This function
 // should wait until node group size is updated.
-func (ng *ClusterapiNodeGroup) DeleteNodes([]*v1.Node) error {
-	// TODO waiting for https://github.com/kubernetes-sigs/cluster-api/pull/513
-	klog.Info("ClusterapiNodeGroup.DeleteNodes not implemented")
+//
+// The machines of the nodes are marked with the delete-machine annotation in the order of sortForDeletion,
+// then the replica count is lowered, so that cluster-api removes exactly these machines. Nodes whose machine
+// is gone or being deleted count as deleted, so that retries succeed. The nodes are refused as a whole if any
+// of them may not be deleted or the min size would be undercut. If some machines can't be marked, the others
+// still are and the replica count is only lowered by the number of marked machines, so that no unmarked
+// machine is removed in their place. MachinePools have no machines, see deleteMachinePoolNodes.
+func (ng *ClusterapiNodeGroup) DeleteNodes(nodes []*v1.Node) error {
+	if err := ng.checkObserveOnly(); err != nil {
+		return err
+	}
+	if err := ng.checkScaleDownEnabled(); err != nil {
+		return err
+	}
+	if err := ng.checkCooldown(); err != nil {
+		return err
+	}
+	if err := ng.checkMaxDeleteBatch(nodes); err != nil {
+		return err
+	}
+	if err := ng.checkCordonedNodes(nodes); err != nil {
+		return err
+	}
+	size, err := ng.TargetSize()
+	if err != nil {
+		return err
+	}
+
+	// a stale cache or colliding providerIDs must never lead to deleting another group's machines,
+	// so no machine is touched unless all nodes verifiably belong to this group
+	if ng.machinePool != nil {
+		if err := ng.checkSizeBounds(size, -len(nodes)); err != nil {
+			return err
+		}
+		return ng.deleteMachinePoolNodes(nodes, size)
+	}
+
+	machines, err := ng.machineManager.MachinesByProviderID()
+	if err != nil {
+		return autoscalerError(err)
+	}
+	deletions := make([]machineDeletion, 0, len(nodes))
+	foreign := make([]string, 0)
+	lifetime := minNodeLifetime(ng.object())
+	for _, node := range nodes {
+		var machine *v1alpha1.Machine
+		if node.Spec.ProviderID == "" {
+			if machine = ng.machineManager.MachineForNode(node); machine == nil {
+				return fmt.Errorf("no machine found for node %s", node.Name)
+			}
+		} else if _, _, ok := pendingMachineKey(node.Spec.ProviderID); ok {
+			// machines without providerID can't be read by it, the cache is the only reference
+			if machine = ng.machineManager.MachineForNode(node); machine == nil || machineDeleting(machine) {
+				infoS("Machine of node is already deleted", ng.logKeys("DeleteNodes", "node", node.Name)...)
+				continue
+			}
+		} else {
+			var found bool
+			machine, found = machines[NormalizeProviderID(node.Spec.ProviderID)]
+			if found && machine == nil {
+				return fmt.Errorf("several machines have the providerID of node %s", node.Name)
+			}
+			if !found || machineDeleting(machine) {
+				infoS("Machine of node is already deleted", ng.logKeys("DeleteNodes", "node", node.Name)...)
+				continue
+			}
+		}
+		if !ng.contains(node) || machine.Namespace != ng.object().GetNamespace() || !machineOwnsNode(machine, node) {
+			foreign = append(foreign, node.Name)
+			continue
+		}
+		if err := ng.checkMachineDeletable(machine, node, lifetime); err != nil {
+			return err
+		}
+		deletions = append(deletions, machineDeletion{machine: machine, node: node})
+	}
+	if len(foreign) > 0 {
+		return fmt.Errorf("nodes %s do not belong to node group %s", strings.Join(foreign, ", "), ng.Id())
+	}
+	if len(deletions) == 0 {
+		return nil
+	}
+	excluded := make(map[types.UID]bool, len(deletions))
+	for _, deletion := range deletions {
+		excluded[deletion.machine.UID] = true
+	}
+	size = ng.targetSizeWithoutDeletions(excluded)
+	if err := ng.checkSizeBounds(size, -len(deletions)); err != nil {
+		return err
+	}
+
+	if len(deletions) > 1 && ng.cloudConfig.pdbAwareDeletion() {
+		ng.countGuardedPods(deletions)
+	}
+	sortForDeletion(deletions)
+	if len(deletions) > 1 {
+		ng.balanceFailureDomains(deletions)
+	}
+	marked := make([]machineDeletion, 0, len(deletions))
+	names := make([]string, 0, len(deletions))
+	errs := make([]error, 0)
+	for _, deletion := range deletions {
+		if err := ng.machineManager.MarkMachineForDeletion(deletion.machine); err != nil {
+			errs = append(errs, autoscalerError(err).AddPrefix("could not mark machine %s of node %s for deletion: ", deletion.machine.Name, deletion.node.Name))
+			continue
+		}
+		marked = append(marked, deletion)
+		names = append(names, deletion.machine.Name)
+	}
+	if len(names) == 0 {
+		return aggregateError(errs)
+	}
+	if err := ng.setSize(size - len(names)); err != nil {
+		return err
+	}
+	if ng.onDeleteStrategy() {
+		// the replica count is lowered first, so that cluster-api doesn't replace the deleted machines
+		for _, deletion := range marked {
+			if err := ng.machineManager.DeleteMachine(deletion.machine); err != nil {
+				errs = append(errs, autoscalerError(err).AddPrefix("could not delete machine %s of node %s: ", deletion.machine.Name, deletion.node.Name))
+			}
+		}
+	}
+	ng.lastScaleAction = time.Now()
+	infoS("Scaled down node group", ng.logKeys("DeleteNodes", "from", size, "to", size-len(names), "machines", names)...)
+	registerScaleDown(ng.object(), len(names))
+	ng.recordScaleEvent("ScaledDown", "Scaled down from %d to %d replicas", size, size-len(names))
+	return aggregateError(errs)
+}
+
+// checkMaxDeleteBatch fails if more nodes than the configured max-delete-batch are to be deleted at once,
+// which likely is a mistake of the core autoscaler rather than an intended scale down
+func (ng *ClusterapiNodeGroup) checkMaxDeleteBatch(nodes []*v1.Node) error {
+	if maxBatch := ng.cloudConfig.getMaxDeleteBatch(); len(nodes) > maxBatch {
+		warningS("Refusing to delete too many nodes at once", ng.logKeys("DeleteNodes", "nodes", len(nodes), "maxDeleteBatch", maxBatch)...)
+		return fmt.Errorf("deleting %d nodes of node group %s at once exceeds max-delete-batch of %d", len(nodes), ng.Id(), maxBatch)
+	}
+	return nil
+}
+
+// checkCordonedNodes fails if protect-cordoned-nodes is configured and any of the nodes was cordoned by other
+// tooling, e.g. for maintenance, which is recorded as an event
+func (ng *ClusterapiNodeGroup) checkCordonedNodes(nodes []*v1.Node) error {
+	if !ng.cloudConfig.protectCordonedNodes() {
+		return nil
+	}
+	for _, node := range nodes {
+		if externallyCordoned(node) {
+			infoS("Node is cordoned externally, protected from scale down", ng.logKeys("DeleteNodes", "node", node.Name)...)
+			ng.recordScaleEvent("ScaleDownProtected", "Node %s is cordoned externally and protected from scale down", node.Name)
+			return fmt.Errorf("node %s is cordoned externally and protected from scale down", node.Name)
+		}
+	}
+	return nil
+}
+
+// checkMachineDeletable fails if the machine of a node may not be deleted: if it never registered its node,
+// e.g. because it is stuck in provisioning, unless delete-unregistered-machines is configured, if it has scale
+// down disabled with ScaleDownDisabledAnnotation, or if it is younger than the min node lifetime of the node group
+func (ng *ClusterapiNodeGroup) checkMachineDeletable(machine *v1alpha1.Machine, node *v1.Node, lifetime time.Duration) error {
+	if unregisteredNode(node, machine) && !ng.cloudConfig.deleteUnregisteredMachines() {
+		return fmt.Errorf("machine %s of node %s has not registered a node, deleting it requires delete-unregistered-machines", machine.Name, node.Name)
+	}
+	if machine.Annotations[ScaleDownDisabledAnnotation] == "true" {
+		return fmt.Errorf("machine %s of node %s has scale down disabled", machine.Name, node.Name)
+	}
+	if age := time.Since(machine.CreationTimestamp.Time); age < lifetime {
+		return fmt.Errorf("machine %s of node %s is %v old, younger than the min node lifetime of %v", machine.Name, node.Name,
+			age.Round(time.Second), lifetime)
+	}
 	return nil
 }
 
+// externallyCordoned checks whether a node was cordoned by other tooling than the autoscaler, whose taint
+// it lacks. The autoscaler taints the nodes only after passing them to DeleteNodes.
+func externallyCordoned(node *v1.Node) bool {
+	return node.Spec.Unschedulable && !deletetaint.HasToBeDeletedTaint(node)
+}
+
+// onDeleteStrategy checks whether the node group is a MachineDeployment with the OnDelete strategy, whose
+// machines are deleted directly rather than left to cluster-api. DeleteNodes deletes them right after lowering
+// the replica count, so that cluster-api doesn't replace them.
+func (ng *ClusterapiNodeGroup) onDeleteStrategy() bool {
+	md := ng.machineDeployment
+	return md != nil && md.Spec.Strategy != nil && md.Spec.Strategy.Type == onDeleteStrategyType
+}
+
+// machineDeletion is a machine to delete along with its node
+type machineDeletion struct {
+	machine       *v1alpha1.Machine
+	node          *v1.Node
+	failureDomain string
+	// guardedPods is the number of pods on the node guarded by a PodDisruptionBudget, only counted with
+	// pdb-aware-deletion
+	guardedPods int
+}
+
+// unhealthy checks whether the machine has failed or its node is cordoned or unready
+func (d machineDeletion) unhealthy() bool {
+	machine := d.machine
+	if machine.Status.ErrorReason != nil || (machine.Status.Phase != nil && *machine.Status.Phase == machinePhaseFailed) {
+		return true
+	}
+	return !kube_util.IsNodeReadyAndSchedulable(d.node)
+}
+
+// cost returns the deletion cost of the machine, 0 if unset or invalid
+func (d machineDeletion) cost() int {
+	val, ok := d.machine.Annotations[DeletionCostAnnotation]
+	if !ok {
+		return 0
+	}
+	cost, err := strconv.Atoi(val)
+	if err != nil {
+		warningS("Invalid deletion cost annotation, ignoring", "namespace", d.machine.Namespace, "machine", d.machine.Name,
+			"value", val)
+		return 0
+	}
+	return cost
+}
+
+// sortForDeletion orders machines so that the least useful capacity goes first: the cheapest machines to
+// delete, then unhealthy machines, then those with the fewest pods guarded by PodDisruptionBudgets, which are
+// only counted with pdb-aware-deletion, see countGuardedPods, then the oldest. DeleteNodes then spreads machines
+// of the same rank across failure domains with balanceFailureDomains. Should cluster-api not delete all marked
+// machines at once, the healthiest nodes are kept.
+func sortForDeletion(deletions []machineDeletion) {
+	sort.SliceStable(deletions, func(i, j int) bool {
+		if costI, costJ := deletions[i].cost(), deletions[j].cost(); costI != costJ {
+			return costI < costJ
+		}
+		if unhealthyI, unhealthyJ := deletions[i].unhealthy(), deletions[j].unhealthy(); unhealthyI != unhealthyJ {
+			return unhealthyI
+		}
+		if deletions[i].guardedPods != deletions[j].guardedPods {
+			return deletions[i].guardedPods < deletions[j].guardedPods
+		}
+		return deletions[i].machine.CreationTimestamp.Before(&deletions[j].machine.CreationTimestamp)
+	})
+}
+
+// balanceFailureDomains reorders machines sorted by sortForDeletion so that, among machines of the same rank,
+// those of the failure domain with the most machines of the node group left go first. Like
+// sortForDeletion, it only matters should cluster-api not delete all marked machines at once, as the nodes
+// are chosen by the core autoscaler.
+func (ng *ClusterapiNodeGroup) balanceFailureDomains(deletions []machineDeletion) {
+	sizes := make(map[string]int)
+	for _, machine := range ng.machines() {
+		if !machineDeleting(machine) {
+			sizes[ng.machineManager.FailureDomain(machine)]++
+		}
+	}
+	for i := range deletions {
+		deletions[i].failureDomain = ng.machineManager.FailureDomain(deletions[i].machine)
+	}
+	for i := range deletions {
+		best := i
+		for j := i + 1; j < len(deletions) && deletions[j].sameRank(deletions[i]); j++ {
+			if sizes[deletions[j].failureDomain] > sizes[deletions[best].failureDomain] {
+				best = j
+			}
+		}
+		deletion := deletions[best]
+		copy(deletions[i+1:best+1], deletions[i:best])
+		deletions[i] = deletion
+		sizes[deletion.failureDomain]--
+	}
+}
+
+// sameRank checks whether two machines are as cheap to delete, as healthy and host as many guarded pods
+func (d machineDeletion) sameRank(other machineDeletion) bool {
+	return d.cost() == other.cost() && d.unhealthy() == other.unhealthy() && d.guardedPods == other.guardedPods
+}
+
+// countGuardedPods counts the pods guarded by PodDisruptionBudgets on the nodes of the machines to delete.
+// The ordering is best effort; if the pods can't be listed, the machines are ordered without them.
+func (ng *ClusterapiNodeGroup) countGuardedPods(deletions []machineDeletion) {
+	nodes := make([]*v1.Node, 0, len(deletions))
+	for _, deletion := range deletions {
+		nodes = append(nodes, deletion.node)
+	}
+	counts, err := ng.machineManager.DisruptionBudgetedPods(nodes)
+	if err != nil {
+		warningS("Could not count pods guarded by PodDisruptionBudgets, ordering deletions without them", ng.logKeys("DeleteNodes", "err", err)...)
+		return
+	}
+	for i := range deletions {
+		deletions[i].guardedPods = counts[deletions[i].node.Name]
+	}
+}
+
+// deleteMachinePoolNodes removes the instances of nodes from the node group's MachinePool
+func (ng *ClusterapiNodeGroup) deleteMachinePoolNodes(nodes []*v1.Node, size int) error {
+	foreign := make([]string, 0)
+	for _, node := range nodes {
+		if !ng.contains(node) {
+			foreign = append(foreign, node.Name)
+		}
+	}
+	if len(foreign) > 0 {
+		return fmt.Errorf("nodes %s do not belong to node group %s", strings.Join(foreign, ", "), ng.Id())
+	}
+
+	if ng.deleted {
+		return ng.deletedError()
+	}
+	applied, err := ng.machineManager.DeleteMachinePoolNodes(ng.machinePool, nodes, size-len(nodes))
+	if err != nil {
+		return ng.notFoundAsDeleted(err)
+	}
+	if applied {
+		ng.setPendingReplicas(size - len(nodes))
+	}
+	ng.lastScaleAction = time.Now()
+	registerScaleDown(ng.object(), len(nodes))
+	ng.recordScaleEvent("ScaledDown", "Scaled down from %d to %d replicas", size, size-len(nodes))
+	return nil
+}
+
+// contains checks whether a node was created by this node group's MachineDeployment, MachineSet or MachinePool
+func (ng *ClusterapiNodeGroup) contains(node *v1.Node) bool {
+	if ng.machineSet != nil {
+		ms := ng.machineManager.MachineSetForNode(node)
+		return ms != nil && ms.UID == ng.machineSet.UID
+	}
+	if ng.machinePool != nil {
+		mp := ng.machineManager.MachinePoolForNode(node)
+		return mp != nil && mp.UID == ng.machinePool.UID
+	}
+	md := ng.machineManager.DeploymentForNode(node)
+	return md != nil && md.UID == ng.machineDeployment.UID
+}
+
+// checkObserveOnly fails if the node group's namespace is configured as observe-only
+func (ng *ClusterapiNodeGroup) checkObserveOnly() error {
+	if namespace := ng.object().GetNamespace(); ng.cloudConfig.observeOnly(namespace) {
+		return fmt.Errorf("namespace %s is observe-only, node group %s is not scaled", namespace, ng.Id())
+	}
+	return nil
+}
+
+// checkScaleDownEnabled fails if the scale down of the node group is disabled with ScaleDownAnnotation. Single
+// machines are excluded with ScaleDownDisabledAnnotation instead, see checkMachineDeletable.
+func (ng *ClusterapiNodeGroup) checkScaleDownEnabled() error {
+	if scaleDownDisabled(ng.object()) {
+		return fmt.Errorf("scale down of node group %s is disabled", ng.Id())
+	}
+	return nil
+}
+
+// checkCooldown fails while the scale cooldown of the node group, if any, hasn't elapsed since its last scale action
+func (ng *ClusterapiNodeGroup) checkCooldown() error {
+	if remaining := ng.cooldownRemaining(); remaining > 0 {
+		return fmt.Errorf("scale cooldown in progress for node group %s, %v remaining", ng.Id(), remaining.Round(time.Second))
+	}
+	return nil
+}
+
+// cooldownRemaining returns the time until the scale cooldown of the node group has elapsed, 0 if it has
+func (ng *ClusterapiNodeGroup) cooldownRemaining() time.Duration {
+	cooldown := scaleCooldown(ng.object())
+	if cooldown == 0 || ng.lastScaleAction.IsZero() {
+		return 0
+	}
+	if remaining := cooldown - time.Since(ng.lastScaleAction); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// machineOwnsNode checks that a machine refers to the node, unless it has no node reference yet
+func machineOwnsNode(machine *v1alpha1.Machine, node *v1.Node) bool {
+	return machine.Status.NodeRef == nil || machine.Status.NodeRef.Name == node.Name
+}
+
 // DecreaseTargetSize decreases the target size of the node group. This function
 // doesn't permit to delete any existing node and can be used only to reduce the
 // request for new nodes that have not been yet fulfilled. Delta should be negative.
 // It is assumed that cloud provider will not delete the existing nodes when there
 // is an option to just decrease the target.
+//
+// The replica count is lowered at most down to the number of registered nodes, so only
+// machines that never became nodes are given up. A group without any registered node
+// may be decreased to zero.
 func (ng *ClusterapiNodeGroup) DecreaseTargetSize(delta int) error {
 	if delta >= 0 {
 		return fmt.Errorf("ClusterapiNodeGroup size decrease size must be negative")
 	}
+	if err := ng.checkObserveOnly(); err != nil {
+		return err
+	}
+	if err := ng.checkScaleDownEnabled(); err != nil {
+		return err
+	}
 
 	size, err := ng.TargetSize()
 	if err != nil {
 		return err
 	}
-	nodes := ng.machineManager.NodesForDeployment(ng.machineDeployment)
-	if nodes == nil {
-		return fmt.Errorf("ClusterapiNodeGroup MachineDeployment not found: %s", ng.machineDeployment.Name)
+	registered := len(ng.nodes())
+	if size+delta < registered {
+		return fmt.Errorf("ClusterapiNodeGroup size decrease too large, would delete registered nodes - desired:%d registered:%d",
+			size+delta, registered)
 	}
-	if size+delta < len(nodes) {
-		return fmt.Errorf("attempt to delete existing nodes targetSize:%d delta:%d existingNodes: %d",
-			size, delta, len(nodes))
+	if err := ng.setSize(size + delta); err != nil {
+		return err
 	}
-	return ng.machineManager.SetDeploymentSize(ng.machineDeployment, size+delta)
+	infoS("Decreased node group target size", ng.logKeys("DecreaseTargetSize", "from", size, "to", size+delta)...)
+	registerScaleDown(ng.object(), -delta)
+	ng.recordScaleEvent("ScaledDown", "Decreased target size from %d to %d replicas", size, size+delta)
+	return nil
 	// TODO interface documentation: "This function should wait until node group size is updated"
 	//  have we fulfilled that?
 }
 
-// Id returns an unique identifier of the node group.
+// logKeys returns the key/value pairs identifying the node group and an operation on it, followed by keysAndValues
+func (ng *ClusterapiNodeGroup) logKeys(operation string, keysAndValues ...interface{}) []interface{} {
+	return append(append(objectKeys(ng.object()), "operation", operation), keysAndValues...)
+}
+
+// Id returns an unique identifier of the node group. It is composed of the namespace and name of its
+// MachineDeployment, MachineSet or MachinePool, as objects of different namespaces may have the same name.
 func (ng *ClusterapiNodeGroup) Id() string {
-	return ng.machineDeployment.Name
+	return nodeGroupId(ng.object())
+}
+
+// nodeGroupId returns the id of the node group of a MachineDeployment, MachineSet or MachinePool
+func nodeGroupId(obj apimachv1.Object) string {
+	return obj.GetNamespace() + "/" + obj.GetName()
 }
 
-// Debug returns a string containing all information regarding this node group.
+// Debug returns a string containing all information regarding this node group: its MachineDeployment, MachineSet
+// or MachinePool, its sizes, the readiness of its instances and the remaining scale cooldown, if any.
 func (ng *ClusterapiNodeGroup) Debug() string {
-	return fmt.Sprintf("%s (%d:%d)", ng.Id(), ng.MinSize(), ng.MaxSize())
+	obj := ng.object()
+	current, ready := ng.readiness()
+	debug := fmt.Sprintf("%s %s/%s (min:%d max:%d target:%d current:%d ready:%d notReady:%d)", kindOf(obj), obj.GetNamespace(),
+		obj.GetName(), ng.MinSize(), ng.MaxSize(), ng.replicas(), current, ready, current-ready)
+	if remaining := ng.cooldownRemaining(); remaining > 0 {
+		debug += fmt.Sprintf(" cooldown:%v", remaining.Round(time.Second))
+	}
+	return debug
+}
+
+// readiness returns the number of instances of the node group and how many of them have a ready node
+func (ng *ClusterapiNodeGroup) readiness() (current, ready int) {
+	if ng.machinePool != nil {
+		for _, node := range ng.nodes() {
+			if nodeReady(node) {
+				ready++
+			}
+		}
+		return len(ng.machinePool.Spec.ProviderIDList), ready
+	}
+	machines := ng.machines()
+	for _, machine := range machines {
+		if node := ng.machineManager.NodeForMachine(machine); node != nil && nodeReady(node) {
+			ready++
+		}
+	}
+	return len(machines), ready
+}
+
+func nodeReady(node *v1.Node) bool {
+	ready, _, err := kube_util.GetReadinessState(node)
+	return err == nil && ready
 }
 
 // Nodes returns a list of all nodes that belong to this node group.
+//
+// There is an instance for each machine, including machines that have not registered a node
+// yet, with its state derived from the machine's phase. Machines whose creation failed or
+// timed out are reported as failed placements, see failStuckCreation, as are machines whose node never
+// became ready within the node startup timeout, see failStuckStartup. MachinePools have an
+// instance for each providerID, which is running once its node has registered. Replicas that
+// cluster-api hasn't created a machine or providerID for yet are creating instances as well,
+// so that the autoscaler sees all pending instances and can detect stuck provisioning. They
+// are failed placements once the status replicas lag behind for too long, see unrealizedError.
 func (ng *ClusterapiNodeGroup) Nodes() ([]cloudprovider.Instance, error) {
-	nodes := ng.machineManager.NodesForDeployment(ng.machineDeployment)
-	if nodes == nil {
-		klog.Infof("Empty ClusterapiNodeGroup: MachineDeployment %s", ng.machineDeployment.Name)
-		return []cloudprovider.Instance{}, nil
+	now := time.Now()
+	if ng.machinePool != nil {
+		return ng.machinePoolInstances(now), nil
 	}
-
-	result := make([]cloudprovider.Instance, len(nodes))
-	for i, node := range nodes {
-		result[i] = cloudprovider.Instance{
-			Id: string(node.Spec.ProviderID),
+	machines := ng.machines()
+	timeout := scaleUpTimeout(ng.object())
+	startupTimeout := nodeStartupTimeout(ng.object(), ng.cloudConfig.getMaxNodeProvisionTime())
+	result := make([]cloudprovider.Instance, 0, len(machines))
+	requested := 0
+	for _, machine := range machines {
+		node := ng.machineManager.NodeForMachine(machine)
+		status := instanceStatus(machine, node)
+		failStuckCreation(status, machine, timeout, now)
+		failStuckStartup(status, machine, node, startupTimeout, now)
+		if status.State != cloudprovider.InstanceDeleting {
+			requested++
 		}
+		result = append(result, cloudprovider.Instance{
+			Id:     instanceId(machine, node),
+			Status: status,
+		})
+	}
+	result = append(result, ng.uncreatedInstances(ng.replicas()-requested, ng.unrealizedError(now))...)
+	if len(result) == 0 {
+		infoS("Empty node group", objectKeys(ng.object())...)
 	}
 	return result, nil
 }
 
+// Pending returns the number of requested replicas of the node group whose node hasn't registered yet
+func (ng *ClusterapiNodeGroup) Pending() int {
+	registered := 0
+	if ng.machinePool != nil {
+		registered = len(ng.nodes())
+	} else {
+		for _, machine := range ng.machines() {
+			if machine.Status.NodeRef != nil && !machineDeleting(machine) {
+				registered++
+			}
+		}
+	}
+	if pending := ng.replicas() - registered; pending > 0 {
+		return pending
+	}
+	return 0
+}
+
+// uncreatedInstances returns count creating instances for replicas that cluster-api hasn't created yet,
+// with the given error if any. Their ids are stable as long as the replicas stay uncreated.
+func (ng *ClusterapiNodeGroup) uncreatedInstances(count int, errorInfo *cloudprovider.InstanceErrorInfo) []cloudprovider.Instance {
+	obj := ng.object()
+	result := make([]cloudprovider.Instance, 0)
+	for i := 0; i < count; i++ {
+		result = append(result, cloudprovider.Instance{
+			Id:     fmt.Sprintf("%s%s/%s/uncreated-%d", pendingMachinePrefix, obj.GetNamespace(), obj.GetName(), i),
+			Status: &cloudprovider.InstanceStatus{State: cloudprovider.InstanceCreating, ErrorInfo: errorInfo},
+		})
+	}
+	return result
+}
+
+// unrealizedError returns the error of the replicas cluster-api hasn't created, once the status replicas of the
+// node group have fallen behind its spec replicas for longer than its replica divergence timeout, e.g. because
+// the infrastructure provider is stuck. The autoscaler then backs off the node group instead of waiting.
+func (ng *ClusterapiNodeGroup) unrealizedError(now time.Time) *cloudprovider.InstanceErrorInfo {
+	spec, status := ng.replicas(), ng.statusReplicas()
+	if status >= spec {
+		ng.divergedSince = time.Time{}
+		return nil
+	}
+	if ng.divergedSince.IsZero() {
+		ng.divergedSince = now
+	}
+	timeout := replicaDivergenceTimeout(ng.object(), ng.cloudConfig.getMaxNodeProvisionTime())
+	if timeout == 0 || now.Sub(ng.divergedSince) <= timeout {
+		return nil
+	}
+	return &cloudprovider.InstanceErrorInfo{
+		ErrorClass:   cloudprovider.OutOfResourcesErrorClass,
+		ErrorCode:    replicasNotRealizedErrorCode,
+		ErrorMessage: fmt.Sprintf("%d of %d replicas not realized after %v", spec-status, spec, timeout),
+	}
+}
+
+// machinePoolInstances returns the instances of the node group's MachinePool
+func (ng *ClusterapiNodeGroup) machinePoolInstances(now time.Time) []cloudprovider.Instance {
+	registered := make(map[string]bool)
+	for _, node := range ng.nodes() {
+		registered[NormalizeProviderID(node.Spec.ProviderID)] = true
+	}
+	result := make([]cloudprovider.Instance, 0, len(ng.machinePool.Spec.ProviderIDList))
+	for _, providerID := range ng.machinePool.Spec.ProviderIDList {
+		instance := cloudprovider.Instance{Id: providerID, Status: &cloudprovider.InstanceStatus{State: cloudprovider.InstanceCreating}}
+		if registered[NormalizeProviderID(providerID)] {
+			instance.Status.State = cloudprovider.InstanceRunning
+		}
+		result = append(result, instance)
+	}
+	return append(result, ng.uncreatedInstances(ng.replicas()-len(result), ng.unrealizedError(now))...)
+}
+
 // TemplateNodeInfo returns a schedulercache.NodeInfo structure of an empty
 // (as if just started) node. This will be used in scale-up simulations to
 // predict what would a new node look like if a node group was expanded. The returned
 // NodeInfo is expected to have a fully populated Node object, with all of the labels,
 // capacity and allocatable information as well as all pods that are started on
 // the node by default, using manifest (most likely only kube-proxy).
+//
+// The node is sampled from a ready node of the group. Without one, it is built from the capacity
+// annotations of the MachineDeployment or MachineSet, which override those of its infrastructure template,
+// falling back to the capacity configured for its machine type, the capacity of its flavor looked up from
+// Nova and then to its well-known OpenStack flavor. A group
+// without either that is scaled to zero can't be simulated and yields cloudprovider.ErrNotImplemented.
+// The node is labeled with the node group's hints. It carries the taints of the machine template, the
+// bootstrap config and the taints annotation, so that only pods tolerating them are scheduled onto it.
 func (ng *ClusterapiNodeGroup) TemplateNodeInfo() (*cache.NodeInfo, error) {
-	node, err := buildNodeFromOpenstackMachineDeployment(ng.machineDeployment)
+	obj := ng.object()
+	var node *v1.Node
+	var found bool
+	var err error
+	annotated := obj
+	if infrastructureTemplateRef(obj) != nil {
+		templateAnnotations, err := ng.machineManager.InfrastructureTemplateAnnotations(obj)
+		if err != nil {
+			return nil, err
+		}
+		annotated = withTemplateCapacityAnnotations(obj, templateAnnotations)
+	}
+	if liveNode := sampleNode(ng.nodes()); liveNode != nil {
+		// a registered node is more accurate than annotations, e.g. for hugepages and extended resources
+		node, found = buildNodeFromLiveNode(obj, liveNode), true
+	} else if node, found, err = buildNodeFromCapacityAnnotations(annotated); err != nil {
+		return nil, err
+	}
+	if !found && ng.cloudConfig.hasMachineTypeCapacities() {
+		var capacity v1.ResourceList
+		if capacity, found = ng.cloudConfig.machineTypeCapacity(ng.machineManager.MachineType(obj)); found {
+			node = buildNodeFromCapacity(obj, capacity)
+		}
+	}
+	if !found {
+		var capacity v1.ResourceList
+		if capacity, found = ng.machineManager.MachineTypeCapacity(obj); found {
+			node = buildNodeFromCapacity(obj, capacity)
+		}
+	}
+	if !found {
+		node, err = buildNodeFromOpenstackProviderSpec(obj)
+		if err != nil {
+			if size, sizeErr := ng.TargetSize(); sizeErr == nil && size == 0 {
+				verboseInfoS(4, "Cannot build template node of node group scaled to zero", ng.logKeys("TemplateNodeInfo", "err", err)...)
+				return nil, cloudprovider.ErrNotImplemented
+			}
+			return nil, err
+		}
+	}
+	bootstrapLabels, bootstrapTaints, err := ng.machineManager.BootstrapNodeRegistration(obj)
+	if err != nil {
+		return nil, err
+	}
+	annotatedTaints, err := taintsFromAnnotations(annotated)
 	if err != nil {
 		return nil, err
 	}
+	reserved, err := reservedResources(obj, ng.cloudConfig)
+	if err != nil {
+		return nil, err
+	}
+	applyMachineTemplate(node, obj, bootstrapLabels, mergeTaints(bootstrapTaints, annotatedTaints), reserved)
+	applyZoneLabels(node, ng.machineManager.FailureDomain(obj))
+	applyHints(node, ng.Hints())
+	if price, ok := obj.GetAnnotations()[PricePerHourAnnotation]; ok {
+		node.Annotations = cloudprovider.JoinStringMaps(node.Annotations, map[string]string{PricePerHourAnnotation: price})
+	}
 
-	nodeInfo := schedulercache.NewNodeInfo(cloudprovider.BuildKubeProxy(ng.machineDeployment.Name))
+	// the id isn't a valid pod name
+	nodeInfo := schedulercache.NewNodeInfo(cloudprovider.BuildKubeProxy(obj.GetName()))
 	nodeInfo.SetNode(node)
 	return nodeInfo, nil
 }
 
+// GpuConfig returns how the GPU nodes of the node group are recognized, which its MachineDeployment,
+// MachineSet or MachinePool may override with annotations
+func (ng *ClusterapiNodeGroup) GpuConfig() *GpuConfig {
+	return gpuConfigFromAnnotations(ng.object())
+}
+
+// GetOptions returns the scale-down options of the node group, which its MachineDeployment or MachineSet
+// may override with annotations. Options that are not overridden keep the given defaults.
+func (ng *ClusterapiNodeGroup) GetOptions(defaults config.NodeGroupAutoscalingOptions) (*config.NodeGroupAutoscalingOptions, error) {
+	return autoscalingOptionsFromAnnotations(ng.object(), defaults), nil
+}
+
 // Exist checks if the node group really exists on the cloud provider side. Allows to tell the
-// theoretical node group from the real one.
+// theoretical node group from the real one. A node group found deleted while scaling doesn't
+// exist anymore, even before the next refresh drops it.
 func (ng *ClusterapiNodeGroup) Exist() bool {
-	return true
+	uid := ng.object().GetUID()
+	if uid == "" || ng.deleted {
+		return false
+	}
+	if ng.machineSet != nil {
+		for _, ms := range ng.machineManager.AllMachineSets() {
+			if ms.UID == uid {
+				return true
+			}
+		}
+		return false
+	}
+	if ng.machinePool != nil {
+		for _, mp := range ng.machineManager.AllMachinePools() {
+			if mp.UID == uid {
+				return true
+			}
+		}
+		return false
+	}
+	for _, md := range ng.machineManager.AllDeployments() {
+		if md.UID == uid {
+			return true
+		}
+	}
+	return false
 }
 
-// Create creates the node group on the cloud provider side.
+// Create creates the node group on the cloud provider side. Only autoprovisioned
+// MachineDeployments can be created.
 func (ng *ClusterapiNodeGroup) Create() (cloudprovider.NodeGroup, error) {
-	return nil, cloudprovider.ErrAlreadyExist
+	if !ng.Autoprovisioned() {
+		return nil, cloudprovider.ErrNotImplemented
+	}
+	if ng.Exist() {
+		return nil, cloudprovider.ErrAlreadyExist
+	}
+	md, err := ng.machineManager.CreateMachineDeployment(ng.machineDeployment)
+	if err != nil {
+		return nil, err
+	}
+	created := NewClusterapiNodeGroup(ng.machineManager, md, ng.cloudConfig)
+	created.eventRecorder = ng.eventRecorder
+	return created, nil
 }
 
 // Delete deletes the node group on the cloud provider side.
 // This will be executed only for autoprovisioned node groups, once their size drops to 0.
 func (ng *ClusterapiNodeGroup) Delete() error {
-	return cloudprovider.ErrNotImplemented
+	if !ng.Autoprovisioned() {
+		return cloudprovider.ErrNotImplemented
+	}
+	size, err := ng.TargetSize()
+	if err != nil {
+		return err
+	}
+	if size > 0 {
+		return fmt.Errorf("cannot delete node group %s with target size %d", ng.Id(), size)
+	}
+	return ng.machineManager.DeleteMachineDeployment(ng.machineDeployment)
 }
 
 // Autoprovisioned returns true if the node group is autoprovisioned. An autoprovisioned group
-// was created by CA and can be deleted when scaled to 0.
+// was created by CA and can be deleted when scaled to 0. Only MachineDeployments carrying the
+// autoprovisioned annotation are autoprovisioned.
 func (ng *ClusterapiNodeGroup) Autoprovisioned() bool {
-	return false
+	return ng.machineDeployment != nil && ng.machineDeployment.Annotations[AutoprovisionedAnnotation] == "true"
 }
@@ -17,10 +17,25 @@ limitations under the License.
 package clusterapi
 
 import (
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider/clusterapi/exp"
+	"k8s.io/autoscaler/cluster-autoscaler/config"
+	"k8s.io/autoscaler/cluster-autoscaler/utils/deletetaint"
+	"k8s.io/autoscaler/cluster-autoscaler/utils/gpu"
+	"k8s.io/autoscaler/cluster-autoscaler/utils/test"
+	"k8s.io/client-go/tools/record"
+	kubeletapis "k8s.io/kubernetes/pkg/kubelet/apis"
+	"sigs.k8s.io/cluster-api/pkg/apis/cluster/common"
 	"sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	"strings"
 	"testing"
+	"time"
 )
 
 func newNodeGroup(t *testing.T) *ClusterapiNodeGroup {
@@ -30,7 +45,8 @@ func newNodeGroup(t *testing.T) *ClusterapiNodeGroup {
 		machineManager: manager,
 		machineDeployment: &v1alpha1.MachineDeployment{
 			ObjectMeta: v1.ObjectMeta{
-				Name: "ngName",
+				Name:      "ngName",
+				Namespace: "kube-system",
 			},
 			Spec: v1alpha1.MachineDeploymentSpec{
 				Replicas: int32Ptr(5),
@@ -55,12 +71,31 @@ func TestMinize(t *testing.T) {
 
 func TestId(t *testing.T) {
 	ng := newNodeGroup(t)
-	assert.Equal(t, "ngName", ng.Id())
+	assert.Equal(t, "kube-system/ngName", ng.Id())
 }
 
 func TestDebug(t *testing.T) {
-	ng := newNodeGroup(t)
-	assert.Equal(t, "ngName (0:10)", ng.Debug())
+	md := buildTestMachineDeployment("md", 3, 1, 10)
+	md.Annotations[ScaleCooldownAnnotation] = "10m"
+	ms := buildTestMachineSet(md, "ms", 3)
+	n1 := buildTestNode("n1")
+	n2 := buildTestNode("n2")
+	test.SetNodeReadyState(n1, true, time.Now())
+	test.SetNodeReadyState(n2, false, time.Now())
+	m1 := buildTestMachine(ms, "m1", n1)
+	m2 := buildTestMachine(ms, "m2", n2)
+	m3 := buildTestMachine(ms, "m3", nil)
+
+	manager := newTestMachineManager(t)
+	manager.On("MachinesForDeployment", md).Return([]*v1alpha1.Machine{m1, m2, m3})
+	manager.On("NodeForMachine", m1).Return(n1)
+	manager.On("NodeForMachine", m2).Return(n2)
+	manager.On("NodeForMachine", m3).Return((*apiv1.Node)(nil))
+	ng := NewClusterapiNodeGroup(manager, md, nil)
+	assert.Equal(t, "MachineDeployment kube-system/md (min:1 max:10 target:3 current:3 ready:1 notReady:2)", ng.Debug())
+
+	ng.lastScaleAction = time.Now().Add(-time.Minute)
+	assert.Equal(t, "MachineDeployment kube-system/md (min:1 max:10 target:3 current:3 ready:1 notReady:2) cooldown:9m0s", ng.Debug())
 }
 
 func TestTargetSize(t *testing.T) {
@@ -71,10 +106,76 @@ func TestTargetSize(t *testing.T) {
 	assert.Equal(t, 5, targetSize)
 }
 
+func TestIncreaseSizeDryRun(t *testing.T) {
+	md := buildTestMachineDeployment("md", 3, 0, 10)
+	mp := buildTestMachinePool("mp", 3, 0, 10)
+
+	manager := newTestMachineManager(t)
+	manager.On("SetDeploymentSize", md, 5).Return(false, nil)
+	manager.On("SetMachinePoolSize", mp, 5).Return(false, nil)
+
+	for _, ng := range []*ClusterapiNodeGroup{NewClusterapiNodeGroup(manager, md, nil), NewClusterapiMachinePoolNodeGroup(manager, mp, nil)} {
+		assert.NoError(t, ng.IncreaseSize(2))
+		size, err := ng.TargetSize()
+		assert.NoError(t, err)
+		assert.Equal(t, 3, size, ng.Id())
+	}
+	manager.AssertExpectations(t)
+}
+
+func TestTargetSizeNilReplicas(t *testing.T) {
+	md := buildTestMachineDeployment("md", 0, 0, 10)
+	md.Spec.Replicas = nil
+
+	manager := newTestMachineManager(t)
+	manager.On("SetDeploymentSize", md, 2).Return(true, nil)
+	manager.On("NodesForDeployment", md).Return([]*apiv1.Node(nil))
+	// the decrease starts from the size the node group was increased to
+	manager.On("SetDeploymentSize", md, 1).Return(true, nil)
+	ng := NewClusterapiNodeGroup(manager, md, nil)
+
+	size, err := ng.TargetSize()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, size)
+
+	assert.NoError(t, ng.IncreaseSize(1))
+	assert.NoError(t, ng.DecreaseTargetSize(-1))
+	manager.AssertExpectations(t)
+
+	ms := buildTestStandaloneMachineSet("ms", 0, 0, 10)
+	ms.Spec.Replicas = nil
+	size, err = NewClusterapiMachineSetNodeGroup(manager, ms, nil).TargetSize()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, size)
+}
+
+func TestTargetSizeAboveMaxSize(t *testing.T) {
+	md := buildTestMachineDeployment("md", 12, 0, 10)
+	manager := newTestMachineManager(t)
+	ng := NewClusterapiNodeGroup(manager, md, nil)
+
+	size, err := ng.TargetSize()
+	assert.NoError(t, err)
+	assert.Equal(t, 12, size)
+	assert.EqualError(t, ng.IncreaseSize(1), "ClusterapiNodeGroup size increase too large - group:kube-system/md current:12 delta:1 desired:13 min:0 max:10")
+	manager.AssertExpectations(t)
+}
+
 func TestExists(t *testing.T) {
-	ng := newNodeGroup(t)
+	md := buildTestMachineDeployment("md", 1, 0, 10)
+	gone := buildTestMachineDeployment("gone", 1, 0, 10)
+	ms := buildTestStandaloneMachineSet("ms", 1, 0, 10)
+	manager := newTestMachineManager(t)
+	manager.On("AllDeployments").Return([]*v1alpha1.MachineDeployment{md})
+	manager.On("AllMachineSets").Return([]*v1alpha1.MachineSet{ms})
 
-	assert.True(t, ng.Exist())
+	assert.True(t, NewClusterapiNodeGroup(manager, md, nil).Exist())
+	assert.False(t, NewClusterapiNodeGroup(manager, gone, nil).Exist())
+	assert.True(t, NewClusterapiMachineSetNodeGroup(manager, ms, nil).Exist())
+
+	// a node group that wasn't created yet has no UID
+	gone.UID = ""
+	assert.False(t, NewClusterapiNodeGroup(manager, gone, nil).Exist())
 }
 
 func TestCreate(t *testing.T) {
@@ -83,7 +184,28 @@ func TestCreate(t *testing.T) {
 	newNg, err := ng.Create()
 
 	assert.Nil(t, newNg)
-	assert.EqualError(t, err, "Already exist")
+	assert.EqualError(t, err, "Not implemented")
+}
+
+func TestCreateAutoprovisioned(t *testing.T) {
+	md := buildTestMachineDeployment("md", 0, 0, 10)
+	md.UID = ""
+	md.Annotations[AutoprovisionedAnnotation] = "true"
+	created := md.DeepCopy()
+	created.UID = "created"
+
+	manager := newTestMachineManager(t)
+	manager.On("CreateMachineDeployment", md).Return(created, nil)
+	ng := NewClusterapiNodeGroup(manager, md, nil)
+
+	newNg, err := ng.Create()
+	assert.NoError(t, err)
+	assert.Equal(t, created, newNg.(*ClusterapiNodeGroup).machineDeployment)
+	assert.True(t, newNg.Autoprovisioned())
+
+	manager.On("AllDeployments").Return([]*v1alpha1.MachineDeployment{created})
+	_, err = newNg.Create()
+	assert.Equal(t, cloudprovider.ErrAlreadyExist, err)
 }
 
 func TestDelete(t *testing.T) {
@@ -94,10 +216,29 @@ func TestDelete(t *testing.T) {
 	assert.EqualError(t, err, "Not implemented")
 }
 
+func TestDeleteAutoprovisioned(t *testing.T) {
+	md := buildTestMachineDeployment("md", 1, 0, 10)
+	md.Annotations[AutoprovisionedAnnotation] = "true"
+
+	manager := newTestMachineManager(t)
+	manager.On("DeleteMachineDeployment", md).Return(nil)
+	ng := NewClusterapiNodeGroup(manager, md, nil)
+
+	assert.EqualError(t, ng.Delete(), "cannot delete node group kube-system/md with target size 1")
+	manager.AssertNotCalled(t, "DeleteMachineDeployment", md)
+
+	md.Spec.Replicas = int32Ptr(0)
+	assert.NoError(t, ng.Delete())
+	manager.AssertExpectations(t)
+}
+
 func TestAutoprovisioned(t *testing.T) {
 	ng := newNodeGroup(t)
 
 	assert.False(t, ng.Autoprovisioned())
+
+	ng.machineDeployment.Annotations = map[string]string{AutoprovisionedAnnotation: "true"}
+	assert.True(t, ng.Autoprovisioned())
 }
 
 func TestIncreaseWithTooLargeTargetSize(t *testing.T) {
@@ -105,7 +246,8 @@ func TestIncreaseWithTooLargeTargetSize(t *testing.T) {
 
 	err := ng.IncreaseSize(100)
 
-	assert.EqualError(t, err, "ClusterapiNodeGroup size increase too large - desired:105 max:10")
+	assert.EqualError(t, err, "ClusterapiNodeGroup size increase too large - group:kube-system/ngName current:5 delta:100 desired:105 min:0 max:10")
+	assert.Equal(t, &SizeBoundError{NodeGroup: "kube-system/ngName", Current: 5, Delta: 100, Min: 0, Max: 10}, err)
 }
 
 func TestIncreaseWithNegativeTargetSize(t *testing.T) {
@@ -113,7 +255,8 @@ func TestIncreaseWithNegativeTargetSize(t *testing.T) {
 
 	err := ng.IncreaseSize(-1)
 
-	assert.EqualError(t, err, "ClusterapiNodeGroup size increase size must be positive")
+	assert.EqualError(t, err, "ClusterapiNodeGroup size increase size must be positive - delta:-1")
+	assert.EqualError(t, ng.IncreaseSize(0), "ClusterapiNodeGroup size increase size must be positive - delta:0")
 }
 
 func TestDecreaseWithPositiveTargetSize(t *testing.T) {
@@ -123,3 +266,1170 @@ func TestDecreaseWithPositiveTargetSize(t *testing.T) {
 
 	assert.EqualError(t, err, "ClusterapiNodeGroup size decrease size must be negative")
 }
+
+func TestDecreaseTargetSize(t *testing.T) {
+	md := buildTestMachineDeployment("md", 5, 0, 10)
+	n1 := buildTestNode("n1")
+	n2 := buildTestNode("n2")
+
+	manager := newTestMachineManager(t)
+	manager.On("NodesForDeployment", md).Return([]*apiv1.Node{n1, n2})
+	manager.On("SetDeploymentSize", md, 2).Return(true, nil)
+	ng := NewClusterapiNodeGroup(manager, md, nil)
+
+	err := ng.DecreaseTargetSize(-4)
+	assert.EqualError(t, err, "ClusterapiNodeGroup size decrease too large, would delete registered nodes - desired:1 registered:2")
+	manager.AssertNotCalled(t, "SetDeploymentSize", md, 1)
+
+	assert.NoError(t, ng.DecreaseTargetSize(-3))
+	manager.AssertExpectations(t)
+}
+
+func TestDecreaseTargetSizeWithoutRegisteredNodes(t *testing.T) {
+	md := buildTestMachineDeployment("md", 2, 0, 10)
+
+	manager := newTestMachineManager(t)
+	manager.On("NodesForDeployment", md).Return([]*apiv1.Node(nil))
+	manager.On("SetDeploymentSize", md, 0).Return(true, nil)
+	ng := NewClusterapiNodeGroup(manager, md, nil)
+
+	assert.NoError(t, ng.DecreaseTargetSize(-2))
+	manager.AssertExpectations(t)
+}
+
+func TestGetOptions(t *testing.T) {
+	md := buildTestMachineDeployment("md", 1, 0, 10)
+	md.Annotations[ScaleDownUtilizationThresholdAnnotation] = "0.7"
+	md.Annotations[ScaleDownGpuUtilizationThresholdAnnotation] = "1.5"
+	md.Annotations[ScaleDownUnneededTimeAnnotation] = "20m"
+	md.Annotations[ScaleDownUnreadyTimeAnnotation] = "soon"
+	ng := NewClusterapiNodeGroup(newTestMachineManager(t), md, nil)
+
+	defaults := config.NodeGroupAutoscalingOptions{
+		ScaleDownUtilizationThreshold:    0.5,
+		ScaleDownGpuUtilizationThreshold: 0.5,
+		ScaleDownUnneededTime:            10 * time.Minute,
+		ScaleDownUnreadyTime:             20 * time.Minute,
+	}
+	options, err := ng.GetOptions(defaults)
+	assert.NoError(t, err)
+	assert.Equal(t, &config.NodeGroupAutoscalingOptions{
+		ScaleDownUtilizationThreshold:    0.7,
+		ScaleDownGpuUtilizationThreshold: 0.5,
+		ScaleDownUnneededTime:            20 * time.Minute,
+		ScaleDownUnreadyTime:             20 * time.Minute,
+	}, options)
+}
+
+func TestGetOptionsDefaults(t *testing.T) {
+	ms := buildTestStandaloneMachineSet("ms", 1, 0, 10)
+	ng := NewClusterapiMachineSetNodeGroup(newTestMachineManager(t), ms, nil)
+
+	defaults := config.NodeGroupAutoscalingOptions{ScaleDownUtilizationThreshold: 0.5, ScaleDownUnneededTime: time.Minute}
+	options, err := ng.GetOptions(defaults)
+	assert.NoError(t, err)
+	assert.Equal(t, &defaults, options)
+}
+
+func TestTemplateNodeInfoGpuTaints(t *testing.T) {
+	md := buildTestMachineDeployment("md", 0, 0, 10)
+	md.Annotations[CpuCapacityAnnotation] = "8"
+	md.Annotations[MemoryCapacityAnnotation] = "64Gi"
+	md.Annotations[GpuCountCapacityAnnotation] = "1"
+	md.Spec.Template.Spec.Taints = []apiv1.Taint{{Key: gpu.ResourceNvidiaGPU, Value: "dedicated", Effect: apiv1.TaintEffectNoSchedule}}
+	setTestInfrastructureTemplate(md, "infrastructure.cluster.x-k8s.io/v1alpha2", "OpenStackMachineTemplate", "gpu")
+
+	manager := newTestMachineManager(t)
+	manager.On("NodesForDeployment", md).Return([]*apiv1.Node(nil))
+	manager.On("InfrastructureTemplateAnnotations", md).Return(map[string]string{TaintsCapacityAnnotation: "example.com/local-nvme:NoSchedule"}, nil)
+	manager.On("BootstrapNodeRegistration", md).Return(map[string]string(nil), []apiv1.Taint(nil), nil)
+	manager.On("FailureDomain", md).Return("")
+	ng := NewClusterapiNodeGroup(manager, md, nil)
+
+	nodeInfo, err := ng.TemplateNodeInfo()
+	assert.NoError(t, err)
+	// the machine template's GPU taint replaces the default one, so only pods tolerating it fit
+	assert.Equal(t, []apiv1.Taint{
+		{Key: gpu.ResourceNvidiaGPU, Value: "dedicated", Effect: apiv1.TaintEffectNoSchedule},
+		{Key: "example.com/local-nvme", Effect: apiv1.TaintEffectNoSchedule},
+	}, nodeInfo.Node().Spec.Taints)
+}
+
+func TestTemplateNodeInfoFromCapacityAnnotations(t *testing.T) {
+	md := buildTestMachineDeployment("md", 0, 0, 10)
+	md.Annotations[CpuCapacityAnnotation] = "4"
+	md.Annotations[MemoryCapacityAnnotation] = "16Gi"
+	md.Annotations[MaxPodsCapacityAnnotation] = "50"
+	md.Annotations[SpotHintAnnotation] = "true"
+	md.Spec.Template.Spec.Labels = map[string]string{"pool": "workers"}
+	md.Spec.Template.Spec.Taints = []apiv1.Taint{{Key: "dedicated", Value: "workers", Effect: apiv1.TaintEffectNoSchedule}}
+	bootstrapTaints := []apiv1.Taint{{Key: "cluster-autoscaler.kubernetes.io/scale-from-zero", Effect: apiv1.TaintEffectNoExecute}}
+
+	cloudConfig, err := ReadCloudConfig(strings.NewReader("[global]\nkube-reserved = cpu=500m,memory=1Gi\n"))
+	assert.NoError(t, err)
+	manager := newTestMachineManager(t)
+	manager.On("NodesForDeployment", md).Return([]*apiv1.Node(nil))
+	manager.On("BootstrapNodeRegistration", md).Return(map[string]string{"pool": "bootstrap", "zone": "a"}, bootstrapTaints, nil)
+	manager.On("FailureDomain", md).Return("az-1")
+	ng := NewClusterapiNodeGroup(manager, md, cloudConfig)
+
+	nodeInfo, err := ng.TemplateNodeInfo()
+	assert.NoError(t, err)
+	node := nodeInfo.Node()
+	assert.Equal(t, "workers", node.Labels["pool"])
+	assert.Equal(t, "a", node.Labels["zone"])
+	assert.Equal(t, "az-1", node.Labels[LabelTopologyZone])
+	assert.Equal(t, "az-1", node.Labels[kubeletapis.LabelZoneFailureDomain])
+	assert.Equal(t, "true", node.Labels[SpotHintAnnotation])
+	assert.Equal(t, append(bootstrapTaints, md.Spec.Template.Spec.Taints...), node.Spec.Taints)
+	assert.Equal(t, int64(4000), node.Status.Capacity.Cpu().MilliValue())
+	assert.Equal(t, int64(3500), node.Status.Allocatable.Cpu().MilliValue())
+	assert.Equal(t, int64(15*1024*1024*1024), node.Status.Allocatable.Memory().Value())
+	assert.Equal(t, int64(50), node.Status.Allocatable.Pods().Value())
+}
+
+func TestTemplateNodeInfoFromMachineTypeCapacity(t *testing.T) {
+	md := buildTestMachineDeployment("md", 0, 0, 10)
+	annotated := buildTestMachineDeployment("annotated", 0, 0, 10)
+	annotated.Annotations[CpuCapacityAnnotation] = "4"
+	annotated.Annotations[MemoryCapacityAnnotation] = "16Gi"
+
+	cloudConfig, err := ReadCloudConfig(strings.NewReader("[machine-type \"m1.small\"]\ncpu = 2\nmemory = 4Gi\n"))
+	assert.NoError(t, err)
+	manager := newTestMachineManager(t)
+	for _, obj := range []*v1alpha1.MachineDeployment{md, annotated} {
+		manager.On("NodesForDeployment", obj).Return([]*apiv1.Node(nil))
+		manager.On("BootstrapNodeRegistration", obj).Return(map[string]string(nil), []apiv1.Taint(nil), nil)
+		manager.On("FailureDomain", obj).Return("")
+	}
+	manager.On("MachineType", md).Return("m1.small")
+
+	nodeInfo, err := NewClusterapiNodeGroup(manager, md, cloudConfig).TemplateNodeInfo()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2000), nodeInfo.Node().Status.Capacity.Cpu().MilliValue())
+	assert.Equal(t, int64(4*1024*1024*1024), nodeInfo.Node().Status.Allocatable.Memory().Value())
+	assert.Equal(t, int64(defaultMaxPods), nodeInfo.Node().Status.Capacity.Pods().Value())
+
+	// the annotations take precedence over the machine type
+	nodeInfo, err = NewClusterapiNodeGroup(manager, annotated, cloudConfig).TemplateNodeInfo()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4000), nodeInfo.Node().Status.Capacity.Cpu().MilliValue())
+
+	manager.AssertExpectations(t)
+}
+
+func TestTemplateNodeInfoFromTemplateCapacityAnnotations(t *testing.T) {
+	md := buildTestMachineDeployment("md", 0, 0, 10)
+	md.Annotations[CpuCapacityAnnotation] = "8"
+	setTestInfrastructureTemplate(md, "infrastructure.cluster.x-k8s.io/v1alpha2", "OpenStackMachineTemplate", "large")
+
+	manager := newTestMachineManager(t)
+	manager.On("NodesForDeployment", md).Return([]*apiv1.Node(nil))
+	manager.On("InfrastructureTemplateAnnotations", md).Return(map[string]string{
+		CpuCapacityAnnotation:      "4",
+		MemoryCapacityAnnotation:   "16Gi",
+		GpuCountCapacityAnnotation: "1",
+		"unrelated":                "annotation",
+	}, nil)
+	manager.On("BootstrapNodeRegistration", md).Return(nil, nil, nil)
+	manager.On("FailureDomain", md).Return("")
+	ng := NewClusterapiNodeGroup(manager, md, nil)
+
+	nodeInfo, err := ng.TemplateNodeInfo()
+	assert.NoError(t, err)
+	capacity := nodeInfo.Node().Status.Capacity
+	// the MachineDeployment's annotations override the template's
+	assert.Equal(t, int64(8000), capacity.Cpu().MilliValue())
+	assert.Equal(t, int64(16*1024*1024*1024), capacity.Memory().Value())
+	gpus := capacity[gpu.ResourceNvidiaGPU]
+	assert.Equal(t, int64(1), gpus.Value())
+	// the MachineDeployment itself isn't changed
+	assert.Equal(t, map[string]string{
+		MinSizeAnnotation:     "0",
+		MaxSizeAnnotation:     "10",
+		CpuCapacityAnnotation: "8",
+	}, md.Annotations)
+
+	manager = newTestMachineManager(t)
+	manager.On("NodesForDeployment", md).Return([]*apiv1.Node(nil))
+	manager.On("InfrastructureTemplateAnnotations", md).Return(nil, fmt.Errorf("connection refused"))
+	_, err = NewClusterapiNodeGroup(manager, md, nil).TemplateNodeInfo()
+	assert.EqualError(t, err, "connection refused")
+}
+
+func TestTemplateNodeInfoBootstrapConfigError(t *testing.T) {
+	md := buildTestMachineDeployment("md", 0, 0, 10)
+	md.Annotations[CpuCapacityAnnotation] = "4"
+	md.Annotations[MemoryCapacityAnnotation] = "16Gi"
+
+	manager := newTestMachineManager(t)
+	manager.On("NodesForDeployment", md).Return([]*apiv1.Node(nil))
+	manager.On("BootstrapNodeRegistration", md).Return(nil, nil, fmt.Errorf("not found"))
+	ng := NewClusterapiNodeGroup(manager, md, nil)
+
+	_, err := ng.TemplateNodeInfo()
+	assert.EqualError(t, err, "not found")
+}
+
+func TestTemplateNodeInfoScaledToZeroWithoutCapacity(t *testing.T) {
+	md := buildTestMachineDeployment("md", 0, 0, 10)
+	manager := newTestMachineManager(t)
+	manager.On("NodesForDeployment", md).Return([]*apiv1.Node(nil))
+	manager.On("MachineTypeCapacity", md).Return(nil, false)
+	ng := NewClusterapiNodeGroup(manager, md, nil)
+
+	nodeInfo, err := ng.TemplateNodeInfo()
+	assert.Nil(t, nodeInfo)
+	assert.Equal(t, cloudprovider.ErrNotImplemented, err)
+}
+
+func TestTemplateNodeInfoFromFlavorLookup(t *testing.T) {
+	md := buildTestMachineDeployment("md", 0, 0, 10)
+	manager := newTestMachineManager(t)
+	manager.On("NodesForDeployment", md).Return([]*apiv1.Node(nil))
+	manager.On("MachineTypeCapacity", md).Return(apiv1.ResourceList{
+		apiv1.ResourceCPU:    resource.MustParse("2"),
+		apiv1.ResourceMemory: resource.MustParse("8Gi"),
+	}, true)
+	manager.On("BootstrapNodeRegistration", md).Return(nil, nil, nil)
+	manager.On("FailureDomain", md).Return("")
+	ng := NewClusterapiNodeGroup(manager, md, nil)
+
+	nodeInfo, err := ng.TemplateNodeInfo()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), nodeInfo.Node().Status.Capacity.Cpu().Value())
+	assert.Equal(t, int64(8*1024*1024*1024), nodeInfo.Node().Status.Allocatable.Memory().Value())
+}
+
+func TestTemplateNodeInfoWithoutCapacity(t *testing.T) {
+	md := buildTestMachineDeployment("md", 1, 0, 10)
+	manager := newTestMachineManager(t)
+	// nodes that aren't ready aren't sampled
+	manager.On("NodesForDeployment", md).Return([]*apiv1.Node{buildTestNode("n")})
+	manager.On("MachineTypeCapacity", md).Return(nil, false)
+	ng := NewClusterapiNodeGroup(manager, md, nil)
+
+	_, err := ng.TemplateNodeInfo()
+	assert.EqualError(t, err, "providerconfig.value is nil")
+}
+
+func TestTemplateNodeInfoFromLiveNode(t *testing.T) {
+	md := buildTestMachineDeployment("md", 2, 0, 10)
+	md.Annotations[CpuCapacityAnnotation] = "4"
+	md.Annotations[MemoryCapacityAnnotation] = "16Gi"
+	md.Annotations[PricePerHourAnnotation] = "0.5"
+	md.Spec.Template.Spec.Labels = map[string]string{"pool": "workers"}
+
+	unready := buildTestNode("unready")
+	ready := test.BuildTestNode("ready", 8000, 32*1024*1024*1024)
+	ready.Labels = map[string]string{kubeletapis.LabelHostname: "ready", kubeletapis.LabelZoneFailureDomain: "a"}
+	ready.Status.Capacity["hugepages-2Mi"] = resource.MustParse("1Gi")
+	ready.Status.Allocatable[apiv1.ResourceCPU] = resource.MustParse("7500m")
+	ready.Status.Conditions = cloudprovider.BuildReadyConditions()
+	ready.Spec.Taints = []apiv1.Taint{{Key: "node.kubernetes.io/unreachable", Effect: apiv1.TaintEffectNoExecute}}
+
+	cloudConfig, err := ReadCloudConfig(strings.NewReader("[global]\nkube-reserved = cpu=1\n"))
+	assert.NoError(t, err)
+	manager := newTestMachineManager(t)
+	manager.On("NodesForDeployment", md).Return([]*apiv1.Node{unready, ready})
+	manager.On("BootstrapNodeRegistration", md).Return(nil, nil, nil)
+	manager.On("FailureDomain", md).Return("")
+	ng := NewClusterapiNodeGroup(manager, md, cloudConfig)
+
+	nodeInfo, err := ng.TemplateNodeInfo()
+	assert.NoError(t, err)
+	node := nodeInfo.Node()
+	assert.NotEqual(t, "ready", node.Name)
+	assert.Equal(t, node.Name, node.Labels[kubeletapis.LabelHostname])
+	assert.Equal(t, "a", node.Labels[kubeletapis.LabelZoneFailureDomain])
+	assert.Equal(t, "workers", node.Labels["pool"])
+	assert.Equal(t, map[string]string{PricePerHourAnnotation: "0.5"}, node.Annotations)
+	assert.Empty(t, node.Spec.Taints)
+	assert.Equal(t, int64(8000), node.Status.Capacity.Cpu().MilliValue())
+	assert.Equal(t, int64(7500), node.Status.Allocatable.Cpu().MilliValue())
+	hugepages := node.Status.Capacity["hugepages-2Mi"]
+	assert.Equal(t, "1Gi", hugepages.String())
+}
+
+func TestMachineSetNodeGroup(t *testing.T) {
+	ms := buildTestStandaloneMachineSet("ms", 3, 1, 5)
+	ms.Annotations[CpuCapacityAnnotation] = "2"
+	ms.Annotations[MemoryCapacityAnnotation] = "8Gi"
+	ms.Spec.Template.Spec.Labels = map[string]string{"pool": "standalone"}
+	n := buildTestNode("n")
+
+	manager := newTestMachineManager(t)
+	manager.On("NodesForMachineSet", ms).Return([]*apiv1.Node{n})
+	manager.On("SetMachineSetSize", ms, 2).Return(true, nil)
+	manager.On("BootstrapNodeRegistration", ms).Return(nil, nil, nil)
+	manager.On("FailureDomain", ms).Return("")
+	ng := NewClusterapiMachineSetNodeGroup(manager, ms, nil)
+
+	assert.Equal(t, "kube-system/ms", ng.Id())
+	assert.Equal(t, 1, ng.MinSize())
+	assert.Equal(t, 5, ng.MaxSize())
+	size, err := ng.TargetSize()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, size)
+
+	assert.NoError(t, ng.DecreaseTargetSize(-1))
+
+	nodeInfo, err := ng.TemplateNodeInfo()
+	assert.NoError(t, err)
+	assert.Equal(t, "standalone", nodeInfo.Node().Labels["pool"])
+	assert.Equal(t, int64(2000), nodeInfo.Node().Status.Capacity.Cpu().MilliValue())
+
+	manager.AssertExpectations(t)
+}
+
+func TestNodesPending(t *testing.T) {
+	md := buildTestMachineDeployment("md", 4, 0, 5)
+	ms := buildTestMachineSet(md, "ms", 4)
+	n1 := buildTestNode("n1")
+	registered := buildTestMachine(ms, "registered", n1)
+	provisioning := buildTestMachine(ms, "provisioning", nil)
+	provisioning.CreationTimestamp = v1.Now()
+	n2 := buildTestNode("n2")
+	deleting := buildTestMachine(ms, "deleting", n2)
+	deleting.DeletionTimestamp = &v1.Time{Time: time.Now()}
+	// the phase may be seen before the deletion timestamp
+	n3 := buildTestNode("n3")
+	departing := buildTestMachine(ms, "departing", n3)
+	phase := machinePhaseDeleting
+	departing.Status.Phase = &phase
+
+	manager := newTestMachineManager(t)
+	manager.On("MachinesForDeployment", md).Return([]*v1alpha1.Machine{registered, provisioning, deleting, departing})
+	manager.On("NodeForMachine", registered).Return(n1)
+	manager.On("NodeForMachine", provisioning).Return((*apiv1.Node)(nil))
+	manager.On("NodeForMachine", deleting).Return(n2)
+	manager.On("NodeForMachine", departing).Return(n3)
+	ng := NewClusterapiNodeGroup(manager, md, nil)
+
+	instances, err := ng.Nodes()
+	assert.NoError(t, err)
+	creating := &cloudprovider.InstanceStatus{State: cloudprovider.InstanceCreating}
+	// the replacements of the deleting machines have no machine yet
+	assert.Equal(t, []cloudprovider.Instance{
+		{Id: "n1", Status: &cloudprovider.InstanceStatus{State: cloudprovider.InstanceRunning}},
+		{Id: "clusterapi://kube-system/provisioning", Status: creating},
+		{Id: "n2", Status: &cloudprovider.InstanceStatus{State: cloudprovider.InstanceDeleting}},
+		{Id: "n3", Status: &cloudprovider.InstanceStatus{State: cloudprovider.InstanceDeleting}},
+		{Id: "clusterapi://kube-system/md/uncreated-0", Status: creating},
+		{Id: "clusterapi://kube-system/md/uncreated-1", Status: creating},
+	}, instances)
+	assert.Equal(t, 3, ng.Pending())
+
+	manager.AssertExpectations(t)
+}
+
+func TestNodesReplicasNotRealized(t *testing.T) {
+	md := buildTestMachineDeployment("md", 2, 0, 5)
+	md.Status.Replicas = 1
+	ms := buildTestMachineSet(md, "ms", 2)
+	n1 := buildTestNode("n1")
+	m1 := buildTestMachine(ms, "m1", n1)
+
+	manager := newTestMachineManager(t)
+	manager.On("MachinesForDeployment", md).Return([]*v1alpha1.Machine{m1})
+	manager.On("NodeForMachine", m1).Return(n1)
+	ng := NewClusterapiNodeGroup(manager, md, nil)
+
+	// the divergence is tracked from the first time it is seen
+	instances, err := ng.Nodes()
+	assert.NoError(t, err)
+	assert.Nil(t, instances[1].Status.ErrorInfo)
+	assert.WithinDuration(t, time.Now(), ng.divergedSince, time.Second)
+
+	// past max-node-provision-time, the replicas not created are failed placements
+	ng.divergedSince = time.Now().Add(-16 * time.Minute)
+	instances, err = ng.Nodes()
+	assert.NoError(t, err)
+	assert.Equal(t, &cloudprovider.InstanceStatus{
+		State: cloudprovider.InstanceCreating,
+		ErrorInfo: &cloudprovider.InstanceErrorInfo{
+			ErrorClass:   cloudprovider.OutOfResourcesErrorClass,
+			ErrorCode:    replicasNotRealizedErrorCode,
+			ErrorMessage: "1 of 2 replicas not realized after 15m0s",
+		},
+	}, instances[1].Status)
+	assert.Equal(t, cloudprovider.InstanceRunning, instances[0].Status.State)
+
+	md.Annotations[ReplicaDivergenceTimeoutAnnotation] = "1h"
+	instances, err = ng.Nodes()
+	assert.NoError(t, err)
+	assert.Nil(t, instances[1].Status.ErrorInfo)
+
+	md.Annotations[ReplicaDivergenceTimeoutAnnotation] = "0"
+	ng.divergedSince = time.Now().Add(-24 * time.Hour)
+	instances, err = ng.Nodes()
+	assert.NoError(t, err)
+	assert.Nil(t, instances[1].Status.ErrorInfo)
+
+	// the tracking ends once the status catches up
+	md.Status.Replicas = 2
+	_, err = ng.Nodes()
+	assert.NoError(t, err)
+	assert.True(t, ng.divergedSince.IsZero())
+}
+
+func TestReplicaDivergenceTimeout(t *testing.T) {
+	md := buildTestMachineDeployment("md", 1, 0, 5)
+	assert.Equal(t, 10*time.Minute, replicaDivergenceTimeout(md, 10*time.Minute))
+
+	md.Annotations[ReplicaDivergenceTimeoutAnnotation] = "30m"
+	assert.Equal(t, 30*time.Minute, replicaDivergenceTimeout(md, 10*time.Minute))
+
+	md.Annotations[ReplicaDivergenceTimeoutAnnotation] = "-1m"
+	assert.Equal(t, 10*time.Minute, replicaDivergenceTimeout(md, 10*time.Minute))
+}
+
+func TestMachinePoolNodeGroup(t *testing.T) {
+	n1 := buildTestNode("n1")
+	n2 := buildTestNode("n2")
+	mp := buildTestMachinePool("mp", 3, 1, 5, n1, n2)
+	mp.Spec.ProviderIDList = append(mp.Spec.ProviderIDList, "pending")
+	other := buildTestNode("other")
+
+	manager := newTestMachineManager(t)
+	manager.On("NodesForMachinePool", mp).Return([]*apiv1.Node{n1, n2})
+	manager.On("MachinePoolForNode", n1).Return(mp)
+	manager.On("MachinePoolForNode", other).Return((*exp.MachinePool)(nil))
+	manager.On("SetMachinePoolSize", mp, 4).Return(true, nil)
+	manager.On("DeleteMachinePoolNodes", mp, []*apiv1.Node{n1}, 3).Return(true, nil)
+	manager.On("AllMachinePools").Return([]*exp.MachinePool{mp})
+	ng := NewClusterapiMachinePoolNodeGroup(manager, mp, nil)
+
+	assert.Equal(t, "kube-system/mp", ng.Id())
+	assert.True(t, ng.Exist())
+	instances, err := ng.Nodes()
+	assert.NoError(t, err)
+	assert.Equal(t, []cloudprovider.Instance{
+		{Id: "n1", Status: &cloudprovider.InstanceStatus{State: cloudprovider.InstanceRunning}},
+		{Id: "n2", Status: &cloudprovider.InstanceStatus{State: cloudprovider.InstanceRunning}},
+		{Id: "pending", Status: &cloudprovider.InstanceStatus{State: cloudprovider.InstanceCreating}},
+	}, instances)
+
+	assert.Equal(t, 1, ng.Pending())
+
+	assert.NoError(t, ng.IncreaseSize(1))
+	// the deletion starts from the size the node group was increased to
+	assert.NoError(t, ng.DeleteNodes([]*apiv1.Node{n1}))
+	assert.EqualError(t, ng.DeleteNodes([]*apiv1.Node{other}), "nodes other do not belong to node group kube-system/mp")
+
+	manager.AssertExpectations(t)
+}
+
+func TestDeleteNodes(t *testing.T) {
+	md := buildTestMachineDeployment("md", 3, 1, 5)
+	other := buildTestMachineDeployment("other", 1, 0, 5)
+	ms := buildTestMachineSet(md, "ms", 3)
+	n1 := buildTestNode("n1")
+	m1 := buildTestMachine(ms, "m1", n1)
+	n2 := buildTestNode("n2")
+	m2 := buildTestMachine(ms, "m2", n2)
+	foreign := buildTestNode("foreign")
+	mf := buildTestMachine(buildTestMachineSet(other, "other-ms", 1), "mf", foreign)
+
+	manager := newTestMachineManager(t)
+	manager.On("FailureDomain", mock.AnythingOfType("*v1alpha1.Machine")).Return("")
+	manager.On("DeploymentForNode", n1).Return(md)
+	manager.On("DeploymentForNode", n2).Return(md)
+	manager.On("DeploymentForNode", foreign).Return(other)
+	manager.On("MachinesByProviderID").Return(machinesByProviderID(m1, m2, mf), nil)
+	manager.On("MachinesForDeployment", md).Return([]*v1alpha1.Machine{m1, m2})
+	manager.On("MarkMachineForDeletion", m1).Return(nil)
+	manager.On("MarkMachineForDeletion", m2).Return(nil)
+	manager.On("SetDeploymentSize", md, 1).Return(true, nil)
+	ng := NewClusterapiNodeGroup(manager, md, nil)
+
+	err := ng.DeleteNodes([]*apiv1.Node{n1, foreign})
+	assert.EqualError(t, err, "nodes foreign do not belong to node group kube-system/md")
+	manager.AssertNotCalled(t, "MarkMachineForDeletion", m1)
+
+	assert.NoError(t, ng.DeleteNodes([]*apiv1.Node{n1, n2}))
+	manager.AssertExpectations(t)
+}
+
+func TestDeleteNodesStrategy(t *testing.T) {
+	for _, strategy := range []common.MachineDeploymentStrategyType{"", common.RollingUpdateMachineDeploymentStrategyType, onDeleteStrategyType} {
+		md := buildTestMachineDeployment("md", 2, 0, 5)
+		if strategy != "" {
+			md.Spec.Strategy = &v1alpha1.MachineDeploymentStrategy{Type: strategy}
+		}
+		ms := buildTestMachineSet(md, "ms", 2)
+		n1 := buildTestNode("n1")
+		m1 := buildTestMachine(ms, "m1", n1)
+
+		var calls []string
+		manager := newTestMachineManager(t)
+		manager.On("DeploymentForNode", n1).Return(md)
+		manager.On("MachinesByProviderID").Return(machinesByProviderID(m1), nil)
+		manager.On("MachinesForDeployment", md).Return([]*v1alpha1.Machine{m1})
+		manager.On("MarkMachineForDeletion", m1).Return(nil)
+		manager.On("SetDeploymentSize", md, 1).Return(true, nil).Run(func(mock.Arguments) { calls = append(calls, "SetDeploymentSize") })
+		manager.On("DeleteMachine", m1).Return(nil).Run(func(mock.Arguments) { calls = append(calls, "DeleteMachine") })
+		ng := NewClusterapiNodeGroup(manager, md, nil)
+
+		assert.NoError(t, ng.DeleteNodes([]*apiv1.Node{n1}), string(strategy))
+		if strategy == onDeleteStrategyType {
+			// the machine is only deleted once the replica count is lowered
+			assert.Equal(t, []string{"SetDeploymentSize", "DeleteMachine"}, calls)
+		} else {
+			assert.Equal(t, []string{"SetDeploymentSize"}, calls, string(strategy))
+			manager.AssertNotCalled(t, "DeleteMachine", m1)
+		}
+		manager.AssertCalled(t, "MarkMachineForDeletion", m1)
+	}
+}
+
+func TestDeleteNodesUnregistered(t *testing.T) {
+	md := buildTestMachineDeployment("md", 3, 0, 5)
+	ms := buildTestMachineSet(md, "ms", 3)
+	n1 := buildTestNode("n1")
+	m1 := buildTestMachine(ms, "m1", n1)
+	pending := buildTestMachine(ms, "pending", nil)
+	provisioning := buildTestMachine(ms, "provisioning", nil)
+	providerID := "openstack:///provisioning"
+	provisioning.Spec.ProviderID = &providerID
+	// the autoscaler's stand-ins for the unregistered nodes are named like the instance ids
+	standIn := func(id string) *apiv1.Node {
+		return &apiv1.Node{ObjectMeta: v1.ObjectMeta{Name: id}, Spec: apiv1.NodeSpec{ProviderID: id}}
+	}
+	pendingNode := standIn("clusterapi://kube-system/pending")
+	provisioningNode := standIn(providerID)
+
+	manager := newTestMachineManager(t)
+	manager.On("FailureDomain", mock.AnythingOfType("*v1alpha1.Machine")).Return("")
+	manager.On("DeploymentForNode", pendingNode).Return(md)
+	manager.On("DeploymentForNode", provisioningNode).Return(md)
+	manager.On("MachineForNode", pendingNode).Return(pending)
+	manager.On("MachinesByProviderID").Return(machinesByProviderID(m1, provisioning), nil)
+	manager.On("MachinesForDeployment", md).Return([]*v1alpha1.Machine{m1, pending, provisioning})
+	manager.On("MarkMachineForDeletion", pending).Return(nil)
+	manager.On("MarkMachineForDeletion", provisioning).Return(nil)
+	manager.On("SetDeploymentSize", md, 1).Return(true, nil)
+
+	ng := NewClusterapiNodeGroup(manager, md, nil)
+	err := ng.DeleteNodes([]*apiv1.Node{provisioningNode})
+	assert.EqualError(t, err, "machine provisioning of node openstack:///provisioning has not registered a node, deleting it requires delete-unregistered-machines")
+	manager.AssertNotCalled(t, "MarkMachineForDeletion", mock.Anything)
+
+	cfg, err := ReadCloudConfig(strings.NewReader("[global]\ndelete-unregistered-machines = true\n"))
+	assert.NoError(t, err)
+	ng = NewClusterapiNodeGroup(manager, md, cfg)
+	assert.NoError(t, ng.DeleteNodes([]*apiv1.Node{pendingNode, provisioningNode}))
+	manager.AssertExpectations(t)
+
+	// uncreated replicas have no machine to delete
+	assert.NoError(t, ng.DeleteNodes([]*apiv1.Node{standIn("clusterapi://kube-system/md/uncreated-0")}))
+}
+
+func TestSortForDeletion(t *testing.T) {
+	now := time.Now()
+	deletion := func(name string, age time.Duration, ready bool) machineDeletion {
+		node := buildTestNode(name)
+		test.SetNodeReadyState(node, ready, now)
+		machine := buildTestMachine(nil, name, node)
+		machine.CreationTimestamp = v1.NewTime(now.Add(-age))
+		return machineDeletion{machine: machine, node: node}
+	}
+	young := deletion("young", time.Hour, true)
+	old := deletion("old", 2*time.Hour, true)
+	unready := deletion("unready", 3*time.Minute, false)
+	cordoned := deletion("cordoned", 2*time.Minute, true)
+	cordoned.node.Spec.Unschedulable = true
+	failed := deletion("failed", time.Second, true)
+	failedPhase := machinePhaseFailed
+	failed.machine.Status.Phase = &failedPhase
+
+	deletions := []machineDeletion{young, cordoned, old, failed, unready}
+	sortForDeletion(deletions)
+	names := make([]string, len(deletions))
+	for i, d := range deletions {
+		names[i] = d.machine.Name
+	}
+	assert.Equal(t, []string{"unready", "cordoned", "failed", "old", "young"}, names)
+
+	cheap := deletion("cheap", time.Minute, true)
+	cheap.machine.Annotations = map[string]string{DeletionCostAnnotation: "-10"}
+	expensive := deletion("expensive", 3*time.Hour, false)
+	expensive.machine.Annotations = map[string]string{DeletionCostAnnotation: "100"}
+	invalid := deletion("invalid", 4*time.Hour, true)
+	invalid.machine.Annotations = map[string]string{DeletionCostAnnotation: "cheap"}
+
+	deletions = []machineDeletion{expensive, young, cheap, invalid, unready}
+	sortForDeletion(deletions)
+	names = make([]string, len(deletions))
+	for i, d := range deletions {
+		names[i] = d.machine.Name
+	}
+	assert.Equal(t, []string{"cheap", "unready", "invalid", "young", "expensive"}, names)
+}
+
+func TestDeleteNodesFailureDomains(t *testing.T) {
+	md := buildTestMachineDeployment("md", 6, 0, 10)
+	ms := buildTestMachineSet(md, "ms", 6)
+	now := time.Now()
+	manager := newTestMachineManager(t)
+	nodes := make(map[string]*apiv1.Node)
+	machines := make([]*v1alpha1.Machine, 0)
+	for i, zone := range []string{"az-1", "az-1", "az-1", "az-2", "az-2", "az-3"} {
+		name := fmt.Sprintf("n%d", i+1)
+		node := buildTestNode(name)
+		machine := buildTestMachine(ms, fmt.Sprintf("m%d", i+1), node)
+		machine.CreationTimestamp = v1.NewTime(now.Add(-time.Duration(i) * time.Minute))
+		nodes[name] = node
+		machines = append(machines, machine)
+		manager.On("DeploymentForNode", node).Return(md)
+		manager.On("FailureDomain", machine).Return(zone)
+		manager.On("MarkMachineForDeletion", machine).Return(nil)
+	}
+	manager.On("MachinesByProviderID").Return(machinesByProviderID(machines...), nil)
+	manager.On("MachinesForDeployment", md).Return(machines)
+	manager.On("SetDeploymentSize", md, 2).Return(true, nil)
+	ng := NewClusterapiNodeGroup(manager, md, nil)
+
+	// by age alone, m4 and m5 of az-2 would go first and leave az-1 with the most machines
+	assert.NoError(t, ng.DeleteNodes([]*apiv1.Node{nodes["n1"], nodes["n2"], nodes["n4"], nodes["n5"]}))
+	marked := make([]string, 0)
+	for _, call := range manager.Calls {
+		if call.Method == "MarkMachineForDeletion" {
+			marked = append(marked, call.Arguments.Get(0).(*v1alpha1.Machine).Name)
+		}
+	}
+	assert.Equal(t, []string{"m2", "m5", "m1", "m4"}, marked)
+}
+
+func TestDeleteNodesPDBAware(t *testing.T) {
+	md := buildTestMachineDeployment("md", 3, 0, 10)
+	ms := buildTestMachineSet(md, "ms", 3)
+	now := time.Now()
+	manager := newTestMachineManager(t)
+	nodes := make([]*apiv1.Node, 0)
+	machines := make([]*v1alpha1.Machine, 0)
+	for i := 0; i < 3; i++ {
+		node := buildTestNode(fmt.Sprintf("n%d", i+1))
+		machine := buildTestMachine(ms, fmt.Sprintf("m%d", i+1), node)
+		machine.CreationTimestamp = v1.NewTime(now.Add(-time.Duration(i) * time.Minute))
+		nodes = append(nodes, node)
+		machines = append(machines, machine)
+		manager.On("DeploymentForNode", node).Return(md)
+		manager.On("MarkMachineForDeletion", machine).Return(nil)
+	}
+	manager.On("FailureDomain", mock.AnythingOfType("*v1alpha1.Machine")).Return("")
+	manager.On("MachinesByProviderID").Return(machinesByProviderID(machines...), nil)
+	manager.On("MachinesForDeployment", md).Return(machines)
+	manager.On("SetDeploymentSize", md, 0).Return(true, nil)
+	manager.On("DisruptionBudgetedPods", nodes).Return(map[string]int{"n1": 0, "n2": 2, "n3": 1}, nil)
+	cfg, err := ReadCloudConfig(strings.NewReader("[global]\npdb-aware-deletion = true\n"))
+	assert.NoError(t, err)
+	ng := NewClusterapiNodeGroup(manager, md, cfg)
+
+	// by age alone, m3 would go first
+	assert.NoError(t, ng.DeleteNodes(nodes))
+	marked := make([]string, 0)
+	for _, call := range manager.Calls {
+		if call.Method == "MarkMachineForDeletion" {
+			marked = append(marked, call.Arguments.Get(0).(*v1alpha1.Machine).Name)
+		}
+	}
+	assert.Equal(t, []string{"m1", "m3", "m2"}, marked)
+}
+
+func TestDeleteNodesOfOtherGroups(t *testing.T) {
+	md := buildTestMachineDeployment("md", 5, 1, 10)
+	other := buildTestMachineDeployment("other", 1, 0, 5)
+	ms := buildTestMachineSet(md, "ms", 3)
+	n1 := buildTestNode("n1")
+	m1 := buildTestMachine(ms, "m1", n1)
+	foreign1 := buildTestNode("foreign1")
+	mf1 := buildTestMachine(buildTestMachineSet(other, "other-ms", 1), "mf1", foreign1)
+	foreign2 := buildTestNode("foreign2")
+	mf2 := buildTestMachine(nil, "mf2", foreign2)
+	// a machine found by a colliding providerID that refers to another node
+	collision := buildTestNode("collision")
+	m2 := buildTestMachine(ms, "m2", buildTestNode("n2"))
+	m2.Spec.ProviderID = &collision.Spec.ProviderID
+
+	manager := newTestMachineManager(t)
+	manager.On("DeploymentForNode", n1).Return(md)
+	manager.On("DeploymentForNode", foreign1).Return(other)
+	manager.On("DeploymentForNode", foreign2).Return((*v1alpha1.MachineDeployment)(nil))
+	manager.On("DeploymentForNode", collision).Return(md)
+	manager.On("MachinesByProviderID").Return(machinesByProviderID(m1, mf1, mf2, m2), nil)
+	manager.On("MachinesForDeployment", md).Return([]*v1alpha1.Machine{m1, m2})
+	ng := NewClusterapiNodeGroup(manager, md, nil)
+
+	err := ng.DeleteNodes([]*apiv1.Node{n1, foreign1, collision, foreign2})
+	assert.EqualError(t, err, "nodes foreign1, collision, foreign2 do not belong to node group kube-system/md")
+	manager.AssertNotCalled(t, "MarkMachineForDeletion", mock.Anything)
+	manager.AssertNotCalled(t, "SetDeploymentSize", mock.Anything, mock.Anything)
+}
+
+func TestScaleCooldown(t *testing.T) {
+	md := buildTestMachineDeployment("md", 3, 0, 10)
+	md.Annotations[ScaleCooldownAnnotation] = "10m"
+	n := buildTestNode("n")
+	m := buildTestMachine(buildTestMachineSet(md, "ms", 3), "m", n)
+
+	manager := newTestMachineManager(t)
+	manager.On("SetDeploymentSize", md, 4).Return(true, nil)
+	manager.On("DeploymentForNode", n).Return(md)
+	manager.On("MachinesByProviderID").Return(machinesByProviderID(m), nil)
+	manager.On("MachinesForDeployment", md).Return([]*v1alpha1.Machine{m})
+	ng := NewClusterapiNodeGroup(manager, md, nil)
+
+	assert.NoError(t, ng.IncreaseSize(1))
+	assert.EqualError(t, ng.IncreaseSize(1), "scale cooldown in progress for node group kube-system/md, 10m0s remaining")
+	assert.EqualError(t, ng.DeleteNodes([]*apiv1.Node{n}), "scale cooldown in progress for node group kube-system/md, 10m0s remaining")
+
+	ng.lastScaleAction = time.Now().Add(-11 * time.Minute)
+	manager.On("MarkMachineForDeletion", m).Return(nil)
+	// the deletion starts from the size the node group was increased to
+	manager.On("SetDeploymentSize", md, 3).Return(true, nil)
+	assert.NoError(t, ng.DeleteNodes([]*apiv1.Node{n}))
+	assert.WithinDuration(t, time.Now(), ng.lastScaleAction, time.Second)
+
+	// without the annotation there is no cooldown
+	delete(md.Annotations, ScaleCooldownAnnotation)
+	assert.NoError(t, ng.IncreaseSize(1))
+}
+
+func TestObserveOnlyNamespace(t *testing.T) {
+	md := buildTestMachineDeployment("md", 3, 0, 10)
+	n := buildTestNode("n")
+	cfg, err := ReadCloudConfig(strings.NewReader("[global]\nnamespace = kube-system\nnamespace = tenant-a\nobserve-only-namespace = kube-system\n"))
+	assert.NoError(t, err)
+
+	manager := newTestMachineManager(t)
+	ng := NewClusterapiNodeGroup(manager, md, cfg)
+	size, err := ng.TargetSize()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, size)
+	expected := "namespace kube-system is observe-only, node group kube-system/md is not scaled"
+	assert.EqualError(t, ng.IncreaseSize(1), expected)
+	assert.EqualError(t, ng.DecreaseTargetSize(-1), expected)
+	assert.EqualError(t, ng.DeleteNodes([]*apiv1.Node{n}), expected)
+	manager.AssertNotCalled(t, "SetDeploymentSize", mock.Anything, mock.Anything)
+
+	// the node groups of other namespaces are scaled
+	other := buildTestMachineDeployment("md", 3, 0, 10)
+	other.Namespace = "tenant-a"
+	manager.On("SetDeploymentSize", other, 4).Return(true, nil)
+	assert.NoError(t, NewClusterapiNodeGroup(manager, other, cfg).IncreaseSize(1))
+}
+
+func TestScaleDownDisabled(t *testing.T) {
+	md := buildTestMachineDeployment("md", 3, 0, 10)
+	md.Annotations[ScaleDownAnnotation] = ScaleDownDisabled
+	md.Annotations[ScaleDownUnneededTimeAnnotation] = "1m"
+	n := buildTestNode("n")
+	m := buildTestMachine(buildTestMachineSet(md, "ms", 3), "m", n)
+
+	manager := newTestMachineManager(t)
+	manager.On("SetDeploymentSize", md, 4).Return(true, nil)
+	manager.On("DeploymentForNode", n).Return(md)
+	manager.On("MachinesByProviderID").Return(machinesByProviderID(m), nil)
+	manager.On("MachinesForDeployment", md).Return([]*v1alpha1.Machine{m})
+	ng := NewClusterapiNodeGroup(manager, md, nil)
+
+	// no machine is ever marked for deletion
+	expected := "scale down of node group kube-system/md is disabled"
+	assert.EqualError(t, ng.DeleteNodes([]*apiv1.Node{n}), expected)
+	assert.EqualError(t, ng.DecreaseTargetSize(-1), expected)
+	assert.NoError(t, ng.IncreaseSize(1))
+	manager.AssertNotCalled(t, "MarkMachineForDeletion", mock.Anything)
+	manager.AssertNotCalled(t, "SetDeploymentSize", md, 2)
+
+	options, err := ng.GetOptions(config.NodeGroupAutoscalingOptions{ScaleDownUtilizationThreshold: 0.5, ScaleDownUnneededTime: time.Minute})
+	assert.NoError(t, err)
+	assert.Equal(t, &config.NodeGroupAutoscalingOptions{
+		ScaleDownUnneededTime: scaleDownDisabledTime,
+		ScaleDownUnreadyTime:  scaleDownDisabledTime,
+	}, options)
+
+	for val, disabled := range map[string]bool{"disabled": true, "enabled": false, "off": false} {
+		md.Annotations[ScaleDownAnnotation] = val
+		assert.Equal(t, disabled, scaleDownDisabled(md), val)
+	}
+}
+
+func TestMaxScaleUpStep(t *testing.T) {
+	md := buildTestMachineDeployment("md", 3, 0, 10)
+	md.Annotations[MaxScaleUpStepAnnotation] = "2"
+
+	manager := newTestMachineManager(t)
+	manager.On("SetDeploymentSize", md, 5).Return(true, nil)
+	manager.On("SetDeploymentSize", md, 6).Return(true, nil)
+	manager.On("SetDeploymentSize", md, 10).Return(true, nil)
+	ng := NewClusterapiNodeGroup(manager, md, nil)
+
+	assert.NoError(t, ng.IncreaseSize(5))
+	assert.NoError(t, ng.IncreaseSize(1))
+	// the max size still applies to the full increase
+	assert.IsType(t, &SizeBoundError{}, ng.IncreaseSize(8))
+
+	for _, val := range []string{"0", "-1", "two"} {
+		md.Annotations[MaxScaleUpStepAnnotation] = val
+		assert.Equal(t, 0, maxScaleUpStep(md), val)
+	}
+	delete(md.Annotations, MaxScaleUpStepAnnotation)
+	assert.NoError(t, ng.IncreaseSize(4))
+	manager.AssertExpectations(t)
+}
+
+func TestScaleEvents(t *testing.T) {
+	md := buildTestMachineDeployment("md", 3, 0, 10)
+	n := buildTestNode("n")
+	m := buildTestMachine(buildTestMachineSet(md, "ms", 3), "m", n)
+
+	manager := newTestMachineManager(t)
+	manager.On("SetDeploymentSize", md, 5).Return(true, nil)
+	manager.On("SetDeploymentSize", md, 4).Return(true, nil)
+	manager.On("SetDeploymentSize", md, 2).Return(true, nil)
+	manager.On("NodesForDeployment", md).Return([]*apiv1.Node{n})
+	manager.On("DeploymentForNode", n).Return(md)
+	manager.On("MachinesByProviderID").Return(machinesByProviderID(m), nil)
+	manager.On("MachinesForDeployment", md).Return([]*v1alpha1.Machine{m})
+	manager.On("MarkMachineForDeletion", m).Return(nil)
+	recorder := record.NewFakeRecorder(10)
+	ng := NewClusterapiNodeGroup(manager, md, nil)
+	ng.eventRecorder = recorder
+
+	assert.NoError(t, ng.IncreaseSize(2))
+	assert.NoError(t, ng.DeleteNodes([]*apiv1.Node{n}))
+	assert.NoError(t, ng.DecreaseTargetSize(-2))
+	assert.Equal(t, "Normal ScaledUp Scaled up from 3 to 5 replicas", <-recorder.Events)
+	assert.Equal(t, "Normal ScaledDown Scaled down from 5 to 4 replicas", <-recorder.Events)
+	assert.Equal(t, "Normal ScaledDown Decreased target size from 4 to 2 replicas", <-recorder.Events)
+
+	// failed scale actions are not recorded
+	_ = ng.IncreaseSize(9)
+	assert.Empty(t, recorder.Events)
+}
+
+func TestDeleteNodesScaleDownDisabled(t *testing.T) {
+	md := buildTestMachineDeployment("md", 3, 1, 5)
+	ms := buildTestMachineSet(md, "ms", 3)
+	n1 := buildTestNode("n1")
+	m1 := buildTestMachine(ms, "m1", n1)
+	n2 := buildTestNode("n2")
+	m2 := buildTestMachine(ms, "m2", n2)
+	m2.Annotations = map[string]string{ScaleDownDisabledAnnotation: "true"}
+
+	manager := newTestMachineManager(t)
+	manager.On("DeploymentForNode", n1).Return(md)
+	manager.On("DeploymentForNode", n2).Return(md)
+	manager.On("MachinesByProviderID").Return(machinesByProviderID(m1, m2), nil)
+	manager.On("MachinesForDeployment", md).Return([]*v1alpha1.Machine{m1, m2})
+	ng := NewClusterapiNodeGroup(manager, md, nil)
+
+	err := ng.DeleteNodes([]*apiv1.Node{n1, n2})
+	assert.EqualError(t, err, "machine m2 of node n2 has scale down disabled")
+	manager.AssertNotCalled(t, "MarkMachineForDeletion", m1)
+	manager.AssertNotCalled(t, "SetDeploymentSize", md, 1)
+}
+
+func TestDeleteNodesCordoned(t *testing.T) {
+	md := buildTestMachineDeployment("md", 3, 1, 5)
+	ms := buildTestMachineSet(md, "ms", 3)
+	n1 := buildTestNode("n1")
+	m1 := buildTestMachine(ms, "m1", n1)
+	n2 := buildTestNode("n2")
+	n2.Spec.Unschedulable = true
+	m2 := buildTestMachine(ms, "m2", n2)
+
+	cfg, err := ReadCloudConfig(strings.NewReader("[global]\nprotect-cordoned-nodes = true\n"))
+	assert.NoError(t, err)
+	manager := newTestMachineManager(t)
+	manager.On("FailureDomain", mock.AnythingOfType("*v1alpha1.Machine")).Return("")
+	manager.On("DeploymentForNode", n1).Return(md)
+	manager.On("DeploymentForNode", n2).Return(md)
+	manager.On("MachinesByProviderID").Return(machinesByProviderID(m1, m2), nil)
+	manager.On("MachinesForDeployment", md).Return([]*v1alpha1.Machine{m1, m2})
+	manager.On("MarkMachineForDeletion", m1).Return(nil)
+	manager.On("MarkMachineForDeletion", m2).Return(nil)
+	manager.On("SetDeploymentSize", md, 1).Return(true, nil)
+	ng := NewClusterapiNodeGroup(manager, md, cfg)
+
+	err = ng.DeleteNodes([]*apiv1.Node{n1, n2})
+	assert.EqualError(t, err, "node n2 is cordoned externally and protected from scale down")
+	manager.AssertNotCalled(t, "MarkMachineForDeletion", m1)
+
+	// nodes cordoned by the autoscaler itself are not protected
+	n2.Spec.Taints = append(n2.Spec.Taints, apiv1.Taint{Key: deletetaint.ToBeDeletedTaint, Effect: apiv1.TaintEffectNoSchedule})
+	assert.NoError(t, ng.DeleteNodes([]*apiv1.Node{n1, n2}))
+
+	// without the option, cordoned nodes are deleted like any other
+	n2.Spec.Taints = nil
+	ng = NewClusterapiNodeGroup(manager, md, nil)
+	assert.NoError(t, ng.DeleteNodes([]*apiv1.Node{n1, n2}))
+}
+
+func TestDeleteNodesMinNodeLifetime(t *testing.T) {
+	md := buildTestMachineDeployment("md", 3, 1, 5)
+	md.Annotations[MinNodeLifetimeAnnotation] = "30m"
+	ms := buildTestMachineSet(md, "ms", 3)
+	n1 := buildTestNode("n1")
+	m1 := buildTestMachine(ms, "m1", n1)
+	m1.CreationTimestamp = v1.NewTime(time.Now().Add(-time.Hour))
+	n2 := buildTestNode("n2")
+	m2 := buildTestMachine(ms, "m2", n2)
+	m2.CreationTimestamp = v1.NewTime(time.Now().Add(-10 * time.Minute))
+
+	manager := newTestMachineManager(t)
+	manager.On("DeploymentForNode", n1).Return(md)
+	manager.On("DeploymentForNode", n2).Return(md)
+	manager.On("MachinesByProviderID").Return(machinesByProviderID(m1, m2), nil)
+	manager.On("MachinesForDeployment", md).Return([]*v1alpha1.Machine{m1, m2})
+	manager.On("MarkMachineForDeletion", m1).Return(nil)
+	manager.On("SetDeploymentSize", md, 2).Return(true, nil)
+	ng := NewClusterapiNodeGroup(manager, md, nil)
+
+	err := ng.DeleteNodes([]*apiv1.Node{n1, n2})
+	assert.EqualError(t, err, "machine m2 of node n2 is 10m0s old, younger than the min node lifetime of 30m0s")
+	manager.AssertNotCalled(t, "MarkMachineForDeletion", m1)
+
+	assert.NoError(t, ng.DeleteNodes([]*apiv1.Node{n1}))
+	manager.AssertExpectations(t)
+
+	md.Annotations[MinNodeLifetimeAnnotation] = "soon"
+	assert.Equal(t, time.Duration(0), minNodeLifetime(md))
+}
+
+func TestDeleteNodesBelowMinSize(t *testing.T) {
+	md := buildTestMachineDeployment("md", 2, 1, 5)
+	ms := buildTestMachineSet(md, "ms", 2)
+	n1 := buildTestNode("n1")
+	m1 := buildTestMachine(ms, "m1", n1)
+	n2 := buildTestNode("n2")
+	m2 := buildTestMachine(ms, "m2", n2)
+
+	manager := newTestMachineManager(t)
+	manager.On("DeploymentForNode", n1).Return(md)
+	manager.On("DeploymentForNode", n2).Return(md)
+	manager.On("MachinesByProviderID").Return(machinesByProviderID(m1, m2), nil)
+	manager.On("MachinesForDeployment", md).Return([]*v1alpha1.Machine{m1, m2})
+	ng := NewClusterapiNodeGroup(manager, md, nil)
+
+	err := ng.DeleteNodes([]*apiv1.Node{n1, n2})
+	assert.Equal(t, &SizeBoundError{NodeGroup: "kube-system/md", Current: 2, Delta: -2, Min: 1, Max: 5}, err)
+	assert.EqualError(t, err, "ClusterapiNodeGroup size decrease too large - group:kube-system/md current:2 delta:-2 desired:0 min:1 max:5")
+	manager.AssertNotCalled(t, "MarkMachineForDeletion", mock.Anything)
+	manager.AssertNotCalled(t, "SetDeploymentSize", md, 0)
+}
+
+func TestDeleteNodesAboveMaxBatch(t *testing.T) {
+	md := buildTestMachineDeployment("md", 3, 0, 5)
+	ms := buildTestMachineSet(md, "ms", 3)
+	n1 := buildTestNode("n1")
+	m1 := buildTestMachine(ms, "m1", n1)
+	n2 := buildTestNode("n2")
+	m2 := buildTestMachine(ms, "m2", n2)
+
+	cfg, err := ReadCloudConfig(strings.NewReader("[global]\nmax-delete-batch = 1\n"))
+	assert.NoError(t, err)
+	manager := newTestMachineManager(t)
+	manager.On("MachinesByProviderID").Return(machinesByProviderID(m1, m2), nil)
+	manager.On("MachinesForDeployment", md).Return([]*v1alpha1.Machine{m1, m2})
+	ng := NewClusterapiNodeGroup(manager, md, cfg)
+
+	err = ng.DeleteNodes([]*apiv1.Node{n1, n2})
+	assert.EqualError(t, err, "deleting 2 nodes of node group kube-system/md at once exceeds max-delete-batch of 1")
+	manager.AssertNotCalled(t, "MarkMachineForDeletion", mock.Anything)
+	manager.AssertNotCalled(t, "SetDeploymentSize", md, mock.Anything)
+}
+
+func TestDeleteNodesAlreadyDeleted(t *testing.T) {
+	md := buildTestMachineDeployment("md", 3, 1, 5)
+	ms := buildTestMachineSet(md, "ms", 3)
+	gone := buildTestNode("gone")
+	n1 := buildTestNode("n1")
+	m1 := buildTestMachine(ms, "m1", n1)
+	now := v1.Now()
+	m1.DeletionTimestamp = &now
+	n2 := buildTestNode("n2")
+	m2 := buildTestMachine(ms, "m2", n2)
+
+	manager := newTestMachineManager(t)
+	manager.On("DeploymentForNode", n2).Return(md)
+	manager.On("MachinesByProviderID").Return(machinesByProviderID(m1, m2), nil)
+	manager.On("MachinesForDeployment", md).Return([]*v1alpha1.Machine{m1, m2})
+	manager.On("MarkMachineForDeletion", m2).Return(nil)
+	manager.On("SetDeploymentSize", md, 2).Return(true, nil)
+	ng := NewClusterapiNodeGroup(manager, md, nil)
+
+	assert.NoError(t, ng.DeleteNodes([]*apiv1.Node{gone, n1, n2}))
+	manager.AssertNumberOfCalls(t, "MarkMachineForDeletion", 1)
+
+	// retries of completed deletions are no-ops
+	assert.NoError(t, ng.DeleteNodes([]*apiv1.Node{gone, n1}))
+	manager.AssertNumberOfCalls(t, "SetDeploymentSize", 1)
+}
+
+func TestTargetSizeWithoutDeletions(t *testing.T) {
+	annotated := func(machine *v1alpha1.Machine) *v1alpha1.Machine {
+		machine.Annotations = map[string]string{DeleteMachineAnnotation: "2020-01-01T00:00:00Z"}
+		return machine
+	}
+	deleting := func(machine *v1alpha1.Machine) *v1alpha1.Machine {
+		now := v1.Now()
+		machine.DeletionTimestamp = &now
+		return machine
+	}
+
+	for _, tc := range []struct {
+		description string
+		replicas    int
+		machines    []*v1alpha1.Machine
+		expected    int
+	}{
+		{"no deletions", 3, []*v1alpha1.Machine{buildTestMachine(nil, "m1", nil), buildTestMachine(nil, "m2", nil)}, 3},
+		{"annotated, replicas not lowered yet", 3, []*v1alpha1.Machine{
+			annotated(buildTestMachine(nil, "m1", nil)), buildTestMachine(nil, "m2", nil), buildTestMachine(nil, "m3", nil)}, 2},
+		{"annotated, replicas lowered", 2, []*v1alpha1.Machine{
+			annotated(buildTestMachine(nil, "m1", nil)), buildTestMachine(nil, "m2", nil), buildTestMachine(nil, "m3", nil)}, 2},
+		{"annotated and being deleted", 2, []*v1alpha1.Machine{
+			deleting(annotated(buildTestMachine(nil, "m1", nil))), buildTestMachine(nil, "m2", nil), buildTestMachine(nil, "m3", nil)}, 2},
+		{"annotated during a scale-up", 5, []*v1alpha1.Machine{
+			annotated(buildTestMachine(nil, "m1", nil)), buildTestMachine(nil, "m2", nil)}, 4},
+	} {
+		md := buildTestMachineDeployment("md", tc.replicas, 0, 10)
+		manager := newTestMachineManager(t)
+		manager.On("MachinesForDeployment", md).Return(tc.machines)
+		ng := NewClusterapiNodeGroup(manager, md, nil)
+
+		size, err := ng.TargetSize()
+		assert.NoError(t, err, tc.description)
+		assert.Equal(t, tc.replicas, size, tc.description)
+		assert.Equal(t, tc.expected, ng.TargetSizeWithoutDeletions(), tc.description)
+	}
+}
+
+func TestDeleteNodesBeforeReplicasSettled(t *testing.T) {
+	md := buildTestMachineDeployment("md", 3, 0, 5)
+	ms := buildTestMachineSet(md, "ms", 3)
+	n1 := buildTestNode("n1")
+	m1 := buildTestMachine(ms, "m1", n1)
+	// an earlier scale-down annotated m1, but its replica update didn't land
+	m1.Annotations = map[string]string{DeleteMachineAnnotation: "2020-01-01T00:00:00Z"}
+	n2 := buildTestNode("n2")
+	m2 := buildTestMachine(ms, "m2", n2)
+	n3 := buildTestNode("n3")
+	m3 := buildTestMachine(ms, "m3", n3)
+
+	manager := newTestMachineManager(t)
+	manager.On("DeploymentForNode", n1).Return(md)
+	manager.On("DeploymentForNode", n2).Return(md)
+	manager.On("MachinesByProviderID").Return(machinesByProviderID(m1, m2, m3), nil)
+	manager.On("MachinesForDeployment", md).Return([]*v1alpha1.Machine{m1, m2, m3})
+	manager.On("MarkMachineForDeletion", mock.Anything).Return(nil)
+	manager.On("SetDeploymentSize", md, 1).Return(true, nil).Once()
+	manager.On("SetDeploymentSize", md, 2).Return(true, nil).Once()
+
+	// both m1 and m2 are removed
+	assert.NoError(t, NewClusterapiNodeGroup(manager, md, nil).DeleteNodes([]*apiv1.Node{n2}))
+	// a retry for m1 removes only m1
+	assert.NoError(t, NewClusterapiNodeGroup(manager, md, nil).DeleteNodes([]*apiv1.Node{n1}))
+	manager.AssertExpectations(t)
+}
+
+func TestDeleteNodesMarkError(t *testing.T) {
+	md := buildTestMachineDeployment("md", 3, 0, 5)
+	ms := buildTestMachineSet(md, "ms", 3)
+	n1 := buildTestNode("n1")
+	m1 := buildTestMachine(ms, "m1", n1)
+	n2 := buildTestNode("n2")
+	m2 := buildTestMachine(ms, "m2", n2)
+	n3 := buildTestNode("n3")
+	m3 := buildTestMachine(ms, "m3", n3)
+
+	manager := newTestMachineManager(t)
+	manager.On("FailureDomain", mock.AnythingOfType("*v1alpha1.Machine")).Return("")
+	for _, node := range []*apiv1.Node{n1, n2, n3} {
+		manager.On("DeploymentForNode", node).Return(md)
+	}
+	manager.On("MachinesByProviderID").Return(machinesByProviderID(m1, m2, m3), nil)
+	manager.On("MachinesForDeployment", md).Return([]*v1alpha1.Machine{m1, m2, m3})
+	manager.On("MarkMachineForDeletion", m1).Return(nil)
+	manager.On("MarkMachineForDeletion", m2).Return(fmt.Errorf("conflict"))
+	manager.On("MarkMachineForDeletion", m3).Return(nil)
+	manager.On("SetDeploymentSize", md, 1).Return(true, nil)
+	ng := NewClusterapiNodeGroup(manager, md, nil)
+
+	// the other machines are still deleted
+	err := ng.DeleteNodes([]*apiv1.Node{n1, n2, n3})
+	assert.EqualError(t, err, "could not mark machine m2 of node n2 for deletion: conflict")
+	manager.AssertExpectations(t)
+	manager.AssertNumberOfCalls(t, "SetDeploymentSize", 1)
+
+	// the replicas aren't lowered unless a machine was marked
+	ng = NewClusterapiNodeGroup(manager, md, nil)
+	err = ng.DeleteNodes([]*apiv1.Node{n2})
+	assert.EqualError(t, err, "could not mark machine m2 of node n2 for deletion: conflict")
+	manager.AssertNumberOfCalls(t, "SetDeploymentSize", 1)
+}
+
+func TestDeleteNodesReadError(t *testing.T) {
+	md := buildTestMachineDeployment("md", 3, 1, 5)
+	n := buildTestNode("n")
+
+	manager := newTestMachineManager(t)
+	manager.On("MachinesByProviderID").Return(nil, fmt.Errorf("connection refused"))
+	ng := NewClusterapiNodeGroup(manager, md, nil)
+
+	assert.EqualError(t, ng.DeleteNodes([]*apiv1.Node{n}), "connection refused")
+	manager.AssertNotCalled(t, "SetDeploymentSize", mock.Anything, mock.Anything)
+}
+
+func TestScaleTargetMachineSet(t *testing.T) {
+	md := buildTestMachineDeployment("md", 3, 0, 10)
+	md.Annotations[ScaleTargetAnnotation] = ScaleTargetMachineSet
+	// the external controller doesn't keep the MachineDeployment's replicas in sync
+	md.Spec.Replicas = int32Ptr(1)
+	old := buildTestMachineSet(md, "old", 2)
+	old.Annotations = map[string]string{RevisionAnnotation: "1"}
+	current := buildTestMachineSet(md, "current", 1)
+	current.Annotations = map[string]string{RevisionAnnotation: "2"}
+
+	manager := newTestMachineManager(t)
+	manager.On("MachineSetsForDeployment", md).Return([]*v1alpha1.MachineSet{current, old})
+	manager.On("SetMachineSetSize", current, 3).Return(true, nil)
+	manager.On("SetMachineSetSize", current, 0).Return(true, nil)
+	manager.On("NodesForDeployment", md).Return([]*apiv1.Node(nil))
+	ng := NewClusterapiNodeGroup(manager, md, nil)
+
+	assert.Equal(t, "kube-system/md", ng.Id())
+	size, err := ng.TargetSize()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, size)
+
+	assert.NoError(t, ng.IncreaseSize(2))
+	assert.NoError(t, ng.DecreaseTargetSize(-1))
+	// the old MachineSet's replicas aren't taken away by the new one
+	assert.Error(t, ng.DecreaseTargetSize(-3))
+	manager.AssertExpectations(t)
+}
+
+func TestActiveMachineSet(t *testing.T) {
+	md := buildTestMachineDeployment("md", 3, 0, 10)
+	old := buildTestMachineSet(md, "old", 2)
+	old.Annotations = map[string]string{RevisionAnnotation: "9"}
+	current := buildTestMachineSet(md, "current", 1)
+	current.Annotations = map[string]string{RevisionAnnotation: "10"}
+	next := buildTestMachineSet(md, "next", 0)
+	next.Annotations = map[string]string{LegacyRevisionAnnotation: "11"}
+
+	assert.Nil(t, activeMachineSet(nil))
+	assert.Equal(t, current, activeMachineSet([]*v1alpha1.MachineSet{old, current}))
+	// a new MachineSet is only scaled once the rollout scaled it up
+	assert.Equal(t, current, activeMachineSet([]*v1alpha1.MachineSet{next, old, current}))
+	next.Spec.Replicas = int32Ptr(1)
+	assert.Equal(t, next, activeMachineSet([]*v1alpha1.MachineSet{next, old, current}))
+	// without replicas, the latest revision is scaled up
+	current.Spec.Replicas = int32Ptr(0)
+	next.Spec.Replicas = int32Ptr(0)
+	old.Spec.Replicas = int32Ptr(0)
+	assert.Equal(t, next, activeMachineSet([]*v1alpha1.MachineSet{next, old, current}))
+}
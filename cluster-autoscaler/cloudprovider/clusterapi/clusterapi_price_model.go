@@ -0,0 +1,165 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
+	kubeletapis "k8s.io/kubernetes/pkg/kubelet/apis"
+	"math"
+	"strconv"
+	"time"
+)
+
+const (
+	// PricePerHourAnnotation sets the hourly price of a single machine of a MachineDeployment or MachineSet
+	PricePerHourAnnotation = "autoscaler.syseleven.de/price-per-hour"
+)
+
+// ClusterapiPriceModel implements PricingModel based on price annotations on
+// MachineDeployments, falling back to configured prices per machine type.
+type ClusterapiPriceModel struct {
+	machineManager    MachineManager
+	machineTypePrices map[string]float64
+}
+
+// NewClusterapiPriceModel creates a ClusterapiPriceModel
+func NewClusterapiPriceModel(machineManager MachineManager, machineTypePrices map[string]float64) *ClusterapiPriceModel {
+	return &ClusterapiPriceModel{
+		machineManager:    machineManager,
+		machineTypePrices: machineTypePrices,
+	}
+}
+
+// NodePrice returns a price of running the given node for a given period of time.
+// Nodes whose price cannot be determined yield cloudprovider.ErrNotImplemented.
+func (model *ClusterapiPriceModel) NodePrice(node *apiv1.Node, startTime time.Time, endTime time.Time) (float64, error) {
+	pricePerHour, found := model.nodePricePerHour(node)
+	if !found {
+		return 0, cloudprovider.ErrNotImplemented
+	}
+	return pricePerHour * getHours(startTime, endTime), nil
+}
+
+// PodPrice returns a theoretical minimum price of running a pod for a given
+// period of time on a perfectly matching machine. The pod is charged the share
+// of a node's price that its requests take up of the node's capacity, using the
+// cheapest priced node group.
+func (model *ClusterapiPriceModel) PodPrice(pod *apiv1.Pod, startTime time.Time, endTime time.Time) (float64, error) {
+	requests := apiv1.ResourceList{}
+	for _, container := range pod.Spec.Containers {
+		for name, quantity := range container.Resources.Requests {
+			sum := requests[name]
+			sum.Add(quantity)
+			requests[name] = sum
+		}
+	}
+
+	objs := make([]metav1.Object, 0)
+	for _, md := range model.machineManager.AllDeployments() {
+		objs = append(objs, md)
+	}
+	for _, ms := range model.machineManager.AllMachineSets() {
+		objs = append(objs, ms)
+	}
+
+	price := math.Inf(1)
+	for _, obj := range objs {
+		node, err := buildNodeFromOpenstackProviderSpec(obj)
+		if err != nil {
+			continue
+		}
+		pricePerHour, found := model.groupPricePerHour(obj, node)
+		if !found {
+			continue
+		}
+		price = math.Min(price, pricePerHour*capacityShare(requests, node.Status.Capacity))
+	}
+
+	if math.IsInf(price, 1) {
+		return 0, cloudprovider.ErrNotImplemented
+	}
+	return price * getHours(startTime, endTime), nil
+}
+
+// nodePricePerHour looks up the hourly price of a node, first from its own price
+// annotation (set on template nodes), then from its MachineDeployment's or MachineSet's
+// annotation, and finally from the configured price of its machine type.
+func (model *ClusterapiPriceModel) nodePricePerHour(node *apiv1.Node) (float64, bool) {
+	if price, found := parsePriceAnnotation(node); found {
+		return price, true
+	}
+	var obj metav1.Object
+	if md := model.machineManager.DeploymentForNode(node); md != nil {
+		obj = md
+	} else if ms := model.machineManager.MachineSetForNode(node); ms != nil {
+		obj = ms
+	}
+	return model.groupPricePerHour(obj, node)
+}
+
+// groupPricePerHour looks up the hourly price of a node of the given MachineDeployment or
+// MachineSet, falling back to the configured price of the node's machine type.
+// obj may be nil for nodes not belonging to a node group.
+func (model *ClusterapiPriceModel) groupPricePerHour(obj metav1.Object, node *apiv1.Node) (float64, bool) {
+	if obj != nil {
+		if price, found := parsePriceAnnotation(obj); found {
+			return price, true
+		}
+	}
+	if machineType, found := node.Labels[kubeletapis.LabelInstanceType]; found {
+		if price, found := model.machineTypePrices[machineType]; found {
+			return price, true
+		}
+	}
+	return 0, false
+}
+
+func parsePriceAnnotation(obj metav1.Object) (float64, bool) {
+	val, ok := obj.GetAnnotations()[PricePerHourAnnotation]
+	if !ok || val == "" {
+		return 0, false
+	}
+	price, err := strconv.ParseFloat(val, 64)
+	if err != nil || price < 0 {
+		warningS("Invalid annotation, ignoring", append(objectKeys(obj), "annotation", PricePerHourAnnotation, "value", val)...)
+		return 0, false
+	}
+	return price, true
+}
+
+// capacityShare returns the largest fraction of capacity consumed by requests
+// over cpu and memory.
+func capacityShare(requests, capacity apiv1.ResourceList) float64 {
+	share := 0.0
+	for _, name := range []apiv1.ResourceName{apiv1.ResourceCPU, apiv1.ResourceMemory} {
+		available := capacity[name]
+		if available.IsZero() {
+			continue
+		}
+		requested := requests[name]
+		share = math.Max(share, float64(requested.MilliValue())/float64(available.MilliValue()))
+	}
+	return share
+}
+
+func getHours(startTime time.Time, endTime time.Time) float64 {
+	minutes := math.Ceil(float64(endTime.Sub(startTime)) / float64(time.Minute))
+	hours := minutes / 60.0
+	return hours
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"github.com/stretchr/testify/assert"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
+	"k8s.io/autoscaler/cluster-autoscaler/utils/test"
+	kubeletapis "k8s.io/kubernetes/pkg/kubelet/apis"
+	"sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	"testing"
+	"time"
+)
+
+func TestNodePrice(t *testing.T) {
+	md1 := buildTestMachineDeployment("md1", 1, 0, 10)
+	md1.Annotations[PricePerHourAnnotation] = "0.5"
+	md2 := buildTestMachineDeployment("md2", 1, 0, 10)
+
+	annotated := buildTestNode("annotated")
+	byType := buildTestNode("by-type")
+	byType.Labels[kubeletapis.LabelInstanceType] = "m1.small"
+	unknown := buildTestNode("unknown")
+	unknown.Labels[kubeletapis.LabelInstanceType] = "m1.unknown"
+	template := buildTestNode("template")
+	template.Annotations = map[string]string{PricePerHourAnnotation: "2"}
+
+	machineManager := newTestMachineManager(t)
+	machineManager.On("DeploymentForNode", annotated).Return(md1)
+	machineManager.On("DeploymentForNode", byType).Return(md2)
+	machineManager.On("DeploymentForNode", unknown).Return((*v1alpha1.MachineDeployment)(nil))
+	machineManager.On("MachineSetForNode", unknown).Return((*v1alpha1.MachineSet)(nil))
+
+	model := NewClusterapiPriceModel(machineManager, map[string]float64{"m1.small": 0.25})
+	now := time.Now()
+	later := now.Add(2 * time.Hour)
+
+	price, err := model.NodePrice(annotated, now, later)
+	assert.NoError(t, err)
+	assert.InDelta(t, 1.0, price, 1e-9)
+
+	price, err = model.NodePrice(byType, now, later)
+	assert.NoError(t, err)
+	assert.InDelta(t, 0.5, price, 1e-9)
+
+	price, err = model.NodePrice(template, now, later)
+	assert.NoError(t, err)
+	assert.InDelta(t, 4.0, price, 1e-9)
+
+	_, err = model.NodePrice(unknown, now, later)
+	assert.Equal(t, cloudprovider.ErrNotImplemented, err)
+}
+
+func TestPodPrice(t *testing.T) {
+	// m1.small: 2 vcpus, 8GiB
+	small := buildTestMachineDeployment("small", 1, 0, 10)
+	setTestOpenstackFlavor(small, "m1.small")
+	small.Annotations[PricePerHourAnnotation] = "1"
+	// m1.medium: 4 vcpus, 16GiB, priced via machine type
+	medium := buildTestMachineDeployment("medium", 1, 0, 10)
+	setTestOpenstackFlavor(medium, "m1.medium")
+	// unpriced
+	large := buildTestMachineDeployment("large", 1, 0, 10)
+	setTestOpenstackFlavor(large, "m1.large")
+
+	machineManager := newTestMachineManager(t)
+	machineManager.On("AllDeployments").Return([]*v1alpha1.MachineDeployment{small, medium, large})
+	machineManager.On("AllMachineSets").Return([]*v1alpha1.MachineSet{})
+
+	model := NewClusterapiPriceModel(machineManager, map[string]float64{"m1.medium": 1.2})
+	now := time.Now()
+	pod := test.BuildTestPod("pod", 1000, 0)
+
+	// a quarter of medium (0.3) is cheaper than half of small (0.5)
+	price, err := model.PodPrice(pod, now, now.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.InDelta(t, 0.3, price, 1e-9)
+}
+
+func TestPodPriceWithoutPricedGroups(t *testing.T) {
+	md := buildTestMachineDeployment("md", 1, 0, 10)
+	setTestOpenstackFlavor(md, "m1.small")
+
+	machineManager := newTestMachineManager(t)
+	machineManager.On("AllDeployments").Return([]*v1alpha1.MachineDeployment{md})
+	machineManager.On("AllMachineSets").Return([]*v1alpha1.MachineSet{})
+
+	model := NewClusterapiPriceModel(machineManager, map[string]float64{})
+	now := time.Now()
+
+	_, err := model.PodPrice(test.BuildTestPod("pod", 1000, 0), now, now.Add(time.Hour))
+	assert.Equal(t, cloudprovider.ErrNotImplemented, err)
+}
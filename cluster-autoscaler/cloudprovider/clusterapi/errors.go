@@ -0,0 +1,117 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"fmt"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/autoscaler/cluster-autoscaler/utils/errors"
+	"net"
+	"strings"
+)
+
+// replicasNotAppliedError is returned if the management cluster's API accepted a replica change but stored
+// another replica count, e.g. because a mutating admission webhook reset it
+type replicasNotAppliedError struct {
+	requested, applied int64
+}
+
+func (e *replicasNotAppliedError) Error() string {
+	return fmt.Sprintf("replicas set to %d but %d were applied", e.requested, e.applied)
+}
+
+// admissionRejection is the AutoscalerError of a change rejected in admission, which stays recognizable by
+// rejectedByAdmission when a prefix is added
+type admissionRejection struct {
+	msg string
+}
+
+func (e admissionRejection) Error() string {
+	return e.msg
+}
+
+func (e admissionRejection) Type() errors.AutoscalerErrorType {
+	return errors.CloudProviderError
+}
+
+func (e admissionRejection) AddPrefix(msg string, args ...interface{}) errors.AutoscalerError {
+	e.msg = fmt.Sprintf(msg, args...) + e.msg
+	return e
+}
+
+// autoscalerError classifies an error of the management cluster's API for the core autoscaler. AutoscalerErrors
+// are returned unchanged. err must not be nil.
+func autoscalerError(err error) errors.AutoscalerError {
+	if _, ok := err.(errors.AutoscalerError); !ok && rejectedByAdmission(err) {
+		return admissionRejection{msg: err.Error()}
+	}
+	return errors.ToAutoscalerError(autoscalerErrorType(err), err)
+}
+
+// autoscalerErrorType returns ApiCallError for errors that may not recur on a retry, i.e. failed requests,
+// timeouts, throttling, conflicts and server errors, CloudProviderError for changes rejected in admission,
+// see rejectedByAdmission, and InternalError for all others. Aggregates are ApiCallErrors only if all
+// their errors are.
+func autoscalerErrorType(err error) errors.AutoscalerErrorType {
+	if rejectedByAdmission(err) {
+		return errors.CloudProviderError
+	}
+	switch e := err.(type) {
+	case errors.AutoscalerError:
+		return e.Type()
+	case utilerrors.Aggregate:
+		for _, err := range e.Errors() {
+			if autoscalerErrorType(err) != errors.ApiCallError {
+				return errors.InternalError
+			}
+		}
+		return errors.ApiCallError
+	case apierrors.APIStatus:
+		if apierrors.IsServerTimeout(err) || apierrors.IsTimeout(err) || apierrors.IsTooManyRequests(err) ||
+			apierrors.IsConflict(err) || apierrors.IsInternalError(err) || apierrors.IsServiceUnavailable(err) ||
+			apierrors.IsUnexpectedServerError(err) {
+			return errors.ApiCallError
+		}
+		return errors.InternalError
+	case net.Error:
+		// the request didn't reach the API server or its response got lost
+		return errors.ApiCallError
+	}
+	return errors.InternalError
+}
+
+// rejectedByAdmission checks whether the management cluster's API rejected a change in admission, i.e. the
+// change failed validation, was denied by an admission webhook or was reverted by a mutating one. Such
+// rejections recur until the policy of the management cluster is fixed.
+func rejectedByAdmission(err error) bool {
+	switch err.(type) {
+	case admissionRejection, *replicasNotAppliedError:
+		return true
+	case apierrors.APIStatus:
+		return apierrors.IsInvalid(err) || strings.Contains(err.Error(), "admission webhook")
+	}
+	return false
+}
+
+// aggregateError aggregates errors of the management cluster's API into a classified error, nil if there are none
+func aggregateError(errs []error) error {
+	if err := utilerrors.NewAggregate(errs); err != nil {
+		return autoscalerError(err)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/autoscaler/cluster-autoscaler/utils/errors"
+	"k8s.io/client-go/tools/record"
+	"net/url"
+	"sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	"syscall"
+	"testing"
+)
+
+func TestAutoscalerErrorType(t *testing.T) {
+	resource := schema.GroupResource{Resource: machineDeploymentResource}
+	conflict := apierrors.NewConflict(resource, "md", fmt.Errorf("modified"))
+	forbidden := apierrors.NewForbidden(resource, "md", fmt.Errorf("denied"))
+	webhookDenied := apierrors.NewForbidden(resource, "md", fmt.Errorf("admission webhook \"x\" denied the request: no"))
+
+	for _, tc := range []struct {
+		err      error
+		expected errors.AutoscalerErrorType
+	}{
+		{conflict, errors.ApiCallError},
+		{apierrors.NewServerTimeout(resource, "update", 1), errors.ApiCallError},
+		{apierrors.NewTooManyRequests("throttled", 1), errors.ApiCallError},
+		{apierrors.NewInternalError(fmt.Errorf("etcd")), errors.ApiCallError},
+		{apierrors.NewServiceUnavailable("down"), errors.ApiCallError},
+		{&url.Error{Op: "Get", URL: "https://api", Err: syscall.ECONNREFUSED}, errors.ApiCallError},
+		{forbidden, errors.InternalError},
+		{webhookDenied, errors.CloudProviderError},
+		{apierrors.NewInvalid(schema.GroupKind{Kind: "MachineDeployment"}, "md", nil), errors.CloudProviderError},
+		{&replicasNotAppliedError{requested: 4, applied: 3}, errors.CloudProviderError},
+		{apierrors.NewBadRequest("invalid"), errors.InternalError},
+		{fmt.Errorf("unexpected"), errors.InternalError},
+		{errors.NewAutoscalerError(errors.CloudProviderError, "gone"), errors.CloudProviderError},
+		{utilerrors.NewAggregate([]error{conflict, autoscalerError(conflict)}), errors.ApiCallError},
+		{utilerrors.NewAggregate([]error{conflict, forbidden}), errors.InternalError},
+	} {
+		assert.Equal(t, tc.expected, autoscalerError(tc.err).Type(), tc.err.Error())
+		assert.Equal(t, tc.err.Error(), autoscalerError(tc.err).Error())
+	}
+	assert.Nil(t, aggregateError(nil))
+}
+
+func TestRejectedByAdmission(t *testing.T) {
+	resource := schema.GroupResource{Resource: machineDeploymentResource}
+	webhookDenied := apierrors.NewForbidden(resource, "md", fmt.Errorf("admission webhook \"x\" denied the request: no"))
+
+	assert.True(t, rejectedByAdmission(webhookDenied))
+	assert.True(t, rejectedByAdmission(apierrors.NewInvalid(schema.GroupKind{Kind: "MachineDeployment"}, "md", nil)))
+	assert.True(t, rejectedByAdmission(autoscalerError(webhookDenied).AddPrefix("prefix: ")))
+	assert.False(t, rejectedByAdmission(apierrors.NewForbidden(resource, "md", fmt.Errorf("denied"))))
+	assert.False(t, rejectedByAdmission(fmt.Errorf("admission webhook \"x\" denied the request: no")))
+	assert.False(t, rejectedByAdmission(errors.NewAutoscalerError(errors.CloudProviderError, "gone")))
+}
+
+func TestIncreaseSizeRejectedByAdmission(t *testing.T) {
+	md := buildTestMachineDeployment("md", 3, 1, 5)
+	resource := schema.GroupResource{Resource: machineDeploymentResource}
+	manager := newTestMachineManager(t)
+	manager.On("SetDeploymentSize", md, 4).Return(false, apierrors.NewForbidden(resource, "md",
+		fmt.Errorf("admission webhook \"replicas.example.com\" denied the request: replicas are frozen")))
+	recorder := record.NewFakeRecorder(10)
+	ng := NewClusterapiNodeGroup(manager, md, nil)
+	ng.eventRecorder = recorder
+
+	err := ng.IncreaseSize(1)
+	assert.EqualError(t, err, "scale up of node group kube-system/md rejected by admission: "+
+		"machinedeployments \"md\" is forbidden: admission webhook \"replicas.example.com\" denied the request: replicas are frozen")
+	assert.Equal(t, errors.CloudProviderError, err.(errors.AutoscalerError).Type())
+	assert.Contains(t, <-recorder.Events, "Warning ScaleUpRejected Scale up from 3 to 4 replicas rejected by admission")
+	assert.True(t, ng.lastScaleAction.IsZero())
+}
+
+func TestNodeGroupAutoscalerErrors(t *testing.T) {
+	md := buildTestMachineDeployment("md", 3, 1, 5)
+	ms := buildTestMachineSet(md, "ms", 3)
+	n := buildTestNode("n")
+	m := buildTestMachine(ms, "m", n)
+	resource := schema.GroupResource{Resource: machineResource}
+
+	manager := newTestMachineManager(t)
+	manager.On("SetDeploymentSize", md, 4).Return(false, apierrors.NewServerTimeout(resource, "update", 1))
+	manager.On("DeploymentForNode", n).Return(md)
+	manager.On("MachinesByProviderID").Return(machinesByProviderID(m), nil)
+	manager.On("MachinesForDeployment", md).Return([]*v1alpha1.Machine{m})
+	manager.On("MarkMachineForDeletion", m).Return(apierrors.NewForbidden(resource, "m", fmt.Errorf("denied")))
+	ng := NewClusterapiNodeGroup(manager, md, nil)
+
+	err := ng.IncreaseSize(1)
+	assert.Error(t, err)
+	assert.Equal(t, errors.ApiCallError, err.(errors.AutoscalerError).Type())
+
+	err = ng.DeleteNodes([]*apiv1.Node{n})
+	assert.Error(t, err)
+	assert.Equal(t, errors.InternalError, err.(errors.AutoscalerError).Type())
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package exp holds the experimental cluster-api types the autoscaler uses, which the vendored
+// cluster-api predates. Only the fields the autoscaler needs are defined.
+package exp
+
+import (
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+)
+
+// MachinePool is a group of machines whose lifecycle is delegated to the infrastructure provider,
+// e.g. a scale set. Unlike a MachineDeployment, it lists the providerIDs of its instances.
+type MachinePool struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   MachinePoolSpec   `json:"spec,omitempty"`
+	Status MachinePoolStatus `json:"status,omitempty"`
+}
+
+// MachinePoolSpec defines the desired state of a MachinePool
+type MachinePoolSpec struct {
+	// Replicas is the number of desired machines, defaults to 1
+	Replicas *int32 `json:"replicas,omitempty"`
+
+	// Template describes the machines of the pool
+	Template v1alpha1.MachineTemplateSpec `json:"template"`
+
+	// ProviderIDList are the providerIDs of the pool's instances, as reported by the infrastructure provider
+	ProviderIDList []string `json:"providerIDList,omitempty"`
+}
+
+// MachinePoolStatus defines the observed state of a MachinePool
+type MachinePoolStatus struct {
+	// NodeRefs are the nodes of the pool's instances
+	NodeRefs []v1.ObjectReference `json:"nodeRefs,omitempty"`
+
+	// Replicas is the most recently observed number of replicas
+	Replicas int32 `json:"replicas,omitempty"`
+}
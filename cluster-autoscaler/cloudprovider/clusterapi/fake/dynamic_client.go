@@ -0,0 +1,361 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fake
+
+import (
+	"encoding/json"
+	"github.com/evanphx/json-patch"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"strconv"
+	"sync"
+)
+
+// DynamicAction records a single call made against a DynamicClient
+type DynamicAction struct {
+	Verb        string
+	Resource    schema.GroupVersionResource
+	Namespace   string
+	Name        string
+	Subresource string
+	PatchType   types.PatchType
+	Patch       []byte
+}
+
+// DynamicReactor may intercept a call before it reaches the object store.
+// Returning handled=true makes the call fail with err.
+type DynamicReactor func(action DynamicAction) (handled bool, err error)
+
+// DynamicClient is an in-memory dynamic.Interface for tests. All resources serve
+// a scale subresource backed by spec.replicas.
+type DynamicClient struct {
+	sync.Mutex
+
+	objects         map[schema.GroupVersionResource]map[string]*unstructured.Unstructured
+	watchers        map[schema.GroupVersionResource]*watch.Broadcaster
+	resourceVersion int
+
+	// Actions holds all calls made against the client in order. Use RecordedActions while informers
+	// are running.
+	Actions []DynamicAction
+	// Reactors are consulted in order before a call is executed. Use AddReactor while informers are running.
+	Reactors []DynamicReactor
+}
+
+// NewDynamicClient creates an empty DynamicClient
+func NewDynamicClient() *DynamicClient {
+	return &DynamicClient{
+		objects:  make(map[schema.GroupVersionResource]map[string]*unstructured.Unstructured),
+		watchers: make(map[schema.GroupVersionResource]*watch.Broadcaster),
+	}
+}
+
+// Add stores obj as an instance of resource without recording an action and returns the stored object
+func (c *DynamicClient) Add(resource schema.GroupVersionResource, obj *unstructured.Unstructured) *unstructured.Unstructured {
+	c.Lock()
+	defer c.Unlock()
+	obj = obj.DeepCopy()
+	c.store(resource, obj, watch.Added)
+	return obj.DeepCopy()
+}
+
+// AddReactor appends a reactor, which is safe while the client is in use
+func (c *DynamicClient) AddReactor(reactor DynamicReactor) {
+	c.Lock()
+	defer c.Unlock()
+	c.Reactors = append(c.Reactors, reactor)
+}
+
+// RecordedActions returns a copy of the actions recorded so far
+func (c *DynamicClient) RecordedActions() []DynamicAction {
+	c.Lock()
+	defer c.Unlock()
+	return append([]DynamicAction(nil), c.Actions...)
+}
+
+// Resource returns an interface to the given resource
+func (c *DynamicClient) Resource(resource schema.GroupVersionResource) dynamic.NamespaceableResourceInterface {
+	return &dynamicResourceClient{client: c, resource: resource}
+}
+
+func (c *DynamicClient) store(resource schema.GroupVersionResource, obj *unstructured.Unstructured, eventType watch.EventType) {
+	if c.objects[resource] == nil {
+		c.objects[resource] = make(map[string]*unstructured.Unstructured)
+	}
+	c.resourceVersion++
+	obj.SetResourceVersion(strconv.Itoa(c.resourceVersion))
+	c.objects[resource][key(obj.GetNamespace(), obj.GetName())] = obj
+	c.broadcaster(resource).Action(eventType, obj.DeepCopy())
+}
+
+func (c *DynamicClient) broadcaster(resource schema.GroupVersionResource) *watch.Broadcaster {
+	if c.watchers[resource] == nil {
+		c.watchers[resource] = watch.NewBroadcaster(100, watch.WaitIfChannelFull)
+	}
+	return c.watchers[resource]
+}
+
+func (c *DynamicClient) react(action DynamicAction) error {
+	c.Actions = append(c.Actions, action)
+	for _, reactor := range c.Reactors {
+		if handled, err := reactor(action); handled {
+			return err
+		}
+	}
+	return nil
+}
+
+// scaleOf returns the autoscaling/v1 Scale of an object
+func scaleOf(obj *unstructured.Unstructured) *unstructured.Unstructured {
+	replicas, _, _ := unstructured.NestedInt64(obj.Object, "spec", "replicas")
+	statusReplicas, _, _ := unstructured.NestedInt64(obj.Object, "status", "replicas")
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "autoscaling/v1",
+			"kind":       "Scale",
+			"metadata": map[string]interface{}{
+				"name":            obj.GetName(),
+				"namespace":       obj.GetNamespace(),
+				"uid":             string(obj.GetUID()),
+				"resourceVersion": obj.GetResourceVersion(),
+			},
+			"spec": map[string]interface{}{
+				"replicas": replicas,
+			},
+			"status": map[string]interface{}{
+				"replicas": statusReplicas,
+			},
+		},
+	}
+}
+
+func key(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+type dynamicResourceClient struct {
+	client    *DynamicClient
+	resource  schema.GroupVersionResource
+	namespace string
+}
+
+func (r *dynamicResourceClient) Namespace(namespace string) dynamic.ResourceInterface {
+	return &dynamicResourceClient{client: r.client, resource: r.resource, namespace: namespace}
+}
+
+func (r *dynamicResourceClient) action(verb, name string, subresources []string) DynamicAction {
+	action := DynamicAction{Verb: verb, Resource: r.resource, Namespace: r.namespace, Name: name}
+	if len(subresources) > 0 {
+		action.Subresource = subresources[0]
+	}
+	return action
+}
+
+func (r *dynamicResourceClient) get(name string) (*unstructured.Unstructured, error) {
+	obj, ok := r.client.objects[r.resource][key(r.namespace, name)]
+	if !ok {
+		return nil, errors.NewNotFound(r.resource.GroupResource(), name)
+	}
+	return obj, nil
+}
+
+func (r *dynamicResourceClient) Create(obj *unstructured.Unstructured, options metav1.CreateOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	r.client.Lock()
+	defer r.client.Unlock()
+	if err := r.client.react(r.action("create", obj.GetName(), subresources)); err != nil {
+		return nil, err
+	}
+	if _, err := r.get(obj.GetName()); err == nil {
+		return nil, errors.NewAlreadyExists(r.resource.GroupResource(), obj.GetName())
+	}
+	obj = obj.DeepCopy()
+	obj.SetNamespace(r.namespace)
+	r.client.store(r.resource, obj, watch.Added)
+	return obj.DeepCopy(), nil
+}
+
+func (r *dynamicResourceClient) Update(obj *unstructured.Unstructured, options metav1.UpdateOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	r.client.Lock()
+	defer r.client.Unlock()
+	if err := r.client.react(r.action("update", obj.GetName(), subresources)); err != nil {
+		return nil, err
+	}
+	existing, err := r.get(obj.GetName())
+	if err != nil {
+		return nil, err
+	}
+	if obj.GetResourceVersion() != "" && obj.GetResourceVersion() != existing.GetResourceVersion() {
+		return nil, errors.NewConflict(r.resource.GroupResource(), obj.GetName(), nil)
+	}
+	if len(subresources) > 0 && subresources[0] == "scale" {
+		replicas, _, _ := unstructured.NestedInt64(obj.Object, "spec", "replicas")
+		updated := existing.DeepCopy()
+		if err := unstructured.SetNestedField(updated.Object, replicas, "spec", "replicas"); err != nil {
+			return nil, errors.NewBadRequest(err.Error())
+		}
+		r.client.store(r.resource, updated, watch.Modified)
+		return scaleOf(updated), nil
+	}
+	obj = obj.DeepCopy()
+	obj.SetNamespace(r.namespace)
+	r.client.store(r.resource, obj, watch.Modified)
+	return obj.DeepCopy(), nil
+}
+
+func (r *dynamicResourceClient) UpdateStatus(obj *unstructured.Unstructured, options metav1.UpdateOptions) (*unstructured.Unstructured, error) {
+	return r.Update(obj, options, "status")
+}
+
+func (r *dynamicResourceClient) Delete(name string, options *metav1.DeleteOptions, subresources ...string) error {
+	r.client.Lock()
+	defer r.client.Unlock()
+	if err := r.client.react(r.action("delete", name, subresources)); err != nil {
+		return err
+	}
+	obj, err := r.get(name)
+	if err != nil {
+		return err
+	}
+	delete(r.client.objects[r.resource], key(r.namespace, name))
+	r.client.broadcaster(r.resource).Action(watch.Deleted, obj.DeepCopy())
+	return nil
+}
+
+func (r *dynamicResourceClient) DeleteCollection(options *metav1.DeleteOptions, listOptions metav1.ListOptions) error {
+	list, err := r.List(listOptions)
+	if err != nil {
+		return err
+	}
+	for _, item := range list.Items {
+		if err := r.Namespace(item.GetNamespace()).Delete(item.GetName(), options); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *dynamicResourceClient) Get(name string, options metav1.GetOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	r.client.Lock()
+	defer r.client.Unlock()
+	if err := r.client.react(r.action("get", name, subresources)); err != nil {
+		return nil, err
+	}
+	obj, err := r.get(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(subresources) > 0 && subresources[0] == "scale" {
+		return scaleOf(obj), nil
+	}
+	return obj.DeepCopy(), nil
+}
+
+func (r *dynamicResourceClient) List(opts metav1.ListOptions) (*unstructured.UnstructuredList, error) {
+	r.client.Lock()
+	defer r.client.Unlock()
+	if err := r.client.react(r.action("list", "", nil)); err != nil {
+		return nil, err
+	}
+	selector, err := labels.Parse(opts.LabelSelector)
+	if err != nil {
+		return nil, errors.NewBadRequest(err.Error())
+	}
+
+	list := &unstructured.UnstructuredList{}
+	list.SetResourceVersion(strconv.Itoa(r.client.resourceVersion))
+	for _, obj := range r.client.objects[r.resource] {
+		if r.namespace != "" && obj.GetNamespace() != r.namespace {
+			continue
+		}
+		if !selector.Matches(labels.Set(obj.GetLabels())) {
+			continue
+		}
+		list.Items = append(list.Items, *obj.DeepCopy())
+	}
+	return list, nil
+}
+
+func (r *dynamicResourceClient) Watch(opts metav1.ListOptions) (watch.Interface, error) {
+	r.client.Lock()
+	defer r.client.Unlock()
+	if err := r.client.react(r.action("watch", "", nil)); err != nil {
+		return nil, err
+	}
+	selector, err := labels.Parse(opts.LabelSelector)
+	if err != nil {
+		return nil, errors.NewBadRequest(err.Error())
+	}
+
+	namespace := r.namespace
+	return watch.Filter(r.client.broadcaster(r.resource).Watch(), func(in watch.Event) (watch.Event, bool) {
+		obj, ok := in.Object.(*unstructured.Unstructured)
+		return in, ok && (namespace == "" || obj.GetNamespace() == namespace) && selector.Matches(labels.Set(obj.GetLabels()))
+	}), nil
+}
+
+func (r *dynamicResourceClient) Patch(name string, pt types.PatchType, data []byte, options metav1.UpdateOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	r.client.Lock()
+	defer r.client.Unlock()
+	action := r.action("patch", name, subresources)
+	action.PatchType = pt
+	action.Patch = data
+	if err := r.client.react(action); err != nil {
+		return nil, err
+	}
+	existing, err := r.get(name)
+	if err != nil {
+		return nil, err
+	}
+	original, err := json.Marshal(existing.Object)
+	if err != nil {
+		return nil, err
+	}
+
+	var patched []byte
+	switch pt {
+	case types.JSONPatchType:
+		patch, err := jsonpatch.DecodePatch(data)
+		if err != nil {
+			return nil, errors.NewBadRequest(err.Error())
+		}
+		patched, err = patch.Apply(original)
+		if err != nil {
+			return nil, errors.NewInvalid(schema.GroupKind{Group: r.resource.Group}, name, nil)
+		}
+	default:
+		// merge, strategic merge and apply patches of the simple
+		// documents used in tests all behave like a JSON merge patch
+		patched, err = jsonpatch.MergePatch(original, data)
+		if err != nil {
+			return nil, errors.NewBadRequest(err.Error())
+		}
+	}
+
+	// decode like a real client, i.e. with integers as int64
+	obj := &unstructured.Unstructured{}
+	if err := obj.UnmarshalJSON(patched); err != nil {
+		return nil, err
+	}
+	r.client.store(r.resource, obj, watch.Modified)
+	return obj.DeepCopy(), nil
+}
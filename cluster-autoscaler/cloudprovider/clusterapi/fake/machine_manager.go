@@ -17,8 +17,11 @@ limitations under the License.
 package fake
 
 import (
+	"context"
 	"github.com/stretchr/testify/mock"
 	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider/clusterapi/exp"
 	"sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
 )
 
@@ -33,26 +36,207 @@ func (m *MachineManagerMock) AllDeployments() []*v1alpha1.MachineDeployment {
 	return args.Get(0).([]*v1alpha1.MachineDeployment)
 }
 
+// AllMachineSets returns all standalone MachineSets of the cluster
+func (m *MachineManagerMock) AllMachineSets() []*v1alpha1.MachineSet {
+	args := m.Called()
+	return args.Get(0).([]*v1alpha1.MachineSet)
+}
+
+// AllMachinePools returns all MachinePools of the cluster
+func (m *MachineManagerMock) AllMachinePools() []*exp.MachinePool {
+	args := m.Called()
+	return args.Get(0).([]*exp.MachinePool)
+}
+
+// AvailableMachineTypes returns the sorted, distinct machine types of all MachineDeployments and standalone MachineSets
+func (m *MachineManagerMock) AvailableMachineTypes() []string {
+	args := m.Called()
+	return args.Get(0).([]string)
+}
+
+// BootstrapNodeRegistration returns the node labels and taints of a MachineDeployment's or MachineSet's bootstrap config
+func (m *MachineManagerMock) BootstrapNodeRegistration(obj metav1.Object) (map[string]string, []v1.Taint, error) {
+	args := m.Called(obj)
+	labels, _ := args.Get(0).(map[string]string)
+	taints, _ := args.Get(1).([]v1.Taint)
+	return labels, taints, args.Error(2)
+}
+
+// HasSynced checks whether the informer caches of the MachineManager are synced
+func (m *MachineManagerMock) HasSynced() bool {
+	args := m.Called()
+	return args.Bool(0)
+}
+
+// InfrastructureTemplateAnnotations returns the annotations of a MachineDeployment's or MachineSet's infrastructure template
+func (m *MachineManagerMock) InfrastructureTemplateAnnotations(obj metav1.Object) (map[string]string, error) {
+	args := m.Called(obj)
+	annotations, _ := args.Get(0).(map[string]string)
+	return annotations, args.Error(1)
+}
+
+// Cleanup stops the informers of the MachineManager
+func (m *MachineManagerMock) Cleanup() error {
+	args := m.Called()
+	return args.Error(0)
+}
+
+// CreateMachineDeployment creates a MachineDeployment
+func (m *MachineManagerMock) CreateMachineDeployment(md *v1alpha1.MachineDeployment) (*v1alpha1.MachineDeployment, error) {
+	args := m.Called(md)
+	created, _ := args.Get(0).(*v1alpha1.MachineDeployment)
+	return created, args.Error(1)
+}
+
+// DeleteMachine deletes a Machine
+func (m *MachineManagerMock) DeleteMachine(machine *v1alpha1.Machine) error {
+	args := m.Called(machine)
+	return args.Error(0)
+}
+
+// DeleteMachineDeployment deletes a MachineDeployment
+func (m *MachineManagerMock) DeleteMachineDeployment(md *v1alpha1.MachineDeployment) error {
+	args := m.Called(md)
+	return args.Error(0)
+}
+
+// DeleteMachinePoolNodes removes the instances of nodes from a MachinePool
+func (m *MachineManagerMock) DeleteMachinePoolNodes(mp *exp.MachinePool, nodes []*v1.Node, size int) (bool, error) {
+	args := m.Called(mp, nodes, size)
+	return args.Bool(0), args.Error(1)
+}
+
 // DeploymentForNode returns the MachineDeployment that created a specific node
 func (m *MachineManagerMock) DeploymentForNode(node *v1.Node) *v1alpha1.MachineDeployment {
 	args := m.Called(node)
 	return args.Get(0).(*v1alpha1.MachineDeployment)
 }
 
+// DisruptionBudgetedPods counts the pods guarded by a PodDisruptionBudget on each of the given nodes
+func (m *MachineManagerMock) DisruptionBudgetedPods(nodes []*v1.Node) (map[string]int, error) {
+	args := m.Called(nodes)
+	return args.Get(0).(map[string]int), args.Error(1)
+}
+
+// FailureDomain returns the failure domain of the machines of a MachineDeployment, MachineSet or MachinePool
+func (m *MachineManagerMock) FailureDomain(obj metav1.Object) string {
+	args := m.Called(obj)
+	return args.String(0)
+}
+
+// MachineForNode returns the Machine backing a specific node
+func (m *MachineManagerMock) MachineForNode(node *v1.Node) *v1alpha1.Machine {
+	args := m.Called(node)
+	return args.Get(0).(*v1alpha1.Machine)
+}
+
+// MachineType returns the machine type of a MachineDeployment, MachineSet or MachinePool
+func (m *MachineManagerMock) MachineType(obj metav1.Object) string {
+	args := m.Called(obj)
+	return args.String(0)
+}
+
+// MachineTypeCapacity returns the node capacity of the machine type of a MachineDeployment, MachineSet or MachinePool
+func (m *MachineManagerMock) MachineTypeCapacity(obj metav1.Object) (v1.ResourceList, bool) {
+	args := m.Called(obj)
+	capacity, _ := args.Get(0).(v1.ResourceList)
+	return capacity, args.Bool(1)
+}
+
+// MachinePoolForNode returns the MachinePool whose instances include a specific node
+func (m *MachineManagerMock) MachinePoolForNode(node *v1.Node) *exp.MachinePool {
+	args := m.Called(node)
+	return args.Get(0).(*exp.MachinePool)
+}
+
+// MachineSetForNode returns the standalone MachineSet that created a specific node
+func (m *MachineManagerMock) MachineSetForNode(node *v1.Node) *v1alpha1.MachineSet {
+	args := m.Called(node)
+	return args.Get(0).(*v1alpha1.MachineSet)
+}
+
+// MachinesForDeployment returns all machines of a specific MachineDeployment
+func (m *MachineManagerMock) MachinesForDeployment(md *v1alpha1.MachineDeployment) []*v1alpha1.Machine {
+	args := m.Called(md)
+	return args.Get(0).([]*v1alpha1.Machine)
+}
+
+// MachinesForMachineSet returns all machines of a specific standalone MachineSet
+func (m *MachineManagerMock) MachinesForMachineSet(ms *v1alpha1.MachineSet) []*v1alpha1.Machine {
+	args := m.Called(ms)
+	return args.Get(0).([]*v1alpha1.Machine)
+}
+
+// MachinesByProviderID reads all Machines from the API server and returns them by normalized providerID
+func (m *MachineManagerMock) MachinesByProviderID() (map[string]*v1alpha1.Machine, error) {
+	args := m.Called()
+	machines, _ := args.Get(0).(map[string]*v1alpha1.Machine)
+	return machines, args.Error(1)
+}
+
+// MachineSetsForDeployment returns all MachineSets of a specific MachineDeployment
+func (m *MachineManagerMock) MachineSetsForDeployment(md *v1alpha1.MachineDeployment) []*v1alpha1.MachineSet {
+	args := m.Called(md)
+	mss, _ := args.Get(0).([]*v1alpha1.MachineSet)
+	return mss
+}
+
+// MarkMachineForDeletion sets the delete-machine annotation on a Machine
+func (m *MachineManagerMock) MarkMachineForDeletion(machine *v1alpha1.Machine) error {
+	args := m.Called(machine)
+	return args.Error(0)
+}
+
+// NodeForMachine returns the node of a specific Machine
+func (m *MachineManagerMock) NodeForMachine(machine *v1alpha1.Machine) *v1.Node {
+	args := m.Called(machine)
+	return args.Get(0).(*v1.Node)
+}
+
 // NodesForDeployment returns all nodes that were created by a specific MachineDeployment
 func (m *MachineManagerMock) NodesForDeployment(md *v1alpha1.MachineDeployment) []*v1.Node {
 	args := m.Called(md)
 	return args.Get(0).([]*v1.Node)
 }
 
+// NodesForMachineSet returns all nodes that were created by a specific standalone MachineSet
+func (m *MachineManagerMock) NodesForMachineSet(ms *v1alpha1.MachineSet) []*v1.Node {
+	args := m.Called(ms)
+	return args.Get(0).([]*v1.Node)
+}
+
+// NodesForMachinePool returns all nodes of the instances of a specific MachinePool
+func (m *MachineManagerMock) NodesForMachinePool(mp *exp.MachinePool) []*v1.Node {
+	args := m.Called(mp)
+	return args.Get(0).([]*v1.Node)
+}
+
 // SetDeploymentSize sets a MachineDeployment's replica count
-func (m *MachineManagerMock) SetDeploymentSize(md *v1alpha1.MachineDeployment, size int) error {
+func (m *MachineManagerMock) SetDeploymentSize(md *v1alpha1.MachineDeployment, size int) (bool, error) {
 	args := m.Called(md, size)
+	return args.Bool(0), args.Error(1)
+}
+
+// SetMachineSetSize sets a standalone MachineSet's replica count
+func (m *MachineManagerMock) SetMachineSetSize(ms *v1alpha1.MachineSet, size int) (bool, error) {
+	args := m.Called(ms, size)
+	return args.Bool(0), args.Error(1)
+}
+
+// SetMachinePoolSize sets a MachinePool's replica count
+func (m *MachineManagerMock) SetMachinePoolSize(mp *exp.MachinePool, size int) (bool, error) {
+	args := m.Called(mp, size)
+	return args.Bool(0), args.Error(1)
+}
+
+// WaitForCacheSync blocks until the informer caches of the MachineManager are synced
+func (m *MachineManagerMock) WaitForCacheSync(ctx context.Context) error {
+	args := m.Called(ctx)
 	return args.Error(0)
 }
 
 // Refresh reloads the ClusterapiMachineManager's cached representation of the cluster state
-func (m *MachineManagerMock) Refresh() error {
-	args := m.Called()
+func (m *MachineManagerMock) Refresh(ctx context.Context) error {
+	args := m.Called(ctx)
 	return args.Error(0)
 }
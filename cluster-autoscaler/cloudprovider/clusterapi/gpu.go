@@ -0,0 +1,62 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/autoscaler/cluster-autoscaler/utils/gpu"
+)
+
+const (
+	// GpuLabelAnnotation sets the node label that marks the GPU nodes of a node group, defaults to the
+	// label the autoscaler core uses
+	GpuLabelAnnotation = "autoscaler.syseleven.de/gpu-label"
+	// GpuResourceNameAnnotation sets the extended resource name of the GPUs of a node group, defaults to
+	// nvidia.com/gpu. It takes precedence over the gpu-type capacity annotation.
+	GpuResourceNameAnnotation = "autoscaler.syseleven.de/gpu-resource-name"
+)
+
+// GpuConfig describes how the GPU nodes of a node group are recognized and which resource their GPUs
+// are tracked as, e.g. for the GPU utilization considered on scale-down
+type GpuConfig struct {
+	// Label marks GPU nodes, its value is the GPU type
+	Label string
+	// ExtendedResourceName is the resource name of the GPUs
+	ExtendedResourceName apiv1.ResourceName
+}
+
+// gpuConfigFromAnnotations returns the GPU config of a MachineDeployment, MachineSet or MachinePool
+func gpuConfigFromAnnotations(obj metav1.Object) *GpuConfig {
+	label := obj.GetAnnotations()[GpuLabelAnnotation]
+	if label == "" {
+		label = gpu.GPULabel
+	}
+	return &GpuConfig{Label: label, ExtendedResourceName: gpuResourceName(obj)}
+}
+
+// hasGpu checks whether a node is a GPU node according to the config, i.e. it has the GPU label or GPUs
+func (cfg *GpuConfig) hasGpu(node *apiv1.Node) bool {
+	if _, ok := node.Labels[cfg.Label]; ok {
+		return true
+	}
+	if gpus, ok := node.Status.Capacity[cfg.ExtendedResourceName]; ok && !gpus.IsZero() {
+		return true
+	}
+	gpus, ok := node.Status.Allocatable[cfg.ExtendedResourceName]
+	return ok && !gpus.IsZero()
+}
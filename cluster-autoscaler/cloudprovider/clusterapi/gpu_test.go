@@ -0,0 +1,78 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider/clusterapi/exp"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider/clusterapi/fake"
+	"k8s.io/autoscaler/cluster-autoscaler/utils/gpu"
+	"sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	"testing"
+)
+
+func TestGpuConfigFromAnnotations(t *testing.T) {
+	md := buildTestMachineDeployment("md", 1, 0, 10)
+	assert.Equal(t, &GpuConfig{Label: gpu.GPULabel, ExtendedResourceName: gpu.ResourceNvidiaGPU}, gpuConfigFromAnnotations(md))
+
+	md.Annotations[GpuTypeCapacityAnnotation] = "amd.com/gpu"
+	assert.Equal(t, &GpuConfig{Label: gpu.GPULabel, ExtendedResourceName: "amd.com/gpu"}, gpuConfigFromAnnotations(md))
+
+	md.Annotations[GpuLabelAnnotation] = "syseleven.de/gpu"
+	md.Annotations[GpuResourceNameAnnotation] = "nvidia.com/mig-1g.5gb"
+	assert.Equal(t, &GpuConfig{Label: "syseleven.de/gpu", ExtendedResourceName: "nvidia.com/mig-1g.5gb"}, gpuConfigFromAnnotations(md))
+}
+
+func TestGpuConfigHasGpu(t *testing.T) {
+	cfg := &GpuConfig{Label: "syseleven.de/gpu", ExtendedResourceName: "amd.com/gpu"}
+
+	labeled := buildTestNode("labeled")
+	labeled.Labels = map[string]string{"syseleven.de/gpu": "mi100"}
+	assert.True(t, cfg.hasGpu(labeled))
+
+	unlabeled := buildTestNode("unlabeled")
+	unlabeled.Status.Allocatable = apiv1.ResourceList{"amd.com/gpu": resource.MustParse("2")}
+	assert.True(t, cfg.hasGpu(unlabeled))
+
+	other := buildTestNode("other")
+	other.Labels = map[string]string{gpu.GPULabel: "nvidia-tesla-t4"}
+	other.Status.Capacity = apiv1.ResourceList{gpu.ResourceNvidiaGPU: resource.MustParse("1"), "amd.com/gpu": resource.MustParse("0")}
+	assert.False(t, cfg.hasGpu(other))
+}
+
+func TestGetNodeGpuConfig(t *testing.T) {
+	md := buildTestMachineDeployment("md", 2, 0, 10)
+	md.Annotations[GpuLabelAnnotation] = "syseleven.de/gpu"
+	gpuNode := buildTestNode("gpu")
+	gpuNode.Labels = map[string]string{"syseleven.de/gpu": "a100"}
+	cpuNode := buildTestNode("cpu")
+	unmanaged := buildTestNode("unmanaged")
+
+	provider := newTestProvider(t)
+	manager := provider.machineManager.(*fake.MachineManagerMock)
+	manager.On("DeploymentForNode", gpuNode).Return(md)
+	manager.On("DeploymentForNode", cpuNode).Return(md)
+	manager.On("DeploymentForNode", unmanaged).Return((*v1alpha1.MachineDeployment)(nil))
+	manager.On("MachineSetForNode", unmanaged).Return((*v1alpha1.MachineSet)(nil))
+	manager.On("MachinePoolForNode", unmanaged).Return((*exp.MachinePool)(nil))
+
+	assert.Equal(t, &GpuConfig{Label: "syseleven.de/gpu", ExtendedResourceName: gpu.ResourceNvidiaGPU}, provider.GetNodeGpuConfig(gpuNode))
+	assert.Nil(t, provider.GetNodeGpuConfig(cpuNode))
+	assert.Nil(t, provider.GetNodeGpuConfig(unmanaged))
+}
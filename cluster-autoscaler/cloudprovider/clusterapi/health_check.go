@@ -0,0 +1,97 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HealthCheckPath is the path of the health check of the clusterapi cloud provider, registered by BuildClusterapi
+const HealthCheckPath = "/health-check/clusterapi"
+
+// healthCheck implements http.Handler to report whether the cluster-api objects are watched and were
+// refreshed recently. It fails once the management cluster was unreachable for longer than the
+// configured health check staleness, so that the autoscaler is restarted.
+type healthCheck struct {
+	lock       sync.Mutex
+	clusterapi *ClusterapiCloudProvider
+}
+
+var (
+	// defaultHealthCheck is served at HealthCheckPath of the default ServeMux
+	defaultHealthCheck      = &healthCheck{}
+	registerHealthCheckOnce sync.Once
+)
+
+// registerHealthCheck serves the health check of a cloud provider at HealthCheckPath of the default ServeMux.
+// It may be called more than once, the provider of the last call is checked.
+func registerHealthCheck(clusterapi *ClusterapiCloudProvider) {
+	defaultHealthCheck.setProvider(clusterapi)
+	registerHealthCheckOnce.Do(func() {
+		http.Handle(HealthCheckPath, defaultHealthCheck)
+	})
+}
+
+// setProvider sets the cloud provider to check
+func (hc *healthCheck) setProvider(clusterapi *ClusterapiCloudProvider) {
+	hc.lock.Lock()
+	defer hc.lock.Unlock()
+	hc.clusterapi = clusterapi
+}
+
+// ServeHTTP responds with 200 if the cloud provider is healthy, 503 otherwise
+func (hc *healthCheck) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hc.lock.Lock()
+	clusterapi := hc.clusterapi
+	hc.lock.Unlock()
+
+	if clusterapi == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("Error: cloud provider not built yet"))
+		return
+	}
+	if err := clusterapi.healthy(time.Now()); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(fmt.Sprintf("Error: %v", err)))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// healthy fails unless the informer caches are synced and the last successful refresh is at most the
+// configured health check staleness ago
+func (clusterapi *ClusterapiCloudProvider) healthy(now time.Time) error {
+	if !clusterapi.machineManager.HasSynced() {
+		return fmt.Errorf("informer caches not synced")
+	}
+	clusterapi.nodeGroupsLock.Lock()
+	lastRefresh := clusterapi.lastRefresh
+	clusterapi.nodeGroupsLock.Unlock()
+
+	if lastRefresh.IsZero() {
+		return fmt.Errorf("not refreshed yet")
+	}
+	staleness := clusterapi.cloudConfig.getHealthCheckStaleness()
+	if now.Sub(lastRefresh) > staleness {
+		return fmt.Errorf("last successful refresh %v ago, more than %v", now.Sub(lastRefresh).Round(time.Second), staleness)
+	}
+	return nil
+}
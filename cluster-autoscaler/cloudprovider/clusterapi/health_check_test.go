@@ -0,0 +1,86 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthCheck(t *testing.T) {
+	cloudConfig, err := ReadCloudConfig(strings.NewReader("[global]\nhealth-check-staleness = 1m\n"))
+	assert.NoError(t, err)
+	manager := newTestMachineManager(t)
+	manager.On("HasSynced").Return(true)
+	provider := &ClusterapiCloudProvider{machineManager: manager, cloudConfig: cloudConfig}
+	hc := &healthCheck{clusterapi: provider}
+
+	serve := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		hc.ServeHTTP(w, httptest.NewRequest("GET", HealthCheckPath, nil))
+		return w
+	}
+
+	w := serve()
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "Error: not refreshed yet", w.Body.String())
+
+	provider.lastRefresh = time.Now()
+	w = serve()
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "OK", w.Body.String())
+
+	provider.lastRefresh = time.Now().Add(-2 * time.Minute)
+	w = serve()
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "Error: last successful refresh 2m0s ago, more than 1m0s", w.Body.String())
+
+	manager = newTestMachineManager(t)
+	manager.On("HasSynced").Return(false)
+	provider.machineManager = manager
+	provider.lastRefresh = time.Now()
+	w = serve()
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "Error: informer caches not synced", w.Body.String())
+}
+
+func TestRegisterHealthCheck(t *testing.T) {
+	serve := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(w, httptest.NewRequest("GET", HealthCheckPath, nil))
+		return w
+	}
+	build := func(synced bool) *ClusterapiCloudProvider {
+		manager := newTestMachineManager(t)
+		manager.On("HasSynced").Return(synced)
+		return &ClusterapiCloudProvider{machineManager: manager, cloudConfig: &CloudConfig{}, lastRefresh: time.Now()}
+	}
+
+	registerHealthCheck(build(false))
+	w := serve()
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "Error: informer caches not synced", w.Body.String())
+
+	// building the cloud provider again checks the new one
+	registerHealthCheck(build(true))
+	w = serve()
+	assert.Equal(t, http.StatusOK, w.Code)
+}
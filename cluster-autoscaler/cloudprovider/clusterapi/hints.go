@@ -0,0 +1,128 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	apiv1 "k8s.io/api/core/v1"
+	apimachv1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"strconv"
+	"strings"
+)
+
+const (
+	// SpotHintAnnotation marks a node group of spot or preemptible instances
+	SpotHintAnnotation = "autoscaler.syseleven.de/spot"
+	// DiskTypeHintAnnotation names the disk type of a node group's instances
+	DiskTypeHintAnnotation = "autoscaler.syseleven.de/disk-type"
+	// NetworkClassHintAnnotation names the network throughput class of a node group's instances
+	NetworkClassHintAnnotation = "autoscaler.syseleven.de/network-class"
+	// OverflowGroupAnnotation names the MachineDeployment or MachineSet of the same namespace that takes
+	// over once the node group reached its max size, e.g. a spot sibling of an on-demand node group
+	OverflowGroupAnnotation = "autoscaler.syseleven.de/overflow-group"
+	// ExpanderPriorityAnnotation sets the priority of a node group for the priority expander. Like in the
+	// expander's ConfigMap, node groups of higher priority are preferred.
+	ExpanderPriorityAnnotation = "autoscaler.syseleven.de/expander-priority"
+)
+
+// defaultHintAnnotations are the hints exposed unless hint-annotation is configured
+var defaultHintAnnotations = []string{SpotHintAnnotation, DiskTypeHintAnnotation, NetworkClassHintAnnotation}
+
+// Hints returns the hints of the node group for expanders, the values of the configured hint annotations
+// of its MachineDeployment, MachineSet or MachinePool, its overflow group and its expander priority. The
+// hints are also labels of its template node. They don't change how the node group is scaled.
+func (ng *ClusterapiNodeGroup) Hints() map[string]string {
+	hints := hints(ng.object(), ng.cloudConfig.getHintAnnotations())
+	if overflow := overflowGroupName(ng.object()); overflow != "" {
+		hints[OverflowGroupAnnotation] = overflow
+	}
+	if priority, ok := ng.ExpanderPriority(); ok {
+		hints[ExpanderPriorityAnnotation] = strconv.Itoa(priority)
+	}
+	return hints
+}
+
+// ExpanderPriority returns the priority of the node group for the priority expander, false if it has none
+// or it is invalid
+func (ng *ClusterapiNodeGroup) ExpanderPriority() (int, bool) {
+	obj := ng.object()
+	val, ok := obj.GetAnnotations()[ExpanderPriorityAnnotation]
+	if !ok {
+		return 0, false
+	}
+	priority, err := strconv.Atoi(val)
+	if err != nil {
+		warningS("Ignoring invalid expander priority", append(objectKeys(obj), "value", val)...)
+		return 0, false
+	}
+	return priority, true
+}
+
+// OverflowGroup returns the id of the node group that takes over once this one reached its max size,
+// empty if there is none. The overflow group isn't scaled automatically, this is left to the expander.
+func (ng *ClusterapiNodeGroup) OverflowGroup() string {
+	name := overflowGroupName(ng.object())
+	if name == "" {
+		return ""
+	}
+	return ng.object().GetNamespace() + "/" + name
+}
+
+// overflowGroupName returns the name of the overflow group of an object, empty if it has none or it is
+// invalid. As a label value, it can't name another namespace.
+func overflowGroupName(obj apimachv1.Object) string {
+	name, ok := obj.GetAnnotations()[OverflowGroupAnnotation]
+	if !ok {
+		return ""
+	}
+	if errs := validation.IsValidLabelValue(name); len(errs) > 0 || name == "" || name == obj.GetName() {
+		warningS("Ignoring invalid overflow group", append(objectKeys(obj), "value", name)...)
+		return ""
+	}
+	return name
+}
+
+// hints returns the values of the given annotations of an object. Values that aren't valid label values
+// are left out with a warning.
+func hints(obj apimachv1.Object, annotations []string) map[string]string {
+	hints := make(map[string]string)
+	for _, annotation := range annotations {
+		val, ok := obj.GetAnnotations()[annotation]
+		if !ok {
+			continue
+		}
+		if errs := validation.IsValidLabelValue(val); len(errs) > 0 {
+			warningS("Ignoring invalid hint", append(objectKeys(obj), "annotation", annotation, "value", val, "err", strings.Join(errs, "; "))...)
+			continue
+		}
+		hints[annotation] = val
+	}
+	return hints
+}
+
+// applyHints labels a template node with the hints of its node group
+func applyHints(node *apiv1.Node, hints map[string]string) {
+	if len(hints) == 0 {
+		return
+	}
+	if node.Labels == nil {
+		node.Labels = make(map[string]string)
+	}
+	for key, val := range hints {
+		node.Labels[key] = val
+	}
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	"strings"
+	"testing"
+)
+
+func TestHints(t *testing.T) {
+	md := buildTestMachineDeployment("md", 1, 0, 10)
+	md.Annotations[SpotHintAnnotation] = "true"
+	md.Annotations[DiskTypeHintAnnotation] = "local-nvme"
+	md.Annotations[NetworkClassHintAnnotation] = "not a label value"
+	md.Annotations["example.com/gpu-interconnect"] = "nvlink"
+
+	ng := NewClusterapiNodeGroup(newTestMachineManager(t), md, nil)
+	assert.Equal(t, map[string]string{SpotHintAnnotation: "true", DiskTypeHintAnnotation: "local-nvme"}, ng.Hints())
+
+	// the configured annotations replace the defaults
+	cfg, err := ReadCloudConfig(strings.NewReader("[global]\nhint-annotation = example.com/gpu-interconnect\nhint-annotation = " + SpotHintAnnotation + "\n"))
+	assert.NoError(t, err)
+	ng = NewClusterapiNodeGroup(newTestMachineManager(t), md, cfg)
+	assert.Equal(t, map[string]string{SpotHintAnnotation: "true", "example.com/gpu-interconnect": "nvlink"}, ng.Hints())
+}
+
+func TestOverflowGroup(t *testing.T) {
+	md := buildTestMachineDeployment("on-demand", 10, 0, 10)
+	md.Annotations[OverflowGroupAnnotation] = "spot"
+	manager := newTestMachineManager(t)
+	ng := NewClusterapiNodeGroup(manager, md, nil)
+
+	assert.Equal(t, "kube-system/spot", ng.OverflowGroup())
+	assert.Equal(t, map[string]string{OverflowGroupAnnotation: "spot"}, ng.Hints())
+	assert.Equal(t, 10, ng.MaxSize())
+	err := ng.IncreaseSize(1)
+	assert.IsType(t, &SizeBoundError{}, err)
+	manager.AssertNotCalled(t, "SetDeploymentSize", md, 11)
+
+	// a node group can't overflow into itself or another namespace
+	for _, val := range []string{"on-demand", "other/spot", ""} {
+		md.Annotations[OverflowGroupAnnotation] = val
+		assert.Empty(t, ng.OverflowGroup(), val)
+		assert.Empty(t, ng.Hints(), val)
+	}
+}
+
+func TestExpanderPriority(t *testing.T) {
+	md := buildTestMachineDeployment("md", 1, 0, 10)
+	ng := NewClusterapiNodeGroup(newTestMachineManager(t), md, nil)
+	_, ok := ng.ExpanderPriority()
+	assert.False(t, ok)
+
+	md.Annotations[ExpanderPriorityAnnotation] = "-10"
+	priority, ok := ng.ExpanderPriority()
+	assert.True(t, ok)
+	assert.Equal(t, -10, priority)
+	assert.Equal(t, map[string]string{ExpanderPriorityAnnotation: "-10"}, ng.Hints())
+
+	md.Annotations[ExpanderPriorityAnnotation] = "high"
+	_, ok = ng.ExpanderPriority()
+	assert.False(t, ok)
+	assert.Empty(t, ng.Hints())
+}
+
+func TestApplyHints(t *testing.T) {
+	node := &apiv1.Node{}
+	applyHints(node, map[string]string{})
+	assert.Nil(t, node.Labels)
+
+	node.Labels = map[string]string{"pool": "workers", SpotHintAnnotation: "false"}
+	applyHints(node, map[string]string{SpotHintAnnotation: "true"})
+	assert.Equal(t, map[string]string{"pool": "workers", SpotHintAnnotation: "true"}, node.Labels)
+}
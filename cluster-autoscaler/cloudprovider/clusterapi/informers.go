@@ -0,0 +1,369 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"context"
+	"fmt"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	apimachv1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider/clusterapi/exp"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/pager"
+	"sigs.k8s.io/cluster-api/pkg/apis/cluster/common"
+	"sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	"time"
+)
+
+const (
+	// nodeProviderIDIndex indexes nodes by their normalized spec.providerID
+	nodeProviderIDIndex = "nodeProviderIDIndex"
+)
+
+// informerOptions configure the informers of a ClusterapiMachineManager
+type informerOptions struct {
+	// pageSize is the number of objects listed at once, 0 lists all objects at once
+	pageSize int64
+	// resyncPeriod is the period of the informers' resyncs, 0 disables them
+	resyncPeriod time.Duration
+	// errorHandler is called with the errors of the cluster-api informers' lists and watches, if set
+	errorHandler func(error)
+}
+
+// handleError passes an error of a list or watch to the errorHandler
+func (opts informerOptions) handleError(err error) {
+	if err != nil && opts.errorHandler != nil {
+		opts.errorHandler(err)
+	}
+}
+
+// pagedList lists in pages of the configured page size. The apiserver ignores the limit of lists served
+// from its watch cache, which informers ask for on their initial list, so paged lists are read from etcd.
+func (opts informerOptions) pagedList(list func(options apimachv1.ListOptions) (runtime.Object, error)) func(options apimachv1.ListOptions) (runtime.Object, error) {
+	if opts.pageSize <= 0 {
+		return list
+	}
+	return func(options apimachv1.ListOptions) (runtime.Object, error) {
+		if options.ResourceVersion == "0" {
+			options.ResourceVersion = ""
+		}
+		listPager := pager.New(pager.SimplePageFunc(list))
+		listPager.PageSize = opts.pageSize
+		return listPager.List(context.Background(), options)
+	}
+}
+
+// newInformer creates an informer for unstructured objects of the given cluster-api resource
+func newInformer(dynamicClient dynamic.Interface, gvr schema.GroupVersionResource, namespace string, indexers cache.Indexers, opts informerOptions) cache.SharedIndexInformer {
+	return newFilteredInformer(dynamicClient, gvr, namespace, indexers, labels.Everything(), opts)
+}
+
+// newFilteredInformer creates an informer for the unstructured objects of the given cluster-api resource
+// that match the label selector
+func newFilteredInformer(dynamicClient dynamic.Interface, gvr schema.GroupVersionResource, namespace string, indexers cache.Indexers, selector labels.Selector, opts informerOptions) cache.SharedIndexInformer {
+	return cache.NewSharedIndexInformer(&cache.ListWatch{
+		ListFunc: opts.pagedList(func(options apimachv1.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = selector.String()
+			list, err := dynamicClient.Resource(gvr).Namespace(namespace).List(options)
+			opts.handleError(err)
+			return list, err
+		}),
+		WatchFunc: func(options apimachv1.ListOptions) (watch.Interface, error) {
+			options.LabelSelector = selector.String()
+			w, err := dynamicClient.Resource(gvr).Namespace(namespace).Watch(options)
+			opts.handleError(err)
+			return w, err
+		},
+	}, &unstructured.Unstructured{}, opts.resyncPeriod, indexers)
+}
+
+// namespaceInformers holds the informers of the cluster-api resources of a namespace, keyed by resource
+type namespaceInformers map[string]cache.SharedIndexInformer
+
+func newNamespaceInformers(dynamicClient dynamic.Interface, groupVersion schema.GroupVersion, namespace string, opts informerOptions) namespaceInformers {
+	return namespaceInformers{
+		machineResource:           newMachineInformer(dynamicClient, groupVersion, namespace, labels.Everything(), opts),
+		machineSetResource:        newInformer(dynamicClient, groupVersion.WithResource(machineSetResource), namespace, cache.Indexers{}, opts),
+		machineDeploymentResource: newInformer(dynamicClient, groupVersion.WithResource(machineDeploymentResource), namespace, cache.Indexers{}, opts),
+		clusterResource:           newInformer(dynamicClient, groupVersion.WithResource(clusterResource), namespace, cache.Indexers{}, opts),
+	}
+}
+
+// newMachineInformer creates an informer for the Machines matching the label selector
+func newMachineInformer(dynamicClient dynamic.Interface, groupVersion schema.GroupVersion, namespace string, selector labels.Selector, opts informerOptions) cache.SharedIndexInformer {
+	return newFilteredInformer(dynamicClient, groupVersion.WithResource(machineResource), namespace, cache.Indexers{}, selector, opts)
+}
+
+func newNodeInformer(coreApiClient kubernetes.Interface, opts informerOptions) cache.SharedIndexInformer {
+	return cache.NewSharedIndexInformer(&cache.ListWatch{
+		ListFunc: opts.pagedList(func(options apimachv1.ListOptions) (runtime.Object, error) {
+			return coreApiClient.CoreV1().Nodes().List(options)
+		}),
+		WatchFunc: func(options apimachv1.ListOptions) (watch.Interface, error) {
+			return coreApiClient.CoreV1().Nodes().Watch(options)
+		},
+	}, &v1.Node{}, opts.resyncPeriod, cache.Indexers{nodeProviderIDIndex: indexNodeByProviderID})
+}
+
+func indexNodeByProviderID(obj interface{}) ([]string, error) {
+	node, ok := obj.(*v1.Node)
+	if !ok || node.Spec.ProviderID == "" {
+		return nil, nil
+	}
+	return []string{NormalizeProviderID(node.Spec.ProviderID)}, nil
+}
+
+// fromUnstructured converts an unstructured object of any served cluster-api version into its
+// v1alpha1 counterpart. Fields unknown to v1alpha1 are dropped.
+func fromUnstructured(obj interface{}, into runtime.Object) error {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return fmt.Errorf("expected unstructured object, got %T", obj)
+	}
+	return runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, into)
+}
+
+// machineFromUnstructured converts an unstructured Machine. Newer cluster-api versions renamed the
+// v1alpha1 status.errorReason and status.errorMessage to failureReason and failureMessage, which are
+// carried over.
+func machineFromUnstructured(obj interface{}) (*v1alpha1.Machine, error) {
+	machine := &v1alpha1.Machine{}
+	if err := fromUnstructured(obj, machine); err != nil {
+		return nil, err
+	}
+	u := obj.(*unstructured.Unstructured)
+	if reason, found, _ := unstructured.NestedString(u.Object, "status", "failureReason"); found && machine.Status.ErrorReason == nil {
+		errorReason := common.MachineStatusError(reason)
+		machine.Status.ErrorReason = &errorReason
+	}
+	if message, found, _ := unstructured.NestedString(u.Object, "status", "failureMessage"); found && machine.Status.ErrorMessage == nil {
+		machine.Status.ErrorMessage = &message
+	}
+	return machine, nil
+}
+
+// machinePoolFromUnstructured converts an unstructured MachinePool of any served version
+func machinePoolFromUnstructured(obj interface{}) (*exp.MachinePool, error) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("expected unstructured object, got %T", obj)
+	}
+	mp := &exp.MachinePool{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, mp); err != nil {
+		return nil, err
+	}
+	return mp, nil
+}
+
+// enableMachinePools adds informers for the MachinePools of the given version to all managed namespaces.
+// It must be called before the first refresh.
+func (mm *ClusterapiMachineManager) enableMachinePools(groupVersion schema.GroupVersion) {
+	mm.machinePoolGroupVersion = groupVersion
+	for namespace, informers := range mm.informers {
+		informers[machinePoolResource] = newInformer(mm.dynamicClient, groupVersion.WithResource(machinePoolResource), namespace, cache.Indexers{}, mm.informerOptions)
+	}
+}
+
+// configureInformers recreates the informers with the given options. It must be called before the first
+// refresh and before enableMachinePools and restrictMachinesToCluster.
+func (mm *ClusterapiMachineManager) configureInformers(opts informerOptions) {
+	mm.informerOptions = opts
+	mm.nodeInformer = newNodeInformer(mm.coreApiClient, opts)
+	for namespace := range mm.informers {
+		mm.informers[namespace] = newNamespaceInformers(mm.dynamicClient, mm.groupVersion, namespace, opts)
+	}
+}
+
+// restrictMachinesToCluster only watches the Machines of the named Cluster, so that neither the Machines of
+// other clusters sharing the management cluster are cached nor are their nodes matched, and ignores the node
+// groups of other clusters, see isOtherCluster. The Cluster is identified by its name label. It must be called
+// before the first refresh.
+func (mm *ClusterapiMachineManager) restrictMachinesToCluster(clusterName string) {
+	mm.clusterName = clusterName
+	mm.machineSelector = labels.SelectorFromSet(labels.Set{clusterNameLabel(mm.groupVersion): clusterName})
+	for namespace, informers := range mm.informers {
+		informers[machineResource] = newMachineInformer(mm.dynamicClient, mm.groupVersion, namespace, mm.machineSelector, mm.informerOptions)
+	}
+}
+
+// syncInformers starts the informers on first use and waits until their caches are synced or ctx is done
+func (mm *ClusterapiMachineManager) syncInformers(ctx context.Context) error {
+	select {
+	case <-mm.stopCh:
+		return fmt.Errorf("machine manager is stopped")
+	default:
+	}
+
+	mm.startInformers.Do(func() {
+		mm.validateNamespaces()
+		mm.runInformers([]cache.SharedIndexInformer{mm.nodeInformer}, mm.stopCh)
+		mm.versionLock.Lock()
+		defer mm.versionLock.Unlock()
+		mm.runInformers(mm.objectInformers(), mm.informersStopCh)
+		mm.informersStarted = true
+	})
+
+	informers := mm.allInformers()
+	synced := make([]cache.InformerSynced, len(informers))
+	for i, informer := range informers {
+		synced[i] = informer.HasSynced
+	}
+	if !cache.WaitForCacheSync(ctx.Done(), synced...) {
+		return fmt.Errorf("informer caches not synced: %v", ctx.Err())
+	}
+	return nil
+}
+
+// HasSynced checks without blocking whether the informers were started and their caches are synced
+func (mm *ClusterapiMachineManager) HasSynced() bool {
+	select {
+	case <-mm.stopCh:
+		return false
+	default:
+	}
+	for _, informer := range mm.allInformers() {
+		if !informer.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+// runInformers runs informers until stopCh is closed
+func (mm *ClusterapiMachineManager) runInformers(informers []cache.SharedIndexInformer, stopCh <-chan struct{}) {
+	for _, informer := range informers {
+		mm.informersDone.Add(1)
+		go func(informer cache.SharedIndexInformer) {
+			defer mm.informersDone.Done()
+			informer.Run(stopCh)
+		}(informer)
+	}
+}
+
+// allInformers returns the node informer and the informers of all managed namespaces
+func (mm *ClusterapiMachineManager) allInformers() []cache.SharedIndexInformer {
+	mm.versionLock.RLock()
+	defer mm.versionLock.RUnlock()
+	return append([]cache.SharedIndexInformer{mm.nodeInformer}, mm.objectInformers()...)
+}
+
+// objectInformers returns the informers of the cluster-api objects of all managed namespaces. The caller
+// must hold versionLock.
+func (mm *ClusterapiMachineManager) objectInformers() []cache.SharedIndexInformer {
+	informers := make([]cache.SharedIndexInformer, 0)
+	for _, namespace := range mm.namespaces {
+		for _, informer := range mm.informers[namespace] {
+			informers = append(informers, informer)
+		}
+	}
+	return informers
+}
+
+// WaitForCacheSync starts the informers, if they aren't yet, and blocks until their caches are synced. It fails
+// if ctx is done or the manager is stopped before.
+func (mm *ClusterapiMachineManager) WaitForCacheSync(ctx context.Context) error {
+	return mm.syncInformers(ctx)
+}
+
+// Cleanup stops the informers, closing their watches, and waits for them to terminate. Informers that
+// weren't started yet never will be. Cleanup may be called more than once.
+func (mm *ClusterapiMachineManager) Cleanup() error {
+	mm.startInformers.Do(func() {})
+	mm.stopInformers.Do(func() {
+		mm.versionLock.Lock()
+		defer mm.versionLock.Unlock()
+		close(mm.stopCh)
+		close(mm.informersStopCh)
+	})
+	mm.informersDone.Wait()
+	return nil
+}
+
+// validateNamespaces warns about configured namespaces that don't exist, which is likely a misconfiguration
+func (mm *ClusterapiMachineManager) validateNamespaces() {
+	for _, namespace := range mm.namespaces {
+		if namespace == apimachv1.NamespaceAll {
+			continue
+		}
+		_, err := mm.managementClient.CoreV1().Namespaces().Get(namespace, apimachv1.GetOptions{})
+		if errors.IsNotFound(err) {
+			warningS("Namespace does not exist", "namespace", namespace)
+		} else if err != nil {
+			warningS("Could not check that namespace exists", "namespace", namespace, "err", err)
+		}
+	}
+}
+
+// informersFor returns the informers watching a namespace, or nil if the namespace is not managed
+func (mm *ClusterapiMachineManager) informersFor(namespace string) namespaceInformers {
+	mm.versionLock.RLock()
+	defer mm.versionLock.RUnlock()
+	if informers, ok := mm.informers[namespace]; ok {
+		return informers
+	}
+	return mm.informers[apimachv1.NamespaceAll]
+}
+
+// list returns the unstructured objects of a cluster-api resource in all managed namespaces
+func (mm *ClusterapiMachineManager) list(resource string) []interface{} {
+	mm.versionLock.RLock()
+	defer mm.versionLock.RUnlock()
+	objs := make([]interface{}, 0)
+	for _, namespace := range mm.namespaces {
+		objs = append(objs, mm.informers[namespace][resource].GetStore().List()...)
+	}
+	return objs
+}
+
+// get returns the unstructured object of a cluster-api resource, or nil if it doesn't exist or its namespace
+// is not managed
+func (mm *ClusterapiMachineManager) get(resource, namespace, name string) *unstructured.Unstructured {
+	informer, ok := mm.informersFor(namespace)[resource]
+	if !ok {
+		return nil
+	}
+	obj, exists, err := informer.GetStore().GetByKey(namespace + "/" + name)
+	if err != nil || !exists {
+		return nil
+	}
+	return obj.(*unstructured.Unstructured)
+}
+
+func (mm *ClusterapiMachineManager) getNode(name string) *v1.Node {
+	obj, exists, err := mm.nodeInformer.GetStore().GetByKey(name)
+	if err != nil || !exists {
+		return nil
+	}
+	return obj.(*v1.Node)
+}
+
+// getNodeByProviderID returns the only node with the given providerID, compared after normalization
+func (mm *ClusterapiMachineManager) getNodeByProviderID(providerID string) *v1.Node {
+	objs, err := mm.nodeInformer.GetIndexer().ByIndex(nodeProviderIDIndex, NormalizeProviderID(providerID))
+	if err != nil || len(objs) != 1 {
+		return nil
+	}
+	return objs[0].(*v1.Node)
+}
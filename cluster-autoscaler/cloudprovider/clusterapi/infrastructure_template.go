@@ -0,0 +1,79 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"fmt"
+	apimachv1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	"strings"
+)
+
+// infrastructureTemplateRef returns the reference to the infrastructure template
+// (e.g. an OpenStackMachineTemplate or MachineClass) the machines of a MachineDeployment
+// or MachineSet are created from, or nil if the providerSpec is inlined.
+func infrastructureTemplateRef(obj apimachv1.Object) *v1alpha1.MachineClassRef {
+	valueFrom := machineTemplateOf(obj).Spec.ProviderSpec.ValueFrom
+	if valueFrom == nil || valueFrom.MachineClass == nil || valueFrom.MachineClass.ObjectReference == nil {
+		return nil
+	}
+	return valueFrom.MachineClass
+}
+
+// infrastructureTemplateResource maps a template reference to its resource
+func infrastructureTemplateResource(ref *v1alpha1.MachineClassRef) (schema.GroupVersionResource, error) {
+	return templateResource(ref.APIVersion, ref.Kind, ref.Name)
+}
+
+// templateResource maps the kind of a referenced template to its resource. Like cluster-api
+// itself we assume the resource name is the lowercased plural of the kind.
+func templateResource(apiVersion, kind, name string) (schema.GroupVersionResource, error) {
+	gv, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		return schema.GroupVersionResource{}, err
+	}
+	if kind == "" {
+		return schema.GroupVersionResource{}, fmt.Errorf("template %s has no kind", name)
+	}
+	return gv.WithResource(strings.ToLower(kind) + "s"), nil
+}
+
+// infrastructureTemplateKey identifies the infrastructure template referenced by a MachineDeployment or
+// MachineSet. A reference without namespace refers to the object's namespace.
+func infrastructureTemplateKey(obj apimachv1.Object) (templateKey, error) {
+	ref := infrastructureTemplateRef(obj)
+	if ref == nil {
+		return templateKey{}, fmt.Errorf("%s %s does not reference an infrastructure template", kindOf(obj), obj.GetName())
+	}
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = obj.GetNamespace()
+	}
+	return templateKey{apiVersion: ref.APIVersion, kind: ref.Kind, namespace: namespace, name: ref.Name}, nil
+}
+
+// infrastructureTemplate returns the infrastructure template referenced by a MachineDeployment or MachineSet
+// from the template cache, nil if it doesn't exist
+func (mm *ClusterapiMachineManager) infrastructureTemplate(obj apimachv1.Object) (*unstructured.Unstructured, error) {
+	key, err := infrastructureTemplateKey(obj)
+	if err != nil {
+		return nil, err
+	}
+	return mm.getTemplate(key)
+}
@@ -0,0 +1,197 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"fmt"
+	"k8s.io/api/core/v1"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
+	"k8s.io/autoscaler/cluster-autoscaler/clusterstate"
+	"sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	"strings"
+	"time"
+)
+
+const (
+	// pendingMachinePrefix prefixes the instance ids of machines that have neither a node nor a providerID yet,
+	// and of replicas that have no machine yet
+	pendingMachinePrefix = "clusterapi://"
+
+	machinePhasePending      = "Pending"
+	machinePhaseProvisioning = "Provisioning"
+	machinePhaseProvisioned  = "Provisioned"
+	machinePhaseRunning      = "Running"
+	machinePhaseDeleting     = "Deleting"
+	machinePhaseFailed       = "Failed"
+
+	// RemediateMachineAnnotation marks a Machine a MachineHealthCheck found unhealthy to be remediated by its owner
+	RemediateMachineAnnotation = "cluster.x-k8s.io/remediate-machine"
+	// scaleUpTimeoutErrorCode is the error code of machines that didn't come up within the scale-up timeout
+	scaleUpTimeoutErrorCode = "ScaleUpTimeout"
+	// nodeStartupTimeoutErrorCode is the error code of machines whose node didn't become ready within the node
+	// startup timeout
+	nodeStartupTimeoutErrorCode = "NodeStartupTimeout"
+	// replicasNotRealizedErrorCode is the error code of replicas that cluster-api didn't create within the
+	// replica divergence timeout
+	replicasNotRealizedErrorCode = "ReplicasNotRealized"
+
+	// ownerRemediatedCondition is set to false by a MachineHealthCheck until the owner remediated the Machine
+	ownerRemediatedCondition = "OwnerRemediated"
+)
+
+// instanceId returns the id of a machine's instance, which is its node's providerID once registered. The id
+// is not normalized, as the autoscaler compares it to the providerIDs of the nodes as they are. It is
+// resolved to the node group by its normalized form, see NormalizeProviderID.
+func instanceId(machine *v1alpha1.Machine, node *v1.Node) string {
+	if node != nil && node.Spec.ProviderID != "" {
+		return node.Spec.ProviderID
+	}
+	if machine.Spec.ProviderID != nil && *machine.Spec.ProviderID != "" {
+		return *machine.Spec.ProviderID
+	}
+	return pendingMachinePrefix + machine.Namespace + "/" + machine.Name
+}
+
+// pendingMachineKey returns the namespace and name of the machine of an instance id of a machine that has neither
+// a node nor a providerID yet, see instanceId. ok is false for other ids, including those of uncreated replicas.
+func pendingMachineKey(id string) (namespace, name string, ok bool) {
+	if !strings.HasPrefix(id, pendingMachinePrefix) {
+		return "", "", false
+	}
+	parts := strings.Split(strings.TrimPrefix(id, pendingMachinePrefix), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// unregisteredNode checks whether a node is the autoscaler's stand-in for the instance of a machine that hasn't
+// registered a node, named like the instance id. Unlike real nodes, it has no uid.
+func unregisteredNode(node *v1.Node, machine *v1alpha1.Machine) bool {
+	return node.UID == "" && machine.Status.NodeRef == nil
+}
+
+// machineDeleting checks whether a machine is being deleted, by its deletion timestamp or its phase, which may
+// be seen before the deletion timestamp. Its node still exists until the machine is gone, but is going away.
+func machineDeleting(machine *v1alpha1.Machine) bool {
+	return machine.DeletionTimestamp != nil || (machine.Status.Phase != nil && *machine.Status.Phase == machinePhaseDeleting)
+}
+
+// machineRemediating checks whether a MachineHealthCheck flagged a machine for remediation, i.e. its
+// owner will delete and replace it
+func machineRemediating(machine *v1alpha1.Machine) bool {
+	if _, ok := machine.Annotations[RemediateMachineAnnotation]; ok {
+		return true
+	}
+	for _, condition := range machine.Status.Conditions {
+		if string(condition.Type) == ownerRemediatedCondition && condition.Status == v1.ConditionFalse {
+			return true
+		}
+	}
+	return false
+}
+
+// instanceStatus maps a machine's phase to the state of its instance. Machines without a phase, as
+// set by old cluster-api versions, are running once their node has registered and creating before.
+func instanceStatus(machine *v1alpha1.Machine, node *v1.Node) *cloudprovider.InstanceStatus {
+	status := &cloudprovider.InstanceStatus{}
+
+	phase := ""
+	if machine.Status.Phase != nil {
+		phase = *machine.Status.Phase
+	}
+	switch {
+	case machineDeleting(machine):
+		status.State = cloudprovider.InstanceDeleting
+	case machineRemediating(machine):
+		// the machine is about to be replaced, so it doesn't provide capacity
+		status.State = cloudprovider.InstanceDeleting
+	case phase == machinePhaseRunning:
+		status.State = cloudprovider.InstanceRunning
+	case phase == machinePhasePending || phase == machinePhaseProvisioning || phase == machinePhaseProvisioned:
+		status.State = cloudprovider.InstanceCreating
+	case node != nil:
+		status.State = cloudprovider.InstanceRunning
+	default:
+		// includes failed machines that never registered, whose creation has failed
+		status.State = cloudprovider.InstanceCreating
+	}
+
+	if machine.Status.ErrorReason != nil || machine.Status.ErrorMessage != nil || phase == machinePhaseFailed {
+		status.ErrorInfo = &cloudprovider.InstanceErrorInfo{
+			ErrorClass: cloudprovider.OtherErrorClass,
+		}
+		if machine.Status.ErrorReason != nil {
+			status.ErrorInfo.ErrorCode = string(*machine.Status.ErrorReason)
+		}
+		if machine.Status.ErrorMessage != nil {
+			status.ErrorInfo.ErrorMessage = *machine.Status.ErrorMessage
+		}
+	}
+	return status
+}
+
+// failStuckCreation reports a machine that is still being created as a failed placement if its creation failed
+// or it didn't come up within the scale-up timeout, e.g. because the infrastructure is out of quota. The
+// autoscaler then backs off its node group instead of waiting for the machine. A zero timeout never expires.
+func failStuckCreation(status *cloudprovider.InstanceStatus, machine *v1alpha1.Machine, timeout time.Duration, now time.Time) {
+	if status.State != cloudprovider.InstanceCreating {
+		return
+	}
+	if status.ErrorInfo != nil {
+		status.ErrorInfo.ErrorClass = cloudprovider.OutOfResourcesErrorClass
+		return
+	}
+	if timeout > 0 && now.Sub(machine.CreationTimestamp.Time) > timeout {
+		status.ErrorInfo = &cloudprovider.InstanceErrorInfo{
+			ErrorClass:   cloudprovider.OutOfResourcesErrorClass,
+			ErrorCode:    scaleUpTimeoutErrorCode,
+			ErrorMessage: fmt.Sprintf("machine %s not running after %v", machine.Name, timeout),
+		}
+	}
+}
+
+// failStuckStartup reports a running machine as a failed placement if its node registered but didn't become ready
+// within the node startup timeout, e.g. because of a broken image. Nodes that were ready before and are unready
+// now failed after starting and are left to the autoscaler's unready node handling. A zero timeout never expires.
+func failStuckStartup(status *cloudprovider.InstanceStatus, machine *v1alpha1.Machine, node *v1.Node, timeout time.Duration,
+	now time.Time) {
+	if status.State != cloudprovider.InstanceRunning || status.ErrorInfo != nil || timeout == 0 || node == nil {
+		return
+	}
+	if !nodeStarting(node) || now.Sub(machine.CreationTimestamp.Time) <= timeout {
+		return
+	}
+	status.State = cloudprovider.InstanceCreating
+	status.ErrorInfo = &cloudprovider.InstanceErrorInfo{
+		ErrorClass:   cloudprovider.OutOfResourcesErrorClass,
+		ErrorCode:    nodeStartupTimeoutErrorCode,
+		ErrorMessage: fmt.Sprintf("node %s of machine %s not ready after %v", node.Name, machine.Name, timeout),
+	}
+}
+
+// nodeStarting checks whether a node has never been ready, like the autoscaler does: its ready condition hasn't
+// changed since it was set shortly after the node's creation. Nodes without ready condition aren't starting.
+func nodeStarting(node *v1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == v1.NodeReady {
+			return condition.Status != v1.ConditionTrue &&
+				condition.LastTransitionTime.Time.Sub(node.CreationTimestamp.Time) < clusterstate.MaxStatusSettingDelayAfterCreation
+		}
+	}
+	return false
+}
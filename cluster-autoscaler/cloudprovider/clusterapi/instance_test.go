@@ -0,0 +1,246 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
+	"k8s.io/autoscaler/cluster-autoscaler/utils/test"
+	"sigs.k8s.io/cluster-api/pkg/apis/cluster/common"
+	"testing"
+	"time"
+)
+
+func TestInstanceId(t *testing.T) {
+	ms := buildTestStandaloneMachineSet("ms", 1, 0, 5)
+	n := buildTestNode("n")
+	m := buildTestMachine(ms, "m", n)
+	assert.Equal(t, "n", instanceId(m, n))
+	assert.Equal(t, "n", instanceId(m, nil))
+
+	pending := buildTestMachine(ms, "pending", nil)
+	assert.Equal(t, "clusterapi://kube-system/pending", instanceId(pending, nil))
+}
+
+func TestInstanceStatus(t *testing.T) {
+	ms := buildTestStandaloneMachineSet("ms", 1, 0, 5)
+	n := buildTestNode("n")
+
+	for _, tc := range []struct {
+		phase    string
+		node     bool
+		expected cloudprovider.InstanceState
+	}{
+		{"", true, cloudprovider.InstanceRunning},
+		{"", false, cloudprovider.InstanceCreating},
+		{machinePhasePending, false, cloudprovider.InstanceCreating},
+		{machinePhaseProvisioning, false, cloudprovider.InstanceCreating},
+		{machinePhaseProvisioned, true, cloudprovider.InstanceCreating},
+		{machinePhaseRunning, true, cloudprovider.InstanceRunning},
+		{machinePhaseDeleting, true, cloudprovider.InstanceDeleting},
+		{machinePhaseFailed, false, cloudprovider.InstanceCreating},
+		{machinePhaseFailed, true, cloudprovider.InstanceRunning},
+	} {
+		m := buildTestMachine(ms, "m", nil)
+		node := n
+		if !tc.node {
+			node = nil
+		}
+		if tc.phase != "" {
+			phase := tc.phase
+			m.Status.Phase = &phase
+		}
+		status := instanceStatus(m, node)
+		assert.Equal(t, tc.expected, status.State, "phase %q, node %v", tc.phase, tc.node)
+		assert.Equal(t, tc.phase == machinePhaseFailed, status.ErrorInfo != nil, "phase %q, node %v", tc.phase, tc.node)
+	}
+}
+
+func TestInstanceStatusDeletionTimestamp(t *testing.T) {
+	m := buildTestMachine(nil, "m", buildTestNode("n"))
+	now := v1.Now()
+	m.DeletionTimestamp = &now
+	assert.Equal(t, cloudprovider.InstanceDeleting, instanceStatus(m, nil).State)
+}
+
+func TestPendingMachineKey(t *testing.T) {
+	namespace, name, ok := pendingMachineKey(instanceId(buildTestMachine(nil, "m", nil), nil))
+	assert.True(t, ok)
+	assert.Equal(t, "kube-system", namespace)
+	assert.Equal(t, "m", name)
+
+	for _, id := range []string{"clusterapi://kube-system/md/uncreated-0", "clusterapi://m", "openstack:///m", "m"} {
+		_, _, ok = pendingMachineKey(id)
+		assert.False(t, ok, id)
+	}
+}
+
+func TestMachineDeleting(t *testing.T) {
+	m := buildTestMachine(nil, "m", buildTestNode("n"))
+	assert.False(t, machineDeleting(m))
+
+	phase := machinePhaseDeleting
+	m.Status.Phase = &phase
+	assert.True(t, machineDeleting(m))
+
+	m.Status.Phase = nil
+	now := v1.Now()
+	m.DeletionTimestamp = &now
+	assert.True(t, machineDeleting(m))
+}
+
+func TestInstanceStatusRemediating(t *testing.T) {
+	n := buildTestNode("n")
+	running := machinePhaseRunning
+
+	m := buildTestMachine(nil, "m", n)
+	m.Status.Phase = &running
+	assert.Equal(t, cloudprovider.InstanceRunning, instanceStatus(m, n).State)
+
+	m.Annotations = map[string]string{RemediateMachineAnnotation: ""}
+	assert.Equal(t, cloudprovider.InstanceDeleting, instanceStatus(m, n).State)
+
+	m = buildTestMachine(nil, "m", n)
+	m.Status.Phase = &running
+	m.Status.Conditions = []apiv1.NodeCondition{{Type: ownerRemediatedCondition, Status: apiv1.ConditionTrue}}
+	assert.Equal(t, cloudprovider.InstanceRunning, instanceStatus(m, n).State)
+
+	m.Status.Conditions[0].Status = apiv1.ConditionFalse
+	assert.Equal(t, cloudprovider.InstanceDeleting, instanceStatus(m, n).State)
+}
+
+func TestInstanceStatusErrorInfo(t *testing.T) {
+	m := buildTestMachine(nil, "m", nil)
+	reason := common.CreateMachineError
+	message := "quota exceeded"
+	m.Status.ErrorReason = &reason
+	m.Status.ErrorMessage = &message
+
+	status := instanceStatus(m, nil)
+	assert.Equal(t, cloudprovider.InstanceCreating, status.State)
+	assert.Equal(t, &cloudprovider.InstanceErrorInfo{
+		ErrorClass:   cloudprovider.OtherErrorClass,
+		ErrorCode:    "CreateError",
+		ErrorMessage: "quota exceeded",
+	}, status.ErrorInfo)
+}
+
+func TestFailStuckCreation(t *testing.T) {
+	now := time.Now()
+	m := buildTestMachine(nil, "m", nil)
+	m.CreationTimestamp = v1.NewTime(now.Add(-10 * time.Minute))
+
+	status := instanceStatus(m, nil)
+	failStuckCreation(status, m, 15*time.Minute, now)
+	assert.Nil(t, status.ErrorInfo)
+
+	failStuckCreation(status, m, 5*time.Minute, now)
+	assert.Equal(t, &cloudprovider.InstanceErrorInfo{
+		ErrorClass:   cloudprovider.OutOfResourcesErrorClass,
+		ErrorCode:    scaleUpTimeoutErrorCode,
+		ErrorMessage: "machine m not running after 5m0s",
+	}, status.ErrorInfo)
+
+	status = instanceStatus(m, nil)
+	failStuckCreation(status, m, 0, now)
+	assert.Nil(t, status.ErrorInfo)
+
+	reason := common.CreateMachineError
+	m.Status.ErrorReason = &reason
+	status = instanceStatus(m, nil)
+	failStuckCreation(status, m, 15*time.Minute, now)
+	assert.Equal(t, cloudprovider.OutOfResourcesErrorClass, status.ErrorInfo.ErrorClass)
+	assert.Equal(t, "CreateError", status.ErrorInfo.ErrorCode)
+
+	// running machines keep their errors
+	n := buildTestNode("n")
+	running := machinePhaseRunning
+	m.Status.Phase = &running
+	status = instanceStatus(m, n)
+	failStuckCreation(status, m, time.Minute, now)
+	assert.Equal(t, cloudprovider.OtherErrorClass, status.ErrorInfo.ErrorClass)
+}
+
+func TestFailStuckStartup(t *testing.T) {
+	now := time.Now()
+	m := buildTestMachine(nil, "m", nil)
+	m.CreationTimestamp = v1.NewTime(now.Add(-20 * time.Minute))
+	running := machinePhaseRunning
+	m.Status.Phase = &running
+	n := buildTestNode("n")
+	n.CreationTimestamp = v1.NewTime(now.Add(-18 * time.Minute))
+	test.SetNodeReadyState(n, false, n.CreationTimestamp.Add(10*time.Second))
+
+	status := instanceStatus(m, n)
+	failStuckStartup(status, m, n, 30*time.Minute, now)
+	assert.Equal(t, cloudprovider.InstanceRunning, status.State)
+	assert.Nil(t, status.ErrorInfo)
+
+	failStuckStartup(status, m, n, 15*time.Minute, now)
+	assert.Equal(t, cloudprovider.InstanceCreating, status.State)
+	assert.Equal(t, &cloudprovider.InstanceErrorInfo{
+		ErrorClass:   cloudprovider.OutOfResourcesErrorClass,
+		ErrorCode:    nodeStartupTimeoutErrorCode,
+		ErrorMessage: "node n of machine m not ready after 15m0s",
+	}, status.ErrorInfo)
+
+	status = instanceStatus(m, n)
+	failStuckStartup(status, m, n, 0, now)
+	assert.Nil(t, status.ErrorInfo)
+
+	// a node that was ready before failed after starting
+	test.SetNodeReadyState(n, false, now.Add(-time.Minute))
+	status = instanceStatus(m, n)
+	failStuckStartup(status, m, n, 15*time.Minute, now)
+	assert.Equal(t, cloudprovider.InstanceRunning, status.State)
+	assert.Nil(t, status.ErrorInfo)
+
+	test.SetNodeReadyState(n, true, now.Add(-time.Minute))
+	status = instanceStatus(m, n)
+	failStuckStartup(status, m, n, 15*time.Minute, now)
+	assert.Nil(t, status.ErrorInfo)
+}
+
+func TestNodeStartupTimeout(t *testing.T) {
+	md := buildTestMachineDeployment("md", 1, 0, 10)
+	assert.Equal(t, 15*time.Minute, nodeStartupTimeout(md, 15*time.Minute))
+
+	md.Annotations[NodeStartupTimeoutAnnotation] = "40m"
+	assert.Equal(t, 40*time.Minute, nodeStartupTimeout(md, 15*time.Minute))
+
+	md.Annotations[NodeStartupTimeoutAnnotation] = "0s"
+	assert.Equal(t, time.Duration(0), nodeStartupTimeout(md, 15*time.Minute))
+
+	md.Annotations[NodeStartupTimeoutAnnotation] = "-1m"
+	assert.Equal(t, 15*time.Minute, nodeStartupTimeout(md, 15*time.Minute))
+}
+
+func TestScaleUpTimeout(t *testing.T) {
+	md := buildTestMachineDeployment("md", 1, 0, 10)
+	assert.Equal(t, defaultScaleUpTimeout, scaleUpTimeout(md))
+
+	md.Annotations[ScaleUpTimeoutAnnotation] = "30m"
+	assert.Equal(t, 30*time.Minute, scaleUpTimeout(md))
+
+	md.Annotations[ScaleUpTimeoutAnnotation] = "0s"
+	assert.Equal(t, time.Duration(0), scaleUpTimeout(md))
+
+	md.Annotations[ScaleUpTimeoutAnnotation] = "later"
+	assert.Equal(t, defaultScaleUpTimeout, scaleUpTimeout(md))
+}
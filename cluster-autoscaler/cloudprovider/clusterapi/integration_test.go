@@ -0,0 +1,320 @@
+//go:build integration
+// +build integration
+
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The integration tests exercise the machine manager and the cloud provider against a real API server, the one
+// of $KUBECONFIG, which serves as both workload and management cluster. That may be a kind cluster or the API
+// server and etcd of envtest's assets. envtest itself isn't vendored, so it can't start the API server from
+// here. The cluster-api CRDs are installed if missing. Run the tests with:
+//
+//	KUBECONFIG=<kubeconfig> go test -tags integration -run Integration ./cloudprovider/clusterapi/
+
+package clusterapi
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// integrationGroupVersion is the cluster-api version the integration tests install and use
+var integrationGroupVersion = schema.GroupVersion{Group: "cluster.x-k8s.io", Version: "v1alpha3"}
+
+var crdGroupVersionResource = schema.GroupVersionResource{Group: "apiextensions.k8s.io", Version: "v1", Resource: "customresourcedefinitions"}
+
+// integrationEnv holds the clients of the API server of an integration test and the objects it created
+// outside of its namespace
+type integrationEnv struct {
+	config    *rest.Config
+	core      kubernetes.Interface
+	dynamic   dynamic.Interface
+	namespace string
+	nodes     []string
+}
+
+// newIntegrationEnv connects to the API server of $KUBECONFIG, skipping the test if it's unset, installs the
+// cluster-api CRDs and creates a namespace. Call cleanup() when the test ends.
+func newIntegrationEnv(t *testing.T) *integrationEnv {
+	kubeconfig := os.Getenv("KUBECONFIG")
+	if kubeconfig == "" {
+		t.Skip("KUBECONFIG not set")
+	}
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &integrationEnv{
+		config:    config,
+		core:      kubernetes.NewForConfigOrDie(config),
+		dynamic:   dynamic.NewForConfigOrDie(config),
+		namespace: "clusterapi-autoscaler-" + uuid.New().String()[:8],
+	}
+
+	for _, kind := range []string{"Machine", "MachineSet", "MachineDeployment"} {
+		_, err := env.dynamic.Resource(crdGroupVersionResource).Create(buildIntegrationCRD(kind), metav1.CreateOptions{})
+		if err != nil && !apierrors.IsAlreadyExists(err) {
+			t.Fatalf("Couldn't install CRD of %s: %v", kind, err)
+		}
+	}
+	discoveryClient := discovery.NewDiscoveryClientForConfigOrDie(config)
+	err = wait.PollImmediate(100*time.Millisecond, 30*time.Second, func() (bool, error) {
+		return servesResource(discoveryClient, integrationGroupVersion, machineResource) &&
+			servesResource(discoveryClient, integrationGroupVersion, machineSetResource) &&
+			servesResource(discoveryClient, integrationGroupVersion, machineDeploymentResource), nil
+	})
+	if err != nil {
+		t.Fatalf("CRDs not served: %v", err)
+	}
+
+	if _, err := env.core.CoreV1().Namespaces().Create(&apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: env.namespace}}); err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+// cleanup deletes the namespace and the nodes of the test
+func (env *integrationEnv) cleanup() {
+	_ = env.core.CoreV1().Namespaces().Delete(env.namespace, &metav1.DeleteOptions{})
+	for _, node := range env.nodes {
+		_ = env.core.CoreV1().Nodes().Delete(node, &metav1.DeleteOptions{})
+	}
+}
+
+// createNode creates a node of the workload cluster with a unique name and providerID
+func (env *integrationEnv) createNode(t *testing.T, name string) *apiv1.Node {
+	node := buildTestNode(env.namespace + "-" + name)
+	node.Spec.ProviderID = fmt.Sprintf("openstack:///%s", uuid.New().String())
+	created, err := env.core.CoreV1().Nodes().Create(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.nodes = append(env.nodes, created.Name)
+	return created
+}
+
+// buildIntegrationCRD builds a CRD of a cluster-api kind that keeps all fields and serves the status and
+// scale subresources like the CRDs of cluster-api
+func buildIntegrationCRD(kind string) *unstructured.Unstructured {
+	plural := strings.ToLower(kind) + "s"
+	preserved := map[string]interface{}{"type": "object", "x-kubernetes-preserve-unknown-fields": true}
+	version := map[string]interface{}{
+		"name":    integrationGroupVersion.Version,
+		"served":  true,
+		"storage": true,
+		"schema": map[string]interface{}{
+			"openAPIV3Schema": map[string]interface{}{
+				"type":                                 "object",
+				"x-kubernetes-preserve-unknown-fields": true,
+				"properties": map[string]interface{}{
+					"spec":   preserved,
+					"status": preserved,
+				},
+			},
+		},
+		"subresources": map[string]interface{}{
+			"status": map[string]interface{}{},
+		},
+	}
+	if kind != "Machine" {
+		version["subresources"].(map[string]interface{})["scale"] = map[string]interface{}{
+			"specReplicasPath":   ".spec.replicas",
+			"statusReplicasPath": ".status.replicas",
+		}
+	}
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apiextensions.k8s.io/v1",
+		"kind":       "CustomResourceDefinition",
+		"metadata": map[string]interface{}{
+			"name": plural + "." + integrationGroupVersion.Group,
+		},
+		"spec": map[string]interface{}{
+			"group": integrationGroupVersion.Group,
+			"scope": "Namespaced",
+			"names": map[string]interface{}{
+				"kind":     kind,
+				"listKind": kind + "List",
+				"plural":   plural,
+				"singular": strings.ToLower(kind),
+			},
+			"versions": []interface{}{version},
+		},
+	}}
+}
+
+// create creates a typed cluster-api object in the namespace of the test and replaces it by the created one,
+// which carries the UID assigned by the API server
+func (env *integrationEnv) create(t *testing.T, resource, kind string, obj runtime.Object) {
+	obj.GetObjectKind().SetGroupVersionKind(integrationGroupVersion.WithKind(kind))
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &unstructured.Unstructured{Object: content}
+	u.SetNamespace(env.namespace)
+	u.SetUID("")
+	u.SetSelfLink("")
+	u.SetCreationTimestamp(metav1.Time{})
+
+	client := env.dynamic.Resource(integrationGroupVersion.WithResource(resource)).Namespace(env.namespace)
+	created, err := client.Create(u, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("Couldn't create %s %s: %v", kind, u.GetName(), err)
+	}
+	// the status subresource ignores the status on create
+	if status, ok := content["status"]; ok {
+		created.Object["status"] = status
+		if created, err = client.UpdateStatus(created, metav1.UpdateOptions{}); err != nil {
+			t.Fatalf("Couldn't update status of %s %s: %v", kind, u.GetName(), err)
+		}
+	}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(created.Object, obj); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// get reads a cluster-api object of the namespace of the test
+func (env *integrationEnv) get(t *testing.T, resource, name string) *unstructured.Unstructured {
+	u, err := env.dynamic.Resource(integrationGroupVersion.WithResource(resource)).Namespace(env.namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// controllerRef returns a controller owner reference to a created cluster-api object
+func controllerRef(kind string, obj metav1.Object) []metav1.OwnerReference {
+	return []metav1.OwnerReference{{
+		APIVersion: integrationGroupVersion.String(),
+		Kind:       kind,
+		Name:       obj.GetName(),
+		UID:        obj.GetUID(),
+		Controller: boolPtr(true),
+	}}
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func TestIntegrationScaleMachineDeployment(t *testing.T) {
+	env := newIntegrationEnv(t)
+	defer env.cleanup()
+
+	node := env.createNode(t, "n")
+
+	md := buildTestMachineDeployment("md", 1, 0, 10)
+	env.create(t, machineDeploymentResource, "MachineDeployment", md)
+	ms := buildTestMachineSet(nil, "ms", 1)
+	ms.OwnerReferences = controllerRef("MachineDeployment", md)
+	env.create(t, machineSetResource, "MachineSet", ms)
+	m := buildTestMachine(nil, "m", node)
+	m.OwnerReferences = controllerRef("MachineSet", ms)
+	env.create(t, machineResource, "Machine", m)
+
+	mm, err := NewMachineManager(env.config, env.config, MachineManagerOptions{Namespaces: []string{env.namespace}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	groupVersion, _ := mm.versions()
+	assert.Equal(t, integrationGroupVersion, groupVersion)
+	provider, err := BuildClusterapiCloudProvider(mm, cloudprovider.NewResourceLimiter(nil, nil), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Cleanup()
+
+	nodeGroups := provider.NodeGroups()
+	if !assert.Len(t, nodeGroups, 1) {
+		return
+	}
+	assert.Equal(t, env.namespace+"/md", nodeGroups[0].Id())
+	if found := mm.DeploymentForNode(node); assert.NotNil(t, found) {
+		assert.Equal(t, md.UID, found.UID)
+	}
+	ng, err := provider.NodeGroupForNode(node)
+	if !assert.NoError(t, err) || !assert.NotNil(t, ng) {
+		return
+	}
+	assert.Equal(t, nodeGroups[0].Id(), ng.Id())
+
+	// the replicas are set through the scale subresource of the CRD
+	if !assert.NoError(t, ng.IncreaseSize(1)) {
+		return
+	}
+	replicas, _, _ := unstructured.NestedInt64(env.get(t, machineDeploymentResource, "md").Object, "spec", "replicas")
+	assert.Equal(t, int64(2), replicas)
+
+	if !assert.NoError(t, ng.DeleteNodes([]*apiv1.Node{node})) {
+		return
+	}
+	replicas, _, _ = unstructured.NestedInt64(env.get(t, machineDeploymentResource, "md").Object, "spec", "replicas")
+	assert.Equal(t, int64(1), replicas)
+	assert.Contains(t, env.get(t, machineResource, "m").GetAnnotations(), DeleteMachineAnnotation)
+}
+
+func TestIntegrationRefreshSeesChanges(t *testing.T) {
+	env := newIntegrationEnv(t)
+	defer env.cleanup()
+
+	md := buildTestMachineDeployment("md", 1, 0, 10)
+	env.create(t, machineDeploymentResource, "MachineDeployment", md)
+	mm, err := NewMachineManager(env.config, env.config, MachineManagerOptions{Namespaces: []string{env.namespace}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mm.Cleanup()
+	if !assert.NoError(t, mm.WaitForCacheSync(context.TODO())) || !assert.NoError(t, mm.Refresh(context.TODO())) {
+		return
+	}
+	if !assert.Len(t, mm.AllDeployments(), 1) {
+		return
+	}
+
+	// a MachineDeployment that isn't autoscaled anymore is dropped by the next refresh once the informers saw it
+	patch := []byte(fmt.Sprintf(`{"metadata":{"annotations":{%q:null,%q:null}}}`, MinSizeAnnotation, MaxSizeAnnotation))
+	_, err = env.dynamic.Resource(integrationGroupVersion.WithResource(machineDeploymentResource)).Namespace(env.namespace).
+		Patch("md", types.MergePatchType, patch, metav1.UpdateOptions{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, wait.PollImmediate(100*time.Millisecond, 10*time.Second, func() (bool, error) {
+		if err := mm.Refresh(context.TODO()); err != nil {
+			return false, err
+		}
+		return len(mm.AllDeployments()) == 0, nil
+	}))
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"fmt"
+	apimachv1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+	"strings"
+)
+
+// The vendored klog predates klog/v2 and its structured logging, and the rest of the autoscaler still
+// uses it. Until klog/v2 is vendored, infoS, warningS and errorS write their messages in the format of
+// klog/v2's InfoS and ErrorS, a quoted message followed by key="value" pairs, so that the logs of a single
+// node group can be filtered already and the calls can be migrated one-to-one.
+
+// infoS logs a message with key/value pairs like klog/v2's InfoS
+func infoS(msg string, keysAndValues ...interface{}) {
+	klog.InfoDepth(1, formatS(msg, nil, keysAndValues))
+}
+
+// verboseInfoS logs a message with key/value pairs like klog/v2's V(level).InfoS
+func verboseInfoS(level klog.Level, msg string, keysAndValues ...interface{}) {
+	if klog.V(level) {
+		klog.InfoDepth(1, formatS(msg, nil, keysAndValues))
+	}
+}
+
+// warningS logs a warning with key/value pairs. klog/v2 has no WarningS, its InfoS is used there.
+func warningS(msg string, keysAndValues ...interface{}) {
+	klog.WarningDepth(1, formatS(msg, nil, keysAndValues))
+}
+
+// errorS logs an error with key/value pairs like klog/v2's ErrorS
+func errorS(err error, msg string, keysAndValues ...interface{}) {
+	klog.ErrorDepth(1, formatS(msg, err, keysAndValues))
+}
+
+// formatS formats a message, an optional error and key/value pairs like klog/v2's text format
+func formatS(msg string, err error, keysAndValues []interface{}) string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "%q", msg)
+	if err != nil {
+		writeKeyValue(b, "err", err)
+	}
+	for i := 0; i < len(keysAndValues); i += 2 {
+		var value interface{} = "(MISSING)"
+		if i+1 < len(keysAndValues) {
+			value = keysAndValues[i+1]
+		}
+		writeKeyValue(b, keysAndValues[i], value)
+	}
+	return b.String()
+}
+
+func writeKeyValue(b *strings.Builder, key, value interface{}) {
+	switch v := value.(type) {
+	case string:
+		fmt.Fprintf(b, " %s=%q", key, v)
+	case error:
+		fmt.Fprintf(b, " %s=%q", key, v.Error())
+	case fmt.Stringer:
+		fmt.Fprintf(b, " %s=%q", key, v.String())
+	default:
+		fmt.Fprintf(b, " %s=%+v", key, v)
+	}
+}
+
+// objectKeys returns the key/value pairs identifying a cluster-api object, its namespace and its name keyed
+// by its lowercase kind, e.g. namespace="tenant-a" machinedeployment="workers"
+func objectKeys(obj apimachv1.Object) []interface{} {
+	return []interface{}{"namespace", obj.GetNamespace(), strings.ToLower(kindOf(obj)), obj.GetName()}
+}
@@ -0,0 +1,43 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	apimachv1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider/clusterapi/exp"
+	"sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	"testing"
+	"time"
+)
+
+func TestFormatS(t *testing.T) {
+	assert.Equal(t, `"Scaled up node group" namespace="tenant-a" from=1 to=3 backoff="5s"`,
+		formatS("Scaled up node group", nil, []interface{}{"namespace", "tenant-a", "from", 1, "to", 3, "backoff", 5 * time.Second}))
+	assert.Equal(t, `"Refresh failed" err="timeout" operation="Refresh"`,
+		formatS("Refresh failed", errors.New("timeout"), []interface{}{"operation", "Refresh"}))
+	assert.Equal(t, `"Odd" machines=[a b] key="(MISSING)"`, formatS("Odd", nil, []interface{}{"machines", []string{"a", "b"}, "key"}))
+}
+
+func TestObjectKeys(t *testing.T) {
+	meta := apimachv1.ObjectMeta{Namespace: "tenant-a", Name: "workers"}
+	assert.Equal(t, []interface{}{"namespace", "tenant-a", "machinedeployment", "workers"},
+		objectKeys(&v1alpha1.MachineDeployment{ObjectMeta: meta}))
+	assert.Equal(t, []interface{}{"namespace", "tenant-a", "machineset", "workers"}, objectKeys(&v1alpha1.MachineSet{ObjectMeta: meta}))
+	assert.Equal(t, []interface{}{"namespace", "tenant-a", "machinepool", "workers"}, objectKeys(&exp.MachinePool{ObjectMeta: meta}))
+}
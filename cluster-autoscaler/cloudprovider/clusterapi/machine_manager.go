@@ -17,251 +17,1751 @@ limitations under the License.
 package clusterapi
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	apimachv1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider/clusterapi/exp"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
-	"k8s.io/klog"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/client-go/util/workqueue"
 	"sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
-	clusterclientset "sigs.k8s.io/cluster-api/pkg/client/clientset_generated/clientset"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
-	// MinSizeAnnotation sets a MachineDeployment's minimum size during autoscaling
-	MinSizeAnnotation = "cluster-autoscaler/min-size"
-	// MaxSizeAnnotation sets a MachineDeployment's maximum size during autoscaling
-	MaxSizeAnnotation = "cluster-autoscaler/max-size"
+	refreshBackoffInitial = 5 * time.Second
+	refreshBackoffMax     = 5 * time.Minute
+	refreshBackoffJitter  = 0.1
 )
 
-// MachineDeploymentAttrs holds parsed-out attributes of a MD
+// startupRefreshBackoff retries the initial refresh on startup. Its delays outlast the jittered refresh backoff
+// of the machine manager after as many failures, during which its refreshes fail right away.
+var startupRefreshBackoff = wait.Backoff{
+	Duration: time.Duration(float64(refreshBackoffInitial) * (1 + refreshBackoffJitter)),
+	Factor:   2.0,
+	Jitter:   0.5,
+}
+
+// markForDeletionBackoff retries conflicting delete-machine annotation patches, e.g. when an admission
+// webhook rejects a concurrent change. The jitter spreads the retries of the machines of a batch.
+var markForDeletionBackoff = wait.Backoff{
+	Steps:    5,
+	Duration: 50 * time.Millisecond,
+	Factor:   2.0,
+	Jitter:   0.5,
+}
+
+const (
+	// MinSizeAnnotation sets a MachineDeployment's or MachineSet's minimum size during autoscaling
+	MinSizeAnnotation = "cluster.x-k8s.io/cluster-api-autoscaler-node-group-min-size"
+	// MaxSizeAnnotation sets a MachineDeployment's or MachineSet's maximum size during autoscaling
+	MaxSizeAnnotation = "cluster.x-k8s.io/cluster-api-autoscaler-node-group-max-size"
+
+	// LegacyMinSizeAnnotation is the deprecated predecessor of MinSizeAnnotation
+	LegacyMinSizeAnnotation = "cluster-autoscaler/min-size"
+	// LegacyMaxSizeAnnotation is the deprecated predecessor of MaxSizeAnnotation
+	LegacyMaxSizeAnnotation = "cluster-autoscaler/max-size"
+
+	// DeleteMachineAnnotation marks a Machine to be deleted first when its MachineSet is scaled down
+	DeleteMachineAnnotation = "cluster.x-k8s.io/delete-machine"
+
+	// AutoprovisionedAnnotation marks a MachineDeployment created by the autoscaler's node autoprovisioning
+	AutoprovisionedAnnotation = "autoscaler.syseleven.de/autoprovisioned"
+
+	// ScaleDownDisabledAnnotation protects a Machine from being deleted by the autoscaler, like the node annotation of the same name
+	ScaleDownDisabledAnnotation = "cluster-autoscaler.kubernetes.io/scale-down-disabled"
+	// DeletionCostAnnotation sets the integer cost of deleting a Machine, defaults to 0. Cheaper machines are deleted first.
+	DeletionCostAnnotation = "autoscaler.syseleven.de/deletion-cost"
+
+	// EnabledAnnotation set to "false" excludes a MachineDeployment from autoscaling, regardless of its other annotations
+	EnabledAnnotation = "autoscaler.syseleven.de/enabled"
+
+	// PausedAnnotation pauses the reconciliation of a MachineDeployment or Cluster; paused node groups are not autoscaled
+	PausedAnnotation = "cluster.x-k8s.io/paused"
+
+	// ScaleTargetAnnotation set to ScaleTargetMachineSet makes the autoscaler scale the active MachineSet of a
+	// MachineDeployment instead of the MachineDeployment itself, e.g. if an external controller owns its replicas
+	ScaleTargetAnnotation = "autoscaler.syseleven.de/scale-target"
+	// ScaleTargetMachineSet is the value of ScaleTargetAnnotation delegating scaling to the MachineSets
+	ScaleTargetMachineSet = "machineset"
+	// RevisionAnnotation is set by cluster-api on the MachineSets of a MachineDeployment to their rollout revision
+	RevisionAnnotation = "machinedeployment.clusters.x-k8s.io/revision"
+	// LegacyRevisionAnnotation is the v1alpha1 predecessor of RevisionAnnotation
+	LegacyRevisionAnnotation = "machinedeployment.clusters.k8s.io/revision"
+
+	// MachineAnnotation is set on nodes by cluster-api to the name of their Machine
+	MachineAnnotation = "cluster.x-k8s.io/machine"
+	// ClusterNamespaceAnnotation is set on nodes by cluster-api to the namespace of their Machine
+	ClusterNamespaceAnnotation = "cluster.x-k8s.io/cluster-namespace"
+
+	// ClusterNameLabel names the Cluster a cluster-api object belongs to
+	ClusterNameLabel = "cluster.x-k8s.io/cluster-name"
+	// LegacyClusterNameLabel is the v1alpha1 predecessor of ClusterNameLabel
+	LegacyClusterNameLabel = "cluster.k8s.io/cluster-name"
+	// MachineDeploymentNameLabel names the MachineDeployment of a Machine
+	MachineDeploymentNameLabel = "cluster.x-k8s.io/deployment-name"
+	// ManagedByLabel names the autoscaler instance that scaled a MachineDeployment, MachineSet or MachinePool
+	ManagedByLabel = "autoscaler.syseleven.de/managed-by"
+)
+
+// MachineDeploymentAttrs holds parsed-out attributes of a MD or standalone MachineSet
 type MachineDeploymentAttrs struct {
 	minSize, maxSize int
 }
 
 // GetMachineDeploymentAttrs extracts MachineDeploymentAttrs from a given MachineDeployment
 func GetMachineDeploymentAttrs(md *v1alpha1.MachineDeployment) *MachineDeploymentAttrs {
+	return getNodeGroupAttrs(md)
+}
+
+// GetMachineSetAttrs extracts MachineDeploymentAttrs from a given standalone MachineSet
+func GetMachineSetAttrs(ms *v1alpha1.MachineSet) *MachineDeploymentAttrs {
+	return getNodeGroupAttrs(ms)
+}
+
+// GetMachinePoolAttrs extracts MachineDeploymentAttrs from a given MachinePool
+func GetMachinePoolAttrs(mp *exp.MachinePool) *MachineDeploymentAttrs {
+	return getNodeGroupAttrs(mp)
+}
+
+// getNodeGroupAttrs parses the size annotations of a MachineDeployment or MachineSet. It returns nil,
+// i.e. the object is not autoscaled, if an annotation is missing or the bounds are invalid.
+func getNodeGroupAttrs(obj apimachv1.Object) *MachineDeploymentAttrs {
 	attrs := &MachineDeploymentAttrs{}
 
 	var err error
 
-	if val, ok := md.Annotations[MinSizeAnnotation]; ok {
+	if val, ok := sizeAnnotation(obj, MinSizeAnnotation, LegacyMinSizeAnnotation); ok {
 		attrs.minSize, err = strconv.Atoi(val)
 		if err != nil {
-			klog.Errorf("In %s: Invalid min-size: %v (%s)", md.Name, val, err)
+			errorS(err, "Invalid min-size annotation", append(objectKeys(obj), "value", val)...)
 			return nil
 		}
 	} else {
 		return nil
 	}
 
-	if val, ok := md.Annotations[MaxSizeAnnotation]; ok {
+	if val, ok := sizeAnnotation(obj, MaxSizeAnnotation, LegacyMaxSizeAnnotation); ok {
 		attrs.maxSize, err = strconv.Atoi(val)
 		if err != nil {
-			klog.Errorf("In %s: Invalid max-size: %v (%s)", md.Name, val, err)
+			errorS(err, "Invalid max-size annotation", append(objectKeys(obj), "value", val)...)
 			return nil
 		}
 	} else {
 		return nil
 	}
 
+	if attrs.minSize < 0 || attrs.minSize > attrs.maxSize {
+		errorS(nil, "Invalid size bounds", append(objectKeys(obj), "minSize", attrs.minSize, "maxSize", attrs.maxSize)...)
+		return nil
+	}
+
 	return attrs
 }
 
+// warnAboveMaxSize warns if the replicas of a node group's object exceed its max size, e.g. because someone
+// else scaled it. The replicas are deliberately left alone; the node group reports them as its target size
+// and isn't scaled up until they are back within bounds.
+func warnAboveMaxSize(obj apimachv1.Object, replicas *int32) bool {
+	attrs := getNodeGroupAttrs(obj)
+	if attrs == nil || replicasOf(replicas) <= attrs.maxSize {
+		return false
+	}
+	warningS("Replicas exceed max size of node group, not scaling it up", append(objectKeys(obj),
+		"replicas", replicasOf(replicas), "maxSize", attrs.maxSize)...)
+	return true
+}
+
+// sizeAnnotation returns the value of annotation, falling back to its legacy name
+func sizeAnnotation(obj apimachv1.Object, annotation, legacyAnnotation string) (string, bool) {
+	if val, ok := obj.GetAnnotations()[annotation]; ok {
+		return val, true
+	}
+	if val, ok := obj.GetAnnotations()[legacyAnnotation]; ok {
+		warningS("Deprecated annotation", append(objectKeys(obj), "annotation", legacyAnnotation, "replacement", annotation)...)
+		return val, true
+	}
+	return "", false
+}
+
 // MachineManager interface
 type MachineManager interface {
 	AllDeployments() []*v1alpha1.MachineDeployment
+	AllMachineSets() []*v1alpha1.MachineSet
+	AllMachinePools() []*exp.MachinePool
+	AvailableMachineTypes() []string
+	BootstrapNodeRegistration(obj apimachv1.Object) (map[string]string, []v1.Taint, error)
+	Cleanup() error
+	CreateMachineDeployment(md *v1alpha1.MachineDeployment) (*v1alpha1.MachineDeployment, error)
+	DeleteMachine(machine *v1alpha1.Machine) error
+	DeleteMachineDeployment(md *v1alpha1.MachineDeployment) error
+	DeleteMachinePoolNodes(mp *exp.MachinePool, nodes []*v1.Node, size int) (applied bool, err error)
 	DeploymentForNode(node *v1.Node) *v1alpha1.MachineDeployment
+	DisruptionBudgetedPods(nodes []*v1.Node) (map[string]int, error)
+	FailureDomain(obj apimachv1.Object) string
+	HasSynced() bool
+	InfrastructureTemplateAnnotations(obj apimachv1.Object) (map[string]string, error)
+	MachineForNode(node *v1.Node) *v1alpha1.Machine
+	MachineType(obj apimachv1.Object) string
+	MachineTypeCapacity(obj apimachv1.Object) (v1.ResourceList, bool)
+	MachinePoolForNode(node *v1.Node) *exp.MachinePool
+	MachineSetForNode(node *v1.Node) *v1alpha1.MachineSet
+	MachinesForDeployment(md *v1alpha1.MachineDeployment) []*v1alpha1.Machine
+	MachinesForMachineSet(ms *v1alpha1.MachineSet) []*v1alpha1.Machine
+	MachineSetsForDeployment(md *v1alpha1.MachineDeployment) []*v1alpha1.MachineSet
+	MachinesByProviderID() (map[string]*v1alpha1.Machine, error)
+	MarkMachineForDeletion(machine *v1alpha1.Machine) error
+	NodeForMachine(machine *v1alpha1.Machine) *v1.Node
 	NodesForDeployment(md *v1alpha1.MachineDeployment) []*v1.Node
-	Refresh() error
-	SetDeploymentSize(md *v1alpha1.MachineDeployment, size int) error
+	NodesForMachineSet(ms *v1alpha1.MachineSet) []*v1.Node
+	NodesForMachinePool(mp *exp.MachinePool) []*v1.Node
+	Refresh(ctx context.Context) error
+	SetDeploymentSize(md *v1alpha1.MachineDeployment, size int) (applied bool, err error)
+	SetMachineSetSize(ms *v1alpha1.MachineSet, size int) (applied bool, err error)
+	SetMachinePoolSize(mp *exp.MachinePool, size int) (applied bool, err error)
+	WaitForCacheSync(ctx context.Context) error
 }
 
-// ClusterapiMachineManager is a facade and cache for accessing the cluster's nodes, machines, and MachineDeployments
+// ClusterapiMachineManager is a facade and cache for accessing the cluster's nodes, machines, MachineDeployments,
+// standalone MachineSets, i.e. MachineSets not owned by a MachineDeployment, and MachinePools
 type ClusterapiMachineManager struct {
-	coreApiClient    kubernetes.Interface
-	clusterApiClient clusterclientset.Interface
+	// coreApiClient accesses the nodes of the workload cluster
+	coreApiClient kubernetes.Interface
+	// managementClient accesses the cluster holding the cluster-api objects, which may be the workload cluster
+	managementClient kubernetes.Interface
+	// dynamicClient accesses the cluster-api objects independent of their version, as well as
+	// infrastructure templates, whose kinds are not known in advance
+	dynamicClient dynamic.Interface
+	// versionLock guards the served versions below, the informers of the cluster-api objects and the
+	// machineSelector, which are replaced when the served versions change, see rediscoverVersions
+	versionLock sync.RWMutex
+	// groupVersion is the served cluster-api version
+	groupVersion schema.GroupVersion
+	// machinePoolGroupVersion is the served MachinePool version, empty if MachinePools aren't served
+	machinePoolGroupVersion schema.GroupVersion
+	// discoveryClient rediscovers the served versions once API calls suggest they changed, e.g. during a
+	// cluster-api upgrade. nil keeps the versions fixed.
+	discoveryClient discovery.DiscoveryInterface
+	// versionsSuspect is set to 1 by API calls failing as if the served versions changed
+	versionsSuspect int32
 
-	// cache data structures.
-	// each api object (Node, Machine, MachineDeployment etc.) is stored as a unique
-	// pointer shared across all data structures.
+	// autoDiscoverySelectors restrict the node groups to objects matching any of them. Empty means no restriction.
+	autoDiscoverySelectors []labels.Selector
+	// namespaces are the sorted namespaces whose cluster-api objects are managed. NamespaceAll manages all.
+	namespaces []string
+	// refreshConcurrency limits the number of namespaces refreshed in parallel
+	refreshConcurrency int
+	// refreshInterval is the minimum time between two refreshes; Refresh() keeps the cached state
+	// until lastRefresh is that long ago
+	refreshInterval time.Duration
+	// refreshLock serializes refreshes and guards lastRefresh and the refresh backoff state below
+	refreshLock sync.Mutex
+	lastRefresh time.Time
+	// machineSelector restricts the watched Machines, e.g. to those of the Cluster named clusterName
+	machineSelector labels.Selector
+	clusterName     string
+	// flavors looks up the capacity of machine types, nil unless OpenStack credentials are configured
+	flavors *novaFlavors
+	// applyClient sends server-side apply patches, nil patches objects instead. applyUnsupported is set to 1
+	// once the apiserver rejected the apply patch type.
+	applyClient      rest.Interface
+	applyUnsupported int32
+	// templates caches the infrastructure and bootstrap config templates referenced by the node group objects
+	templates *templateCache
+	// dryRun logs the changes to cluster-api objects instead of applying them
+	dryRun bool
+	// instanceID is set as ManagedByLabel on the objects the manager scales, unless empty
+	instanceID string
+	// skipForeignNodeGroups ignores the objects whose ManagedByLabel names another instance
+	skipForeignNodeGroups bool
+	// loggedExclusions holds the UIDs of the MachineDeployments whose exclusion via EnabledAnnotation was logged
+	loggedExclusions sync.Map
 
-	allDeploymentsByUid map[types.UID]*v1alpha1.MachineDeployment
+	// refreshFailures counts the consecutive failed refreshes. Until refreshBackoffUntil, Refresh()
+	// fails fast with refreshError instead of contacting the apiserver again.
+	refreshFailures     int
+	refreshBackoffUntil time.Time
+	refreshError        error
 
-	deploymentByMachineUid  map[types.UID]*v1alpha1.MachineDeployment
-	nodeByMachineUid        map[types.UID]*v1.Node
-	machinesByDeploymentUid map[types.UID][]*v1alpha1.Machine
+	// informers watch the cluster-api objects of each managed namespace and the nodes; Refresh() builds the
+	// cache data structures from their stores. The informers of the cluster-api objects are stopped by
+	// informersStopCh, which is replaced along with them, the node informer by stopCh.
+	informers        map[string]namespaceInformers
+	informerOptions  informerOptions
+	nodeInformer     cache.SharedIndexInformer
+	startInformers   sync.Once
+	informersStarted bool
+	stopInformers    sync.Once
+	informersDone    sync.WaitGroup
+	stopCh           chan struct{}
+	informersStopCh  chan struct{}
 
-	deploymentByNodeUid  map[types.UID]*v1alpha1.MachineDeployment
-	machineByNodeUid     map[types.UID]*v1alpha1.Machine
-	nodesByDeploymentUid map[types.UID][]*v1.Node
+	// snapshot holds the *refreshSnapshot of the last successful refresh. It is replaced as a whole, so that
+	// readers never see a partially refreshed state and don't need to lock. Scale actions publish a copy with
+	// the scaled object replaced, serialized by snapshotLock.
+	snapshot     atomic.Value
+	snapshotLock sync.Mutex
+}
+
+// MachineManagerOptions configure a ClusterapiMachineManager created by NewMachineManager, see
+// CloudConfig.machineManagerOptions
+type MachineManagerOptions struct {
+	// AutoDiscoverySelectors restrict the node groups to those matching one of them, no selectors mean no restriction
+	AutoDiscoverySelectors []labels.Selector
+	// Namespaces are the managed namespaces, all if empty
+	Namespaces []string
+	// ClusterName restricts the node groups and Machines to those of the named Cluster, unless empty
+	ClusterName string
+	// RefreshConcurrency is the number of namespaces refreshed in parallel, defaultRefreshConcurrency if 0
+	RefreshConcurrency int
+	// RefreshInterval is the minimum time between two refreshes
+	RefreshInterval time.Duration
+	// ListPageSize is the number of objects the informers list at once, ResyncPeriod their resync period if positive
+	ListPageSize int64
+	ResyncPeriod time.Duration
+	// DryRun logs the changes to cluster-api objects instead of applying them
+	DryRun bool
+	// FailOnMissingPermissions fails the creation if permissions on the cluster-api objects are missing, which
+	// are logged otherwise
+	FailOnMissingPermissions bool
+	// InstanceID is set as ManagedByLabel on the scaled objects, unless empty. SkipForeignNodeGroups ignores the
+	// objects whose ManagedByLabel names another instance.
+	InstanceID            string
+	SkipForeignNodeGroups bool
+
+	// flavors looks up the capacity of machine types, if set
+	flavors *novaFlavors
 }
 
-// NewMachineManager creates a new empty ClusterapiMachineManager. Call Refresh() to initialize it
-func NewMachineManager(kubeConfig *rest.Config) (*ClusterapiMachineManager, error) {
-	coreApiClient, err := kubernetes.NewForConfig(kubeConfig)
+// NewMachineManager creates a new empty ClusterapiMachineManager with the given options. The nodes are taken
+// from the workload cluster, the cluster-api objects from the management cluster. The preferred served
+// cluster-api version is used, and rediscovered by Refresh() once API calls fail as if it isn't served
+// anymore. Call Refresh() to initialize it
+func NewMachineManager(workloadKubeConfig, managementKubeConfig *rest.Config, opts MachineManagerOptions) (*ClusterapiMachineManager, error) {
+	coreApiClient, err := kubernetes.NewForConfig(workloadKubeConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	managementClient, err := kubernetes.NewForConfig(managementKubeConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	clusterApiClient, err := clusterclientset.NewForConfig(kubeConfig)
+	dynamicClient, err := dynamic.NewForConfig(managementKubeConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	return NewMachineManagerFromApiStubs(coreApiClient, clusterApiClient), nil
+	applyClient, err := newApplyClient(managementKubeConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	groupVersion, err := discoverGroupVersion(managementClient.Discovery())
+	if err != nil {
+		return nil, err
+	}
+	infoS("Using cluster-api version", "version", groupVersion)
+
+	mm := NewMachineManagerFromApiStubs(coreApiClient, dynamicClient, groupVersion, opts.Namespaces)
+	mm.managementClient = managementClient
+	mm.applyClient = applyClient
+	mm.discoveryClient = managementClient.Discovery()
+	mm.configureInformers(informerOptions{pageSize: opts.ListPageSize, resyncPeriod: opts.ResyncPeriod, errorHandler: mm.suspectVersions})
+	if opts.ClusterName != "" {
+		mm.restrictMachinesToCluster(opts.ClusterName)
+	}
+	if machinePoolGroupVersion, ok := discoverMachinePoolGroupVersion(managementClient.Discovery()); ok {
+		infoS("Using MachinePool version", "version", machinePoolGroupVersion)
+		mm.enableMachinePools(machinePoolGroupVersion)
+	}
+	mm.autoDiscoverySelectors = opts.AutoDiscoverySelectors
+	if opts.RefreshConcurrency > 0 {
+		mm.refreshConcurrency = opts.RefreshConcurrency
+	}
+	mm.refreshInterval = opts.RefreshInterval
+	mm.flavors = opts.flavors
+	if opts.InstanceID != "" {
+		mm.instanceID = opts.InstanceID
+		mm.skipForeignNodeGroups = opts.SkipForeignNodeGroups
+		infoS("Labeling scaled objects", "label", ManagedByLabel, "instanceID", mm.instanceID, "skipForeignNodeGroups", mm.skipForeignNodeGroups)
+	}
+	mm.dryRun = opts.DryRun
+	if mm.dryRun {
+		warningS("Dry run, cluster-api objects won't be changed")
+	}
+	if err := mm.checkPermissions(); err != nil && opts.FailOnMissingPermissions {
+		return nil, err
+	}
+	return mm, nil
 }
 
-// NewMachineManagerFromApiStubs creates a new empty ClusterapiMachineManager for the given core and cluster API stubs. Call Refresh() to initialize it
-func NewMachineManagerFromApiStubs(coreApiClient kubernetes.Interface, clusterApiClient clusterclientset.Interface) *ClusterapiMachineManager {
+// NewMachineManagerFromApiStubs creates a new empty ClusterapiMachineManager for the given core and dynamic API stubs,
+// accessing the given cluster-api version in the given namespaces, or all namespaces if there are none.
+// Call Refresh() to initialize it
+func NewMachineManagerFromApiStubs(coreApiClient kubernetes.Interface, dynamicClient dynamic.Interface, groupVersion schema.GroupVersion, namespaces []string) *ClusterapiMachineManager {
 	mm := &ClusterapiMachineManager{
-		coreApiClient:    coreApiClient,
-		clusterApiClient: clusterApiClient,
+		coreApiClient:      coreApiClient,
+		managementClient:   coreApiClient,
+		dynamicClient:      dynamicClient,
+		groupVersion:       groupVersion,
+		informers:          make(map[string]namespaceInformers),
+		nodeInformer:       newNodeInformer(coreApiClient, informerOptions{}),
+		stopCh:             make(chan struct{}),
+		informersStopCh:    make(chan struct{}),
+		refreshConcurrency: defaultRefreshConcurrency,
+		machineSelector:    labels.Everything(),
+		templates:          newTemplateCache(dynamicClient),
 	}
+	mm.snapshot.Store(newRefreshSnapshot())
+
+	if len(namespaces) == 0 {
+		namespaces = []string{apimachv1.NamespaceAll}
+	}
+	for _, namespace := range namespaces {
+		if _, ok := mm.informers[namespace]; ok {
+			continue
+		}
+		mm.namespaces = append(mm.namespaces, namespace)
+		mm.informers[namespace] = newNamespaceInformers(dynamicClient, groupVersion, namespace, informerOptions{})
+	}
+	sort.Strings(mm.namespaces)
 
 	return mm
 }
 
-// AllDeployments returns all MachineDeployments of the cluster
+// current returns the snapshot of the last successful refresh
+func (mm *ClusterapiMachineManager) current() *refreshSnapshot {
+	return mm.snapshot.Load().(*refreshSnapshot)
+}
+
+// AllDeployments returns all MachineDeployments of the cluster that are autoscaled, i.e. excluding paused ones
+// and those opted out via EnabledAnnotation
 func (mm *ClusterapiMachineManager) AllDeployments() []*v1alpha1.MachineDeployment {
 	result := make([]*v1alpha1.MachineDeployment, 0)
-	for _, md := range mm.allDeploymentsByUid {
+	for _, md := range mm.current().allDeploymentsByUid {
 		result = append(result, md)
 	}
 	return result
 }
 
+// AllMachineSets returns all standalone MachineSets of the cluster
+func (mm *ClusterapiMachineManager) AllMachineSets() []*v1alpha1.MachineSet {
+	result := make([]*v1alpha1.MachineSet, 0)
+	for _, ms := range mm.current().allMachineSetsByUid {
+		result = append(result, ms)
+	}
+	return result
+}
+
+// AllMachinePools returns all MachinePools of the cluster
+func (mm *ClusterapiMachineManager) AllMachinePools() []*exp.MachinePool {
+	result := make([]*exp.MachinePool, 0)
+	for _, mp := range mm.current().allMachinePoolsByUid {
+		result = append(result, mp)
+	}
+	return result
+}
+
+// AvailableMachineTypes returns the sorted, distinct machine types (OpenStack flavors) of all MachineDeployments,
+// standalone MachineSets and MachinePools
+func (mm *ClusterapiMachineManager) AvailableMachineTypes() []string {
+	return mm.current().machineTypes
+}
+
+// MachineType returns the machine type (OpenStack flavor) of a MachineDeployment, MachineSet or MachinePool as
+// resolved on the last refresh, empty if it couldn't be resolved
+func (mm *ClusterapiMachineManager) MachineType(obj apimachv1.Object) string {
+	return mm.current().machineTypeByUid[obj.GetUID()]
+}
+
+// BootstrapNodeRegistration returns the node labels and taints configured in the bootstrap config template
+// of a MachineDeployment or MachineSet, served from the template cache. Both are empty if it has no bootstrap
+// config template or the template doesn't exist.
+func (mm *ClusterapiMachineManager) BootstrapNodeRegistration(obj apimachv1.Object) (map[string]string, []v1.Taint, error) {
+	u := mm.unstructuredOf(obj)
+	if u == nil {
+		return nil, nil, nil
+	}
+	template, err := mm.bootstrapConfigTemplate(u)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not get bootstrap config template of %s %s: %v", kindOf(obj), obj.GetName(), err)
+	}
+	if template == nil {
+		return nil, nil, nil
+	}
+	return kubeadmNodeRegistration(template)
+}
+
+// InfrastructureTemplateAnnotations returns the annotations of the infrastructure template (e.g. an
+// OpenStackMachineTemplate) a MachineDeployment or MachineSet references, nil if it references none. The
+// template is served from the template cache. A deleted template is only logged, so that the node group can
+// still be scaled with the capacity annotations of the MachineDeployment or MachineSet itself.
+func (mm *ClusterapiMachineManager) InfrastructureTemplateAnnotations(obj apimachv1.Object) (map[string]string, error) {
+	if infrastructureTemplateRef(obj) == nil {
+		return nil, nil
+	}
+	template, err := mm.infrastructureTemplate(obj)
+	if err != nil {
+		return nil, fmt.Errorf("could not get infrastructure template of %s %s: %v", kindOf(obj), obj.GetName(), err)
+	}
+	if template == nil {
+		return nil, nil
+	}
+	return template.GetAnnotations(), nil
+}
+
+// FailureDomain returns the failure domain, i.e. the zone, the machines of a MachineDeployment, MachineSet or
+// MachinePool are placed in. It is empty if the machines may be spread across failure domains. For a Machine,
+// it returns the failure domain the machine is placed in, if known.
+func (mm *ClusterapiMachineManager) FailureDomain(obj apimachv1.Object) string {
+	u := mm.unstructuredOf(obj)
+	if u == nil {
+		return ""
+	}
+	if _, ok := obj.(*v1alpha1.Machine); ok {
+		failureDomain, _, _ := unstructured.NestedString(u.Object, "spec", "failureDomain")
+		return failureDomain
+	}
+	if _, ok := obj.(*exp.MachinePool); ok {
+		failureDomains, _, _ := unstructured.NestedStringSlice(u.Object, "spec", "failureDomains")
+		if len(failureDomains) == 1 {
+			return failureDomains[0]
+		}
+		return ""
+	}
+	failureDomain, _, _ := unstructured.NestedString(u.Object, "spec", "template", "spec", "failureDomain")
+	return failureDomain
+}
+
+// CreateMachineDeployment creates a MachineDeployment, e.g. of an autoprovisioned node group
+func (mm *ClusterapiMachineManager) CreateMachineDeployment(md *v1alpha1.MachineDeployment) (*v1alpha1.MachineDeployment, error) {
+	if mm.skipInDryRun("CreateMachineDeployment", objectKeys(md)...) {
+		return md.DeepCopy(), nil
+	}
+
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(md)
+	if err != nil {
+		return nil, err
+	}
+	groupVersion, _ := mm.versions()
+	u := &unstructured.Unstructured{Object: obj}
+	u.SetAPIVersion(groupVersion.String())
+	u.SetKind("MachineDeployment")
+
+	created, err := mm.dynamicClient.Resource(groupVersion.WithResource(machineDeploymentResource)).Namespace(md.Namespace).
+		Create(u, apimachv1.CreateOptions{})
+	if err != nil {
+		mm.suspectVersions(err)
+		return nil, err
+	}
+	result := &v1alpha1.MachineDeployment{}
+	if err := fromUnstructured(created, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// DeleteMachine deletes a Machine, provided it wasn't replaced by another one of the same name. A Machine
+// that is already gone is taken as deleted.
+func (mm *ClusterapiMachineManager) DeleteMachine(machine *v1alpha1.Machine) error {
+	if mm.skipInDryRun("DeleteMachine", "namespace", machine.Namespace, "machine", machine.Name) {
+		return nil
+	}
+	uid := machine.UID
+	err := mm.resource(machineResource).Namespace(machine.Namespace).
+		Delete(machine.Name, &apimachv1.DeleteOptions{Preconditions: &apimachv1.Preconditions{UID: &uid}})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	mm.suspectVersions(err)
+	return err
+}
+
+// DeleteMachineDeployment deletes a MachineDeployment, provided it wasn't replaced by another one of the same name
+func (mm *ClusterapiMachineManager) DeleteMachineDeployment(md *v1alpha1.MachineDeployment) error {
+	if mm.skipInDryRun("DeleteMachineDeployment", objectKeys(md)...) {
+		return nil
+	}
+	uid := md.UID
+	err := mm.resource(machineDeploymentResource).Namespace(md.Namespace).
+		Delete(md.Name, &apimachv1.DeleteOptions{Preconditions: &apimachv1.Preconditions{UID: &uid}})
+	mm.suspectVersions(err)
+	return err
+}
+
 // DeploymentForNode returns the MachineDeployment that created a specific node
 func (mm *ClusterapiMachineManager) DeploymentForNode(node *v1.Node) *v1alpha1.MachineDeployment {
-	return mm.deploymentByNodeUid[node.UID]
+	if machine := mm.MachineForNode(node); machine != nil {
+		return mm.current().deploymentByMachineUid[machine.UID]
+	}
+	return nil
+}
+
+// DisruptionBudgetedPods counts the pods on each of the given nodes, by node name, that are guarded by a
+// PodDisruptionBudget of the workload cluster. Terminated pods and budgets with an empty selector, which
+// guard no pods, aren't counted.
+func (mm *ClusterapiMachineManager) DisruptionBudgetedPods(nodes []*v1.Node) (map[string]int, error) {
+	pdbs, err := mm.coreApiClient.PolicyV1beta1().PodDisruptionBudgets(v1.NamespaceAll).List(apimachv1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	selectors := make(map[string][]labels.Selector)
+	for _, pdb := range pdbs.Items {
+		selector, err := apimachv1.LabelSelectorAsSelector(pdb.Spec.Selector)
+		if err != nil {
+			warningS("Invalid PodDisruptionBudget selector, ignoring", "namespace", pdb.Namespace, "podDisruptionBudget", pdb.Name, "err", err)
+			continue
+		}
+		if !selector.Empty() {
+			selectors[pdb.Namespace] = append(selectors[pdb.Namespace], selector)
+		}
+	}
+
+	counts := make(map[string]int, len(nodes))
+	for _, node := range nodes {
+		pods, err := mm.coreApiClient.CoreV1().Pods(v1.NamespaceAll).List(apimachv1.ListOptions{
+			FieldSelector: fields.OneTermEqualSelector("spec.nodeName", node.Name).String(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		counts[node.Name] = 0
+		for _, pod := range pods.Items {
+			if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+				continue
+			}
+			for _, selector := range selectors[pod.Namespace] {
+				if selector.Matches(labels.Set(pod.Labels)) {
+					counts[node.Name]++
+					break
+				}
+			}
+		}
+	}
+	return counts, nil
+}
+
+// MachineForNode returns the Machine backing a specific node. The machine is looked up by the node's
+// normalized providerID, falling back to the machines' node references, the node's machine annotation
+// and finally a machine named like the node. The autoscaler's stand-ins for machines without node and
+// providerID are resolved by the machine's namespace and name in their instance id.
+func (mm *ClusterapiMachineManager) MachineForNode(node *v1.Node) *v1alpha1.Machine {
+	s := mm.current()
+	if node.Spec.ProviderID != "" {
+		if machine := uniqueMachine(node, s.machinesByProviderID[NormalizeProviderID(node.Spec.ProviderID)]); machine != nil {
+			return machine
+		}
+	}
+	if namespace, name, ok := pendingMachineKey(node.Spec.ProviderID); ok {
+		for _, machine := range s.machinesByName[name] {
+			if machine.Namespace == namespace && machine.Status.NodeRef == nil {
+				return machine
+			}
+		}
+	}
+	if machine, ok := s.machineByNodeUid[node.UID]; ok {
+		return machine
+	}
+	if name := node.Annotations[MachineAnnotation]; name != "" {
+		if namespace := node.Annotations[ClusterNamespaceAnnotation]; namespace != "" {
+			for _, machine := range s.machinesByName[name] {
+				if machine.Namespace == namespace && machineOwnsNode(machine, node) {
+					return machine
+				}
+			}
+		} else if machine := uniqueMachine(node, s.machinesByName[name]); machine != nil {
+			return machine
+		}
+	}
+	return uniqueMachine(node, s.machinesByName[node.Name])
+}
+
+// uniqueMachine returns the only one of the matching machines, provided it isn't bound to another node
+func uniqueMachine(node *v1.Node, machines []*v1alpha1.Machine) *v1alpha1.Machine {
+	if len(machines) != 1 || !machineOwnsNode(machines[0], node) {
+		return nil
+	}
+	return machines[0]
+}
+
+// MachineSetForNode returns the standalone MachineSet that created a specific node
+func (mm *ClusterapiMachineManager) MachineSetForNode(node *v1.Node) *v1alpha1.MachineSet {
+	if machine := mm.MachineForNode(node); machine != nil {
+		return mm.current().machineSetByMachineUid[machine.UID]
+	}
+	return nil
+}
+
+// MachinePoolForNode returns the MachinePool whose instances include a specific node
+func (mm *ClusterapiMachineManager) MachinePoolForNode(node *v1.Node) *exp.MachinePool {
+	return mm.current().machinePoolByNodeUid[node.UID]
+}
+
+// MachinesForDeployment returns all machines of a specific MachineDeployment, including those without a node yet
+func (mm *ClusterapiMachineManager) MachinesForDeployment(md *v1alpha1.MachineDeployment) []*v1alpha1.Machine {
+	return mm.current().machinesByDeploymentUid[md.UID]
+}
+
+// MachinesForMachineSet returns all machines of a specific standalone MachineSet, including those without a node yet
+func (mm *ClusterapiMachineManager) MachinesForMachineSet(ms *v1alpha1.MachineSet) []*v1alpha1.Machine {
+	return mm.current().machinesByMachineSetUid[ms.UID]
+}
+
+// MachineSetsForDeployment returns all MachineSets of a specific MachineDeployment, e.g. the old and the new
+// one during a rollout
+func (mm *ClusterapiMachineManager) MachineSetsForDeployment(md *v1alpha1.MachineDeployment) []*v1alpha1.MachineSet {
+	return mm.current().machineSetsByDeploymentUid[md.UID]
+}
+
+// MachinesByProviderID reads the Machines of all managed namespaces from the API server, bypassing the cache,
+// and returns them by providerID, normalized with the infrastructure provider of their cached MachineSet like
+// the cache's index. Machines without a providerID are left out. A providerID shared by several Machines maps
+// to nil.
+func (mm *ClusterapiMachineManager) MachinesByProviderID() (map[string]*v1alpha1.Machine, error) {
+	mm.versionLock.RLock()
+	selector := mm.machineSelector
+	mm.versionLock.RUnlock()
+	machines := make(map[string]*v1alpha1.Machine)
+	for _, namespace := range mm.namespaces {
+		list, err := mm.resource(machineResource).Namespace(namespace).List(apimachv1.ListOptions{LabelSelector: selector.String()})
+		if err != nil {
+			mm.suspectVersions(err)
+			return nil, err
+		}
+		for i := range list.Items {
+			machine, err := machineFromUnstructured(&list.Items[i])
+			if err != nil {
+				return nil, err
+			}
+			providerID := normalizedMachineProviderID(machine, mm.cachedMachineSetOf(machine))
+			if providerID == "" {
+				continue
+			}
+			if _, ok := machines[providerID]; ok {
+				machines[providerID] = nil
+				continue
+			}
+			machines[providerID] = machine
+		}
+	}
+	return machines, nil
+}
+
+// cachedMachineSetOf returns the cached MachineSet owning a Machine, nil if it has none or it isn't cached
+func (mm *ClusterapiMachineManager) cachedMachineSetOf(machine *v1alpha1.Machine) *v1alpha1.MachineSet {
+	msRef, ok := findRefByKind(machine.OwnerReferences, "MachineSet")
+	if !ok {
+		return nil
+	}
+	u := mm.get(machineSetResource, machine.Namespace, msRef.Name)
+	if u == nil || u.GetUID() != msRef.UID {
+		return nil
+	}
+	ms := &v1alpha1.MachineSet{}
+	if err := fromUnstructured(u, ms); err != nil {
+		return nil
+	}
+	return ms
+}
+
+// MarkMachineForDeletion sets the delete-machine annotation on a Machine so that it is the
+// one removed when its MachineSet's replica count is lowered next. The annotation is set with
+// server-side apply, or else patched, retrying conflicts with a jittered backoff.
+func (mm *ClusterapiMachineManager) MarkMachineForDeletion(machine *v1alpha1.Machine) error {
+	if mm.skipInDryRun("MarkMachineForDeletion", "namespace", machine.Namespace, "machine", machine.Name, "annotation", DeleteMachineAnnotation) {
+		return nil
+	}
+
+	annotations := map[string]string{DeleteMachineAnnotation: time.Now().UTC().Format(time.RFC3339)}
+	if _, applied, err := mm.apply(machineResource, machine.Namespace, machine.Name, annotations, nil); applied {
+		mm.suspectVersions(err)
+		return err
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	client := mm.resource(machineResource).Namespace(machine.Namespace)
+	err = retry.RetryOnConflict(markForDeletionBackoff, func() error {
+		_, err := client.Patch(machine.Name, types.MergePatchType, patch, apimachv1.UpdateOptions{})
+		return err
+	})
+	mm.suspectVersions(err)
+	return err
+}
+
+// NodeForMachine returns the node of a specific Machine, or nil if it has not registered yet
+func (mm *ClusterapiMachineManager) NodeForMachine(machine *v1alpha1.Machine) *v1.Node {
+	return mm.current().nodeByMachineUid[machine.UID]
 }
 
 // NodesForDeployment returns all nodes that were created by a specific MachineDeployment
 func (mm *ClusterapiMachineManager) NodesForDeployment(md *v1alpha1.MachineDeployment) []*v1.Node {
-	return mm.nodesByDeploymentUid[md.UID]
+	return mm.current().nodesByDeploymentUid[md.UID]
 }
 
-// Refresh reloads the ClusterapiMachineManager's cached representation of the cluster state
-func (mm *ClusterapiMachineManager) Refresh() error {
-	newAllDeploymentsByUid := make(map[types.UID]*v1alpha1.MachineDeployment)
+// NodesForMachineSet returns all nodes that were created by a specific standalone MachineSet
+func (mm *ClusterapiMachineManager) NodesForMachineSet(ms *v1alpha1.MachineSet) []*v1.Node {
+	return mm.current().nodesByMachineSetUid[ms.UID]
+}
 
-	newDeploymentByMachineUid := make(map[types.UID]*v1alpha1.MachineDeployment)
-	newNodeByMachineUid := make(map[types.UID]*v1.Node)
-	newMachinesByDeploymentUid := make(map[types.UID][]*v1alpha1.Machine)
+// NodesForMachinePool returns all nodes of the instances of a specific MachinePool
+func (mm *ClusterapiMachineManager) NodesForMachinePool(mp *exp.MachinePool) []*v1.Node {
+	return mm.current().nodesByMachinePoolUid[mp.UID]
+}
 
-	newDeploymentByNodeUid := make(map[types.UID]*v1alpha1.MachineDeployment)
-	newMachineByNodeUid := make(map[types.UID]*v1alpha1.Machine)
-	newNodesByDeploymentUid := make(map[types.UID][]*v1.Node)
+// Refresh reloads the ClusterapiMachineManager's cached representation of the cluster state from the
+// informer caches. The first call starts the informers and waits for their initial sync. Waiting for the
+// informers and resolving the machine types is aborted once ctx is done.
+//
+// After a failed refresh, further refreshes fail fast for an exponentially increasing, jittered backoff,
+// which is reset by the next successful refresh. Within the refresh interval of the last successful
+// refresh, the cached state is kept.
+//
+// Refreshes are serialized. Readers may run concurrently and see either the previous or the new snapshot.
+// Errors are classified as AutoscalerErrors, see autoscalerError.
+func (mm *ClusterapiMachineManager) Refresh(ctx context.Context) error {
+	mm.refreshLock.Lock()
+	defer mm.refreshLock.Unlock()
 
-	machines, err := mm.clusterApiClient.ClusterV1alpha1().Machines("kube-system").List(apimachv1.ListOptions{})
+	if mm.refreshInterval > 0 && time.Since(mm.lastRefresh) < mm.refreshInterval {
+		verboseInfoS(5, "Skipping refresh", "operation", "Refresh", "lastRefresh", mm.lastRefresh.Format(time.RFC3339))
+		return nil
+	}
+	if time.Now().Before(mm.refreshBackoffUntil) {
+		return autoscalerError(mm.refreshError).AddPrefix("refresh backing off until %s after %d failures: ",
+			mm.refreshBackoffUntil.Format(time.RFC3339), mm.refreshFailures)
+	}
+
+	start := time.Now()
+	err := mm.refresh(ctx)
+	registerRefresh(start, err)
+	mm.updateRefreshBackoff(err)
 	if err != nil {
+		return autoscalerError(err)
+	}
+	mm.lastRefresh = start
+	return nil
+}
+
+// updateRefreshBackoff opens the circuit after a failed refresh and closes it after a successful one
+func (mm *ClusterapiMachineManager) updateRefreshBackoff(err error) {
+	if err == nil {
+		if mm.refreshFailures > 0 {
+			infoS("Refresh succeeded, circuit closed", "operation", "Refresh", "failures", mm.refreshFailures)
+		}
+		mm.refreshFailures = 0
+		mm.refreshBackoffUntil = time.Time{}
+		mm.refreshError = nil
+		registerRefreshBackoff(0, 0)
+		return
+	}
+
+	mm.refreshFailures++
+	backoff := refreshBackoff(mm.refreshFailures)
+	mm.refreshBackoffUntil = time.Now().Add(backoff)
+	mm.refreshError = err
+	if mm.refreshFailures == 1 {
+		warningS("Refresh failed, circuit open", "operation", "Refresh", "backoff", backoff, "err", err)
+	} else {
+		verboseInfoS(4, "Refresh failed", "operation", "Refresh", "failures", mm.refreshFailures, "backoff", backoff, "err", err)
+	}
+	registerRefreshBackoff(backoff, mm.refreshFailures)
+}
+
+// refreshBackoff returns the jittered backoff after the given number of consecutive failures
+func refreshBackoff(failures int) time.Duration {
+	backoff := refreshBackoffInitial
+	for i := 1; i < failures && backoff < refreshBackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > refreshBackoffMax {
+		backoff = refreshBackoffMax
+	}
+	return wait.Jitter(backoff, refreshBackoffJitter)
+}
+
+func (mm *ClusterapiMachineManager) refresh(ctx context.Context) error {
+	if atomic.CompareAndSwapInt32(&mm.versionsSuspect, 1, 0) {
+		if err := mm.rediscoverVersions(); err != nil {
+			atomic.StoreInt32(&mm.versionsSuspect, 1)
+			return err
+		}
+	}
+	if err := mm.syncInformers(ctx); err != nil {
+		return err
+	}
+
+	// cluster-api objects only reference objects of their own namespace, so the namespaces are
+	// processed in parallel and their snapshots are only merged once all of them succeeded.
+	objsByNamespace := make(map[string]map[string][]interface{})
+	resources := []string{machineDeploymentResource, machineSetResource, machineResource}
+	if _, machinePoolGroupVersion := mm.versions(); !machinePoolGroupVersion.Empty() {
+		resources = append(resources, machinePoolResource)
+	}
+	for _, resource := range resources {
+		for _, obj := range mm.list(resource) {
+			o, ok := obj.(apimachv1.Object)
+			if !ok {
+				continue
+			}
+			if objsByNamespace[o.GetNamespace()] == nil {
+				objsByNamespace[o.GetNamespace()] = make(map[string][]interface{})
+			}
+			objsByNamespace[o.GetNamespace()][resource] = append(objsByNamespace[o.GetNamespace()][resource], obj)
+		}
+	}
+	namespaces := make([]string, 0, len(objsByNamespace))
+	for namespace := range objsByNamespace {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+
+	snapshots := make([]*refreshSnapshot, len(namespaces))
+	errs := make([]error, len(namespaces))
+	workqueue.ParallelizeUntil(ctx, mm.refreshConcurrency, len(namespaces), func(i int) {
+		var err error
+		if snapshots[i], err = mm.refreshNamespace(ctx, objsByNamespace[namespaces[i]]); err != nil {
+			errs[i] = autoscalerError(err).AddPrefix("namespace %s: ", namespaces[i])
+		}
+	})
+	if err := utilerrors.NewAggregate(errs); err != nil {
 		return err
 	}
+	// ParallelizeUntil skips the remaining namespaces once ctx is done
+	if ctx.Err() != nil {
+		return fmt.Errorf("refresh aborted: %v", ctx.Err())
+	}
 
-	for i := range machines.Items {
-		machine := &machines.Items[i]
+	snapshot := newRefreshSnapshot()
+	for _, s := range snapshots {
+		snapshot.merge(s)
+	}
 
-		// TODO consider fetching all machines, nodes, ms's and mds in one API call each and cross-refing them in memory,
-		// so that for n machines we have just 4 API calls rather than 3n+1
+	mm.snapshotLock.Lock()
+	mm.snapshot.Store(snapshot)
+	mm.snapshotLock.Unlock()
+
+	nodeGroupsByNamespace := make(map[string]int)
+	for _, md := range snapshot.allDeploymentsByUid {
+		nodeGroupsByNamespace[md.Namespace]++
+	}
+	for _, ms := range snapshot.allMachineSetsByUid {
+		nodeGroupsByNamespace[ms.Namespace]++
+	}
+	for _, mp := range snapshot.allMachinePoolsByUid {
+		nodeGroupsByNamespace[mp.Namespace]++
+	}
+	registerNodeGroups(nodeGroupsByNamespace)
+
+	return nil
+}
+
+// refreshSnapshot holds the cache data structures built by a refresh of one or more namespaces.
+// Each api object (Node, Machine, MachineDeployment etc.) is stored as a unique pointer shared
+// across all data structures. Once stored by the machine manager, the maps aren't modified anymore.
+type refreshSnapshot struct {
+	allDeploymentsByUid map[types.UID]*v1alpha1.MachineDeployment
+
+	// machinesByProviderID and machinesByName hold all machines, by normalized providerID and by name
+	machinesByProviderID map[string][]*v1alpha1.Machine
+	machinesByName       map[string][]*v1alpha1.Machine
+
+	deploymentByMachineUid  map[types.UID]*v1alpha1.MachineDeployment
+	nodeByMachineUid        map[types.UID]*v1.Node
+	machinesByDeploymentUid map[types.UID][]*v1alpha1.Machine
+
+	machineByNodeUid     map[types.UID]*v1alpha1.Machine
+	nodesByDeploymentUid map[types.UID][]*v1.Node
+
+	allMachineSetsByUid map[types.UID]*v1alpha1.MachineSet
+	// machineSetsByDeploymentUid holds the MachineSets owned by MachineDeployment node groups
+	machineSetsByDeploymentUid map[types.UID][]*v1alpha1.MachineSet
+	machineSetByMachineUid     map[types.UID]*v1alpha1.MachineSet
+	machinesByMachineSetUid    map[types.UID][]*v1alpha1.Machine
+	nodesByMachineSetUid       map[types.UID][]*v1.Node
+
+	allMachinePoolsByUid  map[types.UID]*exp.MachinePool
+	machinePoolByNodeUid  map[types.UID]*exp.MachinePool
+	nodesByMachinePoolUid map[types.UID][]*v1.Node
+
+	machineTypes     []string
+	machineTypeByUid map[types.UID]string
+}
+
+func newRefreshSnapshot() *refreshSnapshot {
+	return &refreshSnapshot{
+		allDeploymentsByUid:        make(map[types.UID]*v1alpha1.MachineDeployment),
+		deploymentByMachineUid:     make(map[types.UID]*v1alpha1.MachineDeployment),
+		nodeByMachineUid:           make(map[types.UID]*v1.Node),
+		machinesByDeploymentUid:    make(map[types.UID][]*v1alpha1.Machine),
+		machineByNodeUid:           make(map[types.UID]*v1alpha1.Machine),
+		nodesByDeploymentUid:       make(map[types.UID][]*v1.Node),
+		allMachineSetsByUid:        make(map[types.UID]*v1alpha1.MachineSet),
+		machineSetsByDeploymentUid: make(map[types.UID][]*v1alpha1.MachineSet),
+		machineSetByMachineUid:     make(map[types.UID]*v1alpha1.MachineSet),
+		machinesByMachineSetUid:    make(map[types.UID][]*v1alpha1.Machine),
+		nodesByMachineSetUid:       make(map[types.UID][]*v1.Node),
+		allMachinePoolsByUid:       make(map[types.UID]*exp.MachinePool),
+		machinePoolByNodeUid:       make(map[types.UID]*exp.MachinePool),
+		nodesByMachinePoolUid:      make(map[types.UID][]*v1.Node),
+		machineTypes:               []string{},
+		machineTypeByUid:           make(map[types.UID]string),
+		machinesByProviderID:       make(map[string][]*v1alpha1.Machine),
+		machinesByName:             make(map[string][]*v1alpha1.Machine),
+	}
+}
+
+// machineSet returns the cached standalone MachineSet or MachineSet of a MachineDeployment of the same UID
+func (s *refreshSnapshot) machineSet(ms *v1alpha1.MachineSet) *v1alpha1.MachineSet {
+	if internalMs, ok := s.allMachineSetsByUid[ms.UID]; ok {
+		return internalMs
+	}
+	if mdRef, ok := findRefByKind(ms.OwnerReferences, "MachineDeployment"); ok {
+		for _, internalMs := range s.machineSetsByDeploymentUid[mdRef.UID] {
+			if internalMs.UID == ms.UID {
+				return internalMs
+			}
+		}
+	}
+	return nil
+}
+
+// replace replaces the MachineDeployment, MachineSet or MachinePool of the same UID as obj in all data
+// structures. Slices are copied, so that a snapshot built by merge doesn't modify the one it was built from.
+func (s *refreshSnapshot) replace(obj apimachv1.Object) {
+	switch o := obj.(type) {
+	case *v1alpha1.MachineDeployment:
+		s.allDeploymentsByUid[o.UID] = o
+		for uid, md := range s.deploymentByMachineUid {
+			if md.UID == o.UID {
+				s.deploymentByMachineUid[uid] = o
+			}
+		}
+	case *v1alpha1.MachineSet:
+		if _, ok := s.allMachineSetsByUid[o.UID]; ok {
+			s.allMachineSetsByUid[o.UID] = o
+		}
+		if mdRef, ok := findRefByKind(o.OwnerReferences, "MachineDeployment"); ok {
+			if mss, ok := s.machineSetsByDeploymentUid[mdRef.UID]; ok {
+				replaced := make([]*v1alpha1.MachineSet, len(mss))
+				for i, ms := range mss {
+					if replaced[i] = ms; ms.UID == o.UID {
+						replaced[i] = o
+					}
+				}
+				s.machineSetsByDeploymentUid[mdRef.UID] = replaced
+			}
+		}
+		for uid, ms := range s.machineSetByMachineUid {
+			if ms.UID == o.UID {
+				s.machineSetByMachineUid[uid] = o
+			}
+		}
+	case *exp.MachinePool:
+		s.allMachinePoolsByUid[o.UID] = o
+		for uid, mp := range s.machinePoolByNodeUid {
+			if mp.UID == o.UID {
+				s.machinePoolByNodeUid[uid] = o
+			}
+		}
+	}
+}
+
+// merge adds the objects of another snapshot. As UIDs are unique, no entries are overwritten, while
+// the machines of the same providerID or name are joined.
+func (s *refreshSnapshot) merge(other *refreshSnapshot) {
+	for uid, md := range other.allDeploymentsByUid {
+		s.allDeploymentsByUid[uid] = md
+	}
+	for providerID, machines := range other.machinesByProviderID {
+		s.machinesByProviderID[providerID] = append(s.machinesByProviderID[providerID], machines...)
+	}
+	for name, machines := range other.machinesByName {
+		s.machinesByName[name] = append(s.machinesByName[name], machines...)
+	}
+	for uid, md := range other.deploymentByMachineUid {
+		s.deploymentByMachineUid[uid] = md
+	}
+	for uid, node := range other.nodeByMachineUid {
+		s.nodeByMachineUid[uid] = node
+	}
+	for uid, machines := range other.machinesByDeploymentUid {
+		s.machinesByDeploymentUid[uid] = machines
+	}
+	for uid, machine := range other.machineByNodeUid {
+		s.machineByNodeUid[uid] = machine
+	}
+	for uid, nodes := range other.nodesByDeploymentUid {
+		s.nodesByDeploymentUid[uid] = nodes
+	}
+	for uid, ms := range other.allMachineSetsByUid {
+		s.allMachineSetsByUid[uid] = ms
+	}
+	for uid, mss := range other.machineSetsByDeploymentUid {
+		s.machineSetsByDeploymentUid[uid] = mss
+	}
+	for uid, ms := range other.machineSetByMachineUid {
+		s.machineSetByMachineUid[uid] = ms
+	}
+	for uid, machines := range other.machinesByMachineSetUid {
+		s.machinesByMachineSetUid[uid] = machines
+	}
+	for uid, nodes := range other.nodesByMachineSetUid {
+		s.nodesByMachineSetUid[uid] = nodes
+	}
+	for uid, mp := range other.allMachinePoolsByUid {
+		s.allMachinePoolsByUid[uid] = mp
+	}
+	for uid, mp := range other.machinePoolByNodeUid {
+		s.machinePoolByNodeUid[uid] = mp
+	}
+	for uid, nodes := range other.nodesByMachinePoolUid {
+		s.nodesByMachinePoolUid[uid] = nodes
+	}
+	for uid, machineType := range other.machineTypeByUid {
+		s.machineTypeByUid[uid] = machineType
+	}
+	machineTypes := sets.NewString(s.machineTypes...)
+	machineTypes.Insert(other.machineTypes...)
+	s.machineTypes = machineTypes.List()
+}
+
+// refreshNamespace builds the cache data structures from the informer objects of a single namespace,
+// keyed by resource. The cluster-api objects are converted from the informers' unstructured objects,
+// while nodes are shared read-only with the informer cache.
+func (mm *ClusterapiMachineManager) refreshNamespace(ctx context.Context, objs map[string][]interface{}) (*refreshSnapshot, error) {
+	s := newRefreshSnapshot()
+	// all MachineSets of the namespace, including those owned by MachineDeployments, and the
+	// MachineDeployments by name, to resolve the MachineDeployments of machines
+	machineSetsByUid := make(map[types.UID]*v1alpha1.MachineSet)
+	deploymentsByName := make(map[string]*v1alpha1.MachineDeployment)
+
+	for _, obj := range objs[machineDeploymentResource] {
+		if mm.isPaused(obj) || mm.isExcluded(obj) || mm.isForeign(obj) || mm.isOtherCluster(obj) {
+			continue
+		}
+		md := &v1alpha1.MachineDeployment{}
+		if err := fromUnstructured(obj, md); err != nil {
+			warningS("Failed to convert MachineDeployment", "operation", "Refresh", "err", err)
+			continue
+		}
+		mm.applyTopologyBounds(obj, md)
+		if mm.isNodeGroup(md) {
+			s.allDeploymentsByUid[md.UID] = md
+			deploymentsByName[md.Name] = md
+			warnAboveMaxSize(md, md.Spec.Replicas)
+		}
+	}
+
+	for _, obj := range objs[machineSetResource] {
+		ms := &v1alpha1.MachineSet{}
+		if err := fromUnstructured(obj, ms); err != nil {
+			warningS("Failed to convert MachineSet", "operation", "Refresh", "err", err)
+			continue
+		}
+		machineSetsByUid[ms.UID] = ms
+		if mdRef, ok := findRefByKind(ms.OwnerReferences, "MachineDeployment"); ok {
+			if md, ok := s.allDeploymentsByUid[mdRef.UID]; ok {
+				s.machineSetsByDeploymentUid[md.UID] = append(s.machineSetsByDeploymentUid[md.UID], ms)
+			}
+			continue
+		}
+		if mm.isNodeGroup(ms) && !mm.isPaused(obj) && !mm.isForeign(obj) && !mm.isOtherCluster(obj) {
+			s.allMachineSetsByUid[ms.UID] = ms
+			warnAboveMaxSize(ms, ms.Spec.Replicas)
+		}
+	}
+
+	for _, obj := range objs[machineResource] {
+		machine, err := machineFromUnstructured(obj)
+		if err != nil {
+			warningS("Failed to convert Machine", "operation", "Refresh", "err", err)
+			continue
+		}
+		msRef, ok := findRefByKind(machine.OwnerReferences, "MachineSet")
+		var ms *v1alpha1.MachineSet
+		if ok {
+			ms = machineSetsByUid[msRef.UID]
+		}
+		if providerID := normalizedMachineProviderID(machine, ms); providerID != "" {
+			s.machinesByProviderID[providerID] = append(s.machinesByProviderID[providerID], machine)
+		}
+		s.machinesByName[machine.Name] = append(s.machinesByName[machine.Name], machine)
 
 		var node *v1.Node
 
 		if nodeRef := machine.Status.NodeRef; nodeRef != nil {
-			node, err = mm.coreApiClient.CoreV1().Nodes().Get(nodeRef.Name, apimachv1.GetOptions{})
-			if err != nil {
-				return err
+			node = mm.getNode(nodeRef.Name)
+			if node == nil {
+				verboseInfoS(4, "Node of machine not found", "operation", "Refresh", "namespace", machine.Namespace, "machine", machine.Name, "node", nodeRef.Name)
+			} else {
+				s.nodeByMachineUid[machine.UID] = node
+				s.machineByNodeUid[node.UID] = machine
 			}
-			newNodeByMachineUid[machine.UID] = node
-			newMachineByNodeUid[node.UID] = machine
 		}
 
-		if msRef, ok := findRefByKind(machine.OwnerReferences, "MachineSet"); ok {
-			ms, err := mm.clusterApiClient.ClusterV1alpha1().MachineSets("kube-system").Get(msRef.Name, apimachv1.GetOptions{})
-			if err != nil {
-				return err
+		if !ok {
+			continue
+		}
+
+		if ms, ok := s.allMachineSetsByUid[msRef.UID]; ok {
+			s.machineSetByMachineUid[machine.UID] = ms
+			s.machinesByMachineSetUid[ms.UID] = append(s.machinesByMachineSetUid[ms.UID], machine)
+			if node != nil {
+				s.nodesByMachineSetUid[ms.UID] = append(s.nodesByMachineSetUid[ms.UID], node)
 			}
+			continue
+		}
 
-			if mdRef, ok := findRefByKind(ms.OwnerReferences, "MachineDeployment"); ok {
-				md, err := mm.clusterApiClient.ClusterV1alpha1().MachineDeployments("kube-system").Get(mdRef.Name, apimachv1.GetOptions{})
-				if err != nil {
-					return err
-				}
+		md := deploymentOfMachine(machine, msRef, machineSetsByUid, deploymentsByName, s.allDeploymentsByUid)
+		if md == nil {
+			continue
+		}
 
-				if nil == GetMachineDeploymentAttrs(md) {
-					klog.Infof("MachineDeployment %s has no valid autoscaler annotations; ignoring.", md.Name)
-					continue
-				}
+		s.deploymentByMachineUid[machine.UID] = md
+		s.machinesByDeploymentUid[md.UID] = append(s.machinesByDeploymentUid[md.UID], machine)
 
-				newAllDeploymentsByUid[md.UID] = md
-				newDeploymentByMachineUid[machine.UID] = md
-				newMachinesByDeploymentUid[md.UID] = append(newMachinesByDeploymentUid[md.UID], machine)
+		if node != nil {
+			s.nodesByDeploymentUid[md.UID] = append(s.nodesByDeploymentUid[md.UID], node)
+		}
+	}
 
-				if node != nil {
-					newDeploymentByNodeUid[node.UID] = md
-					newNodesByDeploymentUid[md.UID] = append(newNodesByDeploymentUid[md.UID], node)
-				}
+	// MachinePools have no machines, their instances are matched to nodes by providerID
+	for _, obj := range objs[machinePoolResource] {
+		if mm.isPaused(obj) || mm.isForeign(obj) || mm.isOtherCluster(obj) {
+			continue
+		}
+		mp, err := machinePoolFromUnstructured(obj)
+		if err != nil {
+			warningS("Failed to convert MachinePool", "operation", "Refresh", "err", err)
+			continue
+		}
+		if !mm.isNodeGroup(mp) {
+			continue
+		}
+		s.allMachinePoolsByUid[mp.UID] = mp
+		warnAboveMaxSize(mp, mp.Spec.Replicas)
+		for _, providerID := range mp.Spec.ProviderIDList {
+			node := mm.getNodeByProviderID(providerID)
+			if node == nil {
+				verboseInfoS(4, "Node of MachinePool instance not found", append(objectKeys(mp), "operation", "Refresh", "providerID", providerID)...)
+				continue
 			}
+			s.machinePoolByNodeUid[node.UID] = mp
+			s.nodesByMachinePoolUid[mp.UID] = append(s.nodesByMachinePoolUid[mp.UID], node)
+		}
+	}
+
+	machineTypeByUid, err := mm.resolveMachineTypes(ctx, s.allDeploymentsByUid, s.allMachineSetsByUid, s.allMachinePoolsByUid)
+	if err != nil {
+		return nil, err
+	}
+	machineTypes := sets.NewString()
+	for _, machineType := range machineTypeByUid {
+		machineTypes.Insert(machineType)
+	}
+	s.machineTypes = machineTypes.List()
+	s.machineTypeByUid = machineTypeByUid
+	return s, nil
+}
+
+// publish publishes a snapshot in which a cached MachineDeployment, MachineSet or MachinePool is replaced by
+// an updated copy. The objects of a published snapshot are never modified, as they are read without locking.
+func (mm *ClusterapiMachineManager) publish(obj apimachv1.Object) {
+	mm.snapshotLock.Lock()
+	defer mm.snapshotLock.Unlock()
+
+	s := newRefreshSnapshot()
+	s.merge(mm.current())
+	s.replace(obj)
+	mm.snapshot.Store(s)
+}
+
+// SetDeploymentSize sets a MachineDeployment's replica count. The cached MachineDeployment is replaced by a
+// copy of the new replica count, md is left unchanged. applied is false if the change was skipped in dry-run mode.
+func (mm *ClusterapiMachineManager) SetDeploymentSize(md *v1alpha1.MachineDeployment, size int) (bool, error) {
+	// check that we know the md
+	internalMd := mm.current().allDeploymentsByUid[md.UID]
+	if internalMd == nil {
+		// shouldn't happen as autoscaler should ony pass us mds that we handed out previously
+		return false, fmt.Errorf("STRANGE: MachineDeployment not cached: %v", md.Name)
+	}
+	if mm.skipInDryRun("SetDeploymentSize", append(objectKeys(md), "from", replicasOf(internalMd.Spec.Replicas), "to", size)...) {
+		return false, nil
+	}
+
+	if err := mm.setReplicas(machineDeploymentResource, md.Namespace, md.Name, size); err != nil {
+		return false, err
+	}
+
+	updated := *internalMd
+	updated.Spec.Replicas = int32Ptr(int32(size))
+	mm.publish(&updated)
+	return true, nil
+}
+
+// SetMachineSetSize sets the replica count of a standalone MachineSet, or of a MachineSet of a MachineDeployment
+// node group that delegates scaling to its MachineSets. The cached MachineSet is replaced by a copy of the new
+// replica count, ms is left unchanged. applied is false if the change was skipped in dry-run mode.
+func (mm *ClusterapiMachineManager) SetMachineSetSize(ms *v1alpha1.MachineSet, size int) (bool, error) {
+	// check that we know the ms
+	internalMs := mm.current().machineSet(ms)
+	if internalMs == nil {
+		// shouldn't happen as autoscaler should ony pass us mss that we handed out previously
+		return false, fmt.Errorf("STRANGE: MachineSet not cached: %v", ms.Name)
+	}
+	if mm.skipInDryRun("SetMachineSetSize", append(objectKeys(ms), "from", replicasOf(internalMs.Spec.Replicas), "to", size)...) {
+		return false, nil
+	}
+
+	if err := mm.setReplicas(machineSetResource, ms.Namespace, ms.Name, size); err != nil {
+		return false, err
+	}
+
+	updated := *internalMs
+	updated.Spec.Replicas = int32Ptr(int32(size))
+	mm.publish(&updated)
+	return true, nil
+}
+
+// SetMachinePoolSize sets a MachinePool's replica count. The cached MachinePool is replaced by a copy of the
+// new replica count, mp is left unchanged. applied is false if the change was skipped in dry-run mode.
+func (mm *ClusterapiMachineManager) SetMachinePoolSize(mp *exp.MachinePool, size int) (bool, error) {
+	// check that we know the mp
+	internalMp := mm.current().allMachinePoolsByUid[mp.UID]
+	if internalMp == nil {
+		// shouldn't happen as autoscaler should ony pass us mps that we handed out previously
+		return false, fmt.Errorf("STRANGE: MachinePool not cached: %v", mp.Name)
+	}
+	if mm.skipInDryRun("SetMachinePoolSize", append(objectKeys(mp), "from", replicasOf(internalMp.Spec.Replicas), "to", size)...) {
+		return false, nil
+	}
+
+	if err := mm.setReplicas(machinePoolResource, mp.Namespace, mp.Name, size); err != nil {
+		return false, err
+	}
+
+	updated := *internalMp
+	updated.Spec.Replicas = int32Ptr(int32(size))
+	mm.publish(&updated)
+	return true, nil
+}
+
+// DeleteMachinePoolNodes removes the instances of nodes from a MachinePool. MachinePools delegate the
+// lifecycle of their instances to the infrastructure provider, which deletes the instances whose providerIDs
+// are dropped from spec.providerIDList. The list and the replica count are patched together, guarded by the
+// cached resourceVersion, so that no other instances are removed if the pool changed in the meantime. Like
+// SetMachinePoolSize, only the cached MachinePool is replaced by an updated copy, and applied is false in dry-run mode.
+func (mm *ClusterapiMachineManager) DeleteMachinePoolNodes(mp *exp.MachinePool, nodes []*v1.Node, size int) (bool, error) {
+	internalMp := mm.current().allMachinePoolsByUid[mp.UID]
+	if internalMp == nil {
+		return false, fmt.Errorf("STRANGE: MachinePool not cached: %v", mp.Name)
+	}
+
+	deleted := sets.NewString()
+	for _, node := range nodes {
+		deleted.Insert(NormalizeProviderID(node.Spec.ProviderID))
+	}
+	providerIDs := make([]string, 0, len(mp.Spec.ProviderIDList))
+	for _, providerID := range mp.Spec.ProviderIDList {
+		if !deleted.Has(NormalizeProviderID(providerID)) {
+			providerIDs = append(providerIDs, providerID)
 		}
 	}
+	if len(mp.Spec.ProviderIDList)-len(providerIDs) != len(nodes) {
+		return false, fmt.Errorf("not all nodes are instances of MachinePool %s", mp.Name)
+	}
+	if mm.skipInDryRun("DeleteMachinePoolNodes", append(objectKeys(mp), "from", replicasOf(internalMp.Spec.Replicas), "to", size,
+		"instances", deleted.List())...) {
+		return false, nil
+	}
 
-	// So far we've only found MachineDeployments containing at least one machine.
-	// Iterate over all MachineDeployments directly to also find ones with no machines.
-	mds, err := mm.clusterApiClient.ClusterV1alpha1().MachineDeployments("kube-system").List(apimachv1.ListOptions{})
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": mp.ResourceVersion,
+		},
+		"spec": map[string]interface{}{
+			"replicas":       size,
+			"providerIDList": providerIDs,
+		},
+	})
 	if err != nil {
+		return false, err
+	}
+	_, err = mm.resource(machinePoolResource).Namespace(mp.Namespace).
+		Patch(mp.Name, types.MergePatchType, patch, apimachv1.UpdateOptions{})
+	if err != nil {
+		mm.suspectVersions(err)
+		return false, err
+	}
+
+	updated := *internalMp
+	updated.Spec.Replicas = int32Ptr(int32(size))
+	updated.Spec.ProviderIDList = providerIDs
+	mm.publish(&updated)
+	return true, nil
+}
+
+// skipInDryRun logs a change that is about to be made to a cluster-api object and returns true if it must be
+// skipped because of dry-run mode
+func (mm *ClusterapiMachineManager) skipInDryRun(operation string, keysAndValues ...interface{}) bool {
+	keysAndValues = append([]interface{}{"operation", operation}, keysAndValues...)
+	if !mm.dryRun {
+		verboseInfoS(4, "Changing cluster-api object", keysAndValues...)
+		return false
+	}
+	infoS("Dry run, not changing cluster-api object", keysAndValues...)
+	return true
+}
+
+// setReplicas sets the replica count of a cluster-api object. spec.replicas, which has the same path in all
+// versions, is set with server-side apply, so that the autoscaler owns it. Without server-side apply, it is set
+// through the scale subresource, which doesn't touch any other field, or patched if that isn't served either.
+// Conflicting updates are retried.
+func (mm *ClusterapiMachineManager) setReplicas(resource, namespace, name string, size int) error {
+	client := mm.resource(resource).Namespace(namespace)
+
+	obj, applied, err := mm.apply(resource, namespace, name, nil, map[string]interface{}{"replicas": size})
+	if applied && err == nil {
+		err = checkReplicasApplied(obj, size)
+	}
+	if !applied {
+		err = mm.updateScale(client, resource, namespace, name, size)
+	}
+	if err != nil {
+		mm.suspectVersions(err)
 		return err
 	}
+	mm.markManaged(client, resource, namespace, name)
+	return nil
+}
 
-	for i := range mds.Items {
-		md := &mds.Items[i]
-		if nil == GetMachineDeploymentAttrs(md) {
-			klog.Infof("MachineDeployment %s has no valid autoscaler annotations; ignoring.", md.Name)
-			continue
+// updateScale sets the replica count of a cluster-api object through its scale subresource, or patches
+// spec.replicas if the scale subresource isn't served. Conflicting updates are retried.
+func (mm *ClusterapiMachineManager) updateScale(client dynamic.ResourceInterface, resource, namespace, name string, size int) error {
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		scale, err := client.Get(name, apimachv1.GetOptions{}, "scale")
+		if errors.IsNotFound(err) {
+			verboseInfoS(4, "Scale subresource not found, patching replicas", "namespace", namespace, strings.ToLower(resource), name)
+			return patchReplicas(client, name, size)
+		}
+		if err != nil {
+			return err
 		}
-		if _, ok := newAllDeploymentsByUid[md.UID]; !ok {
-			newAllDeploymentsByUid[md.UID] = md
+
+		if err := unstructured.SetNestedField(scale.Object, int64(size), "spec", "replicas"); err != nil {
+			return err
 		}
+		scale, err = client.Update(scale, apimachv1.UpdateOptions{}, "scale")
+		if err != nil {
+			return err
+		}
+		return checkReplicasApplied(scale, size)
+	})
+}
+
+// markManaged sets ManagedByLabel on an object the manager scaled, unless it already names the manager's
+// instance. Failures are only logged, as the object was scaled.
+func (mm *ClusterapiMachineManager) markManaged(client dynamic.ResourceInterface, resource, namespace, name string) {
+	if mm.instanceID == "" {
+		return
+	}
+	if u := mm.get(resource, namespace, name); u != nil && u.GetLabels()[ManagedByLabel] == mm.instanceID {
+		return
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": map[string]string{ManagedByLabel: mm.instanceID},
+		},
+	})
+	if err == nil {
+		_, err = client.Patch(name, types.MergePatchType, patch, apimachv1.UpdateOptions{})
+	}
+	if err != nil {
+		warningS("Failed to set managed-by label", "namespace", namespace, strings.ToLower(resource), name, "err", err)
 	}
+}
 
-	mm.allDeploymentsByUid = newAllDeploymentsByUid
+// patchReplicas sets spec.replicas with a JSON patch
+func patchReplicas(client dynamic.ResourceInterface, name string, size int) error {
+	patch, err := json.Marshal([]map[string]interface{}{
+		{"op": "add", "path": "/spec/replicas", "value": size},
+	})
+	if err != nil {
+		return err
+	}
 
-	mm.deploymentByMachineUid = newDeploymentByMachineUid
-	mm.nodeByMachineUid = newNodeByMachineUid
-	mm.machinesByDeploymentUid = newMachinesByDeploymentUid
+	obj, err := client.Patch(name, types.JSONPatchType, patch, apimachv1.UpdateOptions{})
+	if err != nil {
+		return err
+	}
+	return checkReplicasApplied(obj, size)
+}
 
-	mm.deploymentByNodeUid = newDeploymentByNodeUid
-	mm.machineByNodeUid = newMachineByNodeUid
-	mm.nodesByDeploymentUid = newNodesByDeploymentUid
+// checkReplicasApplied checks that the object or scale returned for a replica change has the requested
+// spec.replicas. Mutating admission webhooks may change them without failing the request.
+func checkReplicasApplied(obj *unstructured.Unstructured, size int) error {
+	replicas, found, err := unstructured.NestedInt64(obj.Object, "spec", "replicas")
+	if err != nil || !found || replicas == int64(size) {
+		return nil
+	}
+	return &replicasNotAppliedError{requested: int64(size), applied: replicas}
+}
 
-	return nil
+// isNodeGroup checks whether a MachineDeployment or standalone MachineSet is autoscaled, i.e. whether it
+// has valid size annotations and matches one of the auto discovery selectors, if any are configured.
+func (mm *ClusterapiMachineManager) isNodeGroup(obj apimachv1.Object) bool {
+	if nil == getNodeGroupAttrs(obj) {
+		infoS("Ignoring object without valid autoscaler annotations", objectKeys(obj)...)
+		return false
+	}
+	if len(mm.autoDiscoverySelectors) == 0 {
+		return true
+	}
+	for _, selector := range mm.autoDiscoverySelectors {
+		if selector.Matches(labels.Set(obj.GetLabels())) {
+			return true
+		}
+	}
+	verboseInfoS(4, "Ignoring object not matching any auto discovery selector", objectKeys(obj)...)
+	return false
 }
 
-// SetDeploymentSize sets a MachineDeployment's replica count
-func (mm *ClusterapiMachineManager) SetDeploymentSize(md *v1alpha1.MachineDeployment, size int) error {
-	// check that we know the md
-	internalMd := mm.allDeploymentsByUid[md.UID]
-	if internalMd == nil {
-		// shouldn't happen as autoscaler should ony pass us mds that we handed out previously
-		return fmt.Errorf("STRANGE: MachineDeployment not cached: %v", md.Name)
+// unstructuredOf returns the informer's unstructured object of a MachineDeployment, MachineSet, MachinePool or
+// Machine, which holds the fields of newer cluster-api versions that are lost in the conversion to v1alpha1
+func (mm *ClusterapiMachineManager) unstructuredOf(obj apimachv1.Object) *unstructured.Unstructured {
+	resource := machineDeploymentResource
+	switch obj.(type) {
+	case *v1alpha1.MachineSet:
+		resource = machineSetResource
+	case *v1alpha1.Machine:
+		resource = machineResource
+	case *exp.MachinePool:
+		if _, machinePoolGroupVersion := mm.versions(); machinePoolGroupVersion.Empty() {
+			return nil
+		}
+		resource = machinePoolResource
 	}
+	return mm.get(resource, obj.GetNamespace(), obj.GetName())
+}
 
-	internalMd.Spec.Replicas = int32Ptr(int32(size))
-	md.Spec.Replicas = int32Ptr(int32(size))
+// isPaused checks whether a MachineDeployment or MachineSet, given as unstructured informer object, or
+// its Cluster is paused. cluster-api doesn't reconcile paused objects, so scaling them has no effect.
+func (mm *ClusterapiMachineManager) isPaused(obj interface{}) bool {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return false
+	}
+	if objectPaused(u) {
+		infoS("Ignoring paused object", "namespace", u.GetNamespace(), strings.ToLower(u.GetKind()), u.GetName())
+		return true
+	}
 
-	_, err := mm.clusterApiClient.ClusterV1alpha1().MachineDeployments("kube-system").Update(md)
-	return err
+	clusterName := clusterNameOf(u)
+	if clusterName == "" {
+		return false
+	}
+	cluster := mm.get(clusterResource, u.GetNamespace(), clusterName)
+	if cluster == nil {
+		return false
+	}
+	if objectPaused(cluster) {
+		infoS("Ignoring object of paused cluster", "namespace", u.GetNamespace(), strings.ToLower(u.GetKind()), u.GetName(), "cluster", clusterName)
+		return true
+	}
+	return false
+}
+
+// isForeign checks whether a MachineDeployment, MachineSet or MachinePool, given as unstructured informer object,
+// is managed by another autoscaler instance according to its ManagedByLabel, if foreign node groups are skipped.
+// Objects without the label are managed by any instance.
+func (mm *ClusterapiMachineManager) isForeign(obj interface{}) bool {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok || !mm.skipForeignNodeGroups {
+		return false
+	}
+	managedBy, ok := u.GetLabels()[ManagedByLabel]
+	if !ok || managedBy == mm.instanceID {
+		return false
+	}
+	verboseInfoS(4, "Ignoring object managed by another autoscaler", append(objectKeys(u), "managedBy", managedBy)...)
+	return true
+}
+
+// isOtherCluster checks whether a MachineDeployment, MachineSet or MachinePool, given as unstructured informer
+// object, doesn't belong to the Cluster the manager is restricted to, if any
+func (mm *ClusterapiMachineManager) isOtherCluster(obj interface{}) bool {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok || mm.clusterName == "" {
+		return false
+	}
+	clusterName := clusterNameOf(u)
+	if clusterName == mm.clusterName {
+		return false
+	}
+	verboseInfoS(4, "Ignoring object of another cluster", append(objectKeys(u), "cluster", clusterName)...)
+	return true
+}
+
+// isExcluded checks whether a MachineDeployment, given as unstructured informer object, is excluded from
+// autoscaling via EnabledAnnotation. The exclusion is logged once per MachineDeployment.
+func (mm *ClusterapiMachineManager) isExcluded(obj interface{}) bool {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok || u.GetAnnotations()[EnabledAnnotation] != "false" {
+		return false
+	}
+	if _, logged := mm.loggedExclusions.LoadOrStore(u.GetUID(), true); !logged {
+		infoS("Ignoring object excluded from autoscaling", "namespace", u.GetNamespace(), strings.ToLower(u.GetKind()), u.GetName(), "annotation", EnabledAnnotation)
+	}
+	return true
+}
+
+// objectPaused checks for the paused annotation or spec.paused, which MachineDeployments and Clusters have
+func objectPaused(u *unstructured.Unstructured) bool {
+	if _, ok := u.GetAnnotations()[PausedAnnotation]; ok {
+		return true
+	}
+	paused, _, _ := unstructured.NestedBool(u.Object, "spec", "paused")
+	return paused
+}
+
+// clusterNameOf returns the name of the Cluster an object belongs to, or "" if unknown
+func clusterNameOf(u *unstructured.Unstructured) string {
+	if name, _, _ := unstructured.NestedString(u.Object, "spec", "clusterName"); name != "" {
+		return name
+	}
+	if name := u.GetLabels()[ClusterNameLabel]; name != "" {
+		return name
+	}
+	return u.GetLabels()[LegacyClusterNameLabel]
+}
+
+// resolveMachineTypes resolves the machine types of the given MachineDeployments and MachineSets by UID.
+// Objects whose machine type can't be resolved are skipped. It fails if ctx is done before all are resolved.
+func (mm *ClusterapiMachineManager) resolveMachineTypes(ctx context.Context, mds map[types.UID]*v1alpha1.MachineDeployment, mss map[types.UID]*v1alpha1.MachineSet, mps map[types.UID]*exp.MachinePool) (map[types.UID]string, error) {
+	objs := make([]apimachv1.Object, 0, len(mds)+len(mss)+len(mps))
+	for _, md := range mds {
+		objs = append(objs, md)
+	}
+	for _, ms := range mss {
+		objs = append(objs, ms)
+	}
+	for _, mp := range mps {
+		objs = append(objs, mp)
+	}
+
+	machineTypes := make(map[types.UID]string)
+	for _, obj := range objs {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("resolving machine types aborted: %v", ctx.Err())
+		}
+		machineType, err := mm.openstackFlavor(obj)
+		if err != nil {
+			warningS("Could not resolve machine type", append(objectKeys(obj), "err", err)...)
+			continue
+		}
+		if machineType != "" {
+			machineTypes[obj.GetUID()] = machineType
+		}
+	}
+	return machineTypes, nil
+}
+
+// machineTemplateOf returns the template machines of a MachineDeployment, MachineSet or MachinePool are created from
+func machineTemplateOf(obj apimachv1.Object) *v1alpha1.MachineTemplateSpec {
+	switch o := obj.(type) {
+	case *v1alpha1.MachineDeployment:
+		return &o.Spec.Template
+	case *v1alpha1.MachineSet:
+		return &o.Spec.Template
+	case *exp.MachinePool:
+		return &o.Spec.Template
+	}
+	panic(fmt.Sprintf("unexpected node group object %T", obj))
+}
+
+// kindOf returns the kind of a MachineDeployment, MachineSet, MachinePool or Node for messages
+func kindOf(obj apimachv1.Object) string {
+	switch obj.(type) {
+	case *v1alpha1.MachineSet:
+		return "MachineSet"
+	case *exp.MachinePool:
+		return "MachinePool"
+	case *v1.Node:
+		return "Node"
+	}
+	return "MachineDeployment"
+}
+
+// deploymentOfMachine returns the MachineDeployment node group a machine belongs to, if any, following the
+// controller references from the machine to its MachineSet and on to the MachineDeployment. During a rollout
+// the machines of both the old and the new MachineSet thus map to the same MachineDeployment. Machines whose
+// MachineSet isn't in the cache yet, e.g. because it was just created, are matched by their deployment label.
+func deploymentOfMachine(machine *v1alpha1.Machine, msRef apimachv1.OwnerReference, machineSets map[types.UID]*v1alpha1.MachineSet,
+	deploymentsByName map[string]*v1alpha1.MachineDeployment, deploymentsByUid map[types.UID]*v1alpha1.MachineDeployment) *v1alpha1.MachineDeployment {
+	ms, ok := machineSets[msRef.UID]
+	if !ok {
+		name := machine.Labels[MachineDeploymentNameLabel]
+		if name == "" {
+			verboseInfoS(4, "MachineSet of machine not found", "operation", "Refresh", "namespace", machine.Namespace, "machine", machine.Name, "machineset", msRef.Name)
+			return nil
+		}
+		return deploymentsByName[name]
+	}
+	mdRef, ok := findRefByKind(ms.OwnerReferences, "MachineDeployment")
+	if !ok {
+		return nil
+	}
+	return deploymentsByUid[mdRef.UID]
 }
 
 func findRefByKind(orefs []apimachv1.OwnerReference, kind string) (apimachv1.OwnerReference, bool) {
 	for _, ownerRef := range orefs {
-		if *ownerRef.Controller && ownerRef.Kind == kind {
+		if ownerRef.Controller != nil && *ownerRef.Controller && ownerRef.Kind == kind {
 			return ownerRef, true
 		}
 	}
 	return apimachv1.OwnerReference{}, false
 }
 
+// replicasOf returns a replica count, taking nil as the cluster-api default of 1
+func replicasOf(replicas *int32) int {
+	if replicas == nil {
+		return defaultReplicas
+	}
+	return int(*replicas)
+}
+
 func int32Ptr(i int32) *int32 {
 	return &i
 }
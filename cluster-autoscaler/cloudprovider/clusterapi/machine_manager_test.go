@@ -17,12 +17,29 @@ limitations under the License.
 package clusterapi
 
 import (
+	"context"
+	"errors"
 	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider/clusterapi/exp"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider/clusterapi/fake"
 	corefake "k8s.io/client-go/kubernetes/fake"
+	core "k8s.io/client-go/testing"
+	"sigs.k8s.io/cluster-api/pkg/apis/cluster/common"
 	"sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
-	clusterfake "sigs.k8s.io/cluster-api/pkg/client/clientset_generated/clientset/fake"
 	"testing"
+	"time"
 )
 
 func TestGetMachineDeploymentAttrs(t *testing.T) {
@@ -89,10 +106,67 @@ func TestGetMachineDeploymentAttrsInvalidMaxSize(t *testing.T) {
 	assert.Nil(t, attrs)
 }
 
+func TestGetMachineDeploymentAttrsMinGreaterThanMax(t *testing.T) {
+	attrs := GetMachineDeploymentAttrs(&v1alpha1.MachineDeployment{
+		ObjectMeta: v1.ObjectMeta{
+			Annotations: map[string]string{
+				MinSizeAnnotation: "5",
+				MaxSizeAnnotation: "3",
+			},
+		},
+	})
+
+	assert.Nil(t, attrs)
+}
+
+func TestGetMachineDeploymentAttrsNegativeMinSize(t *testing.T) {
+	attrs := GetMachineDeploymentAttrs(&v1alpha1.MachineDeployment{
+		ObjectMeta: v1.ObjectMeta{
+			Annotations: map[string]string{
+				MinSizeAnnotation: "-1",
+				MaxSizeAnnotation: "3",
+			},
+		},
+	})
+
+	assert.Nil(t, attrs)
+}
+
+func TestGetMachineDeploymentAttrsMinEqualsMax(t *testing.T) {
+	attrs := GetMachineDeploymentAttrs(&v1alpha1.MachineDeployment{
+		ObjectMeta: v1.ObjectMeta{
+			Annotations: map[string]string{
+				MinSizeAnnotation: "3",
+				MaxSizeAnnotation: "3",
+			},
+		},
+	})
+
+	assert.Equal(t, 3, attrs.minSize)
+	assert.Equal(t, 3, attrs.maxSize)
+}
+
+func TestGetMachineDeploymentAttrsLegacyAnnotations(t *testing.T) {
+	attrs := GetMachineDeploymentAttrs(&v1alpha1.MachineDeployment{
+		ObjectMeta: v1.ObjectMeta{
+			Annotations: map[string]string{
+				LegacyMinSizeAnnotation: "1",
+				LegacyMaxSizeAnnotation: "4",
+				MaxSizeAnnotation:       "10",
+			},
+		},
+	})
+
+	assert.Equal(t, 1, attrs.minSize)
+	assert.Equal(t, 10, attrs.maxSize)
+}
+
 func TestDeploymentsAndNodes(t *testing.T) {
 	md1 := buildTestMachineDeployment("md1", 1, 0, 10)
 	md2 := buildTestMachineDeployment("md2", 2, 0, 10)
 	md3 := buildTestMachineDeployment("md3", 2, 0, -1)
+	md4 := buildTestMachineDeployment("md4", 1, 0, 10)
+	md4.Annotations[MinSizeAnnotation] = "11"
 
 	ms1 := buildTestMachineSet(md2, "ms1", 2)
 
@@ -110,10 +184,10 @@ func TestDeploymentsAndNodes(t *testing.T) {
 	m4 := buildTestMachine(ms2, "m4", n4)
 
 	coreApiClient := corefake.NewSimpleClientset(n1, n2, n4)
-	clusterApiClient := clusterfake.NewSimpleClientset(m1, m2, m3, m4, ms1, ms2, md1, md2, md3)
+	dynamicClient := newTestDynamicClient(m1, m2, m3, m4, ms1, ms2, md1, md2, md3, md4)
 
-	mm := NewMachineManagerFromApiStubs(coreApiClient, clusterApiClient)
-	err := mm.Refresh()
+	mm := NewMachineManagerFromApiStubs(coreApiClient, dynamicClient, testGroupVersion, nil)
+	err := mm.Refresh(context.TODO())
 	if !assert.Nil(t, err) {
 		return
 	}
@@ -134,6 +208,1189 @@ func TestDeploymentsAndNodes(t *testing.T) {
 	assert.Contains(t, nodes, n1)
 	assert.Contains(t, nodes, n2)
 
-	assert.Nil(t, mm.SetDeploymentSize(md2, 5))
-	assert.Equal(t, int32(5), *md2.Spec.Replicas)
+	cached := mm.DeploymentForNode(n1)
+	_, err = mm.SetDeploymentSize(cached, 5)
+	assert.NoError(t, err)
+	// the cached MachineDeployment is replaced, not modified
+	assert.Equal(t, int32(5), *mm.DeploymentForNode(n1).Spec.Replicas)
+	assert.Equal(t, int32(2), *cached.Spec.Replicas)
+}
+
+func TestScaleConcurrentlyWithReads(t *testing.T) {
+	md := buildTestMachineDeployment("md", 1, 0, 10)
+	ms := buildTestMachineSet(md, "ms", 1)
+	n := buildTestNode("n")
+	m := buildTestMachine(ms, "m", n)
+
+	dynamicClient := newTestDynamicClient(m, ms, md)
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(n), dynamicClient, testGroupVersion, nil)
+	if !assert.Nil(t, mm.Refresh(context.TODO())) {
+		return
+	}
+	ng := NewClusterapiNodeGroup(mm, mm.AllDeployments()[0], nil)
+
+	// run with -race: the cached objects are read without locking, so scaling must not modify them
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			assert.NoError(t, ng.IncreaseSize(1))
+			assert.NoError(t, ng.DecreaseTargetSize(-1))
+			_, err := mm.SetMachineSetSize(mm.MachineSetsForDeployment(md)[0], 1)
+			assert.NoError(t, err)
+		}
+	}()
+	for reading := true; reading; {
+		select {
+		case <-done:
+			reading = false
+		default:
+		}
+		_, err := ng.TargetSize()
+		assert.NoError(t, err)
+		_, err = ng.Nodes()
+		assert.NoError(t, err)
+		for _, ms := range mm.MachineSetsForDeployment(md) {
+			assert.NotNil(t, ms.Spec.Replicas)
+		}
+		assert.NotNil(t, mm.DeploymentForNode(n).Spec.Replicas)
+	}
+
+	size, err := ng.TargetSize()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, size)
+}
+
+func TestDeploymentsAndNodesDuringRollout(t *testing.T) {
+	md := buildTestMachineDeployment("md", 3, 0, 10)
+	// the old MachineSet is being scaled down while the new one is scaled up
+	old := buildTestMachineSet(md, "old", 1)
+	current := buildTestMachineSet(md, "current", 2)
+	// a MachineSet that the informers haven't seen yet
+	created := buildTestMachineSet(md, "created", 1)
+
+	n1 := buildTestNode("n1")
+	m1 := buildTestMachine(old, "m1", n1)
+	n2 := buildTestNode("n2")
+	m2 := buildTestMachine(current, "m2", n2)
+	n3 := buildTestNode("n3")
+	m3 := buildTestMachine(current, "m3", n3)
+	m3.OwnerReferences = append(m3.OwnerReferences, v1.OwnerReference{Kind: "MachineDeployment", Name: "other"})
+	n4 := buildTestNode("n4")
+	m4 := buildTestMachine(created, "m4", n4)
+	m4.Labels[MachineDeploymentNameLabel] = "md"
+	n5 := buildTestNode("n5")
+	m5 := buildTestMachine(created, "m5", n5)
+
+	coreApiClient := corefake.NewSimpleClientset(n1, n2, n3, n4, n5)
+	dynamicClient := newTestDynamicClient(m1, m2, m3, m4, m5, old, current, md)
+
+	mm := NewMachineManagerFromApiStubs(coreApiClient, dynamicClient, testGroupVersion, nil)
+	if !assert.Nil(t, mm.Refresh(context.TODO())) {
+		return
+	}
+
+	assert.Equal(t, []*v1alpha1.MachineDeployment{md}, mm.AllDeployments())
+	assert.Empty(t, mm.AllMachineSets())
+	for _, node := range []*apiv1.Node{n1, n2, n3, n4} {
+		assert.Equal(t, md, mm.DeploymentForNode(node), node.Name)
+	}
+	assert.Nil(t, mm.DeploymentForNode(n5))
+	assert.ElementsMatch(t, []*apiv1.Node{n1, n2, n3, n4}, mm.NodesForDeployment(md))
+	assert.Len(t, mm.MachinesForDeployment(md), 4)
+}
+
+func TestWarnAboveMaxSize(t *testing.T) {
+	md := buildTestMachineDeployment("md", 12, 0, 10)
+	assert.True(t, warnAboveMaxSize(md, md.Spec.Replicas))
+	assert.False(t, warnAboveMaxSize(md, int32Ptr(10)))
+	assert.False(t, warnAboveMaxSize(md, nil))
+
+	unmanaged := buildTestMachineDeployment("unmanaged", 12, 0, 10)
+	unmanaged.Annotations = nil
+	assert.False(t, warnAboveMaxSize(unmanaged, unmanaged.Spec.Replicas))
+
+	// the replicas are reported as they are
+	dynamicClient := newTestDynamicClient(md)
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(), dynamicClient, testGroupVersion, nil)
+	if !assert.Nil(t, mm.Refresh(context.TODO())) {
+		return
+	}
+	assert.Equal(t, int32(12), *mm.AllDeployments()[0].Spec.Replicas)
+}
+
+func TestStandaloneMachineSetsAndNodes(t *testing.T) {
+	md1 := buildTestMachineDeployment("md1", 1, 0, 10)
+	owned := buildTestMachineSet(md1, "owned", 1)
+	owned.Annotations = map[string]string{MinSizeAnnotation: "0", MaxSizeAnnotation: "10"}
+
+	ms1 := buildTestStandaloneMachineSet("ms1", 2, 0, 10)
+	ms2 := buildTestStandaloneMachineSet("ms2", 0, 0, 10)
+	ms3 := buildTestStandaloneMachineSet("ms3", 1, 0, -1)
+
+	n1 := buildTestNode("n1")
+	m1 := buildTestMachine(ms1, "m1", n1)
+
+	n2 := buildTestNode("n2")
+	m2 := buildTestMachine(ms1, "m2", n2)
+
+	n3 := buildTestNode("n3")
+	m3 := buildTestMachine(ms3, "m3", n3)
+
+	n4 := buildTestNode("n4")
+	m4 := buildTestMachine(owned, "m4", n4)
+
+	coreApiClient := corefake.NewSimpleClientset(n1, n2, n3, n4)
+	dynamicClient := newTestDynamicClient(m1, m2, m3, m4, owned, ms1, ms2, ms3, md1)
+
+	mm := NewMachineManagerFromApiStubs(coreApiClient, dynamicClient, testGroupVersion, nil)
+	if !assert.Nil(t, mm.Refresh(context.TODO())) {
+		return
+	}
+
+	sets := mm.AllMachineSets()
+	assert.Len(t, sets, 2)
+	assert.Contains(t, sets, ms1)
+	assert.Contains(t, sets, ms2)
+
+	assert.Equal(t, ms1, mm.MachineSetForNode(n1))
+	assert.Equal(t, ms1, mm.MachineSetForNode(n2))
+	assert.Nil(t, mm.MachineSetForNode(n3))
+	assert.Nil(t, mm.MachineSetForNode(n4))
+	assert.Nil(t, mm.DeploymentForNode(n1))
+	assert.Equal(t, md1, mm.DeploymentForNode(n4))
+
+	nodes := mm.NodesForMachineSet(ms1)
+	assert.Len(t, nodes, 2)
+	assert.Contains(t, nodes, n1)
+	assert.Contains(t, nodes, n2)
+	assert.Nil(t, mm.NodesForMachineSet(ms2))
+
+	machines := mm.MachinesForMachineSet(ms1)
+	assert.Len(t, machines, 2)
+	assert.Contains(t, machines, m1)
+	assert.Contains(t, machines, m2)
+	assert.Equal(t, n1, mm.NodeForMachine(m1))
+	assert.Nil(t, mm.MachinesForMachineSet(ms2))
+
+	_, err := mm.SetMachineSetSize(ms2, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), *mm.current().machineSet(ms2).Spec.Replicas)
+	updated, err := dynamicClient.Resource(testGroupVersion.WithResource(machineSetResource)).Namespace("kube-system").Get("ms2", v1.GetOptions{})
+	assert.NoError(t, err)
+	replicas, _, _ := unstructured.NestedInt64(updated.Object, "spec", "replicas")
+	assert.Equal(t, int64(3), replicas)
+
+	_, err = mm.SetMachineSetSize(ms3, 3)
+	assert.Error(t, err)
+
+	// the MachineSets of MachineDeployments aren't node groups, but may be scaled on their behalf
+	assert.Equal(t, []*v1alpha1.MachineSet{owned}, mm.MachineSetsForDeployment(md1))
+	_, err = mm.SetMachineSetSize(owned, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), *mm.MachineSetsForDeployment(md1)[0].Spec.Replicas)
+}
+
+func TestAutoDiscoverySelectors(t *testing.T) {
+	md1 := buildTestMachineDeployment("md1", 1, 0, 10)
+	md1.Labels["autoscaling"] = "enabled"
+	md2 := buildTestMachineDeployment("md2", 1, 0, 10)
+	ms1 := buildTestStandaloneMachineSet("ms1", 1, 0, 10)
+	ms1.Labels["autoscaling"] = "enabled"
+	ms2 := buildTestStandaloneMachineSet("ms2", 1, 0, 10)
+
+	dynamicClient := newTestDynamicClient(md1, md2, ms1, ms2)
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(), dynamicClient, testGroupVersion, nil)
+	mm.autoDiscoverySelectors = []labels.Selector{labels.SelectorFromSet(labels.Set{"autoscaling": "enabled"})}
+	if !assert.Nil(t, mm.Refresh(context.TODO())) {
+		return
+	}
+	assert.Equal(t, []*v1alpha1.MachineDeployment{md1}, mm.AllDeployments())
+	assert.Equal(t, []*v1alpha1.MachineSet{ms1}, mm.AllMachineSets())
+
+	// discovery is re-evaluated on every refresh
+	_, err := dynamicClient.Resource(testGroupVersion.WithResource(machineDeploymentResource)).Namespace("kube-system").
+		Patch("md2", types.MergePatchType, []byte(`{"metadata":{"labels":{"autoscaling":"enabled"}}}`), v1.UpdateOptions{})
+	assert.NoError(t, err)
+	err = wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return len(mm.AllDeployments()) == 2, mm.Refresh(context.TODO())
+	})
+	assert.NoError(t, err)
+}
+
+func TestPausedNodeGroups(t *testing.T) {
+	md1 := buildTestMachineDeployment("md1", 1, 0, 10)
+	md2 := buildTestMachineDeployment("md2", 1, 0, 10)
+	md2.Annotations[PausedAnnotation] = "true"
+	md3 := buildTestMachineDeployment("md3", 1, 0, 10)
+	md3.Spec.Paused = true
+	md4 := buildTestMachineDeployment("md4", 1, 0, 10)
+	md4.Labels[LegacyClusterNameLabel] = "paused"
+	ms1 := buildTestStandaloneMachineSet("ms1", 1, 0, 10)
+	ms1.Labels[ClusterNameLabel] = "paused"
+
+	cluster := buildTestCluster("paused")
+	cluster.Annotations = map[string]string{PausedAnnotation: "true"}
+
+	dynamicClient := newTestDynamicClient(md1, md2, md3, md4, ms1, cluster)
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(), dynamicClient, testGroupVersion, nil)
+	if !assert.Nil(t, mm.Refresh(context.TODO())) {
+		return
+	}
+	assert.Equal(t, []*v1alpha1.MachineDeployment{md1}, mm.AllDeployments())
+	assert.Empty(t, mm.AllMachineSets())
+
+	// unpaused groups reappear on the next refresh
+	_, err := dynamicClient.Resource(testGroupVersion.WithResource(clusterResource)).Namespace("kube-system").
+		Patch("paused", types.MergePatchType, []byte(`{"metadata":{"annotations":{"cluster.x-k8s.io/paused":null}}}`), v1.UpdateOptions{})
+	assert.NoError(t, err)
+	err = wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return len(mm.AllDeployments()) == 2 && len(mm.AllMachineSets()) == 1, mm.Refresh(context.TODO())
+	})
+	assert.NoError(t, err)
+}
+
+func TestRefreshReplacesSnapshot(t *testing.T) {
+	md := buildTestMachineDeployment("md", 1, 0, 10)
+	ms := buildTestMachineSet(md, "ms", 1)
+	node := buildTestNode("n1")
+	machine := buildTestMachine(ms, "m1", node)
+
+	dynamicClient := newTestDynamicClient(md, ms, machine)
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(node), dynamicClient, testGroupVersion, nil)
+	if !assert.Nil(t, mm.Refresh(context.TODO())) {
+		return
+	}
+	previous := mm.current()
+	assert.Equal(t, []*v1alpha1.Machine{machine}, previous.machinesByProviderID["n1"])
+	assert.Equal(t, []*v1alpha1.Machine{machine}, previous.machinesByName["m1"])
+
+	_, err := dynamicClient.Resource(testGroupVersion.WithResource(machineDeploymentResource)).Namespace("kube-system").
+		Patch("md", types.MergePatchType, []byte(`{"spec":{"replicas":3}}`), v1.UpdateOptions{})
+	assert.NoError(t, err)
+	err = wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return *mm.AllDeployments()[0].Spec.Replicas == 3, mm.Refresh(context.TODO())
+	})
+	assert.NoError(t, err)
+
+	// the previous snapshot is left untouched, and the new one is complete
+	assert.Equal(t, int32(1), *previous.allDeploymentsByUid[md.UID].Spec.Replicas)
+	assert.Equal(t, int32(3), *mm.DeploymentForNode(node).Spec.Replicas)
+}
+
+func TestDisruptionBudgetedPods(t *testing.T) {
+	n1 := buildTestNode("n1")
+	n2 := buildTestNode("n2")
+	pod := func(namespace, name, node, app string, phase apiv1.PodPhase) *apiv1.Pod {
+		return &apiv1.Pod{
+			ObjectMeta: v1.ObjectMeta{Namespace: namespace, Name: name, Labels: map[string]string{"app": app}},
+			Spec:       apiv1.PodSpec{NodeName: node},
+			Status:     apiv1.PodStatus{Phase: phase},
+		}
+	}
+	pdb := func(namespace, name string, selector *v1.LabelSelector) *policyv1.PodDisruptionBudget {
+		return &policyv1.PodDisruptionBudget{
+			ObjectMeta: v1.ObjectMeta{Namespace: namespace, Name: name},
+			Spec:       policyv1.PodDisruptionBudgetSpec{Selector: selector},
+		}
+	}
+	pods := []*apiv1.Pod{
+		pod("default", "db-0", "n1", "db", apiv1.PodRunning),
+		pod("default", "db-1", "n1", "db", apiv1.PodRunning),
+		pod("default", "web-0", "n1", "web", apiv1.PodRunning),
+		pod("default", "db-2", "n2", "db", apiv1.PodSucceeded),
+		// a budget only guards the pods of its own namespace
+		pod("other", "db-0", "n2", "db", apiv1.PodRunning),
+	}
+	coreApiClient := corefake.NewSimpleClientset(
+		pdb("default", "db", &v1.LabelSelector{MatchLabels: map[string]string{"app": "db"}}),
+		pdb("default", "empty", &v1.LabelSelector{}),
+	)
+	// the fake clientset ignores field selectors
+	coreApiClient.PrependReactor("list", "pods", func(action core.Action) (bool, runtime.Object, error) {
+		restrictions := action.(core.ListAction).GetListRestrictions()
+		list := &apiv1.PodList{}
+		for _, pod := range pods {
+			if restrictions.Fields.Matches(fields.Set{"spec.nodeName": pod.Spec.NodeName}) {
+				list.Items = append(list.Items, *pod)
+			}
+		}
+		return true, list, nil
+	})
+	mm := NewMachineManagerFromApiStubs(coreApiClient, newTestDynamicClient(), testGroupVersion, nil)
+
+	counts, err := mm.DisruptionBudgetedPods([]*apiv1.Node{n1, n2})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"n1": 2, "n2": 0}, counts)
+
+	coreApiClient.PrependReactor("list", "poddisruptionbudgets", func(action core.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("forbidden")
+	})
+	_, err = mm.DisruptionBudgetedPods([]*apiv1.Node{n1, n2})
+	assert.EqualError(t, err, "forbidden")
+}
+
+func TestExcludedNodeGroups(t *testing.T) {
+	md1 := buildTestMachineDeployment("md1", 1, 0, 10)
+	md1.Annotations[EnabledAnnotation] = "true"
+	md2 := buildTestMachineDeployment("md2", 1, 0, 10)
+	md2.Annotations[EnabledAnnotation] = "false"
+
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(), newTestDynamicClient(md1, md2), testGroupVersion, nil)
+	if !assert.Nil(t, mm.Refresh(context.TODO())) {
+		return
+	}
+	assert.Equal(t, []*v1alpha1.MachineDeployment{md1}, mm.AllDeployments())
+	_, logged := mm.loggedExclusions.Load(md2.UID)
+	assert.True(t, logged)
+}
+
+func TestManagedByLabel(t *testing.T) {
+	md1 := buildTestMachineDeployment("md1", 1, 0, 10)
+	md2 := buildTestMachineDeployment("md2", 1, 0, 10)
+	md2.Labels[ManagedByLabel] = "autoscaler-a"
+	md3 := buildTestMachineDeployment("md3", 1, 0, 10)
+	md3.Labels[ManagedByLabel] = "autoscaler-b"
+
+	dynamicClient := newTestDynamicClient(md1, md2, md3)
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(), dynamicClient, testGroupVersion, nil)
+	mm.instanceID, mm.skipForeignNodeGroups = "autoscaler-a", true
+	if !assert.Nil(t, mm.Refresh(context.TODO())) {
+		return
+	}
+	names := make([]string, 0)
+	for _, md := range mm.AllDeployments() {
+		names = append(names, md.Name)
+	}
+	assert.ElementsMatch(t, []string{"md1", "md2"}, names)
+
+	// scaled objects are labeled once
+	for _, md := range mm.AllDeployments() {
+		_, err := mm.SetDeploymentSize(md, 2)
+		assert.NoError(t, err)
+	}
+	patches := 0
+	for _, action := range dynamicClient.RecordedActions() {
+		if action.Verb == "patch" {
+			patches++
+			assert.Equal(t, "md1", action.Name)
+		}
+	}
+	assert.Equal(t, 1, patches)
+	stored, err := dynamicClient.Resource(testGroupVersion.WithResource(machineDeploymentResource)).Namespace("kube-system").
+		Get("md1", v1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "autoscaler-a", stored.GetLabels()[ManagedByLabel])
+
+	// without skipping foreign node groups, all are managed
+	mm = NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(), dynamicClient, testGroupVersion, nil)
+	mm.instanceID = "autoscaler-a"
+	if !assert.Nil(t, mm.Refresh(context.TODO())) {
+		return
+	}
+	assert.Len(t, mm.AllDeployments(), 3)
+}
+
+func TestRefreshInformersNotSynced(t *testing.T) {
+	dynamicClient := newTestDynamicClient()
+	dynamicClient.AddReactor(func(action fake.DynamicAction) (bool, error) {
+		return action.Verb == "list", errors.New("unreachable")
+	})
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(), dynamicClient, testGroupVersion, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.EqualError(t, mm.Refresh(ctx), "informer caches not synced: context deadline exceeded")
+}
+
+func TestCleanupStopsInformers(t *testing.T) {
+	md := buildTestMachineDeployment("md", 1, 0, 10)
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(), newTestDynamicClient(md), testGroupVersion, nil)
+	if !assert.NoError(t, mm.Refresh(context.TODO())) {
+		return
+	}
+
+	assert.True(t, mm.HasSynced())
+
+	assert.NoError(t, mm.Cleanup())
+	assert.NoError(t, mm.Cleanup())
+	assert.False(t, mm.HasSynced())
+	assert.EqualError(t, mm.Refresh(context.TODO()), "machine manager is stopped")
+	assert.EqualError(t, mm.WaitForCacheSync(context.TODO()), "machine manager is stopped")
+
+	// a manager that never refreshed doesn't start its informers after cleanup
+	mm = NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(), newTestDynamicClient(md), testGroupVersion, nil)
+	assert.False(t, mm.HasSynced())
+	assert.NoError(t, mm.Cleanup())
+	assert.EqualError(t, mm.Refresh(context.TODO()), "machine manager is stopped")
+}
+
+func TestRefreshInterval(t *testing.T) {
+	md1 := buildTestMachineDeployment("md1", 1, 0, 10)
+	dynamicClient := newTestDynamicClient(md1)
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(), dynamicClient, testGroupVersion, nil)
+	mm.refreshInterval = time.Minute
+	defer mm.Cleanup()
+	if !assert.NoError(t, mm.Refresh(context.TODO())) {
+		return
+	}
+
+	// within the interval the cached state is kept
+	md2 := buildTestMachineDeployment("md2", 1, 0, 10)
+	addTestObject(dynamicClient, md2)
+	assert.NoError(t, mm.Refresh(context.TODO()))
+	assert.Len(t, mm.AllDeployments(), 1)
+
+	// once it has passed, the next refresh picks up changes
+	assert.NoError(t, wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		mm.lastRefresh = time.Now().Add(-time.Minute)
+		return len(mm.AllDeployments()) == 2, mm.Refresh(context.TODO())
+	}))
+	assert.WithinDuration(t, time.Now(), mm.lastRefresh, time.Second)
+}
+
+func TestRefreshBackoff(t *testing.T) {
+	dynamicClient := newTestDynamicClient()
+	dynamicClient.AddReactor(func(action fake.DynamicAction) (bool, error) {
+		return action.Verb == "list", errors.New("unreachable")
+	})
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(), dynamicClient, testGroupVersion, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Error(t, mm.Refresh(ctx))
+	assert.Equal(t, 1, mm.refreshFailures)
+	assert.True(t, mm.refreshBackoffUntil.After(time.Now()))
+	assert.Equal(t, float64(1), metricValue(t, refreshFailuresGauge))
+
+	// while backing off, refreshes fail fast with the last error
+	err := mm.Refresh(context.TODO())
+	assert.Contains(t, err.Error(), "after 1 failures: informer caches not synced: context deadline exceeded")
+	assert.Equal(t, 1, mm.refreshFailures)
+
+	// a successful refresh closes the circuit
+	mm = NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(), newTestDynamicClient(), testGroupVersion, nil)
+	mm.refreshFailures = 3
+	mm.refreshBackoffUntil = time.Now().Add(-time.Second)
+	assert.NoError(t, mm.Refresh(context.TODO()))
+	assert.Equal(t, 0, mm.refreshFailures)
+	assert.True(t, mm.refreshBackoffUntil.IsZero())
+	assert.Equal(t, float64(0), metricValue(t, refreshBackoffGauge))
+}
+
+func TestRefreshBackoffDuration(t *testing.T) {
+	for failures, expected := range map[int]time.Duration{
+		1:   5 * time.Second,
+		2:   10 * time.Second,
+		4:   40 * time.Second,
+		7:   5 * time.Minute,
+		100: 5 * time.Minute,
+	} {
+		backoff := refreshBackoff(failures)
+		assert.True(t, backoff >= expected && backoff <= expected+expected/10, "%d failures: %v", failures, backoff)
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	var mds []*v1alpha1.MachineDeployment
+	var nodes []*apiv1.Node
+	objs := make([]runtime.Object, 0)
+	for _, namespace := range []string{"tenant-a", "tenant-b", "tenant-c"} {
+		md := buildTestMachineDeployment("md", 1, 0, 10)
+		md.Namespace = namespace
+		ms := buildTestMachineSet(md, "ms", 1)
+		ms.Namespace = namespace
+		n := buildTestNode("n-" + namespace)
+		m := buildTestMachine(ms, "m", n)
+		m.Namespace = namespace
+		mds = append(mds, md)
+		nodes = append(nodes, n)
+		objs = append(objs, md, ms, m)
+	}
+	dynamicClient := newTestDynamicClient(objs...)
+	coreApiClient := corefake.NewSimpleClientset(nodes[0], nodes[1], nodes[2],
+		&apiv1.Namespace{ObjectMeta: v1.ObjectMeta{Name: "tenant-a"}})
+
+	mm := NewMachineManagerFromApiStubs(coreApiClient, dynamicClient, testGroupVersion, []string{"tenant-b", "tenant-a", "missing"})
+	if !assert.Nil(t, mm.Refresh(context.TODO())) {
+		return
+	}
+	assert.Equal(t, []string{"missing", "tenant-a", "tenant-b"}, mm.namespaces)
+	assert.ElementsMatch(t, []*v1alpha1.MachineDeployment{mds[0], mds[1]}, mm.AllDeployments())
+	assert.Equal(t, mds[0], mm.DeploymentForNode(nodes[0]))
+	assert.Equal(t, mds[1], mm.DeploymentForNode(nodes[1]))
+	assert.Nil(t, mm.DeploymentForNode(nodes[2]))
+
+	for _, concurrency := range []int{1, 2, 4} {
+		mm = NewMachineManagerFromApiStubs(coreApiClient, dynamicClient, testGroupVersion, nil)
+		mm.refreshConcurrency = concurrency
+		if !assert.Nil(t, mm.Refresh(context.TODO())) {
+			return
+		}
+		assert.ElementsMatch(t, mds, mm.AllDeployments())
+		for i, node := range nodes {
+			assert.Equal(t, mds[i], mm.DeploymentForNode(node))
+		}
+	}
+}
+
+func TestRestrictMachinesToCluster(t *testing.T) {
+	md1 := buildTestMachineDeployment("md1", 1, 0, 10)
+	ms1 := buildTestMachineSet(md1, "ms1", 1)
+	n1 := buildTestNode("n1")
+	m1 := buildTestMachine(ms1, "m1", n1)
+	m1.Labels = map[string]string{LegacyClusterNameLabel: "workload"}
+	md1.Labels[LegacyClusterNameLabel] = "workload"
+	md2 := buildTestMachineDeployment("md2", 1, 0, 10)
+	ms2 := buildTestMachineSet(md2, "ms2", 1)
+	n2 := buildTestNode("n2")
+	m2 := buildTestMachine(ms2, "m2", n2)
+	m2.Labels = map[string]string{LegacyClusterNameLabel: "co-tenant"}
+	md2.Labels[LegacyClusterNameLabel] = "co-tenant"
+	standalone := buildTestStandaloneMachineSet("standalone", 1, 0, 10)
+
+	dynamicClient := newTestDynamicClient(m1, m2, ms1, ms2, md1, md2, standalone)
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(n1, n2), dynamicClient, testGroupVersion, nil)
+	mm.restrictMachinesToCluster("workload")
+	if !assert.Nil(t, mm.Refresh(context.TODO())) {
+		return
+	}
+
+	// only the node groups of the cluster are discovered, unlabeled ones belong to no cluster
+	assert.Equal(t, []*v1alpha1.MachineDeployment{md1}, mm.AllDeployments())
+	assert.Empty(t, mm.AllMachineSets())
+	assert.Equal(t, m1, mm.MachineForNode(n1))
+	assert.Equal(t, md1, mm.DeploymentForNode(n1))
+	assert.Nil(t, mm.MachineForNode(n2))
+	assert.Nil(t, mm.DeploymentForNode(n2))
+	assert.Empty(t, mm.MachinesForDeployment(md2))
+}
+
+func TestSetReplicasUsesScaleSubresource(t *testing.T) {
+	md := buildTestMachineDeployment("md", 1, 0, 10)
+	dynamicClient := newTestDynamicClient(md)
+	conflicts := 0
+	dynamicClient.AddReactor(func(action fake.DynamicAction) (bool, error) {
+		if action.Verb == "update" && action.Subresource == "scale" && conflicts < 2 {
+			conflicts++
+			return true, apierrors.NewConflict(schema.GroupResource{Resource: machineDeploymentResource}, action.Name, nil)
+		}
+		return false, nil
+	})
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(), dynamicClient, testGroupVersion, nil)
+
+	assert.NoError(t, mm.setReplicas(machineDeploymentResource, "kube-system", "md", 3))
+
+	updated, err := dynamicClient.Resource(testGroupVersion.WithResource(machineDeploymentResource)).Namespace("kube-system").Get("md", v1.GetOptions{})
+	assert.NoError(t, err)
+	replicas, _, _ := unstructured.NestedInt64(updated.Object, "spec", "replicas")
+	assert.Equal(t, int64(3), replicas)
+	assert.Equal(t, 2, conflicts)
+	for _, action := range dynamicClient.RecordedActions() {
+		assert.NotEqual(t, "patch", action.Verb)
+	}
+}
+
+func TestSetReplicasWithoutScaleSubresource(t *testing.T) {
+	ms := buildTestStandaloneMachineSet("ms", 1, 0, 10)
+	dynamicClient := newTestDynamicClient(ms)
+	dynamicClient.AddReactor(func(action fake.DynamicAction) (bool, error) {
+		if action.Subresource == "scale" {
+			return true, apierrors.NewNotFound(schema.GroupResource{Resource: machineSetResource}, action.Name)
+		}
+		return false, nil
+	})
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(), dynamicClient, testGroupVersion, nil)
+
+	assert.NoError(t, mm.setReplicas(machineSetResource, "kube-system", "ms", 0))
+
+	updated, err := dynamicClient.Resource(testGroupVersion.WithResource(machineSetResource)).Namespace("kube-system").Get("ms", v1.GetOptions{})
+	assert.NoError(t, err)
+	replicas, found, _ := unstructured.NestedInt64(updated.Object, "spec", "replicas")
+	assert.True(t, found)
+	assert.Equal(t, int64(0), replicas)
+
+	patchTypes := make([]types.PatchType, 0)
+	for _, action := range dynamicClient.RecordedActions() {
+		if action.Verb == "patch" {
+			patchTypes = append(patchTypes, action.PatchType)
+		}
+	}
+	assert.Equal(t, []types.PatchType{types.JSONPatchType}, patchTypes)
+}
+
+func TestSetReplicasRejectedByAdmission(t *testing.T) {
+	md := buildTestMachineDeployment("md", 1, 0, 10)
+	dynamicClient := newTestDynamicClient(md)
+	dynamicClient.AddReactor(func(action fake.DynamicAction) (bool, error) {
+		if action.Verb == "update" && action.Subresource == "scale" {
+			return true, apierrors.NewForbidden(schema.GroupResource{Resource: machineDeploymentResource}, action.Name,
+				errors.New("admission webhook \"replicas.example.com\" denied the request: replicas are frozen"))
+		}
+		return false, nil
+	})
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(), dynamicClient, testGroupVersion, nil)
+
+	err := mm.setReplicas(machineDeploymentResource, "kube-system", "md", 3)
+	assert.Error(t, err)
+	assert.True(t, rejectedByAdmission(err))
+}
+
+func TestCheckReplicasApplied(t *testing.T) {
+	scale := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{"replicas": int64(3)},
+	}}
+	assert.NoError(t, checkReplicasApplied(scale, 3))
+
+	// a mutating webhook reset the replicas
+	err := checkReplicasApplied(scale, 4)
+	assert.EqualError(t, err, "replicas set to 4 but 3 were applied")
+	assert.True(t, rejectedByAdmission(err))
+
+	assert.NoError(t, checkReplicasApplied(&unstructured.Unstructured{Object: map[string]interface{}{}}, 4))
+}
+
+func TestMachinePools(t *testing.T) {
+	n1 := buildTestNode("n1")
+	n1.Spec.ProviderID = "azure:///subscriptions/s/virtualMachineScaleSets/mp/virtualMachines/0"
+	n2 := buildTestNode("n2")
+	n2.Spec.ProviderID = "azure:///subscriptions/s/virtualMachineScaleSets/mp/virtualMachines/1"
+	mp := buildTestMachinePool("mp", 3, 0, 10, n1, n2)
+	// the instance of the third replica hasn't registered its node yet
+	mp.Spec.ProviderIDList = append(mp.Spec.ProviderIDList, "azure:///subscriptions/s/virtualMachineScaleSets/mp/virtualMachines/2")
+	mp.Spec.ProviderIDList[0] = "azure://subscriptions/s/virtualMachineScaleSets/mp/virtualMachines/0"
+	unmanaged := buildTestNode("unmanaged")
+
+	dynamicClient := newTestDynamicClient()
+	addTestMachinePool(dynamicClient, mp)
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(n1, n2, unmanaged), dynamicClient, testGroupVersion, nil)
+	mm.enableMachinePools(testMachinePoolGroupVersion)
+	if !assert.Nil(t, mm.Refresh(context.TODO())) {
+		return
+	}
+
+	assert.Equal(t, []*exp.MachinePool{mp}, mm.AllMachinePools())
+	assert.Equal(t, mp, mm.MachinePoolForNode(n1))
+	assert.Equal(t, mp, mm.MachinePoolForNode(n2))
+	assert.Nil(t, mm.MachinePoolForNode(unmanaged))
+	assert.ElementsMatch(t, []*apiv1.Node{n1, n2}, mm.NodesForMachinePool(mp))
+
+	client := dynamicClient.Resource(testMachinePoolGroupVersion.WithResource(machinePoolResource)).Namespace("kube-system")
+	_, err := mm.SetMachinePoolSize(mp, 4)
+	assert.NoError(t, err)
+	updated, err := client.Get("mp", v1.GetOptions{})
+	assert.NoError(t, err)
+	replicas, _, _ := unstructured.NestedInt64(updated.Object, "spec", "replicas")
+	assert.Equal(t, int64(4), replicas)
+
+	_, err = mm.DeleteMachinePoolNodes(mp, []*apiv1.Node{n1}, 3)
+	assert.NoError(t, err)
+	updated, err = client.Get("mp", v1.GetOptions{})
+	assert.NoError(t, err)
+	replicas, _, _ = unstructured.NestedInt64(updated.Object, "spec", "replicas")
+	assert.Equal(t, int64(3), replicas)
+	providerIDs, _, _ := unstructured.NestedStringSlice(updated.Object, "spec", "providerIDList")
+	assert.Equal(t, []string{
+		"azure:///subscriptions/s/virtualMachineScaleSets/mp/virtualMachines/1",
+		"azure:///subscriptions/s/virtualMachineScaleSets/mp/virtualMachines/2",
+	}, providerIDs)
+	assert.Equal(t, providerIDs, mm.AllMachinePools()[0].Spec.ProviderIDList)
+
+	_, err = mm.DeleteMachinePoolNodes(mm.AllMachinePools()[0], []*apiv1.Node{n1}, 2)
+	assert.EqualError(t, err, "not all nodes are instances of MachinePool mp")
+}
+
+func TestFailureDomain(t *testing.T) {
+	md := buildTestMachineDeployment("md", 1, 0, 10)
+	ms := buildTestStandaloneMachineSet("ms", 1, 0, 10)
+	mp := buildTestMachinePool("mp", 1, 0, 10)
+	m := buildTestMachine(ms, "m", nil)
+	dynamicClient := newTestDynamicClient(md, ms, m)
+	addTestMachinePool(dynamicClient, mp)
+	// v1alpha1 has no failure domain, so it is set on the stored objects only
+	mdResource := dynamicClient.Resource(testGroupVersion.WithResource(machineDeploymentResource)).Namespace("kube-system")
+	stored, err := mdResource.Get("md", v1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, unstructured.SetNestedField(stored.Object, "az-1", "spec", "template", "spec", "failureDomain"))
+	_, err = mdResource.Update(stored, v1.UpdateOptions{})
+	assert.NoError(t, err)
+	mpResource := dynamicClient.Resource(testMachinePoolGroupVersion.WithResource(machinePoolResource)).Namespace("kube-system")
+	stored, err = mpResource.Get("mp", v1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, unstructured.SetNestedStringSlice(stored.Object, []string{"az-2"}, "spec", "failureDomains"))
+	_, err = mpResource.Update(stored, v1.UpdateOptions{})
+	assert.NoError(t, err)
+	machineResource := dynamicClient.Resource(testGroupVersion.WithResource(machineResource)).Namespace("kube-system")
+	stored, err = machineResource.Get("m", v1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, unstructured.SetNestedField(stored.Object, "az-3", "spec", "failureDomain"))
+	_, err = machineResource.Update(stored, v1.UpdateOptions{})
+	assert.NoError(t, err)
+
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(), dynamicClient, testGroupVersion, nil)
+	mm.enableMachinePools(testMachinePoolGroupVersion)
+	if !assert.Nil(t, mm.Refresh(context.TODO())) {
+		return
+	}
+	assert.Equal(t, "az-1", mm.FailureDomain(md))
+	assert.Equal(t, "", mm.FailureDomain(ms))
+	assert.Equal(t, "az-2", mm.FailureDomain(mp))
+	assert.Equal(t, "az-3", mm.FailureDomain(m))
+}
+
+func TestMachinePoolsNotServed(t *testing.T) {
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(), newTestDynamicClient(), testGroupVersion, nil)
+	if !assert.Nil(t, mm.Refresh(context.TODO())) {
+		return
+	}
+	assert.Empty(t, mm.AllMachinePools())
+}
+
+func TestMachineForNodeByProviderID(t *testing.T) {
+	md := buildTestMachineDeployment("md", 1, 0, 10)
+	ms := buildTestMachineSet(md, "ms", 1)
+	n := buildTestNode("n")
+	m := buildTestMachine(ms, "m", n)
+	// the machine controller has set the providerID but not yet the node reference
+	m.Status.NodeRef = nil
+
+	dynamicClient := newTestDynamicClient(m, ms, md)
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(n), dynamicClient, testGroupVersion, nil)
+	if !assert.Nil(t, mm.Refresh(context.TODO())) {
+		return
+	}
+
+	assert.Equal(t, m, mm.MachineForNode(n))
+	assert.Equal(t, md, mm.DeploymentForNode(n))
+	assert.Nil(t, mm.NodesForDeployment(md))
+
+	unknown := buildTestNode("unknown")
+	assert.Nil(t, mm.MachineForNode(unknown))
+	assert.Nil(t, mm.DeploymentForNode(unknown))
+}
+
+func TestMachineForNodeByNormalizedProviderID(t *testing.T) {
+	md := buildTestMachineDeployment("md", 1, 0, 10)
+	ms := buildTestMachineSet(md, "ms", 1)
+	n := buildTestNode("n")
+	n.Spec.ProviderID = "openstack:///0e4c5f2a-9a3b-4c1e-8d3f-6b2a1c9e7d10"
+	m := buildTestMachine(ms, "m", n)
+	providerID := "openstack://0E4C5F2A-9A3B-4C1E-8D3F-6B2A1C9E7D10"
+	m.Spec.ProviderID = &providerID
+	m.Status.NodeRef = nil
+
+	dynamicClient := newTestDynamicClient(m, ms, md)
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(n), dynamicClient, testGroupVersion, nil)
+	if !assert.Nil(t, mm.Refresh(context.TODO())) {
+		return
+	}
+
+	assert.Equal(t, m, mm.MachineForNode(n))
+	assert.Equal(t, md, mm.DeploymentForNode(n))
+}
+
+func TestMachineForNodeByInfrastructureProvider(t *testing.T) {
+	md := buildTestMachineDeployment("md", 1, 0, 10)
+	setTestInfrastructureTemplate(md, "infrastructure.cluster.x-k8s.io/v1alpha4", "KubevirtMachineTemplate", "template")
+	ms := buildTestMachineSet(md, "ms", 1)
+	ms.Spec.Template = md.Spec.Template
+	n := buildTestNode("n")
+	n.Spec.ProviderID = "kubevirt://worker-1"
+	m := buildTestMachine(ms, "m", n)
+	// the providerID is matched with the KubeVirt matcher of the MachineSet's infrastructureRef
+	providerID := "kube-system/worker-1"
+	m.Spec.ProviderID = &providerID
+	m.Status.NodeRef = nil
+
+	dynamicClient := newTestDynamicClient(m, ms, md)
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(n), dynamicClient, testGroupVersion, nil)
+	if !assert.Nil(t, mm.Refresh(context.TODO())) {
+		return
+	}
+
+	assert.Equal(t, m, mm.MachineForNode(n))
+	assert.Equal(t, md, mm.DeploymentForNode(n))
+}
+
+func TestDeleteNodesByInfrastructureProvider(t *testing.T) {
+	md := buildTestMachineDeployment("md", 2, 0, 10)
+	setTestInfrastructureTemplate(md, "infrastructure.cluster.x-k8s.io/v1alpha4", "KubevirtMachineTemplate", "template")
+	ms := buildTestMachineSet(md, "ms", 2)
+	ms.Spec.Template = md.Spec.Template
+	n1 := buildTestNode("n1")
+	n1.Spec.ProviderID = "kubevirt://worker-1"
+	m1 := buildTestMachine(ms, "m1", n1)
+	n2 := buildTestNode("n2")
+	n2.Spec.ProviderID = "kubevirt://worker-2"
+	m2 := buildTestMachine(ms, "m2", n2)
+	// scheme-less providerIDs are only matched with the KubeVirt matcher of the MachineSet's infrastructureRef
+	providerID1, providerID2 := "kube-system/worker-1", "kube-system/worker-2"
+	m1.Spec.ProviderID = &providerID1
+	m2.Spec.ProviderID = &providerID2
+
+	dynamicClient := newTestDynamicClient(m1, m2, ms, md)
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(n1, n2), dynamicClient, testGroupVersion, nil)
+	if !assert.Nil(t, mm.Refresh(context.TODO())) {
+		return
+	}
+
+	assert.NoError(t, NewClusterapiNodeGroup(mm, md, nil).DeleteNodes([]*apiv1.Node{n1}))
+
+	deleted, err := dynamicClient.Resource(testGroupVersion.WithResource(machineResource)).Namespace("kube-system").Get("m1", v1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Contains(t, deleted.GetAnnotations(), DeleteMachineAnnotation)
+	updated, err := dynamicClient.Resource(testGroupVersion.WithResource(machineDeploymentResource)).Namespace("kube-system").Get("md", v1.GetOptions{})
+	assert.NoError(t, err)
+	replicas, _, _ := unstructured.NestedInt64(updated.Object, "spec", "replicas")
+	assert.Equal(t, int64(1), replicas)
+}
+
+func TestMachineForNodeFallbacks(t *testing.T) {
+	md := buildTestMachineDeployment("md", 3, 0, 10)
+	ms := buildTestMachineSet(md, "ms", 3)
+	annotated := buildTestNode("annotated")
+	annotated.Spec.ProviderID = ""
+	annotated.Annotations = map[string]string{MachineAnnotation: "m1", ClusterNamespaceAnnotation: ms.Namespace}
+	m1 := buildTestMachine(ms, "m1", nil)
+	named := buildTestNode("m2")
+	named.Spec.ProviderID = ""
+	m2 := buildTestMachine(ms, "m2", nil)
+	// a machine of the same name as the node that is bound to another node doesn't match
+	bound := buildTestNode("m3")
+	bound.Spec.ProviderID = ""
+	m3 := buildTestMachine(ms, "m3", buildTestNode("other"))
+
+	dynamicClient := newTestDynamicClient(m1, m2, m3, ms, md)
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(annotated, named, bound), dynamicClient, testGroupVersion, nil)
+	if !assert.Nil(t, mm.Refresh(context.TODO())) {
+		return
+	}
+
+	assert.Equal(t, m1, mm.MachineForNode(annotated))
+	assert.Equal(t, md, mm.DeploymentForNode(annotated))
+	assert.Equal(t, m2, mm.MachineForNode(named))
+	assert.Nil(t, mm.MachineForNode(bound))
+
+	// without the namespace annotation the machine is looked up by name in all namespaces
+	delete(annotated.Annotations, ClusterNamespaceAnnotation)
+	assert.Equal(t, m1, mm.MachineForNode(annotated))
+}
+
+func TestMarkMachineForDeletion(t *testing.T) {
+	md := buildTestMachineDeployment("md", 1, 0, 10)
+	ms := buildTestMachineSet(md, "ms", 1)
+	n := buildTestNode("n")
+	m := buildTestMachine(ms, "m", n)
+
+	dynamicClient := newTestDynamicClient(m, ms, md)
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(n), dynamicClient, testGroupVersion, nil)
+	if !assert.Nil(t, mm.Refresh(context.TODO())) {
+		return
+	}
+
+	conflicts := 0
+	dynamicClient.AddReactor(func(action fake.DynamicAction) (bool, error) {
+		if action.Verb != "patch" || conflicts == 2 {
+			return false, nil
+		}
+		conflicts++
+		return true, apierrors.NewConflict(schema.GroupResource{Resource: machineResource}, "m", errors.New("conflict"))
+	})
+
+	machine := mm.MachineForNode(n)
+	assert.Equal(t, m, machine)
+	// conflicts are retried
+	assert.Nil(t, mm.MarkMachineForDeletion(machine))
+	assert.Equal(t, 2, conflicts)
+	assert.Empty(t, machine.Annotations[DeleteMachineAnnotation])
+
+	updated, err := dynamicClient.Resource(testGroupVersion.WithResource(machineResource)).Namespace("kube-system").Get("m", v1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, updated.GetAnnotations()[DeleteMachineAnnotation])
+}
+
+func TestMachinesByProviderID(t *testing.T) {
+	md := buildTestMachineDeployment("md", 3, 0, 10)
+	ms := buildTestMachineSet(md, "ms", 3)
+	n1 := buildTestNode("n1")
+	n1.Spec.ProviderID = "openstack:///1"
+	m1 := buildTestMachine(ms, "m1", n1)
+	m2 := buildTestMachine(ms, "m2", n1)
+	m3 := buildTestMachine(ms, "m3", buildTestNode("n3"))
+	pending := buildTestMachine(ms, "pending", nil)
+
+	dynamicClient := newTestDynamicClient(m1, m2, m3, pending)
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(), dynamicClient, testGroupVersion, nil)
+
+	machines, err := mm.MachinesByProviderID()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]*v1alpha1.Machine{"1": nil, "n3": m3}, machines)
+
+	dynamicClient.AddReactor(func(action fake.DynamicAction) (bool, error) {
+		return action.Verb == "list", errors.New("unreachable")
+	})
+	_, err = mm.MachinesByProviderID()
+	assert.EqualError(t, err, "unreachable")
+}
+
+func TestBootstrapNodeRegistration(t *testing.T) {
+	md1 := buildTestMachineDeployment("md1", 1, 0, 10)
+	md2 := buildTestMachineDeployment("md2", 1, 0, 10)
+	dynamicClient := newTestDynamicClient(md1, md2)
+
+	template := buildTestKubeadmConfigTemplate("workers", map[string]interface{}{
+		"kubeletExtraArgs": map[string]interface{}{"node-labels": "pool=workers"},
+	})
+	dynamicClient.Add(schema.GroupVersionResource{Group: "bootstrap.cluster.x-k8s.io", Version: "v1alpha3", Resource: "kubeadmconfigtemplates"}, template)
+	_, err := dynamicClient.Resource(testGroupVersion.WithResource(machineDeploymentResource)).Namespace("kube-system").Patch("md1", types.MergePatchType,
+		[]byte(`{"spec":{"template":{"spec":{"bootstrap":{"configRef":{"apiVersion":"bootstrap.cluster.x-k8s.io/v1alpha3","kind":"KubeadmConfigTemplate","name":"workers"}}}}}}`),
+		v1.UpdateOptions{})
+	assert.NoError(t, err)
+
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(), dynamicClient, testGroupVersion, nil)
+	if !assert.Nil(t, mm.Refresh(context.TODO())) {
+		return
+	}
+
+	labels, taints, err := mm.BootstrapNodeRegistration(md1)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"pool": "workers"}, labels)
+	assert.Empty(t, taints)
+
+	labels, taints, err = mm.BootstrapNodeRegistration(md2)
+	assert.NoError(t, err)
+	assert.Nil(t, labels)
+	assert.Nil(t, taints)
+
+	// the template is cached
+	dynamicClient.AddReactor(func(action fake.DynamicAction) (bool, error) {
+		return action.Verb == "get", errors.New("connection refused")
+	})
+	labels, _, err = mm.BootstrapNodeRegistration(md1)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"pool": "workers"}, labels)
+}
+
+func TestCreateAndDeleteMachineDeployment(t *testing.T) {
+	dynamicClient := newTestDynamicClient()
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(), dynamicClient, testGroupVersion, nil)
+
+	md := buildTestMachineDeployment("md", 0, 0, 10)
+	md.UID = ""
+	md.Annotations[AutoprovisionedAnnotation] = "true"
+	created, err := mm.CreateMachineDeployment(md)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "md", created.Name)
+	assert.Equal(t, "true", created.Annotations[AutoprovisionedAnnotation])
+
+	client := dynamicClient.Resource(testGroupVersion.WithResource(machineDeploymentResource)).Namespace(md.Namespace)
+	u, err := client.Get("md", v1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, testGroupVersion.String(), u.GetAPIVersion())
+	assert.Equal(t, "MachineDeployment", u.GetKind())
+
+	assert.NoError(t, mm.DeleteMachineDeployment(created))
+	_, err = client.Get("md", v1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+}
+
+func TestPagedList(t *testing.T) {
+	var requests []v1.ListOptions
+	list := func(options v1.ListOptions) (runtime.Object, error) {
+		requests = append(requests, options)
+		page := &unstructured.UnstructuredList{Object: map[string]interface{}{}}
+		page.Items = []unstructured.Unstructured{*buildTestOpenstackMachineTemplate("t"+options.Continue, "m1.small")}
+		if options.Continue == "" {
+			page.SetContinue("2")
+		}
+		return page, nil
+	}
+
+	obj, err := informerOptions{pageSize: 1}.pagedList(list)(v1.ListOptions{ResourceVersion: "0"})
+	assert.NoError(t, err)
+	items, err := meta.ExtractList(obj)
+	assert.NoError(t, err)
+	assert.Len(t, items, 2)
+	// the pages are read from etcd, as the watch cache ignores the limit
+	assert.Equal(t, []v1.ListOptions{{Limit: 1}, {Limit: 1, Continue: "2"}}, requests)
+
+	requests = nil
+	_, err = informerOptions{}.pagedList(list)(v1.ListOptions{ResourceVersion: "0"})
+	assert.NoError(t, err)
+	assert.Equal(t, []v1.ListOptions{{ResourceVersion: "0"}}, requests)
+}
+
+func TestDeleteMachine(t *testing.T) {
+	m := buildTestMachine(nil, "m", buildTestNode("n"))
+	dynamicClient := newTestDynamicClient(m)
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(), dynamicClient, testGroupVersion, nil)
+
+	assert.NoError(t, mm.DeleteMachine(m))
+	_, err := dynamicClient.Resource(testGroupVersion.WithResource(machineResource)).Namespace("kube-system").Get("m", v1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+
+	// deleting it again succeeds
+	assert.NoError(t, mm.DeleteMachine(m))
+}
+
+func TestMachineFailureFields(t *testing.T) {
+	machine, err := machineFromUnstructured(&unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "cluster.x-k8s.io/v1alpha3",
+		"kind":       "Machine",
+		"metadata":   map[string]interface{}{"name": "m", "namespace": "kube-system"},
+		"status": map[string]interface{}{
+			"phase":          "Failed",
+			"failureReason":  "CreateError",
+			"failureMessage": "quota exceeded",
+		},
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, "Failed", *machine.Status.Phase)
+	assert.Equal(t, common.CreateMachineError, *machine.Status.ErrorReason)
+	assert.Equal(t, "quota exceeded", *machine.Status.ErrorMessage)
+}
+
+func TestMachineRemediationCondition(t *testing.T) {
+	machine, err := machineFromUnstructured(&unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "cluster.x-k8s.io/v1alpha3",
+		"kind":       "Machine",
+		"metadata":   map[string]interface{}{"name": "m", "namespace": "kube-system"},
+		"status": map[string]interface{}{
+			"conditions": []interface{}{
+				map[string]interface{}{
+					"type":               "OwnerRemediated",
+					"status":             "False",
+					"severity":           "Warning",
+					"reason":             "WaitingForRemediation",
+					"lastTransitionTime": "2020-01-01T00:00:00Z",
+				},
+			},
+		},
+	}})
+	assert.NoError(t, err)
+	assert.True(t, machineRemediating(machine))
+}
+
+func TestAvailableMachineTypes(t *testing.T) {
+	inline := buildTestMachineDeployment("inline", 1, 0, 10)
+	setTestOpenstackFlavor(inline, "m1.small")
+
+	templated := buildTestMachineDeployment("templated", 1, 0, 10)
+	setTestInfrastructureTemplate(templated, "infrastructure.cluster.x-k8s.io/v1alpha2", "OpenStackMachineTemplate", "large")
+
+	duplicate := buildTestMachineDeployment("duplicate", 1, 0, 10)
+	setTestInfrastructureTemplate(duplicate, "infrastructure.cluster.x-k8s.io/v1alpha2", "OpenStackMachineTemplate", "small")
+
+	missing := buildTestMachineDeployment("missing", 1, 0, 10)
+	setTestInfrastructureTemplate(missing, "infrastructure.cluster.x-k8s.io/v1alpha2", "OpenStackMachineTemplate", "missing")
+
+	dynamicClient := fake.NewDynamicClient()
+	templates := schema.GroupVersionResource{Group: "infrastructure.cluster.x-k8s.io", Version: "v1alpha2", Resource: "openstackmachinetemplates"}
+	dynamicClient.Add(templates, buildTestOpenstackMachineTemplate("large", "m1.large"))
+	dynamicClient.Add(templates, buildTestOpenstackMachineTemplate("small", "m1.small"))
+
+	for _, md := range []*v1alpha1.MachineDeployment{inline, templated, duplicate, missing} {
+		addTestObject(dynamicClient, md)
+	}
+
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(), dynamicClient, testGroupVersion, nil)
+	if !assert.Nil(t, mm.Refresh(context.TODO())) {
+		return
+	}
+
+	assert.Equal(t, []string{"m1.large", "m1.small"}, mm.AvailableMachineTypes())
+	assert.Equal(t, "m1.small", mm.MachineType(inline))
+	assert.Equal(t, "m1.large", mm.MachineType(templated))
+	assert.Equal(t, "", mm.MachineType(missing))
+
+	// the templates are cached, further refreshes don't fetch them
+	gets := func() int {
+		count := 0
+		for _, action := range dynamicClient.RecordedActions() {
+			if action.Verb == "get" && action.Resource == templates {
+				count++
+			}
+		}
+		return count
+	}
+	assert.Equal(t, 3, gets())
+	if !assert.Nil(t, mm.Refresh(context.TODO())) {
+		return
+	}
+	assert.Equal(t, 3, gets())
+	assert.Equal(t, "m1.large", mm.MachineType(templated))
+}
+
+func TestInfrastructureTemplateAnnotations(t *testing.T) {
+	inline := buildTestMachineDeployment("inline", 1, 0, 10)
+	templated := buildTestMachineDeployment("templated", 1, 0, 10)
+	setTestInfrastructureTemplate(templated, "infrastructure.cluster.x-k8s.io/v1alpha2", "OpenStackMachineTemplate", "large")
+	missing := buildTestMachineDeployment("missing", 1, 0, 10)
+	setTestInfrastructureTemplate(missing, "infrastructure.cluster.x-k8s.io/v1alpha2", "OpenStackMachineTemplate", "missing")
+	unreachable := buildTestMachineDeployment("unreachable", 1, 0, 10)
+	setTestInfrastructureTemplate(unreachable, "infrastructure.cluster.x-k8s.io/v1alpha2", "OpenStackMachineTemplate", "small")
+
+	template := buildTestOpenstackMachineTemplate("large", "m1.large")
+	template.SetAnnotations(map[string]string{CpuCapacityAnnotation: "4"})
+	dynamicClient := fake.NewDynamicClient()
+	dynamicClient.Add(schema.GroupVersionResource{Group: "infrastructure.cluster.x-k8s.io", Version: "v1alpha2", Resource: "openstackmachinetemplates"}, template)
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(), dynamicClient, testGroupVersion, nil)
+
+	annotations, err := mm.InfrastructureTemplateAnnotations(inline)
+	assert.NoError(t, err)
+	assert.Nil(t, annotations)
+
+	annotations, err = mm.InfrastructureTemplateAnnotations(templated)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{CpuCapacityAnnotation: "4"}, annotations)
+
+	// a deleted template doesn't keep the node group from scaling
+	annotations, err = mm.InfrastructureTemplateAnnotations(missing)
+	assert.NoError(t, err)
+	assert.Nil(t, annotations)
+
+	// cached templates are served while the apiserver is unreachable
+	dynamicClient.AddReactor(func(action fake.DynamicAction) (bool, error) {
+		return action.Verb == "get", errors.New("connection refused")
+	})
+	annotations, err = mm.InfrastructureTemplateAnnotations(templated)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{CpuCapacityAnnotation: "4"}, annotations)
+	_, err = mm.InfrastructureTemplateAnnotations(unreachable)
+	assert.Error(t, err)
+}
+
+func TestDryRun(t *testing.T) {
+	md := buildTestMachineDeployment("md", 1, 0, 10)
+	ms := buildTestMachineSet(md, "ms", 1)
+	n := buildTestNode("n")
+	m := buildTestMachine(ms, "m", n)
+
+	dynamicClient := newTestDynamicClient(m, ms, md)
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(n), dynamicClient, testGroupVersion, nil)
+	mm.dryRun = true
+	if !assert.Nil(t, mm.Refresh(context.TODO())) {
+		return
+	}
+	applied, err := mm.SetDeploymentSize(mm.AllDeployments()[0], 3)
+	assert.NoError(t, err)
+	assert.False(t, applied)
+	// the node group keeps its size, it isn't waiting for machines that are never created
+	ng := NewClusterapiNodeGroup(mm, mm.AllDeployments()[0], nil)
+	assert.NoError(t, ng.IncreaseSize(1))
+	size, err := ng.TargetSize()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, size)
+	assert.NoError(t, mm.MarkMachineForDeletion(mm.MachineForNode(n)))
+	assert.NoError(t, mm.DeleteMachineDeployment(md))
+	assert.NoError(t, mm.DeleteMachine(m))
+	_, err = mm.CreateMachineDeployment(buildTestMachineDeployment("md2", 0, 0, 10))
+	assert.NoError(t, err)
+
+	for _, action := range dynamicClient.RecordedActions() {
+		assert.Contains(t, []string{"get", "list", "watch"}, action.Verb)
+	}
+	assert.Equal(t, int32(1), *mm.AllDeployments()[0].Spec.Replicas)
 }
@@ -0,0 +1,135 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	apimachv1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sync"
+	"time"
+)
+
+const (
+	caNamespace = "cluster_autoscaler"
+)
+
+var (
+	/**** Metrics related to the clusterapi provider ****/
+	refreshDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: caNamespace,
+			Name:      "clusterapi_refresh_duration_seconds",
+			Help:      "Duration of refreshing the clusterapi machine manager's cache.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+		},
+	)
+
+	refreshErrorCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: caNamespace,
+			Name:      "clusterapi_refresh_errors_total",
+			Help:      "Counter of failed refreshes of the clusterapi machine manager's cache.",
+		},
+	)
+
+	scaledUpNodesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: caNamespace,
+			Name:      "clusterapi_scaled_up_nodes_total",
+			Help:      "Counter of nodes added to each clusterapi node group.",
+		}, []string{"namespace", "node_group"},
+	)
+
+	scaledDownNodesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: caNamespace,
+			Name:      "clusterapi_scaled_down_nodes_total",
+			Help:      "Counter of nodes removed from each clusterapi node group, including cancelled scale-ups.",
+		}, []string{"namespace", "node_group"},
+	)
+
+	nodeGroupsGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: caNamespace,
+			Name:      "clusterapi_node_groups",
+			Help:      "Number of discovered clusterapi node groups per namespace.",
+		}, []string{"namespace"},
+	)
+
+	refreshBackoffGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: caNamespace,
+			Name:      "clusterapi_refresh_backoff_seconds",
+			Help:      "Current backoff after failed refreshes of the clusterapi machine manager's cache, 0 if the last refresh succeeded.",
+		},
+	)
+
+	refreshFailuresGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: caNamespace,
+			Name:      "clusterapi_refresh_consecutive_failures",
+			Help:      "Number of consecutive failed refreshes of the clusterapi machine manager's cache.",
+		},
+	)
+
+	registerMetricsOnce sync.Once
+)
+
+// RegisterMetrics registers all clusterapi metrics. It may be called more than once.
+func RegisterMetrics() {
+	registerMetricsOnce.Do(func() {
+		prometheus.MustRegister(refreshDuration)
+		prometheus.MustRegister(refreshErrorCounter)
+		prometheus.MustRegister(scaledUpNodesCounter)
+		prometheus.MustRegister(scaledDownNodesCounter)
+		prometheus.MustRegister(nodeGroupsGauge)
+		prometheus.MustRegister(refreshBackoffGauge)
+		prometheus.MustRegister(refreshFailuresGauge)
+	})
+}
+
+// registerRefresh records the duration and outcome of a refresh
+func registerRefresh(start time.Time, err error) {
+	refreshDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		refreshErrorCounter.Inc()
+	}
+}
+
+// registerRefreshBackoff records the current refresh backoff and the number of consecutive failures
+func registerRefreshBackoff(backoff time.Duration, failures int) {
+	refreshBackoffGauge.Set(backoff.Seconds())
+	refreshFailuresGauge.Set(float64(failures))
+}
+
+// registerScaleUp records nodes added to a node group
+func registerScaleUp(obj apimachv1.Object, delta int) {
+	scaledUpNodesCounter.WithLabelValues(obj.GetNamespace(), obj.GetName()).Add(float64(delta))
+}
+
+// registerScaleDown records nodes removed from a node group
+func registerScaleDown(obj apimachv1.Object, delta int) {
+	scaledDownNodesCounter.WithLabelValues(obj.GetNamespace(), obj.GetName()).Add(float64(delta))
+}
+
+// registerNodeGroups records the number of node groups per namespace
+func registerNodeGroups(countByNamespace map[string]int) {
+	nodeGroupsGauge.Reset()
+	for namespace, count := range countByNamespace {
+		nodeGroupsGauge.WithLabelValues(namespace).Set(float64(count))
+	}
+}
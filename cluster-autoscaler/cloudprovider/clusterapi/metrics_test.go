@@ -0,0 +1,91 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func metricValue(t *testing.T, metric prometheus.Metric) float64 {
+	m := &dto.Metric{}
+	if err := metric.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	switch {
+	case m.Counter != nil:
+		return m.Counter.GetValue()
+	case m.Gauge != nil:
+		return m.Gauge.GetValue()
+	case m.Histogram != nil:
+		return float64(m.Histogram.GetSampleCount())
+	}
+	t.Fatalf("unexpected metric %v", m)
+	return 0
+}
+
+func TestRegisterRefresh(t *testing.T) {
+	refreshes := metricValue(t, refreshDuration)
+	failures := metricValue(t, refreshErrorCounter)
+
+	registerRefresh(time.Now(), nil)
+	registerRefresh(time.Now(), errors.New("failed"))
+
+	assert.Equal(t, refreshes+2, metricValue(t, refreshDuration))
+	assert.Equal(t, failures+1, metricValue(t, refreshErrorCounter))
+}
+
+func TestRegisterRefreshBackoff(t *testing.T) {
+	registerRefreshBackoff(10*time.Second, 2)
+	assert.Equal(t, float64(10), metricValue(t, refreshBackoffGauge))
+	assert.Equal(t, float64(2), metricValue(t, refreshFailuresGauge))
+
+	registerRefreshBackoff(0, 0)
+	assert.Equal(t, float64(0), metricValue(t, refreshBackoffGauge))
+	assert.Equal(t, float64(0), metricValue(t, refreshFailuresGauge))
+}
+
+func TestRegisterScaling(t *testing.T) {
+	md := buildTestMachineDeployment("metrics", 1, 0, 10)
+	up := metricValue(t, scaledUpNodesCounter.WithLabelValues("kube-system", "metrics"))
+	down := metricValue(t, scaledDownNodesCounter.WithLabelValues("kube-system", "metrics"))
+
+	registerScaleUp(md, 3)
+	registerScaleDown(md, 2)
+
+	assert.Equal(t, up+3, metricValue(t, scaledUpNodesCounter.WithLabelValues("kube-system", "metrics")))
+	assert.Equal(t, down+2, metricValue(t, scaledDownNodesCounter.WithLabelValues("kube-system", "metrics")))
+}
+
+func TestRegisterNodeGroups(t *testing.T) {
+	registerNodeGroups(map[string]int{"a": 2, "b": 1})
+	assert.Equal(t, float64(2), metricValue(t, nodeGroupsGauge.WithLabelValues("a")))
+	assert.Equal(t, float64(1), metricValue(t, nodeGroupsGauge.WithLabelValues("b")))
+
+	registerNodeGroups(map[string]int{"a": 1})
+	assert.Equal(t, float64(1), metricValue(t, nodeGroupsGauge.WithLabelValues("a")))
+	assert.Equal(t, float64(0), metricValue(t, nodeGroupsGauge.WithLabelValues("b")))
+}
+
+func TestRegisterMetricsTwice(t *testing.T) {
+	RegisterMetrics()
+	RegisterMetrics()
+}
@@ -0,0 +1,378 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"encoding/json"
+	"fmt"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
+	"k8s.io/autoscaler/cluster-autoscaler/utils/gpu"
+	kubeletapis "k8s.io/kubernetes/pkg/kubelet/apis"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+// The capacity annotations may also be set on the infrastructure template a MachineDeployment or
+// MachineSet references, as in upstream cluster-api, and are overridden by those of the object itself.
+const (
+	capacityAnnotationPrefix = "capacity.cluster-autoscaler.kubernetes.io/"
+	// CpuCapacityAnnotation sets the cpu capacity of a MachineDeployment's nodes for scale-from-zero
+	CpuCapacityAnnotation = capacityAnnotationPrefix + "cpu"
+	// MemoryCapacityAnnotation sets the memory capacity of a MachineDeployment's nodes for scale-from-zero
+	MemoryCapacityAnnotation = capacityAnnotationPrefix + "memory"
+	// EphemeralStorageCapacityAnnotation sets the ephemeral storage capacity of a MachineDeployment's nodes
+	EphemeralStorageCapacityAnnotation = capacityAnnotationPrefix + "ephemeral-storage"
+	// GpuCountCapacityAnnotation sets the number of GPUs of a MachineDeployment's nodes
+	GpuCountCapacityAnnotation = capacityAnnotationPrefix + "gpu-count"
+	// GpuTypeCapacityAnnotation sets the extended resource name of a MachineDeployment's GPUs, defaults to nvidia.com/gpu
+	GpuTypeCapacityAnnotation = capacityAnnotationPrefix + "gpu-type"
+	// MaxPodsCapacityAnnotation sets the maximum number of pods of a MachineDeployment's nodes, defaults to 110
+	MaxPodsCapacityAnnotation = capacityAnnotationPrefix + "maxPods"
+	// ResourcesCapacityAnnotation sets arbitrary, e.g. extended, resources of a MachineDeployment's nodes as a JSON
+	// encoded resource list like {"syseleven.de/local-nvme": "2"}. The well-known annotations take precedence.
+	ResourcesCapacityAnnotation = capacityAnnotationPrefix + "resources"
+	// TaintsCapacityAnnotation sets taints of a MachineDeployment's nodes that are neither in its machine template
+	// nor its bootstrap config, e.g. those of its infrastructure provider, as a comma separated list like
+	// key1=value1:NoSchedule,key2:NoExecute
+	TaintsCapacityAnnotation = capacityAnnotationPrefix + "taints"
+
+	// KubeReservedAnnotation overrides the configured kube-reserved resources of a MachineDeployment's or
+	// MachineSet's template nodes with a JSON encoded resource list like {"cpu": "200m", "memory": "512Mi"}
+	KubeReservedAnnotation = "autoscaler.syseleven.de/kube-reserved"
+	// SystemReservedAnnotation overrides the configured system-reserved resources like KubeReservedAnnotation
+	SystemReservedAnnotation = "autoscaler.syseleven.de/system-reserved"
+
+	// LabelTopologyZone is the stable successor of the beta zone label, which the vendored kubelet predates
+	LabelTopologyZone = "topology.kubernetes.io/zone"
+	// LabelTopologyRegion is the stable successor of the beta region label
+	LabelTopologyRegion = "topology.kubernetes.io/region"
+
+	defaultMaxPods = 110
+)
+
+// capacityFromAnnotations reads a node capacity from the capacity annotations of a
+// MachineDeployment or MachineSet, including the resources of the generic resources
+// annotation. The capacity is only considered found if at least cpu and memory are annotated.
+func capacityFromAnnotations(obj metav1.Object) (apiv1.ResourceList, bool, error) {
+	annotations := obj.GetAnnotations()
+	if annotations[CpuCapacityAnnotation] == "" || annotations[MemoryCapacityAnnotation] == "" {
+		return nil, false, nil
+	}
+
+	capacity := apiv1.ResourceList{
+		apiv1.ResourcePods: *resource.NewQuantity(defaultMaxPods, resource.DecimalSI),
+	}
+	if val, ok := annotations[ResourcesCapacityAnnotation]; ok {
+		resources := apiv1.ResourceList{}
+		if err := json.Unmarshal([]byte(val), &resources); err != nil {
+			return nil, false, fmt.Errorf("invalid %s annotation on %s %s: %v", ResourcesCapacityAnnotation, kindOf(obj), obj.GetName(), err)
+		}
+		for name, quantity := range resources {
+			capacity[name] = quantity
+		}
+	}
+	for annotation, name := range map[string]apiv1.ResourceName{
+		CpuCapacityAnnotation:              apiv1.ResourceCPU,
+		MemoryCapacityAnnotation:           apiv1.ResourceMemory,
+		EphemeralStorageCapacityAnnotation: apiv1.ResourceEphemeralStorage,
+		GpuCountCapacityAnnotation:         gpuResourceName(obj),
+		MaxPodsCapacityAnnotation:          apiv1.ResourcePods,
+	} {
+		val, ok := annotations[annotation]
+		if !ok {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(val)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid %s annotation on %s %s: %v", annotation, kindOf(obj), obj.GetName(), err)
+		}
+		capacity[name] = quantity
+	}
+	return capacity, true, nil
+}
+
+// withTemplateCapacityAnnotations returns a copy of a MachineDeployment or MachineSet that additionally
+// carries the capacity annotations of its infrastructure template, unless it sets them itself.
+// The object is returned as is if the template adds none.
+func withTemplateCapacityAnnotations(obj metav1.Object, templateAnnotations map[string]string) metav1.Object {
+	added := make(map[string]string)
+	for key, val := range templateAnnotations {
+		if _, ok := obj.GetAnnotations()[key]; !ok && strings.HasPrefix(key, capacityAnnotationPrefix) {
+			added[key] = val
+		}
+	}
+	if len(added) == 0 {
+		return obj
+	}
+	annotated := obj.(runtime.Object).DeepCopyObject().(metav1.Object)
+	annotations := make(map[string]string, len(obj.GetAnnotations())+len(added))
+	for key, val := range obj.GetAnnotations() {
+		annotations[key] = val
+	}
+	for key, val := range added {
+		annotations[key] = val
+	}
+	annotated.SetAnnotations(annotations)
+	return annotated
+}
+
+// gpuResourceName returns the extended resource name of the GPUs of a MachineDeployment's or MachineSet's nodes
+func gpuResourceName(obj metav1.Object) apiv1.ResourceName {
+	if name := obj.GetAnnotations()[GpuResourceNameAnnotation]; name != "" {
+		return apiv1.ResourceName(name)
+	}
+	if gpuType := obj.GetAnnotations()[GpuTypeCapacityAnnotation]; gpuType != "" {
+		return apiv1.ResourceName(gpuType)
+	}
+	return gpu.ResourceNvidiaGPU
+}
+
+// buildNodeFromCapacityAnnotations synthesizes a node from the capacity annotations of a
+// MachineDeployment or MachineSet. found is false if the object has no capacity annotations.
+func buildNodeFromCapacityAnnotations(obj metav1.Object) (node *apiv1.Node, found bool, err error) {
+	capacity, found, err := capacityFromAnnotations(obj)
+	if err != nil || !found {
+		return nil, found, err
+	}
+	return buildNodeFromCapacity(obj, capacity), true, nil
+}
+
+// buildNodeFromCapacity synthesizes a node of a MachineDeployment or MachineSet with the given capacity
+func buildNodeFromCapacity(obj metav1.Object, capacity apiv1.ResourceList) *apiv1.Node {
+	if _, ok := capacity[apiv1.ResourcePods]; !ok {
+		capacity[apiv1.ResourcePods] = *resource.NewQuantity(defaultMaxPods, resource.DecimalSI)
+	}
+	nodeName := fmt.Sprintf("%s-%d", obj.GetName(), rand.Int63())
+	node := &apiv1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:     nodeName,
+			SelfLink: fmt.Sprintf("/api/v1/nodes/%s", nodeName),
+			Labels: map[string]string{
+				kubeletapis.LabelArch:     cloudprovider.DefaultArch,
+				kubeletapis.LabelOS:       cloudprovider.DefaultOS,
+				kubeletapis.LabelHostname: nodeName,
+			},
+		},
+		Status: apiv1.NodeStatus{
+			Capacity:   capacity,
+			Conditions: cloudprovider.BuildReadyConditions(),
+		},
+	}
+
+	// GPU nodes are tainted, so that only pods requesting GPUs are scheduled on them
+	gpuName := gpuResourceName(obj)
+	if gpus, ok := capacity[gpuName]; ok && !gpus.IsZero() {
+		node.Spec.Taints = append(node.Spec.Taints, apiv1.Taint{
+			Key:    string(gpuName),
+			Value:  "present",
+			Effect: apiv1.TaintEffectNoSchedule,
+		})
+	}
+	return node
+}
+
+// buildNodeFromLiveNode synthesizes a node from a registered node of a MachineDeployment or MachineSet,
+// taking over its capacity, allocatable and labels. Its taints are not copied, as they are often transient.
+func buildNodeFromLiveNode(obj metav1.Object, liveNode *apiv1.Node) *apiv1.Node {
+	nodeName := fmt.Sprintf("%s-%d", obj.GetName(), rand.Int63())
+	return &apiv1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:     nodeName,
+			SelfLink: fmt.Sprintf("/api/v1/nodes/%s", nodeName),
+			Labels: cloudprovider.JoinStringMaps(liveNode.Labels, map[string]string{
+				kubeletapis.LabelHostname: nodeName,
+			}),
+		},
+		Status: apiv1.NodeStatus{
+			Capacity:    liveNode.Status.Capacity.DeepCopy(),
+			Allocatable: liveNode.Status.Allocatable.DeepCopy(),
+			Conditions:  cloudprovider.BuildReadyConditions(),
+		},
+	}
+}
+
+// sampleNode returns a ready node with a known capacity to build template nodes from, or nil if there is none
+func sampleNode(nodes []*apiv1.Node) *apiv1.Node {
+	for _, node := range nodes {
+		if node == nil || node.Status.Capacity.Cpu().IsZero() || node.Status.Capacity.Memory().IsZero() {
+			continue
+		}
+		for _, condition := range node.Status.Conditions {
+			if condition.Type == apiv1.NodeReady && condition.Status == apiv1.ConditionTrue {
+				return node
+			}
+		}
+	}
+	return nil
+}
+
+// applyMachineTemplate copies the node labels and taints of a MachineDeployment's or
+// MachineSet's bootstrap config and machine template onto a synthesized node and derives
+// its allocatable from its capacity, unless it was sampled from a live node. All taints
+// are kept, including those of the autoscaler. Taints of the same key and effect are
+// overridden in the order of the node's own taints, e.g. that of its GPUs, the given taints
+// and those of the machine template.
+func applyMachineTemplate(node *apiv1.Node, obj metav1.Object, bootstrapLabels map[string]string, taints []apiv1.Taint, reserved apiv1.ResourceList) {
+	template := machineTemplateOf(obj)
+	node.Labels = cloudprovider.JoinStringMaps(node.Labels, bootstrapLabels, template.Spec.Labels)
+	node.Spec.Taints = mergeTaints(node.Spec.Taints, taints, template.Spec.Taints)
+	if node.Status.Allocatable == nil {
+		var exceeded []apiv1.ResourceName
+		node.Status.Allocatable, exceeded = subtractReserved(node.Status.Capacity, reserved)
+		if len(exceeded) > 0 {
+			warningS("Reserved resources exceed the template node's capacity, allocatable clamped to zero",
+				append(objectKeys(obj), "resources", exceeded)...)
+		}
+	}
+}
+
+// mergeTaints joins lists of taints. A taint replaces an earlier one of the same key and effect in place.
+func mergeTaints(lists ...[]apiv1.Taint) []apiv1.Taint {
+	var merged []apiv1.Taint
+	for _, taints := range lists {
+	next:
+		for _, taint := range taints {
+			for i := range merged {
+				if merged[i].MatchTaint(&taint) {
+					merged[i] = taint
+					continue next
+				}
+			}
+			merged = append(merged, taint)
+		}
+	}
+	return merged
+}
+
+// taintsFromAnnotations reads the taints annotation of a MachineDeployment or MachineSet
+func taintsFromAnnotations(obj metav1.Object) ([]apiv1.Taint, error) {
+	val := obj.GetAnnotations()[TaintsCapacityAnnotation]
+	if strings.TrimSpace(val) == "" {
+		return nil, nil
+	}
+	var taints []apiv1.Taint
+	for _, spec := range strings.Split(val, ",") {
+		spec = strings.TrimSpace(spec)
+		sep := strings.LastIndex(spec, ":")
+		if sep < 0 {
+			return nil, fmt.Errorf("invalid %s annotation on %s %s: taint %q has no effect", TaintsCapacityAnnotation, kindOf(obj), obj.GetName(), spec)
+		}
+		taint := apiv1.Taint{Key: spec[:sep], Effect: apiv1.TaintEffect(spec[sep+1:])}
+		if eq := strings.Index(taint.Key, "="); eq >= 0 {
+			taint.Key, taint.Value = taint.Key[:eq], taint.Key[eq+1:]
+		}
+		switch taint.Effect {
+		case apiv1.TaintEffectNoSchedule, apiv1.TaintEffectPreferNoSchedule, apiv1.TaintEffectNoExecute:
+		default:
+			return nil, fmt.Errorf("invalid %s annotation on %s %s: taint %q has unknown effect %s", TaintsCapacityAnnotation, kindOf(obj), obj.GetName(), spec, taint.Effect)
+		}
+		if taint.Key == "" {
+			return nil, fmt.Errorf("invalid %s annotation on %s %s: taint %q has no key", TaintsCapacityAnnotation, kindOf(obj), obj.GetName(), spec)
+		}
+		taints = append(taints, taint)
+	}
+	return taints, nil
+}
+
+// reservedResources returns the resources reserved on the template nodes of a MachineDeployment or MachineSet,
+// the sum of its kube-reserved and system-reserved resources. The annotations of the object take precedence
+// over the configured defaults.
+func reservedResources(obj metav1.Object, cfg *CloudConfig) (apiv1.ResourceList, error) {
+	reserved := apiv1.ResourceList{}
+	for annotation, defaults := range map[string]apiv1.ResourceList{
+		KubeReservedAnnotation:   cfg.getKubeReserved(),
+		SystemReservedAnnotation: cfg.getSystemReserved(),
+	} {
+		list := defaults
+		if val, ok := obj.GetAnnotations()[annotation]; ok {
+			list = apiv1.ResourceList{}
+			if err := json.Unmarshal([]byte(val), &list); err != nil {
+				return nil, fmt.Errorf("invalid %s annotation on %s %s: %v", annotation, kindOf(obj), obj.GetName(), err)
+			}
+		}
+		for name, quantity := range list {
+			sum := reserved[name]
+			sum.Add(quantity)
+			reserved[name] = sum
+		}
+	}
+	return reserved, nil
+}
+
+// applyZoneLabels sets the zone labels of a template node to the failure domain of its node group, if any, so
+// that the zonal node groups of a pool are recognized as similar. The stable topology labels are taken from
+// the beta labels, e.g. those of the OpenStack availability zone, if not set otherwise.
+func applyZoneLabels(node *apiv1.Node, failureDomain string) {
+	if node.Labels == nil {
+		node.Labels = map[string]string{}
+	}
+	if failureDomain != "" {
+		node.Labels[kubeletapis.LabelZoneFailureDomain] = failureDomain
+		node.Labels[LabelTopologyZone] = failureDomain
+	}
+	if zone := node.Labels[kubeletapis.LabelZoneFailureDomain]; zone != "" && node.Labels[LabelTopologyZone] == "" {
+		node.Labels[LabelTopologyZone] = zone
+	}
+	if region := node.Labels[kubeletapis.LabelZoneRegion]; region != "" && node.Labels[LabelTopologyRegion] == "" {
+		node.Labels[LabelTopologyRegion] = region
+	}
+}
+
+// subtractReserved returns capacity minus the reserved resources, never going below zero, and the sorted
+// names of the resources whose reservation exceeds the capacity
+func subtractReserved(capacity, reserved apiv1.ResourceList) (apiv1.ResourceList, []apiv1.ResourceName) {
+	allocatable := apiv1.ResourceList{}
+	var exceeded []apiv1.ResourceName
+	for name, quantity := range capacity {
+		quantity = quantity.DeepCopy()
+		if r, ok := reserved[name]; ok {
+			quantity.Sub(r)
+			if quantity.Sign() < 0 {
+				quantity = *resource.NewQuantity(0, quantity.Format)
+				exceeded = append(exceeded, name)
+			}
+		}
+		allocatable[name] = quantity
+	}
+	sort.Slice(exceeded, func(i, j int) bool { return exceeded[i] < exceeded[j] })
+	return allocatable, exceeded
+}
+
+// parseResourceList parses a kubelet style resource list like "cpu=100m,memory=256Mi"
+func parseResourceList(s string) (apiv1.ResourceList, error) {
+	list := apiv1.ResourceList{}
+	if strings.TrimSpace(s) == "" {
+		return list, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid resource %q, expected <name>=<quantity>", pair)
+		}
+		quantity, err := resource.ParseQuantity(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid quantity for resource %s: %v", kv[0], err)
+		}
+		list[apiv1.ResourceName(kv[0])] = quantity
+	}
+	return list, nil
+}
@@ -0,0 +1,221 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/autoscaler/cluster-autoscaler/utils/gpu"
+	kubeletapis "k8s.io/kubernetes/pkg/kubelet/apis"
+	"strings"
+	"testing"
+)
+
+func TestBuildNodeFromCapacityAnnotations(t *testing.T) {
+	md := buildTestMachineDeployment("md", 0, 0, 10)
+	md.Annotations[CpuCapacityAnnotation] = "4"
+	md.Annotations[MemoryCapacityAnnotation] = "16Gi"
+	md.Annotations[EphemeralStorageCapacityAnnotation] = "100Gi"
+	md.Annotations[GpuCountCapacityAnnotation] = "2"
+
+	node, found, err := buildNodeFromCapacityAnnotations(md)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, resource.MustParse("4"), node.Status.Capacity[apiv1.ResourceCPU])
+	assert.Equal(t, resource.MustParse("16Gi"), node.Status.Capacity[apiv1.ResourceMemory])
+	assert.Equal(t, resource.MustParse("100Gi"), node.Status.Capacity[apiv1.ResourceEphemeralStorage])
+	assert.Equal(t, resource.MustParse("2"), node.Status.Capacity[gpu.ResourceNvidiaGPU])
+	assert.Equal(t, int64(110), node.Status.Capacity.Pods().Value())
+	assert.Equal(t, []apiv1.Taint{{Key: gpu.ResourceNvidiaGPU, Value: "present", Effect: apiv1.TaintEffectNoSchedule}}, node.Spec.Taints)
+}
+
+func TestBuildNodeFromCapacityAnnotationsGpuType(t *testing.T) {
+	md := buildTestMachineDeployment("md", 0, 0, 10)
+	md.Annotations[CpuCapacityAnnotation] = "4"
+	md.Annotations[MemoryCapacityAnnotation] = "16Gi"
+	md.Annotations[GpuCountCapacityAnnotation] = "1"
+	md.Annotations[GpuTypeCapacityAnnotation] = "amd.com/gpu"
+
+	node, _, err := buildNodeFromCapacityAnnotations(md)
+	assert.NoError(t, err)
+	assert.Equal(t, resource.MustParse("1"), node.Status.Capacity["amd.com/gpu"])
+	assert.NotContains(t, node.Status.Capacity, apiv1.ResourceName(gpu.ResourceNvidiaGPU))
+	assert.Equal(t, []apiv1.Taint{{Key: "amd.com/gpu", Value: "present", Effect: apiv1.TaintEffectNoSchedule}}, node.Spec.Taints)
+
+	md.Annotations[GpuCountCapacityAnnotation] = "0"
+	node, _, err = buildNodeFromCapacityAnnotations(md)
+	assert.NoError(t, err)
+	assert.Empty(t, node.Spec.Taints)
+}
+
+func TestBuildNodeFromCapacityAnnotationsMaxPods(t *testing.T) {
+	md := buildTestMachineDeployment("md", 0, 0, 10)
+	md.Annotations[CpuCapacityAnnotation] = "4"
+	md.Annotations[MemoryCapacityAnnotation] = "16Gi"
+	md.Annotations[MaxPodsCapacityAnnotation] = "30"
+
+	node, _, err := buildNodeFromCapacityAnnotations(md)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(30), node.Status.Capacity.Pods().Value())
+
+	md.Annotations[MaxPodsCapacityAnnotation] = "many"
+	_, _, err = buildNodeFromCapacityAnnotations(md)
+	assert.Error(t, err)
+}
+
+func TestBuildNodeFromCapacityAnnotationsResources(t *testing.T) {
+	md := buildTestMachineDeployment("md", 0, 0, 10)
+	md.Annotations[CpuCapacityAnnotation] = "4"
+	md.Annotations[MemoryCapacityAnnotation] = "16Gi"
+	md.Annotations[ResourcesCapacityAnnotation] = `{"syseleven.de/local-nvme": "2", "cpu": "8", "pods": 50}`
+
+	node, found, err := buildNodeFromCapacityAnnotations(md)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, resource.MustParse("2"), node.Status.Capacity["syseleven.de/local-nvme"])
+	assert.Equal(t, resource.MustParse("4"), node.Status.Capacity[apiv1.ResourceCPU])
+	assert.Equal(t, int64(50), node.Status.Capacity.Pods().Value())
+
+	md.Annotations[ResourcesCapacityAnnotation] = `syseleven.de/local-nvme=2`
+	_, _, err = buildNodeFromCapacityAnnotations(md)
+	assert.Error(t, err)
+}
+
+func TestBuildNodeFromCapacityAnnotationsMissing(t *testing.T) {
+	md := buildTestMachineDeployment("md", 0, 0, 10)
+	md.Annotations[CpuCapacityAnnotation] = "4"
+
+	node, found, err := buildNodeFromCapacityAnnotations(md)
+	assert.NoError(t, err)
+	assert.False(t, found)
+	assert.Nil(t, node)
+}
+
+func TestBuildNodeFromCapacityAnnotationsInvalid(t *testing.T) {
+	md := buildTestMachineDeployment("md", 0, 0, 10)
+	md.Annotations[CpuCapacityAnnotation] = "four"
+	md.Annotations[MemoryCapacityAnnotation] = "16Gi"
+
+	_, _, err := buildNodeFromCapacityAnnotations(md)
+	assert.Error(t, err)
+}
+
+func TestTaintsFromAnnotations(t *testing.T) {
+	md := buildTestMachineDeployment("md", 0, 0, 10)
+	taints, err := taintsFromAnnotations(md)
+	assert.NoError(t, err)
+	assert.Empty(t, taints)
+
+	md.Annotations[TaintsCapacityAnnotation] = "dedicated=gpu:NoSchedule, example.com/spot:PreferNoSchedule"
+	taints, err = taintsFromAnnotations(md)
+	assert.NoError(t, err)
+	assert.Equal(t, []apiv1.Taint{
+		{Key: "dedicated", Value: "gpu", Effect: apiv1.TaintEffectNoSchedule},
+		{Key: "example.com/spot", Effect: apiv1.TaintEffectPreferNoSchedule},
+	}, taints)
+
+	for _, val := range []string{"dedicated=gpu", "dedicated:Sometimes", "=gpu:NoSchedule"} {
+		md.Annotations[TaintsCapacityAnnotation] = val
+		_, err = taintsFromAnnotations(md)
+		assert.Error(t, err, val)
+	}
+}
+
+func TestMergeTaints(t *testing.T) {
+	gpuTaint := apiv1.Taint{Key: gpu.ResourceNvidiaGPU, Value: "present", Effect: apiv1.TaintEffectNoSchedule}
+	dedicated := apiv1.Taint{Key: gpu.ResourceNvidiaGPU, Value: "dedicated", Effect: apiv1.TaintEffectNoSchedule}
+	evict := apiv1.Taint{Key: gpu.ResourceNvidiaGPU, Effect: apiv1.TaintEffectNoExecute}
+	other := apiv1.Taint{Key: "other", Effect: apiv1.TaintEffectNoSchedule}
+
+	assert.Equal(t, []apiv1.Taint{dedicated, other, evict}, mergeTaints([]apiv1.Taint{gpuTaint, other}, nil, []apiv1.Taint{dedicated, evict}))
+	assert.Empty(t, mergeTaints(nil, nil))
+}
+
+func TestSubtractReserved(t *testing.T) {
+	allocatable, exceeded := subtractReserved(apiv1.ResourceList{
+		apiv1.ResourceCPU:    resource.MustParse("2"),
+		apiv1.ResourceMemory: resource.MustParse("1Gi"),
+		apiv1.ResourcePods:   resource.MustParse("110"),
+	}, apiv1.ResourceList{
+		apiv1.ResourceCPU:    resource.MustParse("100m"),
+		apiv1.ResourceMemory: resource.MustParse("2Gi"),
+	})
+
+	assert.Equal(t, int64(1900), allocatable.Cpu().MilliValue())
+	assert.Equal(t, int64(0), allocatable.Memory().Value())
+	assert.Equal(t, int64(110), allocatable.Pods().Value())
+	assert.Equal(t, []apiv1.ResourceName{apiv1.ResourceMemory}, exceeded)
+}
+
+func TestReservedResources(t *testing.T) {
+	cfg, err := ReadCloudConfig(strings.NewReader("[global]\nkube-reserved = cpu=100m,memory=256Mi\nsystem-reserved = cpu=50m\n"))
+	assert.NoError(t, err)
+
+	md := buildTestMachineDeployment("md", 1, 0, 10)
+	reserved, err := reservedResources(md, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(150), reserved.Cpu().MilliValue())
+	assert.Equal(t, int64(256*1024*1024), reserved.Memory().Value())
+
+	// the annotations replace the configured defaults
+	md.Annotations[KubeReservedAnnotation] = `{"memory": "1Gi"}`
+	reserved, err = reservedResources(md, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(50), reserved.Cpu().MilliValue())
+	assert.Equal(t, int64(1024*1024*1024), reserved.Memory().Value())
+
+	reserved, err = reservedResources(md, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), reserved.Cpu().MilliValue())
+
+	md.Annotations[SystemReservedAnnotation] = "cpu=100m"
+	_, err = reservedResources(md, cfg)
+	assert.Error(t, err)
+}
+
+func TestParseResourceList(t *testing.T) {
+	list, err := parseResourceList("cpu=100m, memory=256Mi")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), list.Cpu().MilliValue())
+	assert.Equal(t, int64(256*1024*1024), list.Memory().Value())
+
+	list, err = parseResourceList("")
+	assert.NoError(t, err)
+	assert.Empty(t, list)
+
+	_, err = parseResourceList("cpu")
+	assert.Error(t, err)
+
+	_, err = parseResourceList("cpu=lots")
+	assert.Error(t, err)
+}
+
+func TestApplyZoneLabels(t *testing.T) {
+	node := &apiv1.Node{}
+	applyZoneLabels(node, "az-1")
+	assert.Equal(t, map[string]string{
+		kubeletapis.LabelZoneFailureDomain: "az-1",
+		LabelTopologyZone:                  "az-1",
+	}, node.Labels)
+
+	// the zone and region of an OpenStack flavor based node are carried over to the stable labels
+	node.Labels = map[string]string{kubeletapis.LabelZoneFailureDomain: "zone", kubeletapis.LabelZoneRegion: "region"}
+	applyZoneLabels(node, "")
+	assert.Equal(t, "zone", node.Labels[LabelTopologyZone])
+	assert.Equal(t, "region", node.Labels[LabelTopologyRegion])
+}
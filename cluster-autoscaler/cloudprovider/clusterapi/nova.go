@@ -0,0 +1,127 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"fmt"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/flavors"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	apimachv1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sync"
+	"time"
+)
+
+// flavorRelistInterval is the minimum time between two listings of the flavors for unknown flavors
+const flavorRelistInterval = 10 * time.Minute
+
+// novaFlavors looks up the capacity of OpenStack flavors from Nova. All flavors are listed at once and
+// cached, as flavors can't be changed. Unknown flavors are looked up again with the next listing.
+type novaFlavors struct {
+	list func() ([]flavors.Flavor, error)
+
+	lock       sync.Mutex
+	capacities map[string]apiv1.ResourceList
+	listed     time.Time
+}
+
+// newNovaFlavors authenticates with the configured OpenStack credentials and looks up flavors from the
+// compute service of the configured region
+func newNovaFlavors(cfg *CloudConfig) (*novaFlavors, error) {
+	provider, err := openstack.AuthenticatedClient(gophercloud.AuthOptions{
+		IdentityEndpoint: cfg.OpenStack.AuthURL,
+		Username:         cfg.OpenStack.Username,
+		Password:         cfg.OpenStack.Password,
+		DomainName:       cfg.OpenStack.DomainName,
+		TenantID:         cfg.OpenStack.ProjectID,
+		TenantName:       cfg.OpenStack.ProjectName,
+		AllowReauth:      true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not authenticate with OpenStack: %v", err)
+	}
+	client, err := openstack.NewComputeV2(provider, gophercloud.EndpointOpts{Region: cfg.OpenStack.Region})
+	if err != nil {
+		return nil, fmt.Errorf("could not create OpenStack compute client: %v", err)
+	}
+	return &novaFlavors{
+		list: func() ([]flavors.Flavor, error) {
+			pages, err := flavors.ListDetail(client, flavors.ListOpts{AccessType: flavors.AllAccess}).AllPages()
+			if err != nil {
+				return nil, err
+			}
+			return flavors.ExtractFlavors(pages)
+		},
+		capacities: make(map[string]apiv1.ResourceList),
+	}, nil
+}
+
+// capacity returns the node capacity of a flavor, listing the flavors if it isn't cached yet
+func (nf *novaFlavors) capacity(flavor string, now time.Time) (apiv1.ResourceList, bool, error) {
+	nf.lock.Lock()
+	defer nf.lock.Unlock()
+
+	if capacity, ok := nf.capacities[flavor]; ok {
+		return capacity.DeepCopy(), true, nil
+	}
+	if now.Sub(nf.listed) < flavorRelistInterval {
+		return nil, false, nil
+	}
+	list, err := nf.list()
+	if err != nil {
+		return nil, false, fmt.Errorf("could not list OpenStack flavors: %v", err)
+	}
+	nf.listed = now
+	for _, f := range list {
+		nf.capacities[f.Name] = flavorCapacity(f)
+	}
+	capacity, ok := nf.capacities[flavor]
+	return capacity.DeepCopy(), ok, nil
+}
+
+// flavorCapacity returns the node capacity of a flavor. The root disk is the ephemeral storage, unless the
+// flavor boots from volume.
+func flavorCapacity(f flavors.Flavor) apiv1.ResourceList {
+	capacity := apiv1.ResourceList{
+		apiv1.ResourceCPU:    *resource.NewQuantity(int64(f.VCPUs), resource.DecimalSI),
+		apiv1.ResourceMemory: *resource.NewQuantity(int64(f.RAM)*1024*1024, resource.BinarySI),
+	}
+	if f.Disk > 0 {
+		capacity[apiv1.ResourceEphemeralStorage] = *resource.NewQuantity(int64(f.Disk)*1024*1024*1024, resource.BinarySI)
+	}
+	return capacity
+}
+
+// MachineTypeCapacity returns the node capacity of the machine type of a MachineDeployment, MachineSet or
+// MachinePool, looked up from Nova. ok is false if the flavor lookup isn't configured or the flavor is unknown.
+func (mm *ClusterapiMachineManager) MachineTypeCapacity(obj apimachv1.Object) (apiv1.ResourceList, bool) {
+	if mm.flavors == nil {
+		return nil, false
+	}
+	machineType := mm.MachineType(obj)
+	if machineType == "" {
+		return nil, false
+	}
+	capacity, ok, err := mm.flavors.capacity(machineType, time.Now())
+	if err != nil {
+		warningS("Could not look up flavor", append(objectKeys(obj), "flavor", machineType, "err", err)...)
+		return nil, false
+	}
+	return capacity, ok
+}
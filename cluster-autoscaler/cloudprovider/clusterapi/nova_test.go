@@ -0,0 +1,67 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"errors"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/flavors"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	"testing"
+	"time"
+)
+
+func TestNovaFlavorsCapacity(t *testing.T) {
+	listed := 0
+	var listErr error
+	nf := &novaFlavors{
+		list: func() ([]flavors.Flavor, error) {
+			listed++
+			return []flavors.Flavor{{Name: "m1.small", VCPUs: 2, RAM: 4096, Disk: 50}}, listErr
+		},
+		capacities: make(map[string]apiv1.ResourceList),
+	}
+	now := time.Now()
+
+	capacity, ok, err := nf.capacity("m1.small", now)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, int64(2), capacity.Cpu().Value())
+	assert.Equal(t, int64(4096*1024*1024), capacity.Memory().Value())
+	assert.Equal(t, int64(50*1024*1024*1024), capacity.StorageEphemeral().Value())
+
+	// known flavors are cached, unknown flavors are looked up again after the relist interval
+	_, ok, err = nf.capacity("m1.small", now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	_, ok, err = nf.capacity("m1.large", now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, 1, listed)
+
+	listErr = errors.New("unavailable")
+	_, ok, err = nf.capacity("m1.large", now.Add(flavorRelistInterval))
+	assert.Error(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, 2, listed)
+}
+
+func TestFlavorCapacityBootFromVolume(t *testing.T) {
+	capacity := flavorCapacity(flavors.Flavor{Name: "m1.volume", VCPUs: 4, RAM: 8192})
+	assert.Equal(t, int64(4), capacity.Cpu().Value())
+	assert.NotContains(t, capacity, apiv1.ResourceEphemeralStorage)
+}
@@ -22,11 +22,11 @@ import (
 	apiv1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider"
 	kubeletapis "k8s.io/kubernetes/pkg/kubelet/apis"
 	"math/rand"
-	"sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
 )
 
 type parsedProviderConfig struct {
@@ -79,14 +79,11 @@ var knownFlavors = map[string]struct{ ram, disk, vcpus int64 }{
 	"m1.medium":  {16384, 50, 4},
 }
 
-func buildNodeFromOpenstackMachineDeployment(md *v1alpha1.MachineDeployment) (*apiv1.Node, error) {
-	providerSpec := md.Spec.Template.Spec.ProviderSpec
-
-	if providerSpec.Value == nil {
-		return nil, fmt.Errorf("providerconfig.value is nil")
-	}
+// parseOpenstackProviderSpec parses a machine-controller providerSpec, failing
+// with cloudprovider.ErrNotImplemented for other cloud providers than openstack
+func parseOpenstackProviderSpec(raw []byte) (*rawConfig, error) {
 	pconfig := parsedProviderConfig{}
-	err := json.Unmarshal(providerSpec.Value.Raw, &pconfig)
+	err := json.Unmarshal(raw, &pconfig)
 	if err != nil {
 		return nil, err
 	}
@@ -99,6 +96,69 @@ func buildNodeFromOpenstackMachineDeployment(md *v1alpha1.MachineDeployment) (*a
 	if err != nil {
 		return nil, err
 	}
+	return &rawConfig, nil
+}
+
+// openstackFlavor returns the flavor of a MachineDeployment's or MachineSet's machines, taken
+// either from its inlined providerSpec or from the infrastructure template it references. It is
+// empty if the template doesn't exist.
+func (mm *ClusterapiMachineManager) openstackFlavor(obj metav1.Object) (string, error) {
+	if infrastructureTemplateRef(obj) != nil {
+		template, err := mm.infrastructureTemplate(obj)
+		if err != nil || template == nil {
+			return "", err
+		}
+		return openstackFlavorFromTemplate(template)
+	}
+
+	providerSpec := machineTemplateOf(obj).Spec.ProviderSpec
+	if providerSpec.Value == nil {
+		return "", fmt.Errorf("providerconfig.value is nil")
+	}
+	rawConfig, err := parseOpenstackProviderSpec(providerSpec.Value.Raw)
+	if err != nil {
+		return "", err
+	}
+	return rawConfig.Flavor, nil
+}
+
+// openstackFlavorFromTemplate extracts the flavor from either an OpenStackMachineTemplate
+// (spec.template.spec.flavor) or a MachineClass holding a machine-controller providerSpec.
+func openstackFlavorFromTemplate(template *unstructured.Unstructured) (string, error) {
+	if flavor, found, _ := unstructured.NestedString(template.Object, "spec", "template", "spec", "flavor"); found && flavor != "" {
+		return flavor, nil
+	}
+
+	providerSpec, found, err := unstructured.NestedMap(template.Object, "providerSpec")
+	if err != nil || !found {
+		return "", fmt.Errorf("no flavor found in %s %s", template.GetKind(), template.GetName())
+	}
+	raw, err := json.Marshal(providerSpec)
+	if err != nil {
+		return "", err
+	}
+	rawConfig, err := parseOpenstackProviderSpec(raw)
+	if err != nil {
+		return "", err
+	}
+	if rawConfig.Flavor == "" {
+		return "", fmt.Errorf("no flavor found in %s %s", template.GetKind(), template.GetName())
+	}
+	return rawConfig.Flavor, nil
+}
+
+// buildNodeFromOpenstackProviderSpec synthesizes a node from the known OpenStack flavor in
+// the inlined providerSpec of a MachineDeployment or MachineSet.
+func buildNodeFromOpenstackProviderSpec(obj metav1.Object) (*apiv1.Node, error) {
+	providerSpec := machineTemplateOf(obj).Spec.ProviderSpec
+
+	if providerSpec.Value == nil {
+		return nil, fmt.Errorf("providerconfig.value is nil")
+	}
+	rawConfig, err := parseOpenstackProviderSpec(providerSpec.Value.Raw)
+	if err != nil {
+		return nil, err
+	}
 
 	flavor, ok := knownFlavors[rawConfig.Flavor]
 	if !ok {
@@ -106,7 +166,7 @@ func buildNodeFromOpenstackMachineDeployment(md *v1alpha1.MachineDeployment) (*a
 	}
 
 	node := apiv1.Node{}
-	nodeName := fmt.Sprintf("%s-%d", md.Name, rand.Int63())
+	nodeName := fmt.Sprintf("%s-%d", obj.GetName(), rand.Int63())
 
 	node.ObjectMeta = metav1.ObjectMeta{
 		Name:     nodeName,
@@ -123,16 +183,12 @@ func buildNodeFromOpenstackMachineDeployment(md *v1alpha1.MachineDeployment) (*a
 	node.Status.Capacity[apiv1.ResourceCPU] = *resource.NewQuantity(flavor.vcpus, resource.DecimalSI)
 	node.Status.Capacity[apiv1.ResourceMemory] = *resource.NewQuantity(flavor.ram*1024*1024, resource.BinarySI)
 
-	// TODO: use proper allocatable!!
-	node.Status.Allocatable = node.Status.Capacity
+	// allocatable is derived from capacity by applyMachineTemplate
 
 	// NodeLabels
 	//node.Labels = cloudprovider.JoinStringMaps(node.Labels, extractLabelsFromAsg(template.Tags))
 	// GenericLabels
-	node.Labels = cloudprovider.JoinStringMaps(node.Labels, buildGenericLabels(&rawConfig, nodeName))
-
-	// TODO can a MD specify taints?
-	//node.Spec.Taints = extractTaintsFromMD(md)
+	node.Labels = cloudprovider.JoinStringMaps(node.Labels, buildGenericLabels(rawConfig, nodeName))
 
 	node.Status.Conditions = cloudprovider.BuildReadyConditions()
 	return &node, nil
@@ -143,6 +199,7 @@ func buildGenericLabels(rawConfig *rawConfig, nodeName string) map[string]string
 	// TODO: extract it somehow
 	result[kubeletapis.LabelArch] = cloudprovider.DefaultArch
 	result[kubeletapis.LabelOS] = cloudprovider.DefaultOS
+	result[kubeletapis.LabelInstanceType] = rawConfig.Flavor
 
 	result[kubeletapis.LabelZoneRegion] = rawConfig.Region
 	result[kubeletapis.LabelZoneFailureDomain] = rawConfig.AvailabilityZone
@@ -26,20 +26,20 @@ import (
 	"testing"
 )
 
-func TestBuildNodeFromOpenstackMachineDeploymentMissingProviderConfig(t *testing.T) {
-	node, err := buildNodeFromOpenstackMachineDeployment(&v1alpha1.MachineDeployment{})
+func TestBuildNodeFromOpenstackProviderSpecMissingProviderConfig(t *testing.T) {
+	node, err := buildNodeFromOpenstackProviderSpec(&v1alpha1.MachineDeployment{})
 
 	assert.Nil(t, node)
 	assert.EqualError(t, err, "providerconfig.value is nil")
 }
 
-func TestBuildNodeFromOpenstackMachineDeploymentWrongProviderConfig(t *testing.T) {
+func TestBuildNodeFromOpenstackProviderSpecWrongProviderConfig(t *testing.T) {
 	providerConfig, _ := json.Marshal(struct {
 		CloudProvider string
 	}{
 		CloudProvider: "invalid",
 	})
-	node, err := buildNodeFromOpenstackMachineDeployment(&v1alpha1.MachineDeployment{
+	node, err := buildNodeFromOpenstackProviderSpec(&v1alpha1.MachineDeployment{
 		Spec: v1alpha1.MachineDeploymentSpec{
 			Template: v1alpha1.MachineTemplateSpec{
 				Spec: v1alpha1.MachineSpec{
@@ -57,7 +57,7 @@ func TestBuildNodeFromOpenstackMachineDeploymentWrongProviderConfig(t *testing.T
 	assert.EqualError(t, err, "Not implemented")
 }
 
-func TestBuildNodeFromOpenstackMachineDeploymentUnknownFlavor(t *testing.T) {
+func TestBuildNodeFromOpenstackProviderSpecUnknownFlavor(t *testing.T) {
 	cloudProviderSpec, _ := json.Marshal(rawConfig{
 		Flavor: "invalid",
 	})
@@ -68,7 +68,7 @@ func TestBuildNodeFromOpenstackMachineDeploymentUnknownFlavor(t *testing.T) {
 		},
 	})
 
-	node, err := buildNodeFromOpenstackMachineDeployment(&v1alpha1.MachineDeployment{
+	node, err := buildNodeFromOpenstackProviderSpec(&v1alpha1.MachineDeployment{
 		Spec: v1alpha1.MachineDeploymentSpec{
 			Template: v1alpha1.MachineTemplateSpec{
 				Spec: v1alpha1.MachineSpec{
@@ -90,6 +90,7 @@ func TestBuildGenericLabels(t *testing.T) {
 	labels := buildGenericLabels(&rawConfig{
 		Region:           "region",
 		AvailabilityZone: "zone",
+		Flavor:           "m1.small",
 	}, "my-node")
 
 	assert.Equal(t, cloudprovider.DefaultArch, labels[kubeletapis.LabelArch])
@@ -97,4 +98,5 @@ func TestBuildGenericLabels(t *testing.T) {
 	assert.Equal(t, "region", labels[kubeletapis.LabelZoneRegion])
 	assert.Equal(t, "zone", labels[kubeletapis.LabelZoneFailureDomain])
 	assert.Equal(t, "my-node", labels[kubeletapis.LabelHostname])
+	assert.Equal(t, "m1.small", labels[kubeletapis.LabelInstanceType])
 }
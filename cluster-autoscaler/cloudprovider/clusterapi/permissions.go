@@ -0,0 +1,78 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"fmt"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	apimachv1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+)
+
+// requiredVerbs are the verbs the autoscaler needs on the cluster-api resources in each managed namespace
+var requiredVerbs = map[string][]string{
+	machineDeploymentResource: {"get", "list", "patch"},
+	machineResource:           {"get", "list", "patch"},
+}
+
+// checkPermissions reviews with SelfSubjectAccessReviews whether the autoscaler may access the cluster-api
+// resources in all managed namespaces. Missing permissions are logged and returned as error, so that they
+// show up at startup rather than with the first scale action. Permissions that can't be reviewed are only
+// logged. Changes aren't required in dry-run mode.
+func (mm *ClusterapiMachineManager) checkPermissions() error {
+	missing := make([]string, 0)
+	for _, namespace := range mm.namespaces {
+		for _, resource := range []string{machineDeploymentResource, machineResource} {
+			for _, verb := range requiredVerbs[resource] {
+				if verb == "patch" && mm.dryRun {
+					continue
+				}
+				review := &authorizationv1.SelfSubjectAccessReview{
+					Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+						ResourceAttributes: &authorizationv1.ResourceAttributes{
+							Namespace: namespace,
+							Verb:      verb,
+							Group:     mm.groupVersion.Group,
+							Resource:  resource,
+						},
+					},
+				}
+				result, err := mm.managementClient.AuthorizationV1().SelfSubjectAccessReviews().Create(review)
+				if err != nil {
+					warningS("Could not check permission", "namespace", namespace, "resource", resource, "verb", verb, "err", err)
+					continue
+				}
+				if !result.Status.Allowed {
+					errorS(nil, "Missing permission", "namespace", namespace, "resource", resource, "verb", verb, "reason", result.Status.Reason)
+					missing = append(missing, fmt.Sprintf("%s %s in %s", verb, resource, namespaceDescription(namespace)))
+				}
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing permissions: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// namespaceDescription names a namespace for messages, including all namespaces
+func namespaceDescription(namespace string) string {
+	if namespace == apimachv1.NamespaceAll {
+		return "all namespaces"
+	}
+	return "namespace " + namespace
+}
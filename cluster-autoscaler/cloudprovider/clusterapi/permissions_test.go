@@ -0,0 +1,83 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	corefake "k8s.io/client-go/kubernetes/fake"
+	core "k8s.io/client-go/testing"
+	"testing"
+)
+
+// reviewPermissions lets the fake client answer SelfSubjectAccessReviews with the given function
+func reviewPermissions(client *corefake.Clientset, allowed func(attributes *authorizationv1.ResourceAttributes) (bool, error)) {
+	client.PrependReactor("create", "selfsubjectaccessreviews", func(action core.Action) (bool, runtime.Object, error) {
+		review := action.(core.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		ok, err := allowed(review.Spec.ResourceAttributes)
+		if err != nil {
+			return true, &authorizationv1.SelfSubjectAccessReview{}, err
+		}
+		review.Status.Allowed = ok
+		return true, review, nil
+	})
+}
+
+func TestCheckPermissions(t *testing.T) {
+	client := corefake.NewSimpleClientset()
+	mm := NewMachineManagerFromApiStubs(client, newTestDynamicClient(), testGroupVersion, []string{"tenant-a", "tenant-b"})
+	defer mm.Cleanup()
+
+	var reviewed []authorizationv1.ResourceAttributes
+	reviewPermissions(client, func(attributes *authorizationv1.ResourceAttributes) (bool, error) {
+		reviewed = append(reviewed, *attributes)
+		return true, nil
+	})
+	assert.NoError(t, mm.checkPermissions())
+	assert.Len(t, reviewed, 12)
+	assert.Contains(t, reviewed, authorizationv1.ResourceAttributes{Namespace: "tenant-b", Verb: "patch", Group: testGroupVersion.Group, Resource: machineResource})
+
+	reviewPermissions(client, func(attributes *authorizationv1.ResourceAttributes) (bool, error) {
+		return attributes.Namespace != "tenant-b" || attributes.Verb != "patch", nil
+	})
+	err := mm.checkPermissions()
+	assert.EqualError(t, err, "missing permissions: patch machinedeployments in namespace tenant-b, patch machines in namespace tenant-b")
+
+	// patching isn't needed in dry-run mode
+	mm.dryRun = true
+	assert.NoError(t, mm.checkPermissions())
+
+	// permissions that can't be reviewed are not reported as missing
+	mm.dryRun = false
+	reviewPermissions(client, func(attributes *authorizationv1.ResourceAttributes) (bool, error) {
+		return false, errors.New("unavailable")
+	})
+	assert.NoError(t, mm.checkPermissions())
+}
+
+func TestCheckPermissionsAllNamespaces(t *testing.T) {
+	client := corefake.NewSimpleClientset()
+	mm := NewMachineManagerFromApiStubs(client, newTestDynamicClient(), testGroupVersion, nil)
+	defer mm.Cleanup()
+
+	reviewPermissions(client, func(attributes *authorizationv1.ResourceAttributes) (bool, error) {
+		return attributes.Resource != machineDeploymentResource || attributes.Verb != "list", nil
+	})
+	assert.EqualError(t, mm.checkPermissions(), "missing permissions: list machinedeployments in all namespaces")
+}
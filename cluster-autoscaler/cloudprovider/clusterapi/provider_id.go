@@ -0,0 +1,119 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	apimachv1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	"strings"
+)
+
+// providerIDMatcher normalizes the providerIDs of one infrastructure provider, so that the providerIDs of a
+// node and its machine are equal once normalized
+type providerIDMatcher func(providerID string) string
+
+// providerIDMatchers are the matchers by infrastructure provider. The provider is named like the scheme of its
+// providerIDs, so that the providerIDs of nodes, which carry no infrastructureRef, are matched the same way.
+// ProviderIDs of other providers are matched exactly, see normalizeGenericProviderID.
+var providerIDMatchers = map[string]providerIDMatcher{
+	"openstack": normalizeOpenstackProviderID,
+	"kubevirt":  normalizeKubevirtProviderID,
+}
+
+// NormalizeProviderID makes providerIDs comparable that only differ in formatting, with the matcher of the
+// infrastructure provider named by the providerID's scheme. All providerIDs are matched in this form, in
+// particular the ids of the instances returned by Nodes() when they are resolved to their node group.
+func NormalizeProviderID(providerID string) string {
+	return normalizeProviderID("", providerID)
+}
+
+// normalizeProviderID normalizes a providerID with the matcher of the given infrastructure provider, falling
+// back to the one of the providerID's scheme, and to the generic matcher for unknown providers
+func normalizeProviderID(provider, providerID string) string {
+	if matcher, ok := providerIDMatchers[provider]; ok {
+		return matcher(providerID)
+	}
+	if i := strings.Index(providerID, "://"); i >= 0 {
+		if matcher, ok := providerIDMatchers[providerID[:i]]; ok {
+			return matcher(providerID)
+		}
+		return providerID[:i+len("://")] + normalizeGenericProviderID(providerID)
+	}
+	return normalizeGenericProviderID(providerID)
+}
+
+// normalizedMachineProviderID normalizes the providerID of a Machine with the infrastructure provider of its
+// MachineSet, if known, so that scheme-less providerIDs match those of the nodes. It returns "" if the Machine
+// has no providerID.
+func normalizedMachineProviderID(machine *v1alpha1.Machine, ms *v1alpha1.MachineSet) string {
+	if machine.Spec.ProviderID == nil || *machine.Spec.ProviderID == "" {
+		return ""
+	}
+	provider := ""
+	if ms != nil {
+		provider = infrastructureProvider(ms)
+	}
+	return normalizeProviderID(provider, *machine.Spec.ProviderID)
+}
+
+// infrastructureProvider returns the infrastructure provider of a MachineDeployment or MachineSet by the kind of
+// its infrastructureRef, e.g. "kubevirt" for a KubevirtMachineTemplate, or "" if the providerSpec is inlined
+func infrastructureProvider(obj apimachv1.Object) string {
+	ref := infrastructureTemplateRef(obj)
+	if ref == nil {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSuffix(ref.Kind, "MachineTemplate"))
+}
+
+// normalizeOpenstackProviderID matches OpenStack providerIDs as seen between nodes and machines, e.g.
+// "openstack:///0E4C5F2A-..." and "openstack://0e4c5f2a-.../". The scheme is trimmed, slashes are collapsed
+// and trimmed, and the rest is lowercased.
+func normalizeOpenstackProviderID(providerID string) string {
+	return strings.ToLower(strings.Join(providerIDSegments(providerID), "/"))
+}
+
+// normalizeKubevirtProviderID matches KubeVirt providerIDs by the name of the virtual machine, which is the
+// last segment, with or without its namespace, e.g. "kubevirt://tenant-a/worker-1" and "kubevirt://worker-1".
+// The scheme is kept, as virtual machine names are likely to collide with the providerIDs of other providers.
+func normalizeKubevirtProviderID(providerID string) string {
+	segments := providerIDSegments(providerID)
+	if len(segments) == 0 {
+		return ""
+	}
+	return "kubevirt://" + segments[len(segments)-1]
+}
+
+// normalizeGenericProviderID matches the providerIDs of unknown providers exactly, only empty segments are
+// dropped, e.g. of "azure:///subscriptions/..." and "azure://subscriptions/...". The scheme is trimmed.
+func normalizeGenericProviderID(providerID string) string {
+	return strings.Join(providerIDSegments(providerID), "/")
+}
+
+// providerIDSegments returns the non-empty slash separated segments of a providerID after its scheme
+func providerIDSegments(providerID string) []string {
+	if i := strings.Index(providerID, "://"); i >= 0 {
+		providerID = providerID[i+len("://"):]
+	}
+	segments := make([]string, 0)
+	for _, segment := range strings.Split(providerID, "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	return segments
+}
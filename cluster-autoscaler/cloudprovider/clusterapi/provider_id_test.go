@@ -0,0 +1,135 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	corefake "k8s.io/client-go/kubernetes/fake"
+	"strings"
+	"testing"
+)
+
+// malformedProviderIDs are providerIDs in the shapes that nodes and machines disagreed on, differing in
+// the slash count, trailing slashes, casing and the KubeVirt namespace
+var malformedProviderIDs = []string{
+	"openstack:///0e4c5f2a-9a3b-4c1e-8d3f-6b2a1c9e7d10",
+	"openstack://0E4C5F2A-9A3B-4C1E-8D3F-6B2A1C9E7D10",
+	"openstack:////0e4c5f2a-9a3b-4c1e-8d3f-6b2a1c9e7d10/",
+	"openstack://RegionOne//0e4c5f2a-9a3b-4c1e-8d3f-6b2a1c9e7d10",
+	"kubevirt://tenant-a/worker-1",
+	"kubevirt:///worker-1/",
+	"aws:///eu-central-1a/i-0123456789",
+}
+
+func TestNormalizeProviderID(t *testing.T) {
+	for _, tc := range []struct {
+		providerID string
+		expected   string
+	}{
+		{"openstack:///0e4c5f2a-9a3b-4c1e-8d3f-6b2a1c9e7d10", "0e4c5f2a-9a3b-4c1e-8d3f-6b2a1c9e7d10"},
+		{"openstack://0E4C5F2A-9A3B-4C1E-8D3F-6B2A1C9E7D10", "0e4c5f2a-9a3b-4c1e-8d3f-6b2a1c9e7d10"},
+		{"openstack:////0e4c5f2a-9a3b-4c1e-8d3f-6b2a1c9e7d10/", "0e4c5f2a-9a3b-4c1e-8d3f-6b2a1c9e7d10"},
+		{"0e4c5f2a-9a3b-4c1e-8d3f-6b2a1c9e7d10", "0e4c5f2a-9a3b-4c1e-8d3f-6b2a1c9e7d10"},
+		{"openstack://RegionOne//0e4c5f2a-9a3b-4c1e-8d3f-6b2a1c9e7d10", "regionone/0e4c5f2a-9a3b-4c1e-8d3f-6b2a1c9e7d10"},
+		{"kubevirt://tenant-a/worker-1", "kubevirt://worker-1"},
+		{"kubevirt:///worker-1/", "kubevirt://worker-1"},
+		{"aws:///eu-central-1a/i-0123456789", "aws://eu-central-1a/i-0123456789"},
+		{"aws:///eu-central-1a/I-0123456789", "aws://eu-central-1a/I-0123456789"},
+		{"", ""},
+	} {
+		assert.Equal(t, tc.expected, NormalizeProviderID(tc.providerID), tc.providerID)
+	}
+}
+
+func FuzzNormalizeProviderID(f *testing.F) {
+	for _, providerID := range malformedProviderIDs {
+		f.Add(providerID)
+	}
+	f.Fuzz(func(t *testing.T, providerID string) {
+		normalized := NormalizeProviderID(providerID)
+		assert.Equal(t, normalized, NormalizeProviderID(normalized), providerID)
+	})
+}
+
+// FuzzMachineForNodeProviderID checks that a machine is found for its node however the slashes and the
+// casing of their OpenStack providerIDs, or the slashes and namespace of their KubeVirt providerIDs, differ
+func FuzzMachineForNodeProviderID(f *testing.F) {
+	f.Add("0e4c5f2a-9a3b-4c1e-8d3f-6b2a1c9e7d10", false, uint8(1), uint8(2), uint64(0))
+	f.Add("0e4c5f2a-9a3b-4c1e-8d3f-6b2a1c9e7d10", false, uint8(2), uint8(3), uint64(0xf0f0))
+	f.Add("worker-1", true, uint8(0), uint8(5), uint64(0))
+	f.Fuzz(func(t *testing.T, id string, kubevirt bool, machineShape, nodeShape uint8, casing uint64) {
+		if id == "" || strings.Trim(id, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-.") != "" {
+			t.Skip()
+		}
+		variant := func(shape uint8, casing uint64) string {
+			slashes := strings.Repeat("/", int(shape%3)+2)
+			if kubevirt {
+				if shape&4 != 0 {
+					return "kubevirt:" + slashes + "tenant-a/" + id
+				}
+				return "kubevirt:" + slashes + id
+			}
+			flipped := []byte(id)
+			for i, c := range flipped {
+				if casing&(1<<uint(i%64)) != 0 && (c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+					flipped[i] = c ^ 0x20
+				}
+			}
+			if shape&4 != 0 {
+				return "openstack:" + slashes + string(flipped) + "/"
+			}
+			return "openstack:" + slashes + string(flipped)
+		}
+
+		md := buildTestMachineDeployment("md", 1, 0, 10)
+		machine := buildTestMachine(buildTestMachineSet(md, "ms", 1), "m", nil)
+		machineProviderID := variant(machineShape, 0)
+		machine.Spec.ProviderID = &machineProviderID
+		node := buildTestNode("n")
+		node.Spec.ProviderID = variant(nodeShape, casing)
+
+		mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(node), newTestDynamicClient(md, machine), testGroupVersion, nil)
+		defer mm.Cleanup()
+		if !assert.NoError(t, mm.Refresh(context.TODO())) {
+			return
+		}
+		if found := mm.MachineForNode(node); assert.NotNil(t, found, node.Spec.ProviderID) {
+			assert.Equal(t, machine.UID, found.UID, node.Spec.ProviderID)
+		}
+		assert.Equal(t, NormalizeProviderID(machineProviderID), NormalizeProviderID(node.Spec.ProviderID))
+	})
+}
+
+func TestNormalizeProviderIDOfInfrastructureProvider(t *testing.T) {
+	assert.Equal(t, "kubevirt://worker-1", normalizeProviderID("kubevirt", "tenant-a/worker-1"))
+	assert.Equal(t, "abc", normalizeProviderID("openstack", "ABC/"))
+	// unknown providers fall back to the providerID's scheme
+	assert.Equal(t, "abc", normalizeProviderID("docker", "openstack:///ABC"))
+	assert.Equal(t, "docker://ABC", normalizeProviderID("docker", "docker:////ABC"))
+}
+
+func TestInfrastructureProvider(t *testing.T) {
+	md := buildTestMachineDeployment("md", 1, 0, 10)
+	assert.Equal(t, "", infrastructureProvider(md))
+
+	setTestInfrastructureTemplate(md, "infrastructure.cluster.x-k8s.io/v1alpha3", "OpenStackMachineTemplate", "template")
+	assert.Equal(t, "openstack", infrastructureProvider(md))
+
+	setTestInfrastructureTemplate(md, "infrastructure.cluster.x-k8s.io/v1alpha4", "KubevirtMachineTemplate", "template")
+	assert.Equal(t, "kubevirt", infrastructureProvider(md))
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"k8s.io/apimachinery/pkg/api/errors"
+	apimachv1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+	"strings"
+	"sync"
+	"time"
+)
+
+// minTemplateCacheTTL is the minimum time a template is cached, used as well if refreshes aren't rate limited
+const minTemplateCacheTTL = time.Minute
+
+// templateKey identifies a template referenced by a MachineDeployment, MachineSet or MachinePool
+type templateKey struct {
+	apiVersion string
+	kind       string
+	namespace  string
+	name       string
+}
+
+// cachedTemplate is a fetched template, nil if it doesn't exist
+type cachedTemplate struct {
+	template *unstructured.Unstructured
+	fetched  time.Time
+}
+
+// templateCache caches the templates referenced by the node group objects, so that neither refreshes nor node
+// templates fetch them each time. cluster-api treats templates as immutable and rolls out changes by referencing
+// a new template, so a template is only fetched again after the TTL, in case it was deleted or recreated. Missing
+// templates are cached as well, so that they aren't logged on each refresh.
+type templateCache struct {
+	fetch func(key templateKey) (*unstructured.Unstructured, error)
+
+	lock      sync.Mutex
+	templates map[templateKey]cachedTemplate
+}
+
+// newTemplateCache creates a template cache fetching templates through the dynamic client
+func newTemplateCache(dynamicClient dynamic.Interface) *templateCache {
+	return &templateCache{
+		fetch: func(key templateKey) (*unstructured.Unstructured, error) {
+			gvr, err := templateResource(key.apiVersion, key.kind, key.name)
+			if err != nil {
+				return nil, err
+			}
+			return dynamicClient.Resource(gvr).Namespace(key.namespace).Get(key.name, apimachv1.GetOptions{})
+		},
+		templates: make(map[templateKey]cachedTemplate),
+	}
+}
+
+// get returns a template, fetching it if it isn't cached or was fetched more than ttl ago. It returns nil if
+// the template doesn't exist. Fetch errors aren't cached, expired templates are dropped.
+func (tc *templateCache) get(key templateKey, now time.Time, ttl time.Duration) (*unstructured.Unstructured, error) {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	cached, ok := tc.templates[key]
+	if ok && now.Sub(cached.fetched) < ttl {
+		return cached.template, nil
+	}
+	template, err := tc.fetch(key)
+	if errors.IsNotFound(err) {
+		if !ok || cached.template != nil {
+			warningS("Template not found", "namespace", key.namespace, strings.ToLower(key.kind), key.name)
+		}
+		template, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for k, c := range tc.templates {
+		if now.Sub(c.fetched) >= ttl {
+			delete(tc.templates, k)
+		}
+	}
+	tc.templates[key] = cachedTemplate{template: template, fetched: now}
+	return template, nil
+}
+
+// getTemplate returns a referenced template from the template cache, nil if it doesn't exist. Templates are
+// cached for the refresh interval, but at least minTemplateCacheTTL.
+func (mm *ClusterapiMachineManager) getTemplate(key templateKey) (*unstructured.Unstructured, error) {
+	ttl := mm.refreshInterval
+	if ttl < minTemplateCacheTTL {
+		ttl = minTemplateCacheTTL
+	}
+	return mm.templates.get(key, time.Now(), ttl)
+}
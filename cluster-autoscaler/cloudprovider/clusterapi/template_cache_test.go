@@ -0,0 +1,73 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"testing"
+	"time"
+)
+
+func TestTemplateCacheGet(t *testing.T) {
+	fetched := 0
+	var fetchErr error
+	tc := &templateCache{
+		fetch: func(key templateKey) (*unstructured.Unstructured, error) {
+			fetched++
+			if key.name == "missing" {
+				return nil, apierrors.NewNotFound(schema.GroupResource{Resource: "openstackmachinetemplates"}, key.name)
+			}
+			return buildTestOpenstackMachineTemplate(key.name, "m1.large"), fetchErr
+		},
+		templates: make(map[templateKey]cachedTemplate),
+	}
+	large := templateKey{apiVersion: "infrastructure.cluster.x-k8s.io/v1alpha2", kind: "OpenStackMachineTemplate", namespace: "kube-system", name: "large"}
+	missing := large
+	missing.name = "missing"
+	now := time.Now()
+
+	template, err := tc.get(large, now, time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, "large", template.GetName())
+
+	// templates, even missing ones, are only fetched again after the TTL
+	template, err = tc.get(missing, now, time.Minute)
+	assert.NoError(t, err)
+	assert.Nil(t, template)
+	_, err = tc.get(large, now.Add(30*time.Second), time.Minute)
+	assert.NoError(t, err)
+	_, err = tc.get(missing, now.Add(30*time.Second), time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, fetched)
+
+	_, err = tc.get(large, now.Add(time.Minute), time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, fetched)
+
+	// fetch errors aren't cached
+	fetchErr = errors.New("connection refused")
+	_, err = tc.get(large, now.Add(2*time.Minute), time.Minute)
+	assert.Error(t, err)
+	fetchErr = nil
+	_, err = tc.get(large, now.Add(2*time.Minute), time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, fetched)
+}
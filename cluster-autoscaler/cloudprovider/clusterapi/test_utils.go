@@ -17,16 +17,107 @@ limitations under the License.
 package clusterapi
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/google/uuid"
 	apiv1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider/clusterapi/exp"
+	"k8s.io/autoscaler/cluster-autoscaler/cloudprovider/clusterapi/fake"
 	"k8s.io/autoscaler/cluster-autoscaler/utils/test"
+	"reflect"
 	"sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
 	"strconv"
 )
 
+var testGroupVersion = schema.GroupVersion{Group: "cluster.k8s.io", Version: "v1alpha1"}
+
+var testMachinePoolGroupVersion = schema.GroupVersion{Group: "exp.cluster.x-k8s.io", Version: "v1alpha3"}
+
+// newTestDynamicClient creates a fake dynamic client serving the given cluster-api objects as testGroupVersion
+func newTestDynamicClient(objs ...runtime.Object) *fake.DynamicClient {
+	client := fake.NewDynamicClient()
+	for _, obj := range objs {
+		addTestObject(client, obj)
+	}
+	return client
+}
+
+// addTestObject adds a typed cluster-api object to a fake dynamic client. The object is replaced by
+// the stored object, i.e. what the manager reads back, so that tests can compare the two.
+func addTestObject(client *fake.DynamicClient, obj runtime.Object) {
+	var kind, resource string
+	switch obj.(type) {
+	case *v1alpha1.Machine:
+		kind, resource = "Machine", machineResource
+	case *v1alpha1.MachineSet:
+		kind, resource = "MachineSet", machineSetResource
+	case *v1alpha1.MachineDeployment:
+		kind, resource = "MachineDeployment", machineDeploymentResource
+	case *v1alpha1.Cluster:
+		kind, resource = "Cluster", clusterResource
+	default:
+		panic(fmt.Sprintf("unexpected test object %T", obj))
+	}
+
+	obj.GetObjectKind().SetGroupVersionKind(testGroupVersion.WithKind(kind))
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		panic(err)
+	}
+	stored := client.Add(testGroupVersion.WithResource(resource), &unstructured.Unstructured{Object: content})
+
+	v := reflect.ValueOf(obj).Elem()
+	v.Set(reflect.Zero(v.Type()))
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(stored.Object, obj); err != nil {
+		panic(err)
+	}
+}
+
+// addTestMachinePool adds a MachinePool to a fake dynamic client as testMachinePoolGroupVersion. Like
+// addTestObject, the MachinePool is replaced by the stored object.
+func addTestMachinePool(client *fake.DynamicClient, mp *exp.MachinePool) {
+	mp.APIVersion = testMachinePoolGroupVersion.String()
+	mp.Kind = "MachinePool"
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(mp)
+	if err != nil {
+		panic(err)
+	}
+	stored := client.Add(testMachinePoolGroupVersion.WithResource(machinePoolResource), &unstructured.Unstructured{Object: content})
+
+	*mp = exp.MachinePool{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(stored.Object, mp); err != nil {
+		panic(err)
+	}
+}
+
+// buildTestMachinePool builds a MachinePool whose instances are the given nodes
+func buildTestMachinePool(name string, replicas, minSize, maxSize int, nodes ...*apiv1.Node) *exp.MachinePool {
+	mp := &exp.MachinePool{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "kube-system",
+			UID:       types.UID(uuid.New().String()),
+			Labels:    map[string]string{},
+			Annotations: map[string]string{
+				MinSizeAnnotation: strconv.Itoa(minSize),
+				MaxSizeAnnotation: strconv.Itoa(maxSize),
+			},
+		},
+		Spec: exp.MachinePoolSpec{
+			Replicas: int32Ptr(int32(replicas)),
+		},
+	}
+	for _, node := range nodes {
+		mp.Spec.ProviderIDList = append(mp.Spec.ProviderIDList, node.Spec.ProviderID)
+	}
+	return mp
+}
+
 func buildTestMachineDeployment(name string, replicas, minSize, maxSize int) *v1alpha1.MachineDeployment {
 	md := &v1alpha1.MachineDeployment{
 		ObjectMeta: metav1.ObjectMeta{
@@ -51,6 +142,51 @@ func buildTestMachineDeployment(name string, replicas, minSize, maxSize int) *v1
 	return md
 }
 
+func setTestOpenstackFlavor(md *v1alpha1.MachineDeployment, flavor string) {
+	cloudProviderSpec, _ := json.Marshal(rawConfig{
+		Flavor: flavor,
+	})
+	providerConfig, _ := json.Marshal(parsedProviderConfig{
+		CloudProvider: "openstack",
+		CloudProviderSpec: runtime.RawExtension{
+			Raw: cloudProviderSpec,
+		},
+	})
+	md.Spec.Template.Spec.ProviderSpec.Value = &runtime.RawExtension{Raw: providerConfig}
+}
+
+func setTestInfrastructureTemplate(md *v1alpha1.MachineDeployment, apiVersion, kind, name string) {
+	md.Spec.Template.Spec.ProviderSpec.ValueFrom = &v1alpha1.ProviderSpecSource{
+		MachineClass: &v1alpha1.MachineClassRef{
+			ObjectReference: &apiv1.ObjectReference{
+				APIVersion: apiVersion,
+				Kind:       kind,
+				Name:       name,
+			},
+		},
+	}
+}
+
+func buildTestOpenstackMachineTemplate(name, flavor string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "infrastructure.cluster.x-k8s.io/v1alpha2",
+			"kind":       "OpenStackMachineTemplate",
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": "kube-system",
+			},
+			"spec": map[string]interface{}{
+				"template": map[string]interface{}{
+					"spec": map[string]interface{}{
+						"flavor": flavor,
+					},
+				},
+			},
+		},
+	}
+}
+
 func buildTestMachineSet(owner *v1alpha1.MachineDeployment, name string, replicas int) *v1alpha1.MachineSet {
 	ms := &v1alpha1.MachineSet{
 		ObjectMeta: metav1.ObjectMeta{
@@ -72,6 +208,19 @@ func buildTestMachineSet(owner *v1alpha1.MachineDeployment, name string, replica
 	return ms
 }
 
+func buildTestStandaloneMachineSet(name string, replicas, minSize, maxSize int) *v1alpha1.MachineSet {
+	ms := buildTestMachineSet(nil, name, replicas)
+
+	if minSize < maxSize {
+		ms.ObjectMeta.Annotations = map[string]string{
+			MinSizeAnnotation: strconv.Itoa(minSize),
+			MaxSizeAnnotation: strconv.Itoa(maxSize),
+		}
+	}
+
+	return ms
+}
+
 func buildTestMachine(owner *v1alpha1.MachineSet, name string, node *apiv1.Node) *v1alpha1.Machine {
 	m := &v1alpha1.Machine{
 		ObjectMeta: metav1.ObjectMeta{
@@ -96,6 +245,8 @@ func buildTestMachine(owner *v1alpha1.MachineSet, name string, node *apiv1.Node)
 	}
 
 	if nil != node {
+		providerID := node.Spec.ProviderID
+		m.Spec.ProviderID = &providerID
 		m.Status.NodeRef = &apiv1.ObjectReference{
 			APIVersion: "v1",
 			Kind:       "Node",
@@ -107,9 +258,29 @@ func buildTestMachine(owner *v1alpha1.MachineSet, name string, node *apiv1.Node)
 	return m
 }
 
+// machinesByProviderID indexes machines by their normalized providerID like MachineManager.MachinesByProviderID
+func machinesByProviderID(machines ...*v1alpha1.Machine) map[string]*v1alpha1.Machine {
+	index := make(map[string]*v1alpha1.Machine)
+	for _, machine := range machines {
+		index[NormalizeProviderID(*machine.Spec.ProviderID)] = machine
+	}
+	return index
+}
+
 func buildTestNode(name string) *apiv1.Node {
 	n := test.BuildTestNode(name, 100, 100)
 	n.UID = types.UID(uuid.New().String())
 
 	return n
 }
+
+func buildTestCluster(name string) *v1alpha1.Cluster {
+	return &v1alpha1.Cluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "kube-system",
+			UID:       types.UID(uuid.New().String()),
+			SelfLink:  fmt.Sprintf("/apis/cluster.k8s.io/v1alpha1/namespaces/kube-system/clusters/%s", name),
+		},
+	}
+}
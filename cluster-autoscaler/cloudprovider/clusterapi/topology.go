@@ -0,0 +1,85 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+)
+
+const (
+	// TopologyOwnedLabel marks the MachineDeployments the topology controller generates from a Cluster's topology
+	TopologyOwnedLabel = "topology.cluster.x-k8s.io/owned"
+	// TopologyDeploymentNameLabel names the topology.workers.machineDeployments entry of a generated MachineDeployment
+	TopologyDeploymentNameLabel = "topology.cluster.x-k8s.io/deployment-name"
+)
+
+// applyTopologyBounds sets the size annotations of a MachineDeployment generated from its Cluster's topology,
+// given as unstructured informer object and converted, to those of its topology.workers.machineDeployments
+// entry. These are authoritative, as the topology controller may overwrite the annotations of the generated
+// MachineDeployment. Size annotations missing from the entry are left alone.
+func (mm *ClusterapiMachineManager) applyTopologyBounds(obj interface{}, md *v1alpha1.MachineDeployment) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	if _, ok := md.Labels[TopologyOwnedLabel]; !ok {
+		return
+	}
+	name := md.Labels[TopologyDeploymentNameLabel]
+	clusterName := clusterNameOf(u)
+	if name == "" || clusterName == "" {
+		return
+	}
+	cluster := mm.get(clusterResource, md.Namespace, clusterName)
+	if cluster == nil {
+		verboseInfoS(4, "Cluster of topology owned MachineDeployment not found", append(objectKeys(md), "cluster", clusterName)...)
+		return
+	}
+	annotations, ok := topologyDeploymentAnnotations(cluster, name)
+	if !ok {
+		verboseInfoS(4, "Topology entry of MachineDeployment not found", append(objectKeys(md), "cluster", clusterName, "topologyName", name)...)
+		return
+	}
+	for _, annotation := range []string{MinSizeAnnotation, MaxSizeAnnotation} {
+		val, ok := annotations[annotation]
+		if !ok || md.Annotations[annotation] == val {
+			continue
+		}
+		verboseInfoS(4, "Using size annotation of Cluster topology", append(objectKeys(md), "annotation", annotation,
+			"value", val, "previous", md.Annotations[annotation])...)
+		if md.Annotations == nil {
+			md.Annotations = make(map[string]string)
+		}
+		md.Annotations[annotation] = val
+	}
+}
+
+// topologyDeploymentAnnotations returns the metadata annotations of the topology.workers.machineDeployments entry
+// of a Cluster with the given name
+func topologyDeploymentAnnotations(cluster *unstructured.Unstructured, name string) (map[string]string, bool) {
+	entries, _, _ := unstructured.NestedSlice(cluster.Object, "spec", "topology", "workers", "machineDeployments")
+	for _, entry := range entries {
+		e, ok := entry.(map[string]interface{})
+		if !ok || e["name"] != name {
+			continue
+		}
+		annotations, _, _ := unstructured.NestedStringMap(e, "metadata", "annotations")
+		return annotations, true
+	}
+	return nil, false
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterapi
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	corefake "k8s.io/client-go/kubernetes/fake"
+	"sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	"testing"
+)
+
+func buildTestTopologyCluster(name string, machineDeployments ...interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": testGroupVersion.String(),
+			"kind":       "Cluster",
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": "kube-system",
+			},
+			"spec": map[string]interface{}{
+				"topology": map[string]interface{}{
+					"workers": map[string]interface{}{
+						"machineDeployments": machineDeployments,
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestTopologyBounds(t *testing.T) {
+	// the topology controller overwrote the max size of md1, md2 has no size annotations of its own
+	md1 := buildTestMachineDeployment("md1", 1, 0, 3)
+	md2 := buildTestMachineDeployment("md2", 1, 0, 0)
+	md3 := buildTestMachineDeployment("md3", 1, 0, 3)
+	for _, md := range []*v1alpha1.MachineDeployment{md1, md2, md3} {
+		md.Labels[TopologyOwnedLabel] = ""
+		md.Labels[ClusterNameLabel] = "cluster"
+		md.Labels[TopologyDeploymentNameLabel] = "workers-" + md.Name
+	}
+	// md3 has no topology entry and keeps its annotations
+	md3.Labels[TopologyDeploymentNameLabel] = "unknown"
+	cluster := buildTestTopologyCluster("cluster",
+		map[string]interface{}{
+			"name": "workers-md1",
+			"metadata": map[string]interface{}{"annotations": map[string]interface{}{
+				MaxSizeAnnotation: "10",
+			}},
+		},
+		map[string]interface{}{
+			"name": "workers-md2",
+			"metadata": map[string]interface{}{"annotations": map[string]interface{}{
+				MinSizeAnnotation: "1",
+				MaxSizeAnnotation: "5",
+			}},
+		},
+	)
+
+	dynamicClient := newTestDynamicClient(md1, md2, md3)
+	dynamicClient.Add(testGroupVersion.WithResource(clusterResource), cluster)
+	mm := NewMachineManagerFromApiStubs(corefake.NewSimpleClientset(), dynamicClient, testGroupVersion, nil)
+	if !assert.NoError(t, mm.Refresh(context.TODO())) {
+		return
+	}
+
+	attrs := make(map[string]*MachineDeploymentAttrs)
+	for _, md := range mm.AllDeployments() {
+		attrs[md.Name] = GetMachineDeploymentAttrs(md)
+	}
+	assert.Equal(t, map[string]*MachineDeploymentAttrs{
+		"md1": {minSize: 0, maxSize: 10},
+		"md2": {minSize: 1, maxSize: 5},
+		"md3": {minSize: 0, maxSize: 3},
+	}, attrs)
+}
@@ -30,6 +30,18 @@ type GpuLimits struct {
 	Max int64
 }
 
+// NodeGroupAutoscalingOptions contain the scale-down options a node group may override
+type NodeGroupAutoscalingOptions struct {
+	// ScaleDownUtilizationThreshold sets threshold for nodes to be considered for scale down.
+	ScaleDownUtilizationThreshold float64
+	// ScaleDownGpuUtilizationThreshold sets threshold for gpu nodes to be considered for scale down.
+	ScaleDownGpuUtilizationThreshold float64
+	// ScaleDownUnneededTime sets the duration a node has to be unneeded before it is scaled down.
+	ScaleDownUnneededTime time.Duration
+	// ScaleDownUnreadyTime sets the duration an unready node has to be unneeded before it is scaled down.
+	ScaleDownUnreadyTime time.Duration
+}
+
 // AutoscalingOptions contain various options to customize how autoscaling works
 type AutoscalingOptions struct {
 	// MaxEmptyBulkDelete is a number of empty nodes that can be removed at the same time.